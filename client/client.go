@@ -0,0 +1,678 @@
+//go:build !js
+// +build !js
+
+// Package client is the viewer and broadcaster side of the zero-downtime
+// protocol in Go, for headless clients like recorders, monitors and relays.
+//
+// It does what the demo page does. Offers are sent to /doSignaling, waiting
+// in line if the room is full, and the session ID the server answers with is
+// the token the session is resumed by across restarts of the server. Events
+// are followed on /events, reconnecting like an EventSource would, and the
+// session is replaced with a new one if the server couldn't resume it. ICE is
+// restarted when connectivity fails, e.g. because the server came back on
+// another address.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	// retryDelay is how long to wait before trying again after signaling
+	// failed, e.g. because the server was restarting.
+	retryDelay = 2 * time.Second
+
+	// reconnectDelay is how long to wait before following events again
+	// after the stream broke.
+	reconnectDelay = time.Second
+)
+
+var (
+	// ErrRoomClosed is returned by Client.Err once the room was closed.
+	ErrRoomClosed = errors.New("client: room closed")
+
+	// ErrClosed is returned by Client.Err once Close was called.
+	ErrClosed = errors.New("client: closed")
+
+	errSessionLost  = errors.New("client: session lost")
+	errAdmitted     = errors.New("client: admitted")
+	errRehandshaken = errors.New("client: session moved to a new PeerConnection")
+)
+
+// Config is what a Client joins and how.
+type Config struct {
+	// Server is the base URL of the server, like https://zdr.example.com.
+	Server string
+
+	// Room is the room to join, the default one if empty.
+	Room string
+
+	// Token is sent as a bearer token with every request, if set.
+	Token string
+
+	// Guest is the token of a guest grant of the room, broadcasters with
+	// one are on air in place of the broadcaster until it ends.
+	Guest string
+
+	// Tracks are sent to the room as its broadcaster. Without any the client
+	// joins as a viewer.
+	Tracks []webrtc.TrackLocal
+
+	// Backup broadcasters join as the backup ingest of the room, on air
+	// only while the primary one sends nothing.
+	Backup bool
+
+	// AudioOnly viewers don't ask for video.
+	AudioOnly bool
+
+	// API creates PeerConnections, one with the default codecs and
+	// interceptors if nil.
+	API *webrtc.API
+
+	// HTTPClient sends requests, http.DefaultClient if nil.
+	HTTPClient *http.Client
+
+	// OnTrack is called for every track received. It is called again for
+	// the tracks of a new session, if the server couldn't resume the last
+	// one.
+	OnTrack func(*webrtc.TrackRemote, *webrtc.RTPReceiver)
+
+	// OnEvent is called with every event the server sends, after the client
+	// acted on it.
+	OnEvent func(Event)
+}
+
+// Event is an event the server sent, like trackMuted or queuePosition.
+type Event struct {
+	Name string
+	Data json.RawMessage
+}
+
+// Client is a session with the server, replaced on its own whenever the
+// server loses it.
+type Client struct {
+	config Config
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	// negotiating serializes offers, the client sends one at a time.
+	negotiating sync.Mutex
+
+	mu             sync.Mutex
+	peerConnection *webrtc.PeerConnection
+	id             string
+	generation     uint64
+	err            error
+
+	// lose ends the event stream of the session, so it is replaced.
+	lose context.CancelCauseFunc
+}
+
+// Dial joins the room of config and returns once the server answered, which
+// may take a while if the room is full. The client keeps its session going
+// until ctx is done, Close is called or the room closes.
+func Dial(ctx context.Context, config Config) (*Client, error) {
+	if config.API == nil {
+		api, err := defaultAPI()
+		if err != nil {
+			return nil, err
+		}
+		config.API = api
+	}
+	if config.HTTPClient == nil {
+		config.HTTPClient = http.DefaultClient
+	}
+
+	c := &Client{config: config, done: make(chan struct{})}
+	c.ctx, c.cancel = context.WithCancel(ctx)
+	if err := c.connect(); err != nil {
+		c.cancel()
+		return nil, err
+	}
+
+	go c.run()
+	return c, nil
+}
+
+// defaultAPI returns an API with the codecs and interceptors
+// webrtc.NewPeerConnection uses.
+func defaultAPI() (*webrtc.API, error) {
+	mediaEngine := &webrtc.MediaEngine{}
+	if err := mediaEngine.RegisterDefaultCodecs(); err != nil {
+		return nil, err
+	}
+	registry := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(mediaEngine, registry); err != nil {
+		return nil, err
+	}
+	return webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine), webrtc.WithInterceptorRegistry(registry)), nil
+}
+
+// ID returns the ID of the current session.
+func (c *Client) ID() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.id
+}
+
+// PeerConnection returns the PeerConnection of the current session.
+func (c *Client) PeerConnection() *webrtc.PeerConnection {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.peerConnection
+}
+
+// Generation returns the restart generation of the server that last
+// answered an offer.
+func (c *Client) Generation() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.generation
+}
+
+// Done is closed once the client stopped, Err returns why.
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns why the client stopped, nil while it is running.
+func (c *Client) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// UploadLogs sends logs, like a webrtc.StatsReport, to the server along with
+// the session and the generation it was last answered by, so they can be
+// looked into with its history. kind tells what they are, like "stats".
+// Servers without -client-log-dir refuse them.
+func (c *Client) UploadLogs(ctx context.Context, kind string, logs any) error {
+	return c.do(ctx, http.MethodPost, "/sessions/"+c.ID()+"/logs?"+url.Values{"kind": {kind}}.Encode(), logs, nil)
+}
+
+// Metadata is what viewers display about a broadcast, sent to them in
+// metadata events.
+type Metadata struct {
+	Title       string `json:",omitempty"`
+	Description string `json:",omitempty"`
+	NowPlaying  string `json:",omitempty"`
+}
+
+// SetMetadata sets the title, description and now playing of the room, which
+// the server keeps across restarts. Only broadcasters may set it.
+func (c *Client) SetMetadata(ctx context.Context, metadata Metadata) error {
+	return c.do(ctx, http.MethodPut, "/sessions/"+c.ID()+"/metadata", metadata, nil)
+}
+
+// Close leaves the room. The server ends the session right away rather than
+// keeping it to be resumed.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = ErrClosed
+	}
+	id := c.id
+	c.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := c.do(ctx, http.MethodDelete, "/sessions/"+id, nil, nil)
+
+	c.cancel()
+	<-c.done
+	return err
+}
+
+// run follows the events of the session until the client stops, replacing
+// the session whenever the server loses it.
+func (c *Client) run() {
+	defer close(c.done)
+
+	for {
+		err := c.listen()
+		if errors.Is(err, errRehandshaken) {
+			continue
+		} else if errors.Is(err, errSessionLost) && c.ctx.Err() == nil {
+			err = c.connect()
+		}
+		if err != nil {
+			c.stop(err)
+			return
+		}
+	}
+}
+
+// stop closes the PeerConnection and records why, unless Close was called.
+func (c *Client) stop(err error) {
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	peerConnection := c.peerConnection
+	c.mu.Unlock()
+
+	if peerConnection != nil {
+		peerConnection.Close() //nolint:errcheck
+	}
+	c.cancel()
+}
+
+// connect creates a session, trying again every retryDelay while the server
+// can't be reached.
+func (c *Client) connect() error {
+	for {
+		err := c.newSession()
+		switch {
+		case err == nil:
+			return nil
+		case c.ctx.Err() != nil, !retryable(err):
+			return err
+		}
+
+		select {
+		case <-c.ctx.Done():
+			return c.ctx.Err()
+		case <-time.After(retryDelay):
+		}
+	}
+}
+
+// newSession creates a PeerConnection and signals it, replacing the previous
+// session.
+func (c *Client) newSession() error {
+	peerConnection, err := c.newPeerConnection()
+	if err != nil {
+		return err
+	}
+
+	query := url.Values{"room": {c.config.Room}}
+	if c.config.Backup {
+		query.Set("ingest", "backup")
+	}
+	for {
+		answer, header, err := c.offer(peerConnection, "/doSignaling?"+query.Encode(), nil)
+		if err != nil {
+			peerConnection.Close() //nolint:errcheck
+			return err
+		}
+
+		if ticket := header.Get("X-Queue-Ticket"); ticket != "" {
+			if err = c.wait(ticket); err != nil {
+				peerConnection.Close() //nolint:errcheck
+				return err
+			}
+			query.Set("ticket", ticket)
+			continue
+		}
+
+		if err = peerConnection.SetRemoteDescription(answer); err != nil {
+			peerConnection.Close() //nolint:errcheck
+			return err
+		}
+
+		c.mu.Lock()
+		previous := c.peerConnection
+		c.peerConnection, c.id = peerConnection, header.Get("X-Session-ID")
+		c.generation, _ = strconv.ParseUint(header.Get("X-Restart-Generation"), 10, 64)
+		c.mu.Unlock()
+
+		if previous != nil {
+			previous.Close() //nolint:errcheck
+		}
+		return nil
+	}
+}
+
+// newPeerConnection creates a PeerConnection with the tracks of the client.
+func (c *Client) newPeerConnection() (*webrtc.PeerConnection, error) {
+	configuration := webrtc.Configuration{ICEServers: c.iceServers()}
+	peerConnection, err := c.config.API.NewPeerConnection(configuration)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = c.addTracks(peerConnection); err != nil {
+		peerConnection.Close() //nolint:errcheck
+		return nil, err
+	}
+	if c.config.OnTrack != nil {
+		peerConnection.OnTrack(c.config.OnTrack)
+	}
+	peerConnection.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
+		if state == webrtc.ICEConnectionStateFailed {
+			go c.restartICE(peerConnection)
+		}
+	})
+	return peerConnection, nil
+}
+
+// rehandshake moves the session id of peerConnection to a new PeerConnection,
+// whose DTLS handshake replaces the one the server couldn't restore.
+func (c *Client) rehandshake(peerConnection *webrtc.PeerConnection, id string) error {
+	c.negotiating.Lock()
+	defer c.negotiating.Unlock()
+
+	c.mu.Lock()
+	current := c.peerConnection
+	c.mu.Unlock()
+	if peerConnection != current {
+		return nil
+	}
+
+	next, err := c.newPeerConnection()
+	if err != nil {
+		return err
+	}
+	answer, header, err := c.offer(next, "/sessions/"+id+"/rehandshake", nil)
+	if err == nil {
+		err = next.SetRemoteDescription(answer)
+	}
+	if err != nil {
+		next.Close() //nolint:errcheck
+		return err
+	}
+
+	c.mu.Lock()
+	c.peerConnection = next
+	c.generation, _ = strconv.ParseUint(header.Get("X-Restart-Generation"), 10, 64)
+	c.mu.Unlock()
+	peerConnection.Close() //nolint:errcheck
+	return nil
+}
+
+// addTracks adds the tracks of a broadcaster, or receive-only transceivers
+// for a viewer.
+func (c *Client) addTracks(peerConnection *webrtc.PeerConnection) error {
+	if len(c.config.Tracks) == 0 {
+		kinds := []webrtc.RTPCodecType{webrtc.RTPCodecTypeAudio}
+		if !c.config.AudioOnly {
+			kinds = append(kinds, webrtc.RTPCodecTypeVideo)
+		}
+		for _, kind := range kinds {
+			if _, err := peerConnection.AddTransceiverFromKind(kind, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, track := range c.config.Tracks {
+		sender, err := peerConnection.AddTrack(track)
+		if err != nil {
+			return err
+		}
+
+		// RTCP has to be read for interceptors to see keyframe requests.
+		go func() {
+			buffer := make([]byte, 1500)
+			for {
+				if _, _, err := sender.Read(buffer); err != nil {
+					return
+				}
+			}
+		}()
+	}
+	return nil
+}
+
+// offer sends an offer for peerConnection to path and returns the answer
+// along with the headers of the response. The offer is sent once ICE
+// gathering completed, the server doesn't take trickled candidates.
+func (c *Client) offer(peerConnection *webrtc.PeerConnection, path string, options *webrtc.OfferOptions) (webrtc.SessionDescription, http.Header, error) {
+	answer := webrtc.SessionDescription{}
+	offer, err := peerConnection.CreateOffer(options)
+	if err != nil {
+		return answer, nil, err
+	}
+
+	gathered := webrtc.GatheringCompletePromise(peerConnection)
+	if err = peerConnection.SetLocalDescription(offer); err != nil {
+		return answer, nil, err
+	}
+	select {
+	case <-gathered:
+	case <-c.ctx.Done():
+		return answer, nil, c.ctx.Err()
+	}
+
+	ctx, cancel := context.WithTimeout(c.ctx, 30*time.Second)
+	defer cancel()
+	header := http.Header{}
+	err = c.do(ctx, http.MethodPost, path, peerConnection.LocalDescription(), func(res *http.Response) error {
+		header = res.Header
+		if res.StatusCode == http.StatusAccepted {
+			return nil
+		}
+		return json.NewDecoder(res.Body).Decode(&answer)
+	})
+	return answer, header, err
+}
+
+// restartICE renegotiates peerConnection with new ICE credentials. The
+// session is replaced if that fails.
+func (c *Client) restartICE(peerConnection *webrtc.PeerConnection) {
+	if err := c.renegotiate(peerConnection, &webrtc.OfferOptions{ICERestart: true}); err != nil {
+		c.loseSession(peerConnection)
+	}
+}
+
+// renegotiate sends a new offer for the session of peerConnection, unless
+// it was replaced since.
+func (c *Client) renegotiate(peerConnection *webrtc.PeerConnection, options *webrtc.OfferOptions) error {
+	c.negotiating.Lock()
+	defer c.negotiating.Unlock()
+
+	c.mu.Lock()
+	id, current := c.id, c.peerConnection
+	c.mu.Unlock()
+	if peerConnection != current {
+		return nil
+	}
+
+	answer, _, err := c.offer(peerConnection, "/sessions/"+id+"/offer", options)
+	if err != nil {
+		return err
+	}
+	return peerConnection.SetRemoteDescription(answer)
+}
+
+// loseSession replaces the session of peerConnection, unless it was
+// replaced already.
+func (c *Client) loseSession(peerConnection *webrtc.PeerConnection) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if peerConnection == c.peerConnection && c.lose != nil {
+		c.lose(errSessionLost)
+	}
+}
+
+// iceServers returns the TURN servers the server hands out, none if it has
+// none or can't be asked.
+func (c *Client) iceServers() []webrtc.ICEServer {
+	ctx, cancel := context.WithTimeout(c.ctx, 10*time.Second)
+	defer cancel()
+
+	var turn struct {
+		ICEServers []webrtc.ICEServer `json:"iceServers"`
+	}
+	err := c.do(ctx, http.MethodGet, "/turn?"+url.Values{"room": {c.config.Room}}.Encode(), nil, func(res *http.Response) error {
+		return json.NewDecoder(res.Body).Decode(&turn)
+	})
+	if err != nil {
+		return nil
+	}
+	return turn.ICEServers
+}
+
+// listen follows the events of the current session until it has to be
+// replaced or the client stops.
+func (c *Client) listen() error {
+	ctx, lose := context.WithCancelCause(c.ctx)
+	defer lose(nil)
+
+	c.mu.Lock()
+	id, peerConnection := c.id, c.peerConnection
+	c.lose = lose
+	c.mu.Unlock()
+
+	err := c.follow(ctx, id, func(e Event) error {
+		return c.handle(peerConnection, id, e)
+	})
+	if cause := context.Cause(ctx); errors.Is(cause, errSessionLost) {
+		return cause
+	}
+	return err
+}
+
+// handle acts on an event of the session id.
+func (c *Client) handle(peerConnection *webrtc.PeerConnection, id string, e Event) error {
+	var err error
+	switch e.Name {
+	case "candidates":
+		// Candidates that can't be added are left out, ICE goes on with the
+		// others.
+		candidates := []webrtc.ICECandidateInit{}
+		if json.Unmarshal(e.Data, &candidates) == nil {
+			for _, candidate := range candidates {
+				peerConnection.AddICECandidate(candidate) //nolint:errcheck
+			}
+		}
+	case "renegotiate":
+		// The server already stopped sending what we are unsubscribed from,
+		// a new offer gets the transceivers in line with it.
+		if err = c.renegotiate(peerConnection, nil); err != nil {
+			return fmt.Errorf("%w: %v", errSessionLost, err)
+		}
+	case "sessionEnded":
+		// Acknowledging lets the server drop the session right away.
+		ctx, cancel := context.WithTimeout(c.ctx, 5*time.Second)
+		c.do(ctx, http.MethodPost, "/sessions/"+id+"/ack", nil, nil) //nolint:errcheck
+		cancel()
+		err = errSessionLost
+	case "restoreFailed", "reconnect":
+		err = errSessionLost
+	case "rehandshake":
+		// The session survived a restart but its DTLS didn't, events are
+		// followed again for the PeerConnection that redid the handshake.
+		if err = c.rehandshake(peerConnection, id); err != nil {
+			return fmt.Errorf("%w: %v", errSessionLost, err)
+		}
+		err = errRehandshaken
+	case "roomClosed":
+		err = ErrRoomClosed
+	}
+
+	if c.config.OnEvent != nil {
+		c.config.OnEvent(e)
+	}
+	return err
+}
+
+// wait follows the events of a ticket in line for a full room until it is
+// admitted.
+func (c *Client) wait(ticket string) error {
+	err := c.follow(c.ctx, ticket, func(e Event) error {
+		if c.config.OnEvent != nil {
+			c.config.OnEvent(e)
+		}
+
+		switch e.Name {
+		case "admitted":
+			return errAdmitted
+		case "roomClosed":
+			return ErrRoomClosed
+		}
+		return nil
+	})
+	if errors.Is(err, errAdmitted) {
+		return nil
+	}
+	return err
+}
+
+// statusError is a response the server answered with an error status.
+type statusError struct {
+	status  int
+	message string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("client: %d %s", e.status, e.message)
+}
+
+// permanent reports whether trying again won't help, like for credentials
+// that were refused.
+func (e *statusError) permanent() bool {
+	return e.status < http.StatusInternalServerError && e.status != http.StatusTooManyRequests
+}
+
+// retryable reports whether err may go away by itself, like the server
+// restarting or shedding load.
+func retryable(err error) bool {
+	var status *statusError
+	var transport *url.Error
+	switch {
+	case errors.As(err, &status):
+		return !status.permanent()
+	case errors.As(err, &transport), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return true
+	}
+	return false
+}
+
+// do sends a request to the server and hands a successful response to read.
+func (c *Client) do(ctx context.Context, method, path string, body any, read func(*http.Response) error) error {
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.config.Server+path, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.config.Guest != "" {
+		req.Header.Set("X-Guest-Token", c.config.Guest)
+	}
+	if c.config.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.config.Token)
+	}
+	if generation := c.Generation(); generation != 0 {
+		req.Header.Set("X-Restart-Generation", strconv.FormatUint(generation, 10))
+	}
+
+	res, err := c.config.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= http.StatusBadRequest {
+		message, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return &statusError{status: res.StatusCode, message: string(bytes.TrimSpace(message))}
+	} else if read == nil {
+		return nil
+	}
+	return read(res)
+}
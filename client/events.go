@@ -0,0 +1,77 @@
+//go:build !js
+// +build !js
+
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// follow streams the events of id and passes them to handle until it
+// returns an error or ctx is done. Like an EventSource it reconnects whenever
+// the stream breaks, which it does every time the server restarts.
+func (c *Client) follow(ctx context.Context, id string, handle func(Event) error) error {
+	for {
+		var stop error
+		err := c.do(ctx, http.MethodGet, "/events?"+url.Values{"id": {id}}.Encode(), nil, func(res *http.Response) error {
+			return readEvents(res, func(e Event) error {
+				stop = handle(e)
+				return stop
+			})
+		})
+
+		var status *statusError
+		switch {
+		case stop != nil:
+			return stop
+		case ctx.Err() != nil:
+			return ctx.Err()
+		case errors.As(err, &status) && status.permanent():
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(reconnectDelay):
+		}
+	}
+}
+
+// readEvents parses the server-sent events of res.
+func readEvents(res *http.Response, handle func(Event) error) error {
+	scanner := bufio.NewScanner(res.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	e, data := Event{}, []string{}
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			if e.Name != "" {
+				e.Data = json.RawMessage(strings.Join(data, "\n"))
+				if err := handle(e); err != nil {
+					return err
+				}
+			}
+			e, data = Event{}, data[:0]
+			continue
+		}
+
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "event":
+			e.Name = value
+		case "data":
+			data = append(data, value)
+		}
+	}
+	return scanner.Err()
+}
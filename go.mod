@@ -1,30 +1,40 @@
 module webrtc-zero-downtime-reload
 
-go 1.20
+go 1.22
 
 require (
 	github.com/pion/dtls/v2 v2.2.6
 	github.com/pion/ice/v2 v2.3.1
+	github.com/pion/interceptor v0.1.12
+	github.com/pion/logging v0.2.2
 	github.com/pion/rtcp v1.2.10
+	github.com/pion/rtp v1.7.13
+	github.com/pion/sdp/v3 v3.0.6
+	github.com/pion/srtp/v2 v2.0.13-0.20230326035121-5f7175086aae
+	github.com/pion/transport/v2 v2.0.2
 	github.com/pion/webrtc/v3 v3.1.59-0.20230326035336-9a0eb473514a
+	github.com/quic-go/quic-go v0.48.2
+	github.com/quic-go/webtransport-go v0.8.1-0.20241018022711-4ac2c9250e66
 )
 
 require (
+	github.com/go-task/slim-sprig v0.0.0-20230315185526-52ccab3ef572 // indirect
 	github.com/google/uuid v1.3.0 // indirect
+	github.com/onsi/ginkgo/v2 v2.12.0 // indirect
 	github.com/pion/datachannel v1.5.5 // indirect
-	github.com/pion/interceptor v0.1.12 // indirect
-	github.com/pion/logging v0.2.2 // indirect
 	github.com/pion/mdns v0.0.7 // indirect
 	github.com/pion/randutil v0.1.0 // indirect
-	github.com/pion/rtp v1.7.13 // indirect
 	github.com/pion/sctp v1.8.6 // indirect
-	github.com/pion/sdp/v3 v3.0.6 // indirect
-	github.com/pion/srtp/v2 v2.0.13-0.20230326035121-5f7175086aae // indirect
 	github.com/pion/stun v0.4.0 // indirect
-	github.com/pion/transport/v2 v2.0.2 // indirect
 	github.com/pion/turn/v2 v2.1.0 // indirect
 	github.com/pion/udp/v2 v2.0.1 // indirect
-	golang.org/x/crypto v0.7.0 // indirect
-	golang.org/x/net v0.8.0 // indirect
-	golang.org/x/sys v0.6.0 // indirect
+	github.com/quic-go/qpack v0.5.1 // indirect
+	go.uber.org/mock v0.4.0 // indirect
+	golang.org/x/crypto v0.26.0 // indirect
+	golang.org/x/exp v0.0.0-20240506185415-9bf2ced13842 // indirect
+	golang.org/x/mod v0.17.0 // indirect
+	golang.org/x/net v0.28.0 // indirect
+	golang.org/x/sys v0.23.0 // indirect
+	golang.org/x/text v0.17.0 // indirect
+	golang.org/x/tools v0.21.1-0.20240508182429-e35e4ccd0d2d // indirect
 )
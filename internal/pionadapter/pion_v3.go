@@ -0,0 +1,126 @@
+//go:build !js && !pion_webrtc_v4
+// +build !js,!pion_webrtc_v4
+
+package pionadapter
+
+import (
+	"net"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/pion/dtls/v2"
+	"github.com/pion/ice/v2"
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/gcc"
+	"github.com/pion/srtp/v2"
+	"github.com/pion/webrtc/v3"
+)
+
+// Pion is the adapter of the pion versions this is built with. Adapters of
+// other versions go in a file of their own, built with a tag naming them
+// like pion_webrtc_v4, and this file is then built without it, see
+// pion_v4.go.
+var Pion Internals = pionV3{}
+
+// pionV3 is the adapter of pion/webrtc v3.1, pion/dtls v2.2, pion/ice v2.3,
+// pion/srtp v2.0 and pion/interceptor v0.1, as pinned by go.mod.
+type pionV3 struct{}
+
+func (pionV3) ICE(peerConnection *webrtc.PeerConnection) (*webrtc.ICETransport, *webrtc.ICEGatherer, *ice.Agent) {
+	iceTransport := accessUnexported(peerConnection, "iceTransport").(*webrtc.ICETransport)
+	iceGatherer := accessUnexported(iceTransport, "gatherer").(*webrtc.ICEGatherer)
+	iceAgent := accessUnexported(iceGatherer, "agent").(*ice.Agent)
+	return iceTransport, iceGatherer, iceAgent
+}
+
+func (pionV3) DTLSTransport(peerConnection *webrtc.PeerConnection) *webrtc.DTLSTransport {
+	return accessUnexported(peerConnection, "dtlsTransport").(*webrtc.DTLSTransport)
+}
+
+func (p pionV3) DTLSConn(peerConnection *webrtc.PeerConnection) *dtls.Conn {
+	return accessUnexported(p.DTLSTransport(peerConnection), "conn").(*dtls.Conn)
+}
+
+func (pionV3) DTLSIsClient(state *dtls.State) bool {
+	return accessUnexported(state, "isClient").(bool)
+}
+
+func (pionV3) SRTPProfile(state *dtls.State) dtls.SRTPProtectionProfile {
+	return accessUnexported(state, "srtpProtectionProfile").(dtls.SRTPProtectionProfile)
+}
+
+func (p pionV3) SRTPSession(peerConnection *webrtc.PeerConnection) *srtp.SessionSRTP {
+	srtpSession, _ := addressUnexported(p.DTLSTransport(peerConnection), "srtpSession").(*atomic.Value).Load().(*srtp.SessionSRTP)
+	return srtpSession
+}
+
+func (pionV3) SRTPConn(session *srtp.SessionSRTP) *net.Conn {
+	return addressUnexported(session, "nextConn").(*net.Conn)
+}
+
+func (pionV3) SRTPRemoteContext(session *srtp.SessionSRTP) *srtp.Context {
+	return accessUnexported(session, "remoteContext").(*srtp.Context)
+}
+
+func (pionV3) TWCCSequence(i interceptor.Interceptor) *uint32 {
+	return addressUnexported(i, "nextSequenceNr").(*uint32)
+}
+
+func (pionV3) DefaultCodecs(m *webrtc.MediaEngine, kind webrtc.RTPCodecType) []webrtc.RTPCodecParameters {
+	if kind == webrtc.RTPCodecTypeAudio {
+		return accessUnexported(m, "audioCodecs").([]webrtc.RTPCodecParameters)
+	}
+	return accessUnexported(m, "videoCodecs").([]webrtc.RTPCodecParameters)
+}
+
+func (pionV3) BandwidthState(e *gcc.SendSideBWE) *BandwidthState {
+	state := &BandwidthState{Estimate: e.GetTargetBitrate()}
+	loss := accessUnexported(e, "lossController")
+	lossMutex := addressUnexported(loss, "lock").(*sync.Mutex)
+	lossMutex.Lock()
+	state.LossEstimate = *addressUnexported(loss, "bitrate").(*int)
+	state.AverageLoss = *addressUnexported(loss, "averageLoss").(*float64)
+	lossMutex.Unlock()
+
+	rate := accessUnexported(accessUnexported(e, "delayController"), "rateController")
+	rateMutex := addressUnexported(rate, "lock").(*sync.Mutex)
+	rateMutex.Lock()
+	state.RTT = *addressUnexported(rate, "latestRTT").(*time.Duration)
+	state.ReceivedRate = *addressUnexported(rate, "latestReceivedRate").(*int)
+	decrease := accessUnexported(rate, "latestDecreaseRate")
+	state.DecreaseRate = *addressUnexported(decrease, "average").(*float64)
+	state.DecreaseRateVariance = *addressUnexported(decrease, "variance").(*float64)
+	rateMutex.Unlock()
+	return state
+}
+
+func (pionV3) SetBandwidthState(e *gcc.SendSideBWE, state *BandwidthState) {
+	// Nothing runs the estimator before it is bound, no locks needed.
+	loss := accessUnexported(e, "lossController")
+	if state.LossEstimate > 0 {
+		*addressUnexported(loss, "bitrate").(*int) = state.LossEstimate
+	}
+	*addressUnexported(loss, "averageLoss").(*float64) = state.AverageLoss
+
+	rate := accessUnexported(accessUnexported(e, "delayController"), "rateController")
+	*addressUnexported(rate, "latestRTT").(*time.Duration) = state.RTT
+	*addressUnexported(rate, "latestReceivedRate").(*int) = state.ReceivedRate
+	decrease := accessUnexported(rate, "latestDecreaseRate")
+	*addressUnexported(decrease, "average").(*float64) = state.DecreaseRate
+	*addressUnexported(decrease, "variance").(*float64) = state.DecreaseRateVariance
+}
+
+func accessUnexported(object any, field string) any {
+	v := reflect.ValueOf(object).Elem().FieldByName(field)
+	return reflect.NewAt(v.Type(), unsafe.Pointer(v.UnsafeAddr())).Elem().Interface()
+}
+
+// addressUnexported is like accessUnexported, but returns a pointer to the
+// field so it can be changed.
+func addressUnexported(object any, field string) any {
+	v := reflect.ValueOf(object).Elem().FieldByName(field)
+	return reflect.NewAt(v.Type(), unsafe.Pointer(v.UnsafeAddr())).Interface()
+}
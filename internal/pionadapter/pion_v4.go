@@ -0,0 +1,10 @@
+//go:build !js && pion_webrtc_v4
+// +build !js,pion_webrtc_v4
+
+package pionadapter
+
+// There is no adapter of pion/webrtc v4 yet. Building with pion_webrtc_v4
+// leaves out pion_v3.go and stops here, rather than at every use of Pion:
+// moving to v4 means pinning it in go.mod and replacing this with its
+// adapter.
+var Pion Internals = pionV4AdapterNotWritten
@@ -0,0 +1,81 @@
+//go:build !js
+// +build !js
+
+// Package pionadapter reaches the state pion keeps unexported, for pcmigrate
+// and the server. It is internal so the adapter in use can't be swapped or
+// relied on by programs importing them.
+package pionadapter
+
+import (
+	"net"
+	"time"
+
+	"github.com/pion/dtls/v2"
+	"github.com/pion/ice/v2"
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/gcc"
+	"github.com/pion/srtp/v2"
+	"github.com/pion/webrtc/v3"
+)
+
+// Internals reaches the state pion keeps unexported that connections are
+// captured from and restored into. Field names change between pion releases,
+// so every set of pion versions has an adapter of its own, in a file built
+// for them, and updating pion/webrtc, pion/dtls, pion/ice or the others means
+// adding an adapter rather than hunting down field names.
+type Internals interface {
+	// ICE returns the ICE objects of peerConnection.
+	ICE(peerConnection *webrtc.PeerConnection) (*webrtc.ICETransport, *webrtc.ICEGatherer, *ice.Agent)
+
+	// DTLSTransport returns the DTLS transport of peerConnection.
+	DTLSTransport(peerConnection *webrtc.PeerConnection) *webrtc.DTLSTransport
+
+	// DTLSConn returns the DTLS connection of peerConnection, nil before
+	// the handshake.
+	DTLSConn(peerConnection *webrtc.PeerConnection) *dtls.Conn
+
+	// DTLSIsClient and SRTPProfile return what SRTP keys are derived with
+	// from a DTLS state.
+	DTLSIsClient(state *dtls.State) bool
+	SRTPProfile(state *dtls.State) dtls.SRTPProtectionProfile
+
+	// SRTPSession returns the SRTP session packets from the remote side of
+	// peerConnection are decrypted by, nil before SRTP is started.
+	SRTPSession(peerConnection *webrtc.PeerConnection) *srtp.SessionSRTP
+
+	// SRTPConn returns the connection session reads from, to be swapped,
+	// and SRTPRemoteContext the context it decrypts with.
+	SRTPConn(session *srtp.SessionSRTP) *net.Conn
+	SRTPRemoteContext(session *srtp.SessionSRTP) *srtp.Context
+
+	// TWCCSequence returns the next transport wide sequence number of i, a
+	// TWCC header extension interceptor, to be read and set atomically.
+	TWCCSequence(i interceptor.Interceptor) *uint32
+
+	// DefaultCodecs returns the codecs of kind of m.
+	DefaultCodecs(m *webrtc.MediaEngine, kind webrtc.RTPCodecType) []webrtc.RTPCodecParameters
+
+	// BandwidthState returns the state of e. SetBandwidthState puts it
+	// back in e before it is bound.
+	BandwidthState(e *gcc.SendSideBWE) *BandwidthState
+	SetBandwidthState(e *gcc.SendSideBWE, state *BandwidthState)
+}
+
+// BandwidthState is what a send side bandwidth estimator of gcc carries on
+// from. pion keeps the trendline and the overuse threshold of the delay
+// based controller in closures, those start over and settle within a few
+// reports.
+type BandwidthState struct {
+	// Estimate is the target bitrate in bits per second, that of the loss
+	// based controller is LossEstimate.
+	Estimate     int
+	LossEstimate int     `json:",omitempty"`
+	AverageLoss  float64 `json:",omitempty"`
+
+	// RTT, ReceivedRate and the average and variance of the bitrates it had
+	// to decrease at are what the delay based controller increases by.
+	RTT                  time.Duration `json:",omitempty"`
+	ReceivedRate         int           `json:",omitempty"`
+	DecreaseRate         float64       `json:",omitempty"`
+	DecreaseRateVariance float64       `json:",omitempty"`
+}
@@ -4,389 +4,197 @@
 package main
 
 import (
-	"bytes"
-	"encoding/gob"
+	"context"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
-	"io"
+	"net"
 	"net/http"
 	"os"
-	"reflect"
-	"strings"
-	"sync"
-	"sync/atomic"
+	"os/signal"
+	"syscall"
 	"time"
-	"unsafe"
 
-	"github.com/pion/dtls/v2"
-	"github.com/pion/ice/v2"
-	"github.com/pion/rtcp"
-	"github.com/pion/webrtc/v3"
-)
-
-const (
-	serializedPeerConnectionsFile = "peerConnections.gob"
-	indexHtml                     = `
-<html>
-  <head>
-    <title>webrtc-zero-downtime-reload</title>
-  </head>
-
-  <body>
-  	<h1 id="statusElement"> </h1>
-    <video id="videoElement" controls muted autoplay> </video>
-  </body>
-
-  <script>
-	const pc = new RTCPeerConnection()
-    pc.ontrack = event => {
-      videoElement.srcObject = event.streams[0];
-    };
-	const negotiate = () => {
-    	pc.createOffer()
-    	.then(offer => {
-    	  pc.setLocalDescription(offer)
-
-    	  return fetch('/doSignaling', {
-    	    method: 'post',
-    	    headers: {
-    	      'Accept': 'application/json, text/plain, */*',
-    	      'Content-Type': 'application/json'
-    	    },
-    	    body: JSON.stringify(offer)
-    	  })
-    	})
-    	.then(res => res.json())
-    	.then(res => pc.setRemoteDescription(res))
-    	.catch(alert)
-	}
-
-	fetch('/haveBroadcaster', {
-		   headers: {
-			 'Accept': 'application/json, text/plain, */*',
-		   },
-	})
-    .then(res => res.json())
-	.then(res => {
-		if (res.HaveBroadcaster) {
-			statusElement.innerText = 'You are viewing';
-			pc.addTransceiver('audio', {direction: 'recvonly'})
-			pc.addTransceiver('video', {direction: 'recvonly'})
-			negotiate()
-		} else {
-			navigator.mediaDevices.getUserMedia({audio: true, video: true})
-			.then(stream => {
-				statusElement.innerText = 'You are broadcasting';
-	        	videoElement.srcObject = stream;
-				stream.getTracks().forEach(t => pc.addTransceiver(t, {direction: 'sendonly'}))
-				negotiate()
-			})
-		}
-	})
-  </script>
-</html>
-`
-)
-
-type GlobalState struct {
-	PeerConnectionState []PeerConnectionState
-}
-
-type PeerConnectionState struct {
-	RemoteDescription webrtc.SessionDescription
-
-	ICEPort             uint16
-	ICEUsernameFragment string
-	ICEPassword         string
-
-	DTLSConnectionState dtls.State
-
-	SSRCAudio, SSRCVideo webrtc.SSRC
-	SRTPState            map[uint32]uint32
-}
-
-var (
-	audioTrack, videoTrack *webrtc.TrackLocalStaticRTP
-	haveBroadcaster        = atomic.Bool{}
-	peerConnections        = []*webrtc.PeerConnection{}
-	peerConnectionsMutex   sync.Mutex
+	"webrtc-zero-downtime-reload/zdr"
 )
 
 func main() {
-	var err error
-	if videoTrack, err = webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8}, "video", "pion"); err != nil {
-		panic(err)
-	} else if audioTrack, err = webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, "audio", "pion"); err != nil {
-		panic(err)
-	}
-
-	state := GlobalState{}
-	if buffer, err := os.ReadFile(serializedPeerConnectionsFile); err == nil {
-		dec := gob.NewDecoder(bytes.NewBuffer(buffer))
-		if err := dec.Decode(&state); err != nil {
+	config := zdr.DefaultConfig()
+	config.RegisterFlags(flag.CommandLine)
+	listen := flag.String("listen", ":8080", "HTTP address to serve on, another one than the instance at -handoff-from's")
+	listenHTTP3 := flag.String("http3", "", "UDP address to serve HTTP/3 and the /webtransport signaling channel on, in binaries built with -tags http3")
+	tlsCert := flag.String("tls-cert", "", "certificate of -http3, PEM")
+	tlsKey := flag.String("tls-key", "", "key of -tls-cert, PEM")
+	handoffProbe := flag.Bool("handoff-probe", false, "report whether this binary can resume the current snapshot and exit, used before an upgrade")
+	snapshotProto := flag.Bool("snapshot-proto", false, "print the protobuf schema of snapshots written with -snapshot-encoding protobuf and exit")
+	anonymize := flag.String("anonymize", "", "write a copy of -snapshot with keys, passwords and IPs replaced to this file and exit, for bug reports")
+	verify := zdr.VerifyConfig{IP: "127.0.0.1", MaxGap: time.Second}
+	flag.StringVar(&verify.Listen, "verify-proxy", "", "run as a verification proxy in front of -verify-backend on this HTTP address instead of serving sessions")
+	flag.StringVar(&verify.Backend, "verify-backend", "http://localhost:8080", "URL of the instance the verification proxy stands in front of")
+	flag.StringVar(&verify.IP, "verify-ip", verify.IP, "address the relays of the verification proxy listen on and clients send media to")
+	flag.StringVar(&verify.RecorderToken, "verify-recorder-token", "", "-recorder-token of the backend, to check the SRTP authentication of the packets relayed")
+	flag.DurationVar(&verify.MaxGap, "verify-max-gap", verify.MaxGap, "longest a stream may go without packets for the verification to pass")
+	verifyDuration := flag.Duration("verify-duration", 0, "how long the verification proxy runs, until interrupted if 0")
+	verifyReport := flag.String("verify-report", "", "file the verification report is written to, stdout if empty")
+	flag.Parse()
+
+	if *handoffProbe {
+		if err := zdr.WriteHandoffProbe(config, os.Stdout); err != nil {
 			panic(err)
 		}
-	}
-
-	deserialize(state)
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintf(w, indexHtml)
-	})
-	http.HandleFunc("/doSignaling", doSignaling)
-	http.HandleFunc("/haveBroadcaster", func(w http.ResponseWriter, r *http.Request) {
-		out := struct {
-			HaveBroadcaster bool
-		}{haveBroadcaster.Load()}
-		json.NewEncoder(w).Encode(&out)
-	})
-
-	go func() {
-		for range time.NewTicker(2 * time.Second).C {
-			serialize()
+		return
+	} else if *snapshotProto {
+		schema, err := zdr.SnapshotProto()
+		if err != nil {
+			panic(err)
 		}
-	}()
-
-	fmt.Println("Open http://localhost:8080 to access this demo")
-	panic(http.ListenAndServe(":8080", nil))
-}
-
-func doSignaling(w http.ResponseWriter, r *http.Request) {
-	s := webrtc.SettingEngine{}
-	s.SetSRTPProtectionProfiles(dtls.SRTP_AEAD_AES_128_GCM)
-	m := &webrtc.MediaEngine{}
-	if err := m.RegisterDefaultCodecs(); err != nil {
-		panic(err)
-	}
-
-	peerConnection, err := webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithSettingEngine(s)).NewPeerConnection(webrtc.Configuration{})
-	if err != nil {
-		panic(err)
-	}
-
-	peerConnection.OnConnectionStateChange(func(connectionState webrtc.PeerConnectionState) {
-		onConnectionStateChangeHandler(peerConnection, connectionState)
-	})
-	peerConnection.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
-		onTrackHandler(peerConnection, track, receiver)
-	})
-
-	var offer webrtc.SessionDescription
-	if err = json.NewDecoder(r.Body).Decode(&offer); err != nil {
-		panic(err)
-	}
-
-	if strings.Contains(offer.SDP, "recvonly") {
-		if _, err = peerConnection.AddTrack(videoTrack); err != nil {
+		fmt.Print(schema)
+		return
+	} else if *anonymize != "" {
+		if err := anonymizeSnapshot(config.SnapshotPath, *anonymize); err != nil {
 			panic(err)
-		} else if _, err = peerConnection.AddTrack(audioTrack); err != nil {
+		}
+		return
+	} else if verify.Listen != "" {
+		passed, err := runVerifyProxy(verify, *verifyDuration, *verifyReport)
+		if err != nil {
 			panic(err)
+		} else if !passed {
+			os.Exit(1)
 		}
+		return
 	}
 
-	if err = peerConnection.SetRemoteDescription(offer); err != nil {
-		panic(err)
-	}
-
-	gatherComplete := webrtc.GatheringCompletePromise(peerConnection)
-	answer, err := peerConnection.CreateAnswer(nil)
+	server, err := zdr.New(config)
 	if err != nil {
 		panic(err)
-	} else if err = peerConnection.SetLocalDescription(answer); err != nil {
-		panic(err)
-	}
-	<-gatherComplete
-
-	response, err := json.Marshal(*peerConnection.LocalDescription())
-	if err != nil {
+	} else if err = server.Start(context.Background()); err != nil {
 		panic(err)
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	if _, err := w.Write(response); err != nil {
-		panic(err)
-	}
-}
-
-func serialize() {
-	state := GlobalState{
-		PeerConnectionState: []PeerConnectionState{},
-	}
-
-	for i := range peerConnections {
-		iceTransport := accessUnexported(peerConnections[i], "iceTransport").(*webrtc.ICETransport)
-		dtlsTransport := accessUnexported(peerConnections[i], "dtlsTransport").(*webrtc.DTLSTransport)
-		dtlsConn := accessUnexported(dtlsTransport, "conn").(*dtls.Conn)
-		iceGatherer := accessUnexported(iceTransport, "gatherer").(*webrtc.ICEGatherer)
-		iceAgent := accessUnexported(iceGatherer, "agent").(*ice.Agent)
-
-		SSRCVideo, SSRCAudio := webrtc.SSRC(0), webrtc.SSRC(0)
-
-		senders := peerConnections[i].GetSenders()
-		for _, sender := range senders {
-			encodes := sender.GetParameters().Encodings
-			if len(encodes) == 0 {
-				panic("Found no encodes")
-			}
-
-			if sender.Track().Kind() == webrtc.RTPCodecTypeVideo {
-				SSRCVideo = encodes[0].SSRC
-			} else {
-				SSRCAudio = encodes[0].SSRC
-			}
-
+	// Sessions survive being killed, but shutting down on SIGTERM gets the
+	// last changes in and exits within -shutdown-deadline, plus
+	// -reuseport-drain. Once the final snapshot is written, what is left of
+	// the deadline goes to finishing the responses in flight before the
+	// /events streams are cut.
+	httpServer := &http.Server{Addr: *listen, Handler: server.Handler()} //nolint:gosec
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		deadline := time.Now().Add(config.ShutdownDeadline + config.ReusePortDrain)
+		status := 0
+		if err := server.Shutdown(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			status = 1
 		}
 
-		selectedCandidatePair, err := iceTransport.GetSelectedCandidatePair()
-		if err != nil {
-			panic(err)
+		ctx, cancel := context.WithDeadline(context.Background(), deadline)
+		defer cancel()
+		if err := httpServer.Shutdown(ctx); err != nil && !errors.Is(err, context.DeadlineExceeded) {
+			fmt.Fprintln(os.Stderr, err)
 		}
+		os.Exit(status)
+	}()
 
-		localUfrag, localPwd, err := iceAgent.GetLocalUserCredentials()
-		if err != nil {
-			panic(err)
+	// SIGUSR2 hands the sessions and the sockets over to a new process
+	// running the binary at the same path, which may have been replaced.
+	if zdr.HotRestartSignal != nil {
+		restarts := make(chan os.Signal, 1)
+		signal.Notify(restarts, zdr.HotRestartSignal)
+		go func() {
+			for range restarts {
+				binary, err := os.Executable()
+				if err == nil {
+					err = server.HotRestart(context.Background(), binary)
+				}
+				if err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					continue
+				}
+				os.Exit(0)
+			}
+		}()
+	}
+
+	// Once an instance started with -handoff-from took the sessions over,
+	// the responses in flight are finished and this one exits.
+	go func() {
+		<-server.Released()
+		ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownDeadline)
+		defer cancel()
+		if err := httpServer.Shutdown(ctx); err != nil && !errors.Is(err, context.DeadlineExceeded) {
+			fmt.Fprintln(os.Stderr, err)
 		}
+		os.Exit(0)
+	}()
 
-		state.PeerConnectionState = append(state.PeerConnectionState, PeerConnectionState{
-			RemoteDescription:   *peerConnections[i].RemoteDescription(),
-			ICEPort:             selectedCandidatePair.Local.Port,
-			ICEUsernameFragment: localUfrag,
-			ICEPassword:         localPwd,
-			DTLSConnectionState: dtlsConn.ConnectionState(),
-			SSRCAudio:           SSRCAudio,
-			SSRCVideo:           SSRCVideo,
-			SRTPState:           dtlsTransport.GetSRTPState(),
-		})
+	// HTTP/3 is served on top of HTTP/1.1, failing to, for a bad
+	// certificate or a port the previous instance held on to, leaves the
+	// sessions to the clients signaling over HTTP/1.1.
+	if *listenHTTP3 != "" {
+		go func() {
+			if err := server.ServeHTTP3(*listenHTTP3, *tlsCert, *tlsKey); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+			}
+		}()
 	}
 
-	var toSave bytes.Buffer
-	enc := gob.NewEncoder(&toSave)
-	if err := enc.Encode(state); err != nil {
+	listener, err := server.Listen("tcp", httpServer.Addr)
+	if err != nil {
 		panic(err)
 	}
-	if err := os.WriteFile(serializedPeerConnectionsFile, toSave.Bytes(), 0644); err != nil {
+	fmt.Printf("Open http://localhost:%d to access this demo\n", listener.Addr().(*net.TCPAddr).Port)
+	if err := httpServer.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
 		panic(err)
 	}
+	// The signal handler exits once the responses are flushed.
+	select {}
 }
 
-func deserialize(state GlobalState) {
-	peerConnectionsMutex.Lock()
-	defer peerConnectionsMutex.Unlock()
-
-	fmt.Printf("Resuming %d sessions from '%s'\n", len(state.PeerConnectionState), serializedPeerConnectionsFile)
-
-	for i := range state.PeerConnectionState {
-		m := &webrtc.MediaEngine{}
-		if err := m.RegisterDefaultCodecs(); err != nil {
-			panic(err)
-		}
-
-		s := webrtc.SettingEngine{}
-		s.SetSRTPProtectionProfiles(dtls.SRTP_AEAD_AES_128_GCM)
-		s.SetICECredentials(state.PeerConnectionState[i].ICEUsernameFragment, state.PeerConnectionState[i].ICEPassword)
-		if err := s.SetEphemeralUDPPortRange(state.PeerConnectionState[i].ICEPort, state.PeerConnectionState[i].ICEPort); err != nil {
-			panic(err)
-		}
-		s.SetDTLSConnectionState(&state.PeerConnectionState[i].DTLSConnectionState)
-		s.SetSRTPState(state.PeerConnectionState[i].SRTPState)
-
-		peerConnection, err := webrtc.NewAPI(webrtc.WithSettingEngine(s), webrtc.WithMediaEngine(m)).NewPeerConnection(webrtc.Configuration{})
-		if err != nil {
-			panic(err)
-		}
-		peerConnection.OnConnectionStateChange(func(connectionState webrtc.PeerConnectionState) {
-			onConnectionStateChangeHandler(peerConnection, connectionState)
-		})
-		peerConnection.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
-			onTrackHandler(peerConnection, track, receiver)
-		})
-
-		if strings.Contains(state.PeerConnectionState[i].RemoteDescription.SDP, "recvonly") {
-			if _, err = peerConnection.AddTransceiverFromTrack(videoTrack, webrtc.RTPTransceiverInit{
-				Direction:    webrtc.RTPTransceiverDirectionSendonly,
-				SSRCOverride: state.PeerConnectionState[i].SSRCVideo,
-			}); err != nil {
-				panic(err)
-			} else if _, err = peerConnection.AddTransceiverFromTrack(audioTrack, webrtc.RTPTransceiverInit{
-				Direction:    webrtc.RTPTransceiverDirectionSendonly,
-				SSRCOverride: state.PeerConnectionState[i].SSRCAudio,
-			}); err != nil {
-				panic(err)
-			}
-		}
-
-		if err := peerConnection.SetRemoteDescription(state.PeerConnectionState[i].RemoteDescription); err != nil {
-			panic(err)
-		}
-
-		answer, err := peerConnection.CreateAnswer(nil)
-		if err != nil {
-			panic(err)
-		} else if err = peerConnection.SetLocalDescription(answer); err != nil {
-			panic(err)
-		}
-
+func anonymizeSnapshot(from, to string) error {
+	in, err := os.Open(from) //nolint:gosec
+	if err != nil {
+		return err
 	}
-}
-
-func onConnectionStateChangeHandler(peerConnection *webrtc.PeerConnection, connectionState webrtc.PeerConnectionState) {
-	peerConnectionsMutex.Lock()
-	defer peerConnectionsMutex.Unlock()
+	defer in.Close() //nolint:errcheck
 
-	fmt.Printf("PeerConnection is now: %s\n", connectionState)
-
-	if connectionState == webrtc.PeerConnectionStateFailed {
-		n := 0
-		for _, savedPeerConnection := range peerConnections {
-			if savedPeerConnection != peerConnection {
-				peerConnections[n] = savedPeerConnection
-				n++
-			}
-		}
-		peerConnections = peerConnections[:n]
-		peerConnection.Close()
-	} else if connectionState == webrtc.PeerConnectionStateConnected {
-		peerConnections = append(peerConnections, peerConnection)
+	out, err := os.Create(to) //nolint:gosec
+	if err != nil {
+		return err
 	}
-
-	if connectionState == webrtc.PeerConnectionStateFailed || connectionState == webrtc.PeerConnectionStateConnected {
-		serialize()
+	if err = zdr.AnonymizeSnapshot(in, out); err != nil {
+		out.Close() //nolint:errcheck
+		return err
 	}
+	return out.Close()
 }
 
-func onTrackHandler(peerConnection *webrtc.PeerConnection, track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
-	haveBroadcaster.Store(true)
-	go func() {
-		ticker := time.NewTicker(time.Millisecond * 200)
-		for range ticker.C {
-			errSend := peerConnection.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(track.SSRC())}})
-			if errSend != nil {
-				return
-			}
-		}
-	}()
-
-	outputTrack := videoTrack
-	if strings.HasPrefix(track.Codec().MimeType, "audio") {
-		outputTrack = audioTrack
+// runVerifyProxy runs the verification proxy until it is interrupted or
+// duration is over, writes its report to path and returns whether it passed.
+func runVerifyProxy(cfg zdr.VerifyConfig, duration time.Duration, path string) (bool, error) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, duration)
+		defer cancel()
 	}
 
-	for {
-		// Read RTP packets being sent to Pion
-		rtp, _, readErr := track.ReadRTP()
-		if errors.Is(readErr, io.EOF) {
-			return
-		} else if readErr != nil {
-			panic(readErr)
-		}
-
-		if writeErr := outputTrack.WriteRTP(rtp); writeErr != nil {
-			panic(writeErr)
-		}
+	fmt.Fprintf(os.Stderr, "Verifying %s through http://%s\n", cfg.Backend, cfg.Listen)
+	report, err := zdr.RunVerifyProxy(ctx, cfg)
+	if err != nil {
+		return false, err
 	}
-}
 
-func accessUnexported(object any, field string) any {
-	v := reflect.ValueOf(object).Elem().FieldByName(field)
-	return reflect.NewAt(v.Type(), unsafe.Pointer(v.UnsafeAddr())).Elem().Interface()
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return false, err
+	} else if path == "" {
+		_, err = fmt.Println(string(data))
+	} else {
+		err = os.WriteFile(path, data, 0644)
+	}
+	return report.Passed, err
 }
@@ -0,0 +1,162 @@
+//go:build !js
+// +build !js
+
+// Command datachannel keeps the connection of a WebRTC client that only
+// opens DataChannels across restarts, and echoes every message it gets.
+//
+// POST an offer with a DataChannel to /offer and the answer comes back once
+// gathering is complete. Stop the server with SIGTERM, it saves the
+// connection to datachannel.gob, and start it again within the client's ICE
+// timeout. ICE and DTLS pick up where they left off, the SCTP association
+// doesn't: the client sees its channels close and opens new ones on the
+// same connection, without an offer. Channels negotiated out of band, like
+// the "control" channel with ID 1000 here, are created again on both sides
+// instead.
+package main
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/pion/webrtc/v3"
+
+	"webrtc-zero-downtime-reload/pcmigrate"
+)
+
+const statePath = "datachannel.gob"
+
+var (
+	mu             sync.Mutex
+	peerConnection *webrtc.PeerConnection
+)
+
+// onPeerConnection is set on every PeerConnection, new or restored, before
+// it is negotiated.
+func onPeerConnection(pc *webrtc.PeerConnection) {
+	pc.OnDataChannel(echo)
+
+	negotiated, id := true, uint16(1000)
+	control, err := pc.CreateDataChannel("control", &webrtc.DataChannelInit{Negotiated: &negotiated, ID: &id})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	echo(control)
+}
+
+func echo(dataChannel *webrtc.DataChannel) {
+	dataChannel.OnOpen(func() {
+		fmt.Printf("DataChannel %q is open\n", dataChannel.Label())
+	})
+	dataChannel.OnMessage(func(msg webrtc.DataChannelMessage) {
+		if err := dataChannel.Send(msg.Data); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	})
+}
+
+func main() {
+	state := pcmigrate.State{}
+	if file, err := os.Open(statePath); err == nil {
+		err = gob.NewDecoder(file).Decode(&state)
+		_ = file.Close()
+		if err != nil {
+			panic(err)
+		}
+
+		// Without transceivers only ICE and DTLS are restored, there is no
+		// SRTP state to speak of.
+		if peerConnection, err = pcmigrate.RestoreWith(state, pcmigrate.Options{OnPeerConnection: onPeerConnection}); err != nil {
+			panic(err)
+		}
+		fmt.Printf("Restored the connection on port %d\n", state.ICEPort)
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		panic(err)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		if err := save(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}()
+
+	http.HandleFunc("/offer", answer)
+	panic(http.ListenAndServe(":8080", nil))
+}
+
+// answer creates the PeerConnection of the client, replacing any other.
+func answer(w http.ResponseWriter, r *http.Request) {
+	var offer webrtc.SessionDescription
+	if err := json.NewDecoder(r.Body).Decode(&offer); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	onPeerConnection(pc)
+	if err = pc.SetRemoteDescription(offer); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	local, err := pc.CreateAnswer(nil)
+	if err == nil {
+		err = pc.SetLocalDescription(local)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	<-webrtc.GatheringCompletePromise(pc)
+
+	mu.Lock()
+	if peerConnection != nil {
+		_ = peerConnection.Close()
+	}
+	peerConnection = pc
+	mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(pc.LocalDescription())
+}
+
+// save writes the connection to statePath. The PeerConnection isn't
+// closed, that would tell the client it is over, the process exits with it
+// still open.
+func save() error {
+	mu.Lock()
+	defer mu.Unlock()
+	if peerConnection == nil {
+		return nil
+	}
+
+	state, err := pcmigrate.Capture(peerConnection)
+	if err != nil {
+		return err
+	}
+	file, err := os.Create(statePath)
+	if err != nil {
+		return err
+	}
+	if err = gob.NewEncoder(file).Encode(state); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,146 @@
+//go:build !js
+// +build !js
+
+// Command recvonly receives the media of one WebRTC client and keeps
+// receiving it across restarts.
+//
+// POST an offer to /offer and the answer comes back once gathering is
+// complete. Stop the server with SIGTERM, it saves the connection to
+// recvonly.gob, and start it again within the client's ICE timeout: the
+// tracks keep arriving without the client renegotiating.
+package main
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/pion/webrtc/v3"
+
+	"webrtc-zero-downtime-reload/pcmigrate"
+)
+
+const statePath = "recvonly.gob"
+
+var (
+	mu             sync.Mutex
+	peerConnection *webrtc.PeerConnection
+)
+
+// onPeerConnection is set on every PeerConnection, new or restored, before
+// it is negotiated.
+func onPeerConnection(pc *webrtc.PeerConnection) {
+	pc.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		fmt.Printf("Receiving %s with SSRC %d\n", track.Codec().MimeType, track.SSRC())
+		for {
+			if _, _, err := track.ReadRTP(); err != nil {
+				return
+			}
+		}
+	})
+}
+
+func main() {
+	state := pcmigrate.State{}
+	if file, err := os.Open(statePath); err == nil {
+		err = gob.NewDecoder(file).Decode(&state)
+		_ = file.Close()
+		if err != nil {
+			panic(err)
+		}
+
+		// Restored connections receive, the transceivers are created by the
+		// offer, so there are no tracks to hand over.
+		if peerConnection, err = pcmigrate.RestoreWith(state, pcmigrate.Options{OnPeerConnection: onPeerConnection}); err != nil {
+			panic(err)
+		}
+		fmt.Printf("Restored the connection on port %d\n", state.ICEPort)
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		panic(err)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		if err := save(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}()
+
+	http.HandleFunc("/offer", answer)
+	panic(http.ListenAndServe(":8080", nil))
+}
+
+// answer creates the PeerConnection of the client, replacing any other.
+func answer(w http.ResponseWriter, r *http.Request) {
+	var offer webrtc.SessionDescription
+	if err := json.NewDecoder(r.Body).Decode(&offer); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	onPeerConnection(pc)
+	if err = pc.SetRemoteDescription(offer); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	local, err := pc.CreateAnswer(nil)
+	if err == nil {
+		err = pc.SetLocalDescription(local)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	<-webrtc.GatheringCompletePromise(pc)
+
+	mu.Lock()
+	if peerConnection != nil {
+		_ = peerConnection.Close()
+	}
+	peerConnection = pc
+	mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(pc.LocalDescription())
+}
+
+// save writes the connection to statePath. The PeerConnection isn't
+// closed, that would tell the client it is over, the process exits with it
+// still open.
+func save() error {
+	mu.Lock()
+	defer mu.Unlock()
+	if peerConnection == nil {
+		return nil
+	}
+
+	state, err := pcmigrate.Capture(peerConnection)
+	if err != nil {
+		return err
+	}
+	file, err := os.Create(statePath)
+	if err != nil {
+		return err
+	}
+	if err = gob.NewEncoder(file).Encode(state); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
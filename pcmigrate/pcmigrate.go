@@ -0,0 +1,335 @@
+//go:build !js
+// +build !js
+
+// Package pcmigrate moves a pion PeerConnection to another process without
+// its remote peer noticing, for servers that want to restart without
+// dropping their connections.
+//
+// Capture reads what the remote peer knows the connection by: the ICE
+// credentials and port, the DTLS session, the rollover counters of SRTP and
+// the SSRCs sent with. The State it returns can be encoded with gob and
+// handed to the next process any way the program likes, a file, a pipe or a
+// store. There RestoreWith creates a PeerConnection that answers the same
+// offer with the same state, and picks up where the old one left off with the
+// first packet the remote peer sends. Snapshot and Restore do the same for
+// programs that only have an API to hand.
+//
+// Only the answering side of a connection can be migrated, the remote peer
+// must have sent the offer. The port has to be free by the time the
+// connection is restored, the old process closes its PeerConnections or
+// exits first. DataChannels are not migrated: the SCTP association starts
+// over, and channels are opened again by whichever side opened them.
+//
+// It relies on a pion/webrtc with SettingEngine.SetDTLSConnectionState,
+// SetSRTPState and RTPTransceiverInit.SSRCOverride, as pinned by go.mod.
+package pcmigrate
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/pion/dtls/v2"
+	"github.com/pion/interceptor"
+	"github.com/pion/webrtc/v3"
+
+	"webrtc-zero-downtime-reload/internal/pionadapter"
+)
+
+var (
+	// ErrNotConnected is returned by Capture before ICE selected a candidate
+	// pair.
+	ErrNotConnected = errors.New("pcmigrate: no selected candidate pair")
+
+	// ErrNoDTLS is returned by Capture before the DTLS handshake completed.
+	ErrNoDTLS = errors.New("pcmigrate: DTLS handshake not complete")
+
+	// ErrNotAnswerer is returned for a PeerConnection whose remote
+	// description isn't an offer.
+	ErrNotAnswerer = errors.New("pcmigrate: only the answering side can be migrated")
+
+	// ErrMissingTrack is returned by Restore for a state with a transceiver
+	// that sent, when no track is given for its mid.
+	ErrMissingTrack = errors.New("pcmigrate: no track for a transceiver that sent")
+
+	// ErrSnapshotVersion is returned by Restore for a state captured by a
+	// newer pcmigrate than this one.
+	ErrSnapshotVersion = errors.New("pcmigrate: unsupported snapshot version")
+
+	// ErrPortUnavailable is returned by Restore when the ICE port of the
+	// state is still in use by another process.
+	ErrPortUnavailable = errors.New("pcmigrate: port unavailable")
+
+	// ErrDTLSStateMismatch is returned when the DTLS state doesn't belong
+	// to the remote description it was captured with.
+	ErrDTLSStateMismatch = errors.New("pcmigrate: DTLS state doesn't match remote description")
+
+	// ErrRestoreValidation is returned for a state missing something it
+	// needs to be restored.
+	ErrRestoreValidation = errors.New("pcmigrate: invalid PeerConnectionState")
+)
+
+// StateVersion is the Version of the States Capture returns, bumped when
+// one can't be restored by an older pcmigrate.
+const StateVersion = 1
+
+// State is a PeerConnection as Capture found it.
+type State struct {
+	// Version is the StateVersion of the pcmigrate that captured it.
+	Version int
+
+	// RemoteDescription is the offer of the remote peer.
+	RemoteDescription webrtc.SessionDescription
+
+	// ICEPort is the local port of the selected candidate pair, 0 restores
+	// on any port and leaves it to the program to send the remote peer the
+	// new candidates.
+	ICEPort             uint16
+	ICEUsernameFragment string
+	ICEPassword         string
+
+	DTLSConnectionState dtls.State
+
+	// SRTPState is the rollover counter of every SSRC, sent and received.
+	SRTPState map[uint32]uint32
+
+	Transceivers []TransceiverState
+}
+
+// TransceiverState is a transceiver of a captured PeerConnection.
+type TransceiverState struct {
+	Mid       string
+	Kind      webrtc.RTPCodecType
+	Direction webrtc.RTPTransceiverDirection
+
+	// SSRC is what the sender sends with, 0 for transceivers that only
+	// receive.
+	SSRC webrtc.SSRC
+}
+
+// Options are what RestoreWith creates the PeerConnection with.
+type Options struct {
+	// SettingEngine holds the settings of the program, the ICE, DTLS and
+	// SRTP state are set on a copy of it.
+	SettingEngine webrtc.SettingEngine
+
+	// MediaEngine has the codecs, the defaults if nil. It must hold those
+	// of the old PeerConnection for the answer to match the one the remote
+	// peer got.
+	MediaEngine *webrtc.MediaEngine
+
+	// Interceptors are the interceptors, the defaults if nil.
+	Interceptors *interceptor.Registry
+
+	Configuration webrtc.Configuration
+
+	// Tracks are sent on the transceivers of the same mid, with the SSRC
+	// they were sent with before.
+	Tracks map[string]webrtc.TrackLocal
+
+	// OnPeerConnection is called with the PeerConnection before it is
+	// negotiated, to set OnTrack, OnDataChannel and the like so no event
+	// is missed.
+	OnPeerConnection func(*webrtc.PeerConnection)
+}
+
+// Capture returns the state of peerConnection, which must be connected. It
+// can be called any number of times, the rollover counters move on while
+// media flows so the last capture before the process exits is the one to
+// restore from.
+func Capture(peerConnection *webrtc.PeerConnection) (State, error) {
+	remote := peerConnection.RemoteDescription()
+	if remote == nil || remote.Type != webrtc.SDPTypeOffer {
+		return State{}, ErrNotAnswerer
+	}
+
+	iceTransport, _, iceAgent := pionadapter.Pion.ICE(peerConnection)
+	pair, err := iceTransport.GetSelectedCandidatePair()
+	if err != nil {
+		return State{}, err
+	} else if pair == nil {
+		return State{}, ErrNotConnected
+	}
+
+	ufrag, pwd, err := iceAgent.GetLocalUserCredentials()
+	if err != nil {
+		return State{}, err
+	}
+
+	dtlsTransport := pionadapter.Pion.DTLSTransport(peerConnection)
+	dtlsConn := pionadapter.Pion.DTLSConn(peerConnection)
+	if dtlsConn == nil {
+		return State{}, ErrNoDTLS
+	}
+
+	state := State{
+		Version:             StateVersion,
+		RemoteDescription:   *remote,
+		ICEPort:             pair.Local.Port,
+		ICEUsernameFragment: ufrag,
+		ICEPassword:         pwd,
+		DTLSConnectionState: dtlsConn.ConnectionState(),
+		SRTPState:           dtlsTransport.GetSRTPState(),
+	}
+	for _, transceiver := range peerConnection.GetTransceivers() {
+		transceiverState := TransceiverState{Mid: transceiver.Mid(), Kind: transceiver.Kind(), Direction: transceiver.Direction()}
+		if sender := transceiver.Sender(); sender != nil {
+			if encodings := sender.GetParameters().Encodings; len(encodings) > 0 {
+				transceiverState.SSRC = encodings[0].SSRC
+			}
+		}
+		state.Transceivers = append(state.Transceivers, transceiverState)
+	}
+	return state, nil
+}
+
+// Configure sets the ICE, DTLS and SRTP state of state on s, for programs
+// that build the API themselves, see NewAPI.
+func Configure(s *webrtc.SettingEngine, state State) error {
+	s.SetICECredentials(state.ICEUsernameFragment, state.ICEPassword)
+	if state.ICEPort != 0 {
+		if err := s.SetEphemeralUDPPortRange(state.ICEPort, state.ICEPort); err != nil {
+			return err
+		}
+	}
+	s.SetDTLSConnectionState(&state.DTLSConnectionState)
+	s.SetSRTPState(state.SRTPState)
+	return nil
+}
+
+// Resume negotiates peerConnection, created with an API from NewAPI, like
+// the PeerConnection state was captured from.
+// The answer is never sent, the remote peer keeps the one it has.
+func Resume(peerConnection *webrtc.PeerConnection, state State, tracks map[string]webrtc.TrackLocal) error {
+	if state.RemoteDescription.Type != webrtc.SDPTypeOffer {
+		return ErrNotAnswerer
+	}
+
+	// Transceivers added before the offer is applied are matched to its
+	// media sections by kind, in order.
+	for _, transceiver := range state.Transceivers {
+		track, ok := tracks[transceiver.Mid]
+		if !ok || transceiver.SSRC == 0 {
+			continue
+		}
+		if _, err := peerConnection.AddTransceiverFromTrack(track, webrtc.RTPTransceiverInit{
+			Direction:    transceiver.Direction,
+			SSRCOverride: transceiver.SSRC,
+		}); err != nil {
+			return err
+		}
+	}
+
+	if err := peerConnection.SetRemoteDescription(state.RemoteDescription); err != nil {
+		return err
+	}
+	answer, err := peerConnection.CreateAnswer(nil)
+	if err != nil {
+		return err
+	}
+	return peerConnection.SetLocalDescription(answer)
+}
+
+// NewAPI returns an API whose PeerConnection takes over the connection
+// state was captured from, once Resume negotiated it, for programs that set
+// up their MediaEngine and interceptors with options. The settings of state
+// are applied to a copy of s, an API restores one connection.
+func NewAPI(state State, s webrtc.SettingEngine, options ...func(*webrtc.API)) (*webrtc.API, error) {
+	if err := Configure(&s, state); err != nil {
+		return nil, err
+	}
+	return webrtc.NewAPI(append([]func(*webrtc.API){webrtc.WithSettingEngine(s)}, options...)...), nil
+}
+
+// RestoreWith creates a PeerConnection that takes over the connection state
+// was captured from. The errors of Validate and checkPort are wrapped, compare
+// them with errors.Is.
+func RestoreWith(state State, options Options) (*webrtc.PeerConnection, error) {
+	if err := Validate(state); err != nil {
+		return nil, err
+	} else if err = checkPort(state.ICEPort); err != nil {
+		return nil, err
+	}
+
+	m := options.MediaEngine
+	if m == nil {
+		m = &webrtc.MediaEngine{}
+		if err := m.RegisterDefaultCodecs(); err != nil {
+			return nil, err
+		}
+	}
+	i := options.Interceptors
+	if i == nil {
+		i = &interceptor.Registry{}
+		if err := webrtc.RegisterDefaultInterceptors(m, i); err != nil {
+			return nil, err
+		}
+	}
+
+	api, err := NewAPI(state, options.SettingEngine, webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(i))
+	if err != nil {
+		return nil, err
+	}
+	peerConnection, err := api.NewPeerConnection(options.Configuration)
+	if err != nil {
+		return nil, err
+	}
+	if options.OnPeerConnection != nil {
+		options.OnPeerConnection(peerConnection)
+	}
+
+	if err = Resume(peerConnection, state, options.Tracks); err != nil {
+		if closeErr := peerConnection.Close(); closeErr != nil {
+			err = errors.Join(err, closeErr)
+		}
+		return nil, err
+	}
+	return peerConnection, nil
+}
+
+// PeerConnectionState is the State of Snapshot and Restore.
+type PeerConnectionState = State
+
+// Snapshot is Capture, checking the state with Validate so one that could
+// never be restored fails now rather than in the next process.
+func Snapshot(peerConnection *webrtc.PeerConnection) (PeerConnectionState, error) {
+	state, err := Capture(peerConnection)
+	if err != nil {
+		return State{}, err
+	} else if err = Validate(state); err != nil {
+		return State{}, err
+	}
+	return state, nil
+}
+
+// Restore creates a PeerConnection with api, which must come from NewAPI
+// with state, and negotiates it with Resume, sending tracks on the
+// transceivers of the same mid. Every transceiver that sent must be given
+// its track, a connection restored without them would silently stop
+// sending. Handlers set on it may miss the first tracks and DataChannels:
+// programs needing OnTrack use RestoreWith, or NewAPI and Resume. Errors
+// are wrapped, compare them with errors.Is.
+func Restore(api *webrtc.API, state PeerConnectionState, tracks map[string]webrtc.TrackLocal) (*webrtc.PeerConnection, error) {
+	if err := Validate(state); err != nil {
+		return nil, err
+	}
+	for _, transceiver := range state.Transceivers {
+		if _, ok := tracks[transceiver.Mid]; !ok && transceiver.SSRC != 0 {
+			return nil, fmt.Errorf("%w: mid %s", ErrMissingTrack, transceiver.Mid)
+		}
+	}
+	if err := checkPort(state.ICEPort); err != nil {
+		return nil, err
+	}
+
+	peerConnection, err := api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return nil, err
+	}
+	if err = Resume(peerConnection, state, tracks); err != nil {
+		if closeErr := peerConnection.Close(); closeErr != nil {
+			err = errors.Join(err, closeErr)
+		}
+		return nil, err
+	}
+	return peerConnection, nil
+}
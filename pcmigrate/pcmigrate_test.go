@@ -0,0 +1,103 @@
+//go:build !js
+// +build !js
+
+package pcmigrate
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/pion/dtls/v2"
+	"github.com/pion/webrtc/v3"
+)
+
+// stateFixture returns a state that passes Validate, its remote description
+// advertising the fingerprint of its DTLS peer certificate.
+func stateFixture(t *testing.T) State {
+	t.Helper()
+
+	certificate := []byte("certificate")
+	hash := sha256.Sum256(certificate)
+	fingerprint := make([]string, len(hash))
+	for i, b := range hash {
+		fingerprint[i] = fmt.Sprintf("%02X", b)
+	}
+
+	return State{
+		Version: StateVersion,
+		RemoteDescription: webrtc.SessionDescription{
+			Type: webrtc.SDPTypeOffer,
+			SDP:  "v=0\r\no=- 1 2 IN IP4 127.0.0.1\r\ns=-\r\nt=0 0\r\na=fingerprint:sha-256 " + strings.Join(fingerprint, ":") + "\r\n",
+		},
+		ICEUsernameFragment: "ufrag",
+		ICEPassword:         "password",
+		DTLSConnectionState: dtls.State{PeerCertificates: [][]byte{certificate}},
+	}
+}
+
+// TestValidate checks every state Validate refuses is refused with the error
+// callers compare it with.
+func TestValidate(t *testing.T) {
+	if err := Validate(stateFixture(t)); err != nil {
+		t.Fatalf("valid state: %v", err)
+	}
+
+	for _, test := range []struct {
+		name   string
+		modify func(*State)
+		want   error
+	}{
+		{"newer version", func(state *State) { state.Version = StateVersion + 1 }, ErrSnapshotVersion},
+		{"no remote description", func(state *State) { state.RemoteDescription.SDP = "" }, ErrRestoreValidation},
+		{"no ICE credentials", func(state *State) { state.ICEPassword = "" }, ErrRestoreValidation},
+		{"no DTLS peer certificate", func(state *State) { state.DTLSConnectionState.PeerCertificates = nil }, ErrRestoreValidation},
+		{"other DTLS peer certificate", func(state *State) {
+			state.DTLSConnectionState.PeerCertificates = [][]byte{[]byte("another certificate")}
+		}, ErrDTLSStateMismatch},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			state := stateFixture(t)
+			test.modify(&state)
+			if err := Validate(state); !errors.Is(err, test.want) {
+				t.Fatalf("got %v, want %v", err, test.want)
+			}
+		})
+	}
+}
+
+// TestRestoreMissingTrack checks a state whose transceivers sent can't be
+// restored without their tracks.
+func TestRestoreMissingTrack(t *testing.T) {
+	state := stateFixture(t)
+	state.Transceivers = []TransceiverState{
+		{Mid: "0", Kind: webrtc.RTPCodecTypeVideo, Direction: webrtc.RTPTransceiverDirectionSendrecv, SSRC: 1234},
+		{Mid: "1", Kind: webrtc.RTPCodecTypeAudio, Direction: webrtc.RTPTransceiverDirectionRecvonly},
+	}
+
+	if _, err := Restore(webrtc.NewAPI(), state, nil); !errors.Is(err, ErrMissingTrack) {
+		t.Fatalf("got %v, want ErrMissingTrack", err)
+	}
+}
+
+// TestRestorePortUnavailable checks a state isn't restored while another
+// socket holds its ICE port.
+func TestRestorePortUnavailable(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	state := stateFixture(t)
+	state.ICEPort = uint16(conn.LocalAddr().(*net.UDPAddr).Port)
+	if _, err = Restore(webrtc.NewAPI(), state, nil); !errors.Is(err, ErrPortUnavailable) {
+		t.Fatalf("got %v, want ErrPortUnavailable", err)
+	}
+	if _, err = RestoreWith(state, Options{}); !errors.Is(err, ErrPortUnavailable) {
+		t.Fatalf("RestoreWith: got %v, want ErrPortUnavailable", err)
+	}
+}
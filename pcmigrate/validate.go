@@ -0,0 +1,81 @@
+//go:build !js
+// +build !js
+
+package pcmigrate
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/pion/sdp/v3"
+)
+
+// Validate checks state can be restored before any resources are spent on
+// it: that this pcmigrate knows its version, that it has a remote
+// description, ICE credentials and a DTLS peer certificate, and that the
+// certificate is the one the remote description advertised.
+func Validate(state State) error {
+	switch {
+	case state.Version > StateVersion:
+		return fmt.Errorf("%w: %d, newest supported is %d", ErrSnapshotVersion, state.Version, StateVersion)
+	case state.RemoteDescription.SDP == "":
+		return fmt.Errorf("%w: no remote description", ErrRestoreValidation)
+	case state.ICEUsernameFragment == "" || state.ICEPassword == "":
+		return fmt.Errorf("%w: no ICE credentials", ErrRestoreValidation)
+	case len(state.DTLSConnectionState.PeerCertificates) == 0:
+		return fmt.Errorf("%w: no DTLS peer certificate", ErrRestoreValidation)
+	}
+
+	return validateDTLSFingerprint(state)
+}
+
+// validateDTLSFingerprint makes sure the remote certificate in the DTLS state
+// is the one the remote description advertised.
+func validateDTLSFingerprint(state State) error {
+	parsed := &sdp.SessionDescription{}
+	if err := parsed.Unmarshal([]byte(state.RemoteDescription.SDP)); err != nil {
+		return fmt.Errorf("%w: %v", ErrRestoreValidation, err)
+	}
+
+	fingerprints := []string{}
+	if fingerprint, ok := parsed.Attribute("fingerprint"); ok {
+		fingerprints = append(fingerprints, fingerprint)
+	}
+	for _, media := range parsed.MediaDescriptions {
+		if fingerprint, ok := media.Attribute("fingerprint"); ok {
+			fingerprints = append(fingerprints, fingerprint)
+		}
+	}
+
+	hash := sha256.Sum256(state.DTLSConnectionState.PeerCertificates[0])
+	expected := make([]string, len(hash))
+	for i, b := range hash {
+		expected[i] = fmt.Sprintf("%02X", b)
+	}
+
+	for _, fingerprint := range fingerprints {
+		algorithm, value, _ := strings.Cut(fingerprint, " ")
+		if !strings.EqualFold(algorithm, "sha-256") {
+			continue
+		}
+		if !strings.EqualFold(value, strings.Join(expected, ":")) {
+			return fmt.Errorf("%w: sha-256 %s", ErrDTLSStateMismatch, value)
+		}
+	}
+	return nil
+}
+
+// checkPort makes sure port, unless 0, can be bound, the ICE agent otherwise
+// gathers no candidate on it and the remote peer is never heard from.
+func checkPort(port uint16) error {
+	if port == 0 {
+		return nil
+	}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: int(port)})
+	if err != nil {
+		return fmt.Errorf("%w: %d: %v", ErrPortUnavailable, port, err)
+	}
+	return conn.Close()
+}
@@ -0,0 +1,63 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+// configureAbsSendTime negotiates the abs-send-time header extension with
+// viewers and stamps every packet sent to them with it, which receive side
+// bandwidth estimation in browsers goes by when transport wide sequence
+// numbers aren't negotiated. It is the time a packet was sent, not a counter,
+// so there is nothing to save for it to carry on across a restart.
+func configureAbsSendTime(m *webrtc.MediaEngine, i *interceptor.Registry) error {
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio} {
+		if err := m.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: sdp.ABSSendTimeURI}, kind); err != nil {
+			return err
+		}
+	}
+
+	i.Add(&absSendTimeFactory{})
+	return nil
+}
+
+type absSendTimeFactory struct{}
+
+func (f *absSendTimeFactory) NewInterceptor(string) (interceptor.Interceptor, error) {
+	return &absSendTimeInterceptor{}, nil
+}
+
+type absSendTimeInterceptor struct {
+	interceptor.NoOp
+}
+
+// BindLocalStream stamps the packets of streams the viewer negotiated
+// abs-send-time for, the others are left alone.
+func (i *absSendTimeInterceptor) BindLocalStream(info *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	var id uint8
+	for _, extension := range info.RTPHeaderExtensions {
+		if extension.URI == sdp.ABSSendTimeURI {
+			id = uint8(extension.ID)
+		}
+	}
+	if id == 0 {
+		return writer
+	}
+
+	return interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, attributes interceptor.Attributes) (int, error) {
+		extension, err := rtp.NewAbsSendTimeExtension(time.Now()).Marshal()
+		if err != nil {
+			return 0, err
+		} else if err = header.SetExtension(id, extension); err != nil {
+			return 0, err
+		}
+		return writer.Write(header, payload, attributes)
+	})
+}
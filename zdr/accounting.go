@@ -0,0 +1,176 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+)
+
+var (
+	// closedBytesSent and closedBytesReceived hold what sessions that are
+	// gone relayed, so totals never go backwards. They are saved with every
+	// snapshot.
+	closedBytesSent     atomic.Uint64
+	closedBytesReceived atomic.Uint64
+
+	_ = newGauge("relayed_bytes_sent", "bytes of RTP and RTCP sent to all sessions, including closed ones", func() float64 {
+		sent, _ := relayedTotals()
+		return float64(sent)
+	})
+	_ = newGauge("relayed_bytes_received", "bytes of RTP and RTCP received from all sessions, including closed ones", func() float64 {
+		_, received := relayedTotals()
+		return float64(received)
+	})
+)
+
+type accountingInterceptorFactory struct {
+	session *session
+}
+
+func (f *accountingInterceptorFactory) NewInterceptor(string) (interceptor.Interceptor, error) {
+	return &accountingInterceptor{session: f.session}, nil
+}
+
+// accountingInterceptor meters the RTP and RTCP bytes of a session, before
+// SRTP so the numbers don't depend on the negotiated profile.
+type accountingInterceptor struct {
+	interceptor.NoOp
+	session *session
+}
+
+// BindLocalStream and BindRemoteStream also ask the snapshotter for a
+// snapshot when a stream's rollover counter moves on, see rolloverWatch.
+func (i *accountingInterceptor) BindLocalStream(_ *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	var rollover rolloverWatch
+	return interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, attributes interceptor.Attributes) (int, error) {
+		n, err := writer.Write(header, payload, attributes)
+		addRelayed(&i.session.bytesSent, n)
+		if err == nil && rollover.wrapped(header.SequenceNumber) {
+			snapshotter.Trigger("an SRTP rollover")
+		}
+		return n, err
+	})
+}
+
+func (i *accountingInterceptor) BindRemoteStream(_ *interceptor.StreamInfo, reader interceptor.RTPReader) interceptor.RTPReader {
+	var rollover rolloverWatch
+	return interceptor.RTPReaderFunc(func(b []byte, attributes interceptor.Attributes) (int, interceptor.Attributes, error) {
+		n, attributes, err := reader.Read(b, attributes)
+		addRelayed(&i.session.bytesReceived, n)
+		i.authenticated(n, err)
+		if err == nil && n >= 4 && rollover.wrapped(binary.BigEndian.Uint16(b[2:4])) {
+			snapshotter.Trigger("an SRTP rollover")
+		}
+		return n, attributes, err
+	})
+}
+
+func (i *accountingInterceptor) BindRTCPWriter(writer interceptor.RTCPWriter) interceptor.RTCPWriter {
+	return interceptor.RTCPWriterFunc(func(pkts []rtcp.Packet, attributes interceptor.Attributes) (int, error) {
+		n, err := writer.Write(pkts, attributes)
+		addRelayed(&i.session.bytesSent, n)
+		return n, err
+	})
+}
+
+func (i *accountingInterceptor) BindRTCPReader(reader interceptor.RTCPReader) interceptor.RTCPReader {
+	return interceptor.RTCPReaderFunc(func(b []byte, attributes interceptor.Attributes) (int, interceptor.Attributes, error) {
+		n, attributes, err := reader.Read(b, attributes)
+		addRelayed(&i.session.bytesReceived, n)
+		i.authenticated(n, err)
+		return n, attributes, err
+	})
+}
+
+// authenticated tells the latch of a restored session that a packet made it
+// through SRTP, which only hands on those that authenticate.
+func (i *accountingInterceptor) authenticated(n int, err error) {
+	if latch := i.session.latch; latch != nil && n > 0 && err == nil {
+		latch.reach(&latch.srtpAuthenticated, latchSRTP)
+	}
+}
+
+// closeAccounting moves the bytes of a session that is going away into the
+// closed totals. Calling it more than once is harmless.
+func closeAccounting(session *session) {
+	sent, received := session.bytesSent.Swap(0), session.bytesReceived.Swap(0)
+	closedBytesSent.Add(sent)
+	closedBytesReceived.Add(received)
+	session.room.closedBytesSent.Add(sent)
+	session.room.closedBytesReceived.Add(received)
+}
+
+// relayedTotals returns the bytes relayed by every session since the first
+// snapshot was written.
+func relayedTotals() (sent, received uint64) {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+
+	sent, received = closedBytesSent.Load(), closedBytesReceived.Load()
+	for _, session := range sessions {
+		sent += session.bytesSent.Load()
+		received += session.bytesReceived.Load()
+	}
+	return sent, received
+}
+
+type accountingUsage struct {
+	ID            string `json:",omitempty"`
+	Room          string `json:",omitempty"`
+	BytesSent     uint64
+	BytesReceived uint64
+}
+
+// handleAdminAccounting returns the bytes relayed per connected session, per
+// room and in total. Usage is persisted with every snapshot, so it carries on
+// across restarts.
+func handleAdminAccounting(w http.ResponseWriter, r *http.Request) {
+	out := struct {
+		Sessions []accountingUsage
+		Rooms    []accountingUsage
+		Total    accountingUsage
+	}{Sessions: []accountingUsage{}, Rooms: []accountingUsage{}}
+
+	roomsMutex.Lock()
+	byRoom := map[*room]*accountingUsage{}
+	for _, room := range rooms {
+		out.Rooms = append(out.Rooms, accountingUsage{
+			Room:          room.id,
+			BytesSent:     room.closedBytesSent.Load(),
+			BytesReceived: room.closedBytesReceived.Load(),
+		})
+	}
+	for i := range out.Rooms {
+		byRoom[rooms[out.Rooms[i].Room]] = &out.Rooms[i]
+	}
+	roomsMutex.Unlock()
+
+	sessionsMutex.Lock()
+	for _, session := range sessions {
+		usage := accountingUsage{
+			ID:            session.id,
+			Room:          session.room.id,
+			BytesSent:     session.bytesSent.Load(),
+			BytesReceived: session.bytesReceived.Load(),
+		}
+		out.Sessions = append(out.Sessions, usage)
+
+		if room, ok := byRoom[session.room]; ok {
+			room.BytesSent += usage.BytesSent
+			room.BytesReceived += usage.BytesReceived
+		}
+	}
+	sessionsMutex.Unlock()
+	out.Total.BytesSent, out.Total.BytesReceived = relayedTotals()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&out)
+}
@@ -0,0 +1,142 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+type adminSession struct {
+	ID              string
+	ConnectionState string
+	MaxBitrate      uint64
+	Fingerprint     Fingerprint
+	Principal       Principal
+	Layer           string `json:",omitempty"`
+	VideoCodec      string `json:",omitempty"`
+
+	// CodecFallback is set for viewers moved off the codec they couldn't
+	// decode.
+	CodecFallback *CodecFallback `json:",omitempty"`
+
+	// Quarantined is set while SRTP authentication failures are repaired.
+	Quarantined bool `json:",omitempty"`
+}
+
+// handleAdminSessions lists every connected session.
+func handleAdminSessions(w http.ResponseWriter, r *http.Request) {
+	sessionsMutex.Lock()
+	out := []adminSession{}
+	for _, session := range sessions {
+		out = append(out, adminSession{
+			ID:              session.id,
+			ConnectionState: session.peerConnection.ConnectionState().String(),
+			MaxBitrate:      session.maxBitrate.Load(),
+			Fingerprint:     session.fingerprint,
+			Principal:       session.principal,
+			Layer:           session.layer.current(),
+			VideoCodec:      session.videoCodec,
+			CodecFallback:   session.codecFallback.persisted(),
+			Quarantined:     session.srtp.repairing.Load(),
+		})
+	}
+	sessionsMutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&out)
+}
+
+// handleAdminRestore returns the report of the restore done at startup.
+func handleAdminRestore(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(latchReport(lastRestoreReport))
+}
+
+// handleAdminSession serves /admin/sessions/{id}/{setting}.
+func handleAdminSession(w http.ResponseWriter, r *http.Request) {
+	id, setting, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/admin/sessions/"), "/")
+
+	// History and client logs outlive the session.
+	if setting == "history" {
+		handleAdminHistory(w, r, id)
+		return
+	} else if setting == "logs" {
+		handleAdminClientLogs(w, r, id)
+		return
+	}
+
+	session := findSession(id)
+	if session == nil {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+
+	if key, ok := strings.CutPrefix(setting, "kv/"); ok {
+		handleAdminKV(w, r, session, key)
+		return
+	}
+
+	switch setting {
+	case "bitrate":
+		handleAdminBitrate(w, r, session)
+	case "pcap":
+		handleAdminCapture(w, r, session)
+	case "stats":
+		handleAdminStats(w, r, session)
+	case "sync":
+		handleAdminSync(w, r, session)
+	case "pacer":
+		handleAdminPacer(w, r, session)
+	case "bandwidth":
+		handleAdminBandwidth(w, r, session)
+	case "buffers":
+		handleAdminSocketBuffers(w, r, session)
+	case "kv":
+		handleAdminKV(w, r, session, "")
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// handleAdminBitrate sets the max bitrate of a session, 0 removes the cap.
+func handleAdminBitrate(w http.ResponseWriter, r *http.Request, session *session) {
+	if r.Method != http.MethodPut && r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var in struct {
+		MaxBitrate uint64
+	}
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	session.maxBitrate.Store(in.MaxBitrate)
+	recordHistory(session, historyControl, "max bitrate set to %d", in.MaxBitrate)
+	sessionsMutex.Lock()
+	err := serialize(r.Context())
+	sessionsMutex.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func findSession(id string) *session {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+
+	for _, session := range sessions {
+		if session.id == id {
+			return session
+		}
+	}
+	return nil
+}
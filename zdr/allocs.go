@@ -0,0 +1,131 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"context"
+	"math"
+	runtimemetrics "runtime/metrics"
+	"sync/atomic"
+	"time"
+)
+
+// allocInterval is how often the allocations per forwarded packet are worked
+// out.
+const allocInterval = 10 * time.Second
+
+// Runtime metrics the allocation budgets and GC gauges go by.
+const (
+	metricAllocBytes   = "/gc/heap/allocs:bytes"
+	metricAllocObjects = "/gc/heap/allocs:objects"
+	metricGCCycles     = "/gc/cycles/total:gc-cycles"
+	metricHeapGoal     = "/gc/heap/goal:bytes"
+)
+
+var (
+	forwardedPackets = newCounter("forwarded_packets_total", "Packets forwarded from broadcasters and sources to the tracks of rooms.")
+	allocAlerts      = newCounter("alloc_budget_alerts_total", "Times allocations went over -alloc-budget-packet or -alloc-budget-checkpoint.")
+
+	// packetAllocBytes and packetAllocObjects are the bytes and objects
+	// allocated per forwarded packet over the last allocInterval, as
+	// float64 bits. checkpointAllocBytes is what the last checkpoint
+	// allocated.
+	packetAllocBytes     atomic.Uint64
+	packetAllocObjects   atomic.Uint64
+	checkpointAllocBytes atomic.Uint64
+
+	overPacketBudget, overCheckpointBudget atomic.Bool
+
+	_ = newGauge("alloc_bytes_per_packet", "Bytes allocated per forwarded packet over the last 10s.", func() float64 {
+		return loadFloat(&packetAllocBytes)
+	})
+	_ = newGauge("alloc_objects_per_packet", "Objects allocated per forwarded packet over the last 10s.", func() float64 {
+		return loadFloat(&packetAllocObjects)
+	})
+	_ = newGauge("checkpoint_alloc_bytes", "Bytes allocated while taking the last checkpoint.", func() float64 {
+		return float64(checkpointAllocBytes.Load())
+	})
+	_ = newGauge("gc_cycles", "GC cycles completed since the process started.", func() float64 {
+		return float64(readRuntimeMetrics(metricGCCycles)[0])
+	})
+	_ = newGauge("gc_heap_goal_bytes", "Heap size the next GC cycle is started at.", func() float64 {
+		return float64(readRuntimeMetrics(metricHeapGoal)[0])
+	})
+)
+
+// readRuntimeMetrics returns the values of the runtime metrics names, which
+// must be uint64 ones.
+func readRuntimeMetrics(names ...string) []uint64 {
+	samples := make([]runtimemetrics.Sample, len(names))
+	for i, name := range names {
+		samples[i].Name = name
+	}
+	runtimemetrics.Read(samples)
+
+	out := make([]uint64, len(samples))
+	for i, sample := range samples {
+		if sample.Value.Kind() == runtimemetrics.KindUint64 {
+			out[i] = sample.Value.Uint64()
+		}
+	}
+	return out
+}
+
+func loadFloat(v *atomic.Uint64) float64 {
+	return math.Float64frombits(v.Load())
+}
+
+// watchAllocs works out the allocations per forwarded packet every
+// allocInterval, logging an ALERT when they go over -alloc-budget-packet.
+// Every allocation of the process is counted, so it is an upper bound that
+// is close while forwarding is most of what the process does.
+func watchAllocs(ctx context.Context) {
+	last := readRuntimeMetrics(metricAllocBytes, metricAllocObjects)
+	lastPackets := forwardedPackets.value.Load()
+	every(ctx, allocInterval, func(time.Time) {
+		allocs := readRuntimeMetrics(metricAllocBytes, metricAllocObjects)
+		packets := forwardedPackets.value.Load()
+		if packets == lastPackets {
+			return
+		}
+
+		n := float64(packets - lastPackets)
+		bytes, objects := float64(allocs[0]-last[0])/n, float64(allocs[1]-last[1])/n
+		last, lastPackets = allocs, packets
+		packetAllocBytes.Store(math.Float64bits(bytes))
+		packetAllocObjects.Store(math.Float64bits(objects))
+
+		over := config.AllocBudgetPacket != 0 && bytes > float64(config.AllocBudgetPacket)
+		if overPacketBudget.Swap(over) != over {
+			if over {
+				allocAlerts.Inc()
+				logf("ALERT: %.0f bytes allocated per forwarded packet, over the budget of %d\n", bytes, config.AllocBudgetPacket)
+			} else {
+				logf("Back under the allocation budget per forwarded packet\n")
+			}
+		}
+	})
+}
+
+// measureCheckpoint returns a func to call once a checkpoint started now is
+// taken, which records what it allocated and logs an ALERT when checkpoints
+// go over -alloc-budget-checkpoint. Allocations of the rest of the process
+// in the meantime are counted too.
+func measureCheckpoint() func() {
+	start := readRuntimeMetrics(metricAllocBytes)[0]
+	return func() {
+		allocated := readRuntimeMetrics(metricAllocBytes)[0] - start
+		checkpointAllocBytes.Store(allocated)
+
+		over := config.AllocBudgetCheckpoint != 0 && allocated > config.AllocBudgetCheckpoint
+		if overCheckpointBudget.Swap(over) != over {
+			if over {
+				allocAlerts.Inc()
+				logf("ALERT: checkpoint allocated %d bytes, over the budget of %d\n", allocated, config.AllocBudgetCheckpoint)
+			} else {
+				logf("Checkpoints back under their allocation budget\n")
+			}
+		}
+	}
+}
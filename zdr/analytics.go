@@ -0,0 +1,418 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// analyticsMinutes is how many minutes of joins, leaves and failures
+	// rates are worked out from.
+	analyticsMinutes = 60
+
+	// maxAnalyticsKeys bounds how many prefixes, ASNs or countries are
+	// kept, those seen least recently are dropped first.
+	maxAnalyticsKeys = 4096
+
+	// analyticsPrefix, analyticsASN and analyticsCountry are what clients
+	// are grouped by.
+	analyticsPrefix  = "prefix"
+	analyticsASN     = "asn"
+	analyticsCountry = "country"
+)
+
+var (
+	errUnknownDimension = errors.New("unknown analytics dimension")
+
+	geoIPLookupFailures = newCounter("geoip_lookup_failures_total", "Client addresses the GeoIP reader failed to look up.")
+
+	geoIPReader    GeoIPReader
+	analytics      = map[string]*AnalyticsBucket{}
+	analyticsMutex sync.Mutex
+)
+
+// GeoIPRecord is what a GeoIPReader knows about an address. A zero ASN or
+// an empty Country leaves the address out of that dimension.
+type GeoIPRecord struct {
+	ASN          uint32
+	Organization string
+	Country      string
+}
+
+// GeoIPReader looks up the network of client addresses, for analytics by
+// ASN and country.
+type GeoIPReader interface {
+	Lookup(ip net.IP) (GeoIPRecord, error)
+}
+
+// SetGeoIPReader makes the Server look up client addresses with reader, in
+// place of the one of -geoip-file. It must be called before Start.
+func (s *Server) SetGeoIPReader(reader GeoIPReader) {
+	geoIPReader = reader
+}
+
+// AnalyticsBucket counts the clients of a prefix, ASN or country. Counts
+// are saved in the snapshot, so they carry on across restarts and a deploy
+// can be compared to the hour before it.
+type AnalyticsBucket struct {
+	Dimension, Key string
+
+	// Organization is the owner of an ASN.
+	Organization string `json:",omitempty"`
+
+	Joins, Leaves, Failures uint64
+	LastSeen                time.Time
+
+	// Minutes are the counts of the last analyticsMinutes minutes, oldest
+	// first.
+	Minutes []AnalyticsMinute
+}
+
+// AnalyticsMinute counts the joins, leaves and failures of the minute from
+// Start.
+type AnalyticsMinute struct {
+	Start                   time.Time
+	Joins, Leaves, Failures uint64
+}
+
+// clientOrigin is where a client connects from.
+type clientOrigin struct {
+	ip     net.IP
+	record GeoIPRecord
+}
+
+// lookupOrigin returns the origin of a client connecting from addr, a
+// host:port or an address.
+func lookupOrigin(addr string) clientOrigin {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	origin := clientOrigin{ip: net.ParseIP(addr)}
+	if origin.ip == nil || geoIPReader == nil {
+		return origin
+	}
+
+	record, err := geoIPReader.Lookup(origin.ip)
+	if err != nil {
+		geoIPLookupFailures.Inc()
+		return origin
+	}
+	origin.record = record
+	return origin
+}
+
+// address returns the address of o, empty if unknown.
+func (o clientOrigin) address() string {
+	if o.ip == nil {
+		return ""
+	}
+	return o.ip.String()
+}
+
+// prefix returns the /24 or /48 of the address.
+func (o clientOrigin) prefix() string {
+	if o.ip == nil {
+		return ""
+	} else if ip4 := o.ip.To4(); ip4 != nil {
+		return (&net.IPNet{IP: ip4.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}).String()
+	}
+	return (&net.IPNet{IP: o.ip.Mask(net.CIDRMask(48, 128)), Mask: net.CIDRMask(48, 128)}).String()
+}
+
+// keys returns the key of o in every dimension it has one in.
+func (o clientOrigin) keys() map[string]string {
+	out := map[string]string{}
+	if prefix := o.prefix(); prefix != "" {
+		out[analyticsPrefix] = prefix
+	}
+	if o.record.ASN != 0 {
+		out[analyticsASN] = "AS" + strconv.FormatUint(uint64(o.record.ASN), 10)
+	}
+	if o.record.Country != "" {
+		out[analyticsCountry] = strings.ToUpper(o.record.Country)
+	}
+	return out
+}
+
+// countOrigin adds a join, leave or failure of a client from origin.
+func countOrigin(origin clientOrigin, joins, leaves, failures uint64) {
+	now := time.Now()
+	minute := now.Truncate(time.Minute)
+
+	analyticsMutex.Lock()
+	defer analyticsMutex.Unlock()
+
+	for dimension, key := range origin.keys() {
+		bucket, ok := analytics[dimension+"\x00"+key]
+		if !ok {
+			bucket = &AnalyticsBucket{Dimension: dimension, Key: key}
+			analytics[dimension+"\x00"+key] = bucket
+		}
+		if dimension == analyticsASN && origin.record.Organization != "" {
+			bucket.Organization = origin.record.Organization
+		}
+
+		bucket.Joins += joins
+		bucket.Leaves += leaves
+		bucket.Failures += failures
+		bucket.LastSeen = now
+
+		if n := len(bucket.Minutes); n == 0 || bucket.Minutes[n-1].Start.Before(minute) {
+			bucket.Minutes = append(bucket.Minutes, AnalyticsMinute{Start: minute})
+		}
+		last := &bucket.Minutes[len(bucket.Minutes)-1]
+		last.Joins += joins
+		last.Leaves += leaves
+		last.Failures += failures
+		bucket.Minutes = recentMinutes(bucket.Minutes, now)
+	}
+	pruneAnalytics()
+}
+
+// recentMinutes drops the minutes older than analyticsMinutes.
+func recentMinutes(minutes []AnalyticsMinute, now time.Time) []AnalyticsMinute {
+	cutoff := now.Add(-analyticsMinutes * time.Minute)
+	n := 0
+	for n < len(minutes) && !minutes[n].Start.After(cutoff) {
+		n++
+	}
+	return minutes[n:]
+}
+
+// pruneAnalytics drops the buckets seen least recently of the dimensions
+// over maxAnalyticsKeys. analyticsMutex must be held by the caller.
+func pruneAnalytics() {
+	byDimension := map[string][]*AnalyticsBucket{}
+	for _, bucket := range analytics {
+		byDimension[bucket.Dimension] = append(byDimension[bucket.Dimension], bucket)
+	}
+
+	for _, buckets := range byDimension {
+		if len(buckets) <= maxAnalyticsKeys {
+			continue
+		}
+		sort.Slice(buckets, func(i, j int) bool { return buckets[i].LastSeen.Before(buckets[j].LastSeen) })
+		for _, bucket := range buckets[:len(buckets)-maxAnalyticsKeys] {
+			delete(analytics, bucket.Dimension+"\x00"+bucket.Key)
+		}
+	}
+}
+
+// countJoin counts a session that was answered.
+func countJoin(session *session) {
+	countOrigin(session.origin, 1, 0, 0)
+}
+
+// countEnd counts a session that ended for reason, as a failure unless its
+// client left or it was handed back.
+func countEnd(session *session, reason string) {
+	switch reason {
+	case tombstoneLeft, tombstoneHandedBack, tombstoneClosedByServer, "closed":
+		countOrigin(session.origin, 0, 1, 0)
+	default:
+		countOrigin(session.origin, 0, 0, 1)
+	}
+}
+
+// snapshotAnalytics returns a copy of the buckets to save.
+func snapshotAnalytics() []AnalyticsBucket {
+	analyticsMutex.Lock()
+	defer analyticsMutex.Unlock()
+
+	out := make([]AnalyticsBucket, 0, len(analytics))
+	for _, bucket := range analytics {
+		saved := *bucket
+		saved.Minutes = append([]AnalyticsMinute{}, bucket.Minutes...)
+		out = append(out, saved)
+	}
+	return out
+}
+
+func restoreAnalytics(saved []AnalyticsBucket) {
+	analyticsMutex.Lock()
+	defer analyticsMutex.Unlock()
+
+	analytics = map[string]*AnalyticsBucket{}
+	for i := range saved {
+		analytics[saved[i].Dimension+"\x00"+saved[i].Key] = &saved[i]
+	}
+}
+
+// loadGeoIPFile reads a GeoIPReader from a CSV file with a line like
+// "203.0.113.0/24,64500,Example Networks,DE" per network, nil if path is
+// empty. The most specific network of an address wins.
+func loadGeoIPFile(path string) (GeoIPReader, error) {
+	if path == "" {
+		return nil, nil //nolint:nilnil
+	}
+
+	file, err := os.Open(path) //nolint:gosec
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close() //nolint:errcheck
+
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = 4
+	reader.Comment = '#'
+	out := csvGeoIP{}
+	for {
+		line, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+
+		_, network, err := net.ParseCIDR(strings.TrimSpace(line[0]))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		asn, err := strconv.ParseUint(strings.TrimPrefix(strings.TrimSpace(line[1]), "AS"), 10, 32)
+		if err != nil && strings.TrimSpace(line[1]) != "" {
+			return nil, fmt.Errorf("%s: invalid ASN %q", path, line[1])
+		}
+		out = append(out, csvGeoIPNetwork{network: network, record: GeoIPRecord{
+			ASN:          uint32(asn),
+			Organization: strings.TrimSpace(line[2]),
+			Country:      strings.TrimSpace(line[3]),
+		}})
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		a, _ := out[i].network.Mask.Size()
+		b, _ := out[j].network.Mask.Size()
+		return a > b
+	})
+	return out, nil
+}
+
+// csvGeoIP is the GeoIPReader of -geoip-file, most specific network first.
+type csvGeoIP []csvGeoIPNetwork
+
+type csvGeoIPNetwork struct {
+	network *net.IPNet
+	record  GeoIPRecord
+}
+
+func (g csvGeoIP) Lookup(ip net.IP) (GeoIPRecord, error) {
+	for _, network := range g {
+		if network.network.Contains(ip) {
+			return network.record, nil
+		}
+	}
+	return GeoIPRecord{}, nil
+}
+
+type analyticsReport struct {
+	Dimension    string
+	Key          string
+	Organization string `json:",omitempty"`
+
+	// Viewers are connected now.
+	Viewers int
+
+	Joins, Leaves, Failures uint64
+	LastSeen                time.Time
+
+	// JoinRate, LeaveRate and FailureRate are per minute over the window,
+	// FailureRatio is the share of sessions that ended over it that failed.
+	JoinRate, LeaveRate, FailureRate float64
+	FailureRatio                     float64
+}
+
+// handleAdminAnalytics serves GET /admin/analytics?by=asn&window=15m,
+// returning the viewers connected now, the joins, leaves and failures since
+// counting began and their rates over window (the last 15 minutes by
+// default, an hour at most) by prefix, asn or country, most failures first.
+func handleAdminAnalytics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	dimension := r.URL.Query().Get("by")
+	switch dimension {
+	case "":
+		dimension = analyticsPrefix
+	case analyticsPrefix, analyticsASN, analyticsCountry:
+	default:
+		http.Error(w, fmt.Sprintf("%v: %q", errUnknownDimension, dimension), http.StatusBadRequest)
+		return
+	}
+
+	window := 15 * time.Minute
+	if value := r.URL.Query().Get("window"); value != "" {
+		var err error
+		if window, err = time.ParseDuration(value); err != nil || window < time.Minute || window > analyticsMinutes*time.Minute {
+			http.Error(w, "window must be between 1m and 1h", http.StatusBadRequest)
+			return
+		}
+	}
+
+	viewers := map[string]int{}
+	sessionsMutex.Lock()
+	for _, session := range sessions {
+		if key, ok := session.origin.keys()[dimension]; ok && !session.broadcaster {
+			viewers[key]++
+		}
+	}
+	sessionsMutex.Unlock()
+
+	now := time.Now()
+	out := []analyticsReport{}
+	for _, bucket := range snapshotAnalytics() {
+		if bucket.Dimension != dimension {
+			continue
+		}
+
+		report := analyticsReport{
+			Dimension:    bucket.Dimension,
+			Key:          bucket.Key,
+			Organization: bucket.Organization,
+			Viewers:      viewers[bucket.Key],
+			Joins:        bucket.Joins,
+			Leaves:       bucket.Leaves,
+			Failures:     bucket.Failures,
+			LastSeen:     bucket.LastSeen,
+		}
+		var joins, leaves, failures uint64
+		for _, minute := range bucket.Minutes {
+			if now.Sub(minute.Start) < window {
+				joins += minute.Joins
+				leaves += minute.Leaves
+				failures += minute.Failures
+			}
+		}
+		report.JoinRate = float64(joins) / window.Minutes()
+		report.LeaveRate = float64(leaves) / window.Minutes()
+		report.FailureRate = float64(failures) / window.Minutes()
+		if leaves+failures > 0 {
+			report.FailureRatio = float64(failures) / float64(leaves+failures)
+		}
+		out = append(out, report)
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].FailureRate != out[j].FailureRate {
+			return out[i].FailureRate > out[j].FailureRate
+		}
+		return out[i].Key < out[j].Key
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&out)
+}
@@ -0,0 +1,225 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strings"
+
+	"github.com/pion/dtls/v2"
+	"github.com/pion/rtp"
+)
+
+var (
+	ipv4Pattern = regexp.MustCompile(`\b\d{1,3}(\.\d{1,3}){3}\b`)
+	ipv6Pattern = regexp.MustCompile(`[0-9A-Fa-f]*:[0-9A-Fa-f:]*:[0-9A-Fa-f.]*`)
+)
+
+// AnonymizeSnapshot reads a snapshot from r and writes it to w with keys,
+// passwords and IP addresses replaced by placeholders, so it can be attached
+// to a bug report. The same value is always replaced by the same placeholder,
+// of the same length, so sessions can still be told apart and matched up.
+// Media payloads saved for the restore warm-up are zeroed.
+func AnonymizeSnapshot(r io.Reader, w io.Writer) error {
+	buffer, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	state, err := decodeSnapshot(buffer)
+	if err != nil {
+		return err
+	}
+
+	a := &anonymizer{numbers: map[string]int{}, counts: map[string]int{}}
+	for i := range state.PeerConnectionState {
+		if err = a.peerConnection(&state.PeerConnectionState[i]); err != nil {
+			return fmt.Errorf("session %s: %w", state.PeerConnectionState[i].ID, err)
+		}
+	}
+	for i := range state.Rooms {
+		a.room(&state.Rooms[i])
+	}
+	for i := range state.RetiredHistories {
+		a.history(state.RetiredHistories[i].Entries)
+	}
+	for i := range state.Tombstones {
+		state.Tombstones[i].Reason = a.text(state.Tombstones[i].Reason)
+	}
+	for i := range state.Logins {
+		state.Logins[i].ID = a.replace("login", state.Logins[i].ID)
+	}
+	for i := range state.Analytics {
+		if state.Analytics[i].Dimension == analyticsPrefix {
+			state.Analytics[i].Key = a.text(state.Analytics[i].Key)
+		}
+	}
+	return gob.NewEncoder(w).Encode(state)
+}
+
+// anonymizer hands out the placeholders of a snapshot.
+type anonymizer struct {
+	numbers map[string]int
+	counts  map[string]int
+}
+
+// number returns the number of the placeholder of value, values of a kind
+// are numbered from 1 in the order they are seen.
+func (a *anonymizer) number(kind, value string) int {
+	n, ok := a.numbers[kind+"\x00"+value]
+	if !ok {
+		a.counts[kind]++
+		n = a.counts[kind]
+		a.numbers[kind+"\x00"+value] = n
+	}
+	return n
+}
+
+// replace returns the placeholder of value, its kind and number padded to
+// the length of value.
+func (a *anonymizer) replace(kind, value string) string {
+	if value == "" {
+		return ""
+	}
+
+	placeholder := fmt.Sprintf("%s%d", kind, a.number(kind, value))
+	if len(placeholder) < len(value) {
+		placeholder += strings.Repeat("x", len(value)-len(placeholder))
+	}
+	return placeholder
+}
+
+// key returns a placeholder of the same length as key, every byte of it the
+// number of the placeholder.
+func (a *anonymizer) key(key []byte) []byte {
+	if len(key) == 0 {
+		return key
+	}
+	return bytes.Repeat([]byte{byte(a.number("key", string(key)))}, len(key))
+}
+
+// ip returns a documentation address standing in for ip.
+func (a *anonymizer) ip(ip net.IP) string {
+	if ip.To4() != nil {
+		n := a.number("ipv4", ip.String())
+		return fmt.Sprintf("198.51.%d.%d", n/254%256, n%254+1)
+	}
+	return fmt.Sprintf("2001:db8::%x", a.number("ipv6", ip.String()))
+}
+
+// text replaces the IP addresses in s.
+func (a *anonymizer) text(s string) string {
+	s = ipv4Pattern.ReplaceAllStringFunc(s, func(match string) string {
+		if ip := net.ParseIP(match); ip != nil {
+			return a.ip(ip)
+		}
+		return match
+	})
+	return ipv6Pattern.ReplaceAllStringFunc(s, func(match string) string {
+		if ip := net.ParseIP(match); ip != nil && ip.To4() == nil {
+			return a.ip(ip)
+		}
+		return match
+	})
+}
+
+func (a *anonymizer) history(entries []HistoryEntry) {
+	for i := range entries {
+		entries[i].Message = a.text(entries[i].Message)
+	}
+}
+
+func (a *anonymizer) peerConnection(state *PeerConnectionState) error {
+	state.ICEUsernameFragment = a.replace("ufrag", state.ICEUsernameFragment)
+	state.ICEPassword = a.replace("pwd", state.ICEPassword)
+	state.TURN.Password = a.replace("turn", state.TURN.Password)
+	state.RemoteDescription.SDP = a.sdp(state.RemoteDescription.SDP)
+	a.history(state.History)
+	for key, value := range state.KV {
+		state.KV[key] = a.replace("value", value)
+	}
+	state.ClientIP = a.text(state.ClientIP)
+	return a.dtls(&state.DTLSConnectionState)
+}
+
+// sdp replaces the ICE credentials and addresses of a session description.
+func (a *anonymizer) sdp(description string) string {
+	lines := strings.Split(description, "\r\n")
+	for i, line := range lines {
+		if ufrag, ok := strings.CutPrefix(line, "a=ice-ufrag:"); ok {
+			lines[i] = "a=ice-ufrag:" + a.replace("ufrag", ufrag)
+		} else if pwd, ok := strings.CutPrefix(line, "a=ice-pwd:"); ok {
+			lines[i] = "a=ice-pwd:" + a.replace("pwd", pwd)
+		} else if strings.HasPrefix(line, "a=candidate:") {
+			// Candidates may name the ufrag they belong to.
+			fields := strings.Fields(line)
+			for j := 0; j+1 < len(fields); j++ {
+				if fields[j] == "ufrag" {
+					fields[j+1] = a.replace("ufrag", fields[j+1])
+				}
+			}
+			lines[i] = strings.Join(fields, " ")
+		}
+	}
+	return a.text(strings.Join(lines, "\r\n"))
+}
+
+// dtls replaces the master secret, randoms and session ID of state. The
+// certificates of the client are public and kept.
+func (a *anonymizer) dtls(state *dtls.State) error {
+	serialized, err := state.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	// The fields of dtls.State are unexported, gob matches them by name.
+	var fields struct {
+		LocalEpoch            uint16
+		RemoteEpoch           uint16
+		LocalRandom           [32]byte
+		RemoteRandom          [32]byte
+		CipherSuiteID         uint16
+		MasterSecret          []byte
+		SequenceNumber        uint64
+		SRTPProtectionProfile uint16
+		PeerCertificates      [][]byte
+		IdentityHint          []byte
+		SessionID             []byte
+		IsClient              bool
+	}
+	if err = gob.NewDecoder(bytes.NewReader(serialized)).Decode(&fields); err != nil {
+		return err
+	}
+
+	fields.MasterSecret = a.key(fields.MasterSecret)
+	copy(fields.LocalRandom[:], a.key(fields.LocalRandom[:]))
+	copy(fields.RemoteRandom[:], a.key(fields.RemoteRandom[:]))
+	fields.SessionID = a.key(fields.SessionID)
+
+	buffer := &bytes.Buffer{}
+	if err = gob.NewEncoder(buffer).Encode(fields); err != nil {
+		return err
+	}
+	return state.UnmarshalBinary(buffer.Bytes())
+}
+
+// room zeroes the payloads of the packets saved for the restore warm-up,
+// their headers are kept.
+func (a *anonymizer) room(state *RoomState) {
+	for i, sent := range state.SentPackets {
+		packet := &rtp.Packet{}
+		if err := packet.Unmarshal(sent.Packet); err != nil {
+			state.SentPackets[i].Packet = make([]byte, len(sent.Packet))
+			continue
+		}
+		packet.Payload = make([]byte, len(packet.Payload))
+		if raw, err := packet.Marshal(); err == nil {
+			state.SentPackets[i].Packet = raw
+		}
+	}
+}
@@ -0,0 +1,448 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	authStatic        = "static"
+	authJWT           = "jwt"
+	authIntrospection = "oidc"
+
+	roleBroadcaster = "broadcaster"
+	roleViewer      = "viewer"
+	roleAdmin       = "admin"
+
+	introspectionTimeout  = 5 * time.Second
+	introspectionCacheTTL = 30 * time.Second
+)
+
+var (
+	errUnauthenticated = errors.New("missing or invalid credentials")
+	errForbidden       = errors.New("credentials don't allow this")
+	errInvalidAuth     = errors.New("invalid auth provider")
+
+	authFailures = newCounter("auth_failures_total", "Requests refused by the auth provider.")
+
+	// authProvider checks the credentials of every request if set, by -auth
+	// or Server.SetAuthProvider.
+	authProvider AuthProvider
+)
+
+// Principal is who a request was made by, as vouched for by an AuthProvider.
+// The principal of a session is saved with it, so a resumed session is bound
+// to the same one without validating credentials that may have expired.
+type Principal struct {
+	Subject string
+	Roles   []string `json:",omitempty"`
+
+	// Rooms are the rooms the principal may join, all of them if empty.
+	Rooms []string `json:",omitempty"`
+
+	// Tenant is the tenant of -tenants the principal belongs to, it may
+	// only join rooms of that tenant. Without one it may only join rooms
+	// of no tenant.
+	Tenant string `json:",omitempty"`
+}
+
+// AuthProvider validates the credentials of requests. Returning a
+// *HookError answers with its status code, errors wrapping errForbidden with
+// 403 and any other error with 401.
+type AuthProvider interface {
+	// ValidateBroadcaster and ValidateViewer are called for requests that
+	// join room or act on a session of room.
+	ValidateBroadcaster(r *http.Request, room string) (Principal, error)
+	ValidateViewer(r *http.Request, room string) (Principal, error)
+
+	// ValidateAdmin is called for every request to /admin/.
+	ValidateAdmin(r *http.Request) (Principal, error)
+}
+
+// SetAuthProvider makes the Server check every request with provider, in
+// place of the one of -auth. It must be called before the handlers are
+// served.
+func (s *Server) SetAuthProvider(provider AuthProvider) {
+	authProvider = provider
+}
+
+// has reports whether p was granted role.
+func (p Principal) has(role string) bool {
+	for _, r := range p.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// mayJoin reports whether p may join room, any room if room is empty.
+func (p Principal) mayJoin(room string) bool {
+	if len(p.Rooms) == 0 || room == "" {
+		return true
+	}
+	for _, r := range p.Rooms {
+		if r == room {
+			return true
+		}
+	}
+	return false
+}
+
+// authorize checks that p was granted role and may join room.
+func (p Principal) authorize(role, room string) error {
+	if !p.has(role) {
+		return fmt.Errorf("%w: %s is not a %s", errForbidden, p.Subject, role)
+	} else if !p.mayJoin(room) {
+		return fmt.Errorf("%w: %s may not join room %s", errForbidden, p.Subject, room)
+	}
+	return nil
+}
+
+// bearerToken returns the token of r, from its Authorization header or, for
+// EventSource which can't set headers, its token query parameter.
+func bearerToken(r *http.Request) string {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return token
+	}
+	return r.URL.Query().Get("token")
+}
+
+// tokenAuth is an AuthProvider granting what the principal its resolve
+// returns for the bearer token of a request has roles and rooms for.
+type tokenAuth struct {
+	resolve func(ctx context.Context, token string) (Principal, error)
+}
+
+func (a *tokenAuth) validate(r *http.Request, role, room string) (Principal, error) {
+	token := bearerToken(r)
+	if token == "" {
+		return Principal{}, errUnauthenticated
+	}
+
+	principal, err := a.resolve(r.Context(), token)
+	if err != nil {
+		return Principal{}, err
+	}
+	return principal, principal.authorize(role, room)
+}
+
+func (a *tokenAuth) ValidateBroadcaster(r *http.Request, room string) (Principal, error) {
+	return a.validate(r, roleBroadcaster, room)
+}
+
+func (a *tokenAuth) ValidateViewer(r *http.Request, room string) (Principal, error) {
+	return a.validate(r, roleViewer, room)
+}
+
+func (a *tokenAuth) ValidateAdmin(r *http.Request) (Principal, error) {
+	return a.validate(r, roleAdmin, "")
+}
+
+// NewStaticKeyAuth returns an AuthProvider for the bearer tokens in keys,
+// along with the principal each of them is.
+func NewStaticKeyAuth(keys map[string]Principal) AuthProvider {
+	return &tokenAuth{resolve: func(_ context.Context, token string) (Principal, error) {
+		for key, principal := range keys {
+			if hmac.Equal([]byte(key), []byte(token)) {
+				return principal, nil
+			}
+		}
+		return Principal{}, errUnauthenticated
+	}}
+}
+
+// NewJWTAuth returns an AuthProvider for bearer tokens that are JWTs signed
+// with HS256 and secret. The principal is the sub claim, granted the roles
+// and rooms claims, which are arrays of strings, of the tenant claim if any.
+// exp and nbf are checked.
+func NewJWTAuth(secret []byte) AuthProvider {
+	return &tokenAuth{resolve: func(_ context.Context, token string) (Principal, error) {
+		return verifyJWT(token, secret, time.Now())
+	}}
+}
+
+func verifyJWT(token string, secret []byte, now time.Time) (Principal, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return Principal{}, errUnauthenticated
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil || header.Alg != "HS256" {
+		return Principal{}, errUnauthenticated
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return Principal{}, errUnauthenticated
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return Principal{}, errUnauthenticated
+	}
+
+	var claims struct {
+		Subject   string   `json:"sub"`
+		Roles     []string `json:"roles"`
+		Rooms     []string `json:"rooms"`
+		Tenant    string   `json:"tenant"`
+		ExpiresAt int64    `json:"exp"`
+		NotBefore int64    `json:"nbf"`
+	}
+	if err = decodeJWTPart(parts[1], &claims); err != nil {
+		return Principal{}, errUnauthenticated
+	} else if claims.ExpiresAt != 0 && !now.Before(time.Unix(claims.ExpiresAt, 0)) {
+		return Principal{}, fmt.Errorf("%w: token expired", errUnauthenticated)
+	} else if claims.NotBefore != 0 && now.Before(time.Unix(claims.NotBefore, 0)) {
+		return Principal{}, fmt.Errorf("%w: token not valid yet", errUnauthenticated)
+	}
+	return Principal{Subject: claims.Subject, Roles: claims.Roles, Rooms: claims.Rooms, Tenant: claims.Tenant}, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+type introspected struct {
+	principal Principal
+	until     time.Time
+}
+
+// NewIntrospectionAuth returns an AuthProvider for OAuth 2.0 tokens checked
+// against the token introspection endpoint of an OpenID Connect provider
+// (RFC 7662), authenticating with clientID and clientSecret. The principal
+// is the sub of active tokens, granted the roles among the words of their
+// scope, the rooms of their rooms member and the tenant of their tenant
+// member. Answers are cached for introspectionCacheTTL, at most until the
+// token expires.
+func NewIntrospectionAuth(endpoint, clientID, clientSecret string) AuthProvider {
+	client := &http.Client{Timeout: introspectionTimeout}
+	cache := map[string]introspected{}
+	var cacheMutex sync.Mutex
+
+	return &tokenAuth{resolve: func(ctx context.Context, token string) (Principal, error) {
+		now := time.Now()
+		cacheMutex.Lock()
+		cached, ok := cache[token]
+		cacheMutex.Unlock()
+		if ok && now.Before(cached.until) {
+			return cached.principal, nil
+		}
+
+		request, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(url.Values{"token": {token}}.Encode()))
+		if err != nil {
+			return Principal{}, err
+		}
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		request.SetBasicAuth(url.QueryEscape(clientID), url.QueryEscape(clientSecret))
+
+		response, err := client.Do(request)
+		if err != nil {
+			return Principal{}, &HookError{Code: http.StatusBadGateway, Message: fmt.Sprintf("token introspection failed: %v", err)}
+		}
+		defer response.Body.Close() //nolint:errcheck
+		if response.StatusCode != http.StatusOK {
+			return Principal{}, &HookError{Code: http.StatusBadGateway, Message: fmt.Sprintf("token introspection failed: %s", response.Status)}
+		}
+
+		var answer struct {
+			Active    bool     `json:"active"`
+			Subject   string   `json:"sub"`
+			Scope     string   `json:"scope"`
+			Rooms     []string `json:"rooms"`
+			Tenant    string   `json:"tenant"`
+			ExpiresAt int64    `json:"exp"`
+		}
+		if err = json.NewDecoder(response.Body).Decode(&answer); err != nil {
+			return Principal{}, &HookError{Code: http.StatusBadGateway, Message: fmt.Sprintf("token introspection failed: %v", err)}
+		} else if !answer.Active {
+			return Principal{}, errUnauthenticated
+		}
+
+		principal := Principal{Subject: answer.Subject, Rooms: answer.Rooms, Tenant: answer.Tenant}
+		for _, scope := range strings.Fields(answer.Scope) {
+			switch scope {
+			case roleBroadcaster, roleViewer, roleAdmin:
+				principal.Roles = append(principal.Roles, scope)
+			}
+		}
+
+		until := now.Add(introspectionCacheTTL)
+		if answer.ExpiresAt != 0 && time.Unix(answer.ExpiresAt, 0).Before(until) {
+			until = time.Unix(answer.ExpiresAt, 0)
+		}
+		cacheMutex.Lock()
+		for key, entry := range cache {
+			if !now.Before(entry.until) {
+				delete(cache, key)
+			}
+		}
+		cache[token] = introspected{principal: principal, until: until}
+		cacheMutex.Unlock()
+		return principal, nil
+	}}
+}
+
+// parseAuth returns the provider of -auth, one of static:keys.json,
+// jwt:secret-file or oidc:https://idp/introspect, nil if it is empty.
+// clientCredentials is the id:secret of -auth-client, used with oidc.
+func parseAuth(spec, clientCredentials string) (AuthProvider, error) {
+	if spec == "" {
+		return nil, nil
+	}
+
+	kind, target, ok := strings.Cut(spec, ":")
+	if !ok || target == "" {
+		return nil, fmt.Errorf("%w: %q", errInvalidAuth, spec)
+	}
+
+	switch kind {
+	case authStatic:
+		data, err := os.ReadFile(target) //nolint:gosec
+		if err != nil {
+			return nil, err
+		}
+		keys := map[string]Principal{}
+		if err = json.Unmarshal(data, &keys); err != nil {
+			return nil, fmt.Errorf("%s: %w", target, err)
+		}
+		return NewStaticKeyAuth(keys), nil
+	case authJWT:
+		secret, err := os.ReadFile(target) //nolint:gosec
+		if err != nil {
+			return nil, err
+		}
+		return NewJWTAuth([]byte(strings.TrimSpace(string(secret)))), nil
+	case authIntrospection:
+		clientID, clientSecret, _ := strings.Cut(clientCredentials, ":")
+		return NewIntrospectionAuth(target, clientID, clientSecret), nil
+	}
+	return nil, fmt.Errorf("%w: unknown kind %q", errInvalidAuth, kind)
+}
+
+// authError answers a request refused by the auth provider.
+func authError(w http.ResponseWriter, err error) {
+	authFailures.Inc()
+
+	var hookErr *HookError
+	switch {
+	case errors.As(err, &hookErr):
+		http.Error(w, hookErr.Message, hookErr.Code)
+	case errors.Is(err, errForbidden):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	default:
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+	}
+}
+
+// authorizeJoin validates a request to join room as a broadcaster or a
+// viewer. Requests with a login cookie are validated against the principal
+// of the login, those with the key of a tenant against its principal, others
+// by the auth provider. Without one everyone may join as nobody, except that
+// broadcasting takes a login once logins are enabled. Either way the
+// principal must be of the tenant of the room.
+func authorizeJoin(r *http.Request, room string, broadcaster bool) (Principal, error) {
+	principal, err := authorizeRole(r, room, broadcaster)
+	if err != nil {
+		return principal, err
+	}
+	return principal, authorizeTenant(principal, room)
+}
+
+// authorizeRole is authorizeJoin but for the tenant of room.
+func authorizeRole(r *http.Request, room string, broadcaster bool) (Principal, error) {
+	role := roleViewer
+	if broadcaster {
+		role = roleBroadcaster
+	}
+	if principal, ok := loginPrincipal(r); ok {
+		return principal, principal.authorize(role, room)
+	} else if principal, ok := tenantKeyPrincipal(r); ok {
+		return principal, principal.authorize(role, room)
+	}
+
+	if authProvider == nil {
+		if broadcaster && loginsEnabled() {
+			return Principal{}, fmt.Errorf("%w: broadcasting requires logging in", errUnauthenticated)
+		}
+		return Principal{}, nil
+	} else if broadcaster {
+		return authProvider.ValidateBroadcaster(r, room)
+	}
+	return authProvider.ValidateViewer(r, room)
+}
+
+// authorizeAny validates a request made before a client knows whether it
+// will broadcast or view room.
+func authorizeAny(r *http.Request, room string) error {
+	if _, err := authorizeJoin(r, room, false); err == nil {
+		return nil
+	}
+	_, err := authorizeJoin(r, room, true)
+	return err
+}
+
+// authorizeSession validates a request acting on session, which must be
+// made by the principal the session was created by. Sessions created
+// without an auth provider may be acted on by anyone it validates.
+func authorizeSession(r *http.Request, session *session) error {
+	principal, err := authorizeRoomJoin(r, session.room, session.broadcaster)
+	if err != nil {
+		return err
+	} else if session.principal.Subject != "" && principal.Subject != session.principal.Subject {
+		return fmt.Errorf("%w: session %s belongs to someone else", errForbidden, session.id)
+	}
+	return nil
+}
+
+// requireAdmin refuses requests the auth provider doesn't validate as admin,
+// or without one, that lack the bearer token of -admin-token. The admin API
+// spans every tenant, so principals of a tenant are refused too.
+func requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if authProvider != nil {
+			if principal, err := authProvider.ValidateAdmin(r); err != nil {
+				authError(w, err)
+				return
+			} else if principal.Tenant != "" {
+				authError(w, fmt.Errorf("%w: %s belongs to tenant %s", errForbidden, principal.Subject, principal.Tenant))
+				return
+			}
+		} else if config.AdminToken != "" {
+			token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || !hmac.Equal([]byte(token), []byte(config.AdminToken)) {
+				authError(w, errUnauthenticated)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// adminAuthenticated reports whether admin requests are authenticated at all.
+func adminAuthenticated() bool {
+	return authProvider != nil || config.AdminToken != ""
+}
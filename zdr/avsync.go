@@ -0,0 +1,269 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	// syncSmoothing is the weight of a new latency sample, packets of a
+	// frame leave over a few milliseconds so single ones are noisy.
+	syncSmoothing = 0.05
+
+	// ntpEpochOffset is the number of seconds from the NTP epoch, 1900, to
+	// the Unix one.
+	ntpEpochOffset = 2208988800
+)
+
+var _ = newGauge("av_sync_max_skew_seconds", "largest audio/video skew of a room track, positive when video lags", func() float64 {
+	roomsMutex.Lock()
+	defer roomsMutex.Unlock()
+
+	largest := 0.0
+	for _, room := range rooms {
+		for mimeType := range room.videoTracks {
+			if skew, ok := room.syncSkew(mimeType); ok && math.Abs(skew.Seconds()) > math.Abs(largest) {
+				largest = skew.Seconds()
+			}
+		}
+	}
+	return largest
+})
+
+// SyncMapping is the last sender report of a broadcaster track, relating
+// its RTP timestamps to the wall clock they were captured at. The
+// broadcaster keeps its clocks across our restarts, so mappings are saved
+// and measuring carries on with the first packets forwarded after one.
+type SyncMapping struct {
+	MimeType  string
+	NTPTime   uint64
+	RTPTime   uint32
+	ClockRate uint32
+}
+
+// trackSync follows how long packets of a room track take from being
+// captured by the broadcaster to being forwarded.
+type trackSync struct {
+	mapping  SyncMapping
+	latency  time.Duration
+	measured bool
+}
+
+// syncState returns the trackSync of the room track of mimeType, creating it.
+// syncMutex must be held.
+func (r *room) syncState(mimeType string) *trackSync {
+	mimeType = strings.ToLower(mimeType)
+	if r.syncs[mimeType] == nil {
+		r.syncs[mimeType] = &trackSync{}
+	}
+	return r.syncs[mimeType]
+}
+
+// recordSenderReports keeps the mapping of the sender reports among packets,
+// read from the broadcaster track of mimeType.
+func recordSenderReports(room *room, mimeType string, clockRate uint32, packets []rtcp.Packet) {
+	for _, packet := range packets {
+		report, ok := packet.(*rtcp.SenderReport)
+		if !ok || clockRate == 0 {
+			continue
+		}
+
+		room.syncMutex.Lock()
+		room.syncState(mimeType).mapping = SyncMapping{
+			MimeType:  strings.ToLower(mimeType),
+			NTPTime:   report.NTPTime,
+			RTPTime:   report.RTPTime,
+			ClockRate: clockRate,
+		}
+		room.syncMutex.Unlock()
+	}
+}
+
+// observeLatency is called for every packet of the broadcaster track of
+// mimeType before it is forwarded, with its timestamp as the broadcaster
+// set it.
+func observeLatency(room *room, mimeType string, timestamp uint32, now time.Time) {
+	room.syncMutex.Lock()
+	defer room.syncMutex.Unlock()
+
+	state := room.syncState(mimeType)
+	if state.mapping.ClockRate == 0 {
+		return
+	}
+
+	elapsed := time.Duration(int32(timestamp-state.mapping.RTPTime)) * time.Second / time.Duration(state.mapping.ClockRate)
+	latency := now.Sub(ntpToTime(state.mapping.NTPTime).Add(elapsed))
+	if !state.measured {
+		state.latency, state.measured = latency, true
+		return
+	}
+	state.latency += time.Duration(syncSmoothing * float64(latency-state.latency))
+}
+
+// syncLatencies returns the latency of the audio track of r and of its video
+// track of mimeType.
+func (r *room) syncLatencies(mimeType string) (audio, video time.Duration, ok bool) {
+	r.syncMutex.Lock()
+	defer r.syncMutex.Unlock()
+
+	audioSync, videoSync := r.syncs[strings.ToLower(webrtc.MimeTypeOpus)], r.syncs[strings.ToLower(mimeType)]
+	if audioSync == nil || videoSync == nil || !audioSync.measured || !videoSync.measured {
+		return 0, 0, false
+	}
+	return audioSync.latency, videoSync.latency, true
+}
+
+// syncSkew returns how much later than audio the video of mimeType reaches
+// viewers relative to when both were captured.
+func (r *room) syncSkew(mimeType string) (time.Duration, bool) {
+	audio, video, ok := r.syncLatencies(mimeType)
+	return video - audio, ok
+}
+
+// syncCorrection returns how far back sender reports of the video track of
+// mimeType are moved, the skew if it is above -sync-threshold.
+func (r *room) syncCorrection(mimeType string) time.Duration {
+	if config.SyncThreshold <= 0 {
+		return 0
+	}
+
+	skew, ok := r.syncSkew(mimeType)
+	if !ok || (skew < config.SyncThreshold && skew > -config.SyncThreshold) {
+		return 0
+	}
+	return skew
+}
+
+func (r *room) syncMappings() []SyncMapping {
+	r.syncMutex.Lock()
+	defer r.syncMutex.Unlock()
+
+	out := []SyncMapping{}
+	for _, state := range r.syncs {
+		if state.mapping.ClockRate != 0 {
+			out = append(out, state.mapping)
+		}
+	}
+	return out
+}
+
+func (r *room) restoreSyncMappings(mappings []SyncMapping) {
+	r.syncMutex.Lock()
+	defer r.syncMutex.Unlock()
+
+	for _, mapping := range mappings {
+		r.syncState(mapping.MimeType).mapping = mapping
+	}
+}
+
+func ntpToTime(ntp uint64) time.Time {
+	seconds := int64(ntp>>32) - ntpEpochOffset
+	fraction := int64(ntp&0xffffffff) * int64(time.Second) >> 32
+	return time.Unix(seconds, fraction)
+}
+
+func timeToNTP(t time.Time) uint64 {
+	seconds := uint64(t.Unix() + ntpEpochOffset)
+	fraction := uint64(t.Nanosecond()) << 32 / uint64(time.Second)
+	return seconds<<32 | fraction
+}
+
+type syncInterceptorFactory struct {
+	session *session
+}
+
+func (f *syncInterceptorFactory) NewInterceptor(string) (interceptor.Interceptor, error) {
+	return &syncInterceptor{session: f.session, mimeTypes: map[uint32]string{}}, nil
+}
+
+// syncInterceptor moves the NTP time of the sender reports of a viewer's
+// video back by the skew of the room, so the viewer lines it up with audio
+// as it was captured rather than as it was sent. It sits below the reports
+// interceptor, without it viewers get no sender reports and can't sync at
+// all.
+type syncInterceptor struct {
+	interceptor.NoOp
+	session *session
+
+	mutex     sync.Mutex
+	mimeTypes map[uint32]string
+}
+
+func (i *syncInterceptor) BindLocalStream(info *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	i.mutex.Lock()
+	i.mimeTypes[info.SSRC] = info.MimeType
+	i.mutex.Unlock()
+	return writer
+}
+
+func (i *syncInterceptor) UnbindLocalStream(info *interceptor.StreamInfo) {
+	i.mutex.Lock()
+	delete(i.mimeTypes, info.SSRC)
+	i.mutex.Unlock()
+}
+
+func (i *syncInterceptor) BindRTCPWriter(writer interceptor.RTCPWriter) interceptor.RTCPWriter {
+	return interceptor.RTCPWriterFunc(func(pkts []rtcp.Packet, attributes interceptor.Attributes) (int, error) {
+		for _, packet := range pkts {
+			report, ok := packet.(*rtcp.SenderReport)
+			if !ok {
+				continue
+			}
+
+			i.mutex.Lock()
+			mimeType := i.mimeTypes[report.SSRC]
+			i.mutex.Unlock()
+			if !strings.HasPrefix(strings.ToLower(mimeType), "video/") {
+				continue
+			}
+			if correction := i.session.room.syncCorrection(mimeType); correction != 0 {
+				report.NTPTime = timeToNTP(ntpToTime(report.NTPTime).Add(-correction))
+			}
+		}
+		return writer.Write(pkts, attributes)
+	})
+}
+
+type adminSync struct {
+	VideoCodec   string
+	AudioLatency time.Duration
+	VideoLatency time.Duration
+	Skew         time.Duration
+	Correction   time.Duration
+}
+
+// handleAdminSync serves GET /admin/sessions/{id}/sync, the audio/video sync
+// of what a viewer receives.
+func handleAdminSync(w http.ResponseWriter, r *http.Request, session *session) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	room := session.room
+	audio, video, ok := room.syncLatencies(session.videoCodec)
+	if session.broadcaster || session.videoCodec == "" || !ok {
+		http.Error(w, "sync is not measured for this session", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(adminSync{
+		VideoCodec:   session.videoCodec,
+		AudioLatency: audio,
+		VideoLatency: video,
+		Skew:         video - audio,
+		Correction:   room.syncCorrection(session.videoCodec),
+	})
+}
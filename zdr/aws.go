@@ -0,0 +1,92 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// awsCredentials sign the requests of the S3 snapshot store and of KMS.
+type awsCredentials struct {
+	accessKey    string
+	secretKey    string
+	sessionToken string
+}
+
+// awsCredentialsFromEnv returns the credentials of the AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN variables.
+func awsCredentialsFromEnv() awsCredentials {
+	return awsCredentials{
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+}
+
+// signAWS adds the AWS Signature Version 4 of request to service in region
+// to its headers, signing the payload and every header set so far. request
+// must have no query.
+func signAWS(request *http.Request, body []byte, service, region string, credentials awsCredentials, now time.Time) {
+	payloadHash := sha256.Sum256(body)
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+
+	request.Header.Set("x-amz-date", amzDate)
+	request.Header.Set("x-amz-content-sha256", hex.EncodeToString(payloadHash[:]))
+	if credentials.sessionToken != "" {
+		request.Header.Set("x-amz-security-token", credentials.sessionToken)
+	}
+	canonical, signedHeaders := awsCanonicalRequest(request)
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	canonicalHash := sha256.Sum256([]byte(canonical))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	key := []byte("AWS4" + credentials.secretKey)
+	for _, part := range []string{date, region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	request.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		credentials.accessKey, scope, signedHeaders, hex.EncodeToString(hmacSHA256(key, stringToSign))))
+}
+
+// awsCanonicalRequest returns the canonical request of request, whose
+// x-amz-content-sha256 header must be set, and the headers it signs: the
+// host and every header but Authorization.
+func awsCanonicalRequest(request *http.Request) (string, string) {
+	headers := map[string]string{"host": request.URL.Host}
+	for name, values := range request.Header {
+		if name = strings.ToLower(name); name != "authorization" {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonical strings.Builder
+	fmt.Fprintf(&canonical, "%s\n%s\n\n", request.Method, request.URL.EscapedPath())
+	for _, name := range names {
+		fmt.Fprintf(&canonical, "%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+	fmt.Fprintf(&canonical, "\n%s\n%s", signedHeaders, headers["x-amz-content-sha256"])
+	return canonical.String(), signedHeaders
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
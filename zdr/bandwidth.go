@@ -0,0 +1,117 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/interceptor/pkg/gcc"
+
+	"webrtc-zero-downtime-reload/internal/pionadapter"
+)
+
+var bandwidthEstimatesRestored = newCounter("bandwidth_estimates_restored_total", "Viewers whose bandwidth estimator resumed from the estimate of the snapshot.")
+
+// BandwidthState is the bandwidth estimator of a viewer as saved in the
+// snapshot. Without it every viewer would start over from -gcc-initial-bitrate
+// after a restart, all of them at once, and the layer controller would move
+// them down until their estimators got back to where they were.
+type BandwidthState = pionadapter.BandwidthState
+
+// bandwidthState is the send side bandwidth estimator of a viewer, fed with
+// the TWCC feedback of the viewer for the packets it was sent. pion keeps
+// the trendline and the overuse threshold of the delay based controller in
+// closures, those start over on a restore and settle within a few reports,
+// everything else is put back.
+type bandwidthState struct {
+	estimator atomic.Pointer[gcc.SendSideBWE]
+
+	mu       sync.Mutex
+	restored *BandwidthState
+}
+
+// estimate returns the target bitrate of the estimator, 0 if there is none.
+func (s *bandwidthState) estimate() uint64 {
+	if e := s.estimator.Load(); e != nil {
+		return uint64(e.GetTargetBitrate())
+	}
+	return 0
+}
+
+// persisted returns the estimator to save, what was restored while there is
+// none yet, nil if the viewer has neither.
+func (s *bandwidthState) persisted() *BandwidthState {
+	e := s.estimator.Load()
+	if e == nil {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.restored
+	}
+
+	return pionadapter.Pion.BandwidthState(e)
+}
+
+func (s *bandwidthState) restore(state *BandwidthState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.restored = state
+}
+
+// newEstimator creates the estimator of a new PeerConnection of session,
+// carrying on from the one it replaces or from the snapshot. The viewer is
+// paced by its own pacer, gcc doesn't pace.
+func newEstimator(session *session) (cc.BandwidthEstimator, error) {
+	state := session.bandwidth.persisted()
+	initial := config.GCCInitialBitrate
+	if state != nil && state.Estimate > 0 {
+		initial = state.Estimate
+	}
+
+	e, err := gcc.NewSendSideBWE(gcc.SendSideBWEInitialBitrate(initial), gcc.SendSideBWEPacer(gcc.NewNoOpPacer()))
+	if err != nil {
+		return nil, err
+	}
+	if state != nil && state.Estimate > 0 {
+		pionadapter.Pion.SetBandwidthState(e, state)
+		bandwidthEstimatesRestored.Inc()
+		recordHistory(session, historyRestore, "bandwidth estimation resumed at %d bps", state.Estimate)
+	}
+
+	session.bandwidth.estimator.Store(e)
+	return e, nil
+}
+
+// configureGCC adds the bandwidth estimator of a viewer. It has to come
+// before the TWCC header extension interceptor, which numbers the packets
+// it sees.
+func configureGCC(session *session) (*cc.InterceptorFactory, error) {
+	return cc.NewInterceptor(func() (cc.BandwidthEstimator, error) {
+		return newEstimator(session)
+	})
+}
+
+// handleAdminBandwidth returns the bandwidth estimator of a viewer, with the
+// stats pion reports for it.
+func handleAdminBandwidth(w http.ResponseWriter, r *http.Request, session *session) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	e := session.bandwidth.estimator.Load()
+	if e == nil {
+		http.Error(w, "gcc is not enabled for this session", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		*BandwidthState
+		Stats map[string]interface{}
+	}{session.bandwidth.persisted(), e.GetStats()})
+}
@@ -0,0 +1,83 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+// applyBitrateCap adds a b=TIAS line to every video section of the answer so
+// the remote side never sends us more than bitrate bps. A bitrate of zero
+// leaves the SDP untouched.
+func applyBitrateCap(answer string, bitrate uint64) (string, error) {
+	if bitrate == 0 {
+		return answer, nil
+	}
+
+	parsed := &sdp.SessionDescription{}
+	if err := parsed.Unmarshal([]byte(answer)); err != nil {
+		return "", err
+	}
+
+	for _, media := range parsed.MediaDescriptions {
+		if media.MediaName.Media != "video" {
+			continue
+		}
+
+		media.Bandwidth = append(media.Bandwidth, sdp.Bandwidth{Type: "TIAS", Bandwidth: bitrate})
+	}
+
+	out, err := parsed.Marshal()
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
+
+// ingestBitrateCap returns the lowest bitrate cap across the sessions of
+// room. We relay a single encoding to every viewer, so capping one viewer
+// means capping what the broadcaster sends.
+func ingestBitrateCap(room *room) uint64 {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+
+	lowest := uint64(0)
+	for _, session := range sessions {
+		if session.room != room {
+			continue
+		}
+
+		if bitrate := session.maxBitrate.Load(); bitrate != 0 && (lowest == 0 || bitrate < lowest) {
+			lowest = bitrate
+		}
+	}
+	return lowest
+}
+
+// sendBitrateCap sends a REMB for track every second while a cap is
+// configured. Runtime changes from the admin API take effect on the next tick.
+func sendBitrateCap(room *room, peerConnection *webrtc.PeerConnection, track *webrtc.TrackRemote) {
+	for range time.NewTicker(time.Second).C {
+		if peerConnection.ConnectionState() == webrtc.PeerConnectionStateClosed {
+			return
+		}
+
+		bitrate := warmupBitrate(ingestBitrateCap(room))
+		if bitrate == 0 {
+			continue
+		}
+
+		remb := &rtcp.ReceiverEstimatedMaximumBitrate{
+			Bitrate: float32(bitrate),
+			SSRCs:   []uint32{uint32(track.SSRC())},
+		}
+		if err := peerConnection.WriteRTCP([]rtcp.Packet{remb}); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,53 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"context"
+	"time"
+)
+
+// markBroadcasterAlive is called for every packet we receive from the
+// broadcaster of room.
+func markBroadcasterAlive(room *room) {
+	now := time.Now().UnixNano()
+	room.lastBroadcasterPacket.Store(now)
+	if !room.haveBroadcaster.Swap(true) {
+		room.broadcasterSince.Store(now)
+	}
+}
+
+// watchBroadcaster clears haveBroadcaster of a room once no media has arrived
+// for -broadcaster-timeout. A broadcaster that vanishes without closing its
+// PeerConnection would otherwise block anyone else from broadcasting.
+func watchBroadcaster(ctx context.Context) {
+	every(ctx, time.Second, func(time.Time) {
+		lost := []*room{}
+		roomsMutex.Lock()
+		for _, room := range rooms {
+			if !room.haveBroadcaster.Load() {
+				continue
+			}
+
+			last := time.Unix(0, room.lastBroadcasterPacket.Load())
+			if time.Since(last) < config.BroadcasterTimeout || !room.haveBroadcaster.CompareAndSwap(true, false) {
+				continue
+			}
+
+			logf("No media from the broadcaster of room %s since %s, clearing it\n", room.id, last.Format(time.RFC3339))
+			lost = append(lost, room)
+		}
+		roomsMutex.Unlock()
+
+		sessionsMutex.Lock()
+		for _, session := range sessions {
+			for _, room := range lost {
+				if session.room == room {
+					publishEvent(session.id, event{Name: "broadcasterLost"})
+				}
+			}
+		}
+		sessionsMutex.Unlock()
+	})
+}
@@ -0,0 +1,197 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// clientLogLabel is the label of the DataChannel clients upload logs over,
+// every message is an upload of its own.
+const clientLogLabel = "logs"
+
+var (
+	errClientLogsDisabled = errors.New("client log uploads are disabled")
+	errClientLogsFull     = errors.New("the session uploaded all the logs it may")
+
+	clientLogUploads  = newCounter("client_log_uploads_total", "Logs and stats dumps uploaded by clients.")
+	clientLogBytes    = newCounter("client_log_upload_bytes_total", "Bytes of logs and stats dumps uploaded by clients.")
+	clientLogRefusals = newCounter("client_log_refusals_total", "Client log uploads refused for being disabled or over -client-log-max-bytes.")
+
+	clientLogsMutex sync.Mutex
+)
+
+// ClientLog is an upload of a client, its WebRTC logs or a getStats dump,
+// as written to -client-log-dir. It carries the generation the server was
+// in when it got it and the one the client last heard of, so what a client
+// saw can be lined up with the session history across a deploy.
+type ClientLog struct {
+	Session  string
+	Room     string
+	Received time.Time
+
+	// Generation is the restart generation of the server that received the
+	// upload, ClientGeneration the one the client was last answered by.
+	Generation       uint64
+	ClientGeneration uint64 `json:",omitempty"`
+
+	// Via is "http" or "datachannel", Kind what the client says it is, like
+	// "log" or "stats".
+	Via  string
+	Kind string `json:",omitempty"`
+
+	// Data is the upload as is if it is JSON, as a string otherwise.
+	Data json.RawMessage
+}
+
+// clientLogPath is the file the uploads of session id are appended to.
+func clientLogPath(id string) string {
+	return filepath.Join(config.ClientLogDir, id+".jsonl")
+}
+
+// appendClientLog writes an upload of session, as long as the session stays
+// within -client-log-max-bytes.
+func appendClientLog(session *session, upload ClientLog, data []byte) error {
+	if config.ClientLogDir == "" {
+		clientLogRefusals.Inc()
+		return errClientLogsDisabled
+	}
+
+	upload.Data = data
+	if !json.Valid(data) {
+		upload.Data, _ = json.Marshal(string(data))
+	}
+	upload.Session, upload.Room = session.id, session.room.id
+	upload.Received, upload.Generation = time.Now(), generation.Load()
+	line, err := json.Marshal(upload)
+	if err != nil {
+		return err
+	}
+
+	clientLogsMutex.Lock()
+	defer clientLogsMutex.Unlock()
+
+	path, size := clientLogPath(session.id), int64(0)
+	if info, err := os.Stat(path); err == nil {
+		size = info.Size()
+	}
+	if size+int64(len(line))+1 > config.ClientLogMaxBytes {
+		clientLogRefusals.Inc()
+		return errClientLogsFull
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600) //nolint:gosec
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(append(line, '\n')); err != nil {
+		f.Close() //nolint:errcheck
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+
+	clientLogUploads.Inc()
+	clientLogBytes.Add(uint64(len(data)))
+	recordHistory(session, historyControl, "client uploaded %d bytes of %s over %s", len(data), upload.Kind, upload.Via)
+	return nil
+}
+
+// removeClientLogs deletes the uploads of session id, along with its
+// history.
+func removeClientLogs(id string) {
+	if config.ClientLogDir == "" {
+		return
+	}
+
+	clientLogsMutex.Lock()
+	defer clientLogsMutex.Unlock()
+	if err := os.Remove(clientLogPath(id)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		logf("Failed to remove client logs of %s: %v\n", id, err)
+	}
+}
+
+// handleClientLogs serves POST /sessions/{id}/logs?kind=stats, whose body is
+// appended as is to the uploads of the session. Clients send the
+// generation they were last answered by as X-Restart-Generation.
+func handleClientLogs(w http.ResponseWriter, r *http.Request, session *session) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, config.ClientLogMaxBytes))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		clientLogRefusals.Inc()
+		http.Error(w, errClientLogsFull.Error(), http.StatusRequestEntityTooLarge)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if r.URL.Query().Get("kind") == "stats" {
+		checkDecodeStats(session, data)
+	}
+
+	clientGeneration, _ := strconv.ParseUint(r.Header.Get("X-Restart-Generation"), 10, 64)
+	err = appendClientLog(session, ClientLog{ClientGeneration: clientGeneration, Via: "http", Kind: r.URL.Query().Get("kind")}, data)
+	switch {
+	case errors.Is(err, errClientLogsDisabled):
+		http.NotFound(w, r)
+	case errors.Is(err, errClientLogsFull):
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// onClientLogChannel appends every message of a "logs" DataChannel to the
+// uploads of session.
+func onClientLogChannel(session *session, dataChannel *webrtc.DataChannel) {
+	dataChannel.OnMessage(func(msg webrtc.DataChannelMessage) {
+		if err := appendClientLog(session, ClientLog{Via: "datachannel", Kind: "log"}, msg.Data); err != nil {
+			logf("Failed to append client logs of %s: %v\n", session.id, err)
+		}
+	})
+}
+
+// handleAdminClientLogs returns the uploads of a session as JSON lines, also
+// after it is gone.
+func handleAdminClientLogs(w http.ResponseWriter, r *http.Request, id string) {
+	if config.ClientLogDir == "" {
+		http.Error(w, errClientLogsDisabled.Error(), http.StatusNotFound)
+		return
+	}
+
+	clientLogsMutex.Lock()
+	data, err := os.ReadFile(clientLogPath(id))
+	clientLogsMutex.Unlock()
+	if errors.Is(err, fs.ErrNotExist) {
+		http.Error(w, fmt.Sprintf("no logs uploaded for session %s", id), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Write(data) //nolint:errcheck
+}
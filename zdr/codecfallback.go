@@ -0,0 +1,230 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// decodeFailureMinFrames is how many frames a stats upload must have
+// received for its decoded share to tell anything.
+const decodeFailureMinFrames = 60
+
+var (
+	errNoFallbackCodec = errors.New("no codec to fall back to")
+
+	codecFallbacks = newCounter("codec_fallbacks_total", "Viewers moved to another video codec after failing to decode theirs.")
+)
+
+// CodecFallback records a viewer moved from the video codec it was served
+// to another one, because it kept failing to decode it. A viewer falls back
+// once, the record is saved with the session so a restart doesn't move it
+// back.
+type CodecFallback struct {
+	From, To string
+	Reason   string
+	Time     time.Time
+}
+
+// codecFallbackState follows the decode failures of a viewer.
+type codecFallbackState struct {
+	mu sync.Mutex
+
+	// keyframeRequests are when the viewer asked for a keyframe, within
+	// -codec-fallback-window.
+	keyframeRequests []time.Time
+
+	fallback  *CodecFallback
+	switching bool
+
+	// exhausted is set once the viewer was found to have no other codec.
+	exhausted bool
+}
+
+func (s *codecFallbackState) persisted() *CodecFallback {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.fallback
+}
+
+func (s *codecFallbackState) restore(fallback *CodecFallback) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fallback = fallback
+}
+
+// begin reports whether a fallback may start, and marks it started if so.
+func (s *codecFallbackState) begin() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fallback != nil || s.switching || s.exhausted {
+		return false
+	}
+	s.switching = true
+	return true
+}
+
+// end marks a fallback over, the viewer having moved to fallback if not nil,
+// exhausted if it has nothing to move to.
+func (s *codecFallbackState) end(fallback *CodecFallback, exhausted bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.switching = false
+	s.exhausted = exhausted
+	if fallback != nil {
+		s.fallback = fallback
+	}
+}
+
+// noteKeyframeRequest counts a keyframe a viewer asked for. A viewer that
+// can't decode its codec keeps asking, while those that can are satisfied
+// by the keyframe, so only the one failing falls back once it asked
+// -codec-fallback-keyframes times within -codec-fallback-window.
+func noteKeyframeRequest(session *session) {
+	if config.CodecFallbackKeyframes <= 0 || session.broadcaster {
+		return
+	}
+
+	now := time.Now()
+	state := &session.codecFallback
+	state.mu.Lock()
+	requests := append(state.keyframeRequests, now)
+	n := 0
+	for n < len(requests) && now.Sub(requests[n]) > config.CodecFallbackWindow {
+		n++
+	}
+	state.keyframeRequests = requests[n:]
+	count := len(state.keyframeRequests)
+	if count >= config.CodecFallbackKeyframes {
+		state.keyframeRequests = nil
+	}
+	state.mu.Unlock()
+
+	if count >= config.CodecFallbackKeyframes {
+		reason := fmt.Sprintf("%d keyframe requests within %s", count, config.CodecFallbackWindow)
+		go func() {
+			if err := fallBackCodec(session, reason); err != nil && !errors.Is(err, errNoFallbackCodec) {
+				logf("Failed to fall back the codec of %s: %v\n", session.id, err)
+			}
+		}()
+	}
+}
+
+// inboundVideoStats are the fields of an inbound-rtp entry of an uploaded
+// stats report that tell if its frames are decoded.
+type inboundVideoStats struct {
+	Type, Kind                    string
+	FramesReceived, FramesDecoded uint64
+}
+
+// checkDecodeStats falls a viewer back to another codec if a stats report it
+// uploaded, an array of stats or an object of them by ID like getStats
+// returns, shows it decoded less than half of the video frames it received.
+func checkDecodeStats(session *session, data []byte) {
+	if config.CodecFallbackKeyframes <= 0 || session.broadcaster {
+		return
+	}
+
+	var entries []inboundVideoStats
+	if err := json.Unmarshal(data, &entries); err != nil {
+		byID := map[string]inboundVideoStats{}
+		if json.Unmarshal(data, &byID) != nil {
+			return
+		}
+		for _, entry := range byID {
+			entries = append(entries, entry)
+		}
+	}
+
+	for _, entry := range entries {
+		if entry.Type != "inbound-rtp" || entry.Kind != "video" || entry.FramesReceived < decodeFailureMinFrames {
+			continue
+		}
+		if entry.FramesDecoded*2 < entry.FramesReceived {
+			reason := fmt.Sprintf("decoded %d of %d frames", entry.FramesDecoded, entry.FramesReceived)
+			if err := fallBackCodec(session, reason); err != nil && !errors.Is(err, errNoFallbackCodec) {
+				logf("Failed to fall back the codec of %s: %v\n", session.id, err)
+			}
+			return
+		}
+	}
+}
+
+// fallbackCodec returns the codec a viewer served from would fall back to:
+// another codec of its room it negotiated, one the broadcaster sends right
+// now first, in the viewer's order of preference.
+func fallbackCodec(session *session, from string) string {
+	description := session.peerConnection.RemoteDescription()
+	if description == nil || from == "" {
+		return ""
+	}
+
+	candidates := []string{}
+	for _, mimeType := range offeredVideoCodecs(*description) {
+		if track := session.room.videoTrack(mimeType); track != nil && !strings.EqualFold(mimeType, from) {
+			candidates = append(candidates, track.Codec().MimeType)
+		}
+	}
+	for _, mimeType := range candidates {
+		if session.room.hasSource(mimeType) {
+			return mimeType
+		}
+	}
+	if len(candidates) > 0 {
+		return candidates[0]
+	}
+	return ""
+}
+
+// fallBackCodec moves a viewer that can't decode its video codec to another
+// one, leaving the other viewers of its room alone. The new track is sent
+// right away and the client is asked to renegotiate, so its transceivers
+// catch up.
+func fallBackCodec(session *session, reason string) error {
+	if !session.codecFallback.begin() {
+		return nil
+	}
+
+	sessionsMutex.Lock()
+	from := session.videoCodec
+	to := fallbackCodec(session, from)
+	if to != "" {
+		session.videoCodec = to
+	}
+	sessionsMutex.Unlock()
+
+	if to == "" {
+		session.codecFallback.end(nil, true)
+		recordHistory(session, historyControl, "can't decode %s (%s) and has no other codec", from, reason)
+		return fmt.Errorf("%w: %s", errNoFallbackCodec, session.id)
+	}
+
+	if err := applySubscriptions(session); err != nil {
+		sessionsMutex.Lock()
+		session.videoCodec = from
+		sessionsMutex.Unlock()
+		session.codecFallback.end(nil, false)
+		return err
+	}
+
+	fallback := &CodecFallback{From: from, To: to, Reason: reason, Time: time.Now()}
+	session.codecFallback.end(fallback, false)
+	codecFallbacks.Inc()
+	recordHistory(session, historyControl, "fell back from %s to %s: %s", from, to, reason)
+	logf("Viewer %s falls back from %s to %s: %s\n", session.id, from, to, reason)
+
+	publishEvent(session.id, event{Name: "codecFallback", Data: to})
+	publishEvent(session.id, event{Name: "renegotiate", Data: subscribedKinds(session)})
+	session.room.requestKeyframe()
+
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	return serialize(context.Background())
+}
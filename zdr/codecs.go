@@ -0,0 +1,125 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"strings"
+
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+// videoCodecs are the video codecs a room relays, the first is used when
+// nothing else decides. A broadcaster may send several of them at once, for
+// example one transceiver per codec, and every viewer is served the one it
+// negotiated.
+var videoCodecs = []string{webrtc.MimeTypeVP8, webrtc.MimeTypeH264}
+
+// videoTrack returns the output track of room for mimeType, nil if the room
+// doesn't relay that codec.
+func (r *room) videoTrack(mimeType string) *webrtc.TrackLocalStaticRTP {
+	return r.videoTracks[strings.ToLower(mimeType)]
+}
+
+// layerTrack returns the output track of room for the simulcast layer rid of
+// mimeType, the track of the top layer is the one of videoTrack. It returns
+// nil if the room has no such layer.
+func (r *room) layerTrack(mimeType, rid string) *webrtc.TrackLocalStaticRTP {
+	if rid == "" || rid == r.policy.forwardedRID() {
+		return r.videoTrack(mimeType)
+	}
+	return r.layerTracks[strings.ToLower(mimeType)][rid]
+}
+
+// defaultVideoCodec returns the first of videoCodecs the policy of r allows,
+// "" for audio-only rooms.
+func (r *room) defaultVideoCodec() string {
+	for _, mimeType := range videoCodecs {
+		if r.videoTrack(mimeType) != nil {
+			return mimeType
+		}
+	}
+	return ""
+}
+
+// tracks returns every output track of r.
+func (r *room) tracks() []*webrtc.TrackLocalStaticRTP {
+	out := []*webrtc.TrackLocalStaticRTP{r.audioTrack}
+	for _, mimeType := range videoCodecs {
+		if track := r.videoTrack(mimeType); track != nil {
+			out = append(out, track)
+		}
+	}
+	return out
+}
+
+// addSource and removeSource count the broadcaster tracks sending each
+// video codec, so viewers can be steered to codecs that carry media.
+func (r *room) addSource(mimeType string) {
+	r.sourcesMutex.Lock()
+	defer r.sourcesMutex.Unlock()
+	r.sources[strings.ToLower(mimeType)]++
+}
+
+func (r *room) removeSource(mimeType string) {
+	r.sourcesMutex.Lock()
+	defer r.sourcesMutex.Unlock()
+	if r.sources[strings.ToLower(mimeType)]--; r.sources[strings.ToLower(mimeType)] <= 0 {
+		delete(r.sources, strings.ToLower(mimeType))
+	}
+}
+
+func (r *room) hasSource(mimeType string) bool {
+	r.sourcesMutex.Lock()
+	defer r.sourcesMutex.Unlock()
+	return r.sources[strings.ToLower(mimeType)] > 0
+}
+
+// chooseVideoCodec picks the video codec a viewer is served. The codecs of
+// offer are tried in the viewer's order of preference, first among those the
+// broadcaster is sending right now, then among all the room relays. It is ""
+// in audio-only rooms and for offers with none of the codecs of the room,
+// those viewers only receive audio.
+func chooseVideoCodec(room *room, offer webrtc.SessionDescription) string {
+	offered := offeredVideoCodecs(offer)
+	for _, mimeType := range offered {
+		if room.hasSource(mimeType) {
+			return room.videoTrack(mimeType).Codec().MimeType
+		}
+	}
+	for _, mimeType := range offered {
+		if track := room.videoTrack(mimeType); track != nil {
+			return track.Codec().MimeType
+		}
+	}
+	if len(offered) > 0 {
+		return ""
+	}
+	return room.defaultVideoCodec()
+}
+
+// offeredVideoCodecs returns the mime types of the video codecs in offer, in
+// the order they were listed.
+func offeredVideoCodecs(offer webrtc.SessionDescription) []string {
+	parsed := &sdp.SessionDescription{}
+	if err := parsed.Unmarshal([]byte(offer.SDP)); err != nil {
+		return nil
+	}
+
+	out := []string{}
+	for _, media := range parsed.MediaDescriptions {
+		if media.MediaName.Media != webrtc.RTPCodecTypeVideo.String() {
+			continue
+		}
+		for _, format := range media.MediaName.Formats {
+			for _, attribute := range media.Attributes {
+				name, _, ok := strings.Cut(strings.TrimPrefix(attribute.Value, format+" "), "/")
+				if attribute.Key == "rtpmap" && strings.HasPrefix(attribute.Value, format+" ") && ok {
+					out = append(out, "video/"+name)
+				}
+			}
+		}
+	}
+	return out
+}
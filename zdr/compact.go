@@ -0,0 +1,179 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	compactions       = newCounter("compactions_total", "Compactions run by the scheduler or the admin API.")
+	tombstonesPruned  = newCounter("tombstones_pruned_total", "Tombstones dropped for being older than their retention.")
+	historiesPruned   = newCounter("retired_histories_pruned_total", "Histories of ended sessions dropped for being older than their retention.")
+	journalCompaction = newCounter("journal_compactions_total", "Times the journal was rewritten with only the pending negotiations.")
+
+	_ = newGauge("tombstones", "Tombstones kept.", func() float64 {
+		tombstonesMutex.Lock()
+		defer tombstonesMutex.Unlock()
+		return float64(len(tombstones))
+	})
+	_ = newGauge("retired_histories", "Histories of ended sessions kept.", func() float64 {
+		retiredHistoriesMutex.Lock()
+		defer retiredHistoriesMutex.Unlock()
+		return float64(len(retiredHistories))
+	})
+	_ = newGauge("journal_records", "Records appended to the journal since it was last compacted.", func() float64 {
+		journalMutex.Lock()
+		defer journalMutex.Unlock()
+		return float64(journalAppended)
+	})
+
+	lastCompactionsMutex sync.Mutex
+	lastCompactions      = map[string]CompactionReport{}
+)
+
+// Retention is how long tombstones and histories of ended sessions are kept,
+// zero keeps them until they are pushed out by newer ones.
+type Retention struct {
+	Tombstones time.Duration
+	Histories  time.Duration
+}
+
+// CompactionReport describes what a compaction dropped. Room is empty for a
+// compaction of the whole server, which also compacts the journal.
+type CompactionReport struct {
+	Time             time.Time
+	Room             string `json:",omitempty"`
+	Retention        Retention
+	TombstonesPruned int
+	HistoriesPruned  int
+	JournalCompacted bool
+	JournalError     string `json:",omitempty"`
+}
+
+func configuredRetention() Retention {
+	return Retention{Tombstones: config.TombstoneRetention, Histories: config.HistoryRetention}
+}
+
+// compact drops the tombstones and histories of room, or of every room if
+// it is empty, that are older than retention, and then compacts the journal
+// if it is for every room. The result is saved right away.
+func compact(ctx context.Context, room string, retention Retention) CompactionReport {
+	now := time.Now()
+	report := CompactionReport{Time: now, Room: room, Retention: retention}
+	inRoom := func(id string) bool { return room == "" || id == room }
+
+	if retention.Tombstones > 0 {
+		tombstonesMutex.Lock()
+		kept := []Tombstone{}
+		for _, tombstone := range tombstones {
+			if inRoom(tombstone.Room) && now.Sub(tombstone.Time) > retention.Tombstones {
+				report.TombstonesPruned++
+				continue
+			}
+			kept = append(kept, tombstone)
+		}
+		tombstones = kept
+		tombstonesMutex.Unlock()
+	}
+
+	if retention.Histories > 0 {
+		retiredHistoriesMutex.Lock()
+		kept := []SessionHistory{}
+		for _, history := range retiredHistories {
+			if inRoom(history.Room) && now.Sub(history.retiredAt()) > retention.Histories {
+				report.HistoriesPruned++
+				removeClientLogs(history.ID)
+				continue
+			}
+			kept = append(kept, history)
+		}
+		retiredHistories = kept
+		retiredHistoriesMutex.Unlock()
+	}
+
+	if room == "" {
+		journalMutex.Lock()
+		if err := compactJournal(); err != nil {
+			report.JournalError = err.Error()
+		} else {
+			report.JournalCompacted = true
+			journalCompaction.Inc()
+		}
+		journalMutex.Unlock()
+	}
+
+	sessionsMutex.Lock()
+	if err := serialize(ctx); err != nil {
+		logf("Failed to serialize: %v\n", err)
+	}
+	sessionsMutex.Unlock()
+
+	compactions.Inc()
+	tombstonesPruned.Add(uint64(report.TombstonesPruned))
+	historiesPruned.Add(uint64(report.HistoriesPruned))
+	if report.TombstonesPruned != 0 || report.HistoriesPruned != 0 {
+		logf("Compacted %d tombstones and %d histories\n", report.TombstonesPruned, report.HistoriesPruned)
+	}
+
+	lastCompactionsMutex.Lock()
+	lastCompactions[room] = report
+	lastCompactionsMutex.Unlock()
+	return report
+}
+
+// retiredAt is when the session of h ended. Histories saved before that was
+// recorded fall back to their last entry.
+func (h SessionHistory) retiredAt() time.Time {
+	if !h.Retired.IsZero() || len(h.Entries) == 0 {
+		return h.Retired
+	}
+	return h.Entries[len(h.Entries)-1].Time
+}
+
+// handleAdminCompact serves /admin/compact, see handleCompact.
+func handleAdminCompact(w http.ResponseWriter, r *http.Request) {
+	handleCompact(w, r, "")
+}
+
+// handleCompact returns the last compaction of room on GET and compacts it
+// on POST. The retention of -tombstone-retention and -history-retention can
+// be overridden with ?tombstones=1h&histories=24h, 0 keeping them.
+func handleCompact(w http.ResponseWriter, r *http.Request, room string) {
+	switch r.Method {
+	case http.MethodGet:
+		lastCompactionsMutex.Lock()
+		report, ok := lastCompactions[room]
+		lastCompactionsMutex.Unlock()
+		if !ok {
+			http.Error(w, "not compacted yet", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&report)
+	case http.MethodPost:
+		retention := configuredRetention()
+		for name, value := range map[string]*time.Duration{"tombstones": &retention.Tombstones, "histories": &retention.Histories} {
+			if override := r.URL.Query().Get(name); override != "" {
+				d, err := time.ParseDuration(override)
+				if err != nil || d < 0 {
+					http.Error(w, "invalid retention of "+name, http.StatusBadRequest)
+					return
+				}
+				*value = d
+			}
+		}
+
+		report := compact(r.Context(), room, retention)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&report)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,173 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	mathrand "math/rand"
+
+	"github.com/pion/dtls/v2"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/srtp/v2"
+	"github.com/pion/webrtc/v3"
+
+	"webrtc-zero-downtime-reload/internal/pionadapter"
+)
+
+var (
+	errDryRunMismatch = errors.New("restored state doesn't match the live session")
+
+	dryRuns        = newCounter("dry_runs_total", "Sessions snapshotted and restored in isolation to check restores work.")
+	dryRunFailures = newCounter("dry_run_failures_total", "Dry runs where the restored session couldn't carry on the live one.")
+)
+
+// dryRun snapshots one random session and restores its crypto state on its
+// own, away from the live PeerConnection and its ports. A packet protected
+// with the live keys has to come out the same after the round trip,
+// otherwise a real restart would drop the session and we say so now.
+func dryRun() {
+	sessionsMutex.Lock()
+	if len(sessions) == 0 {
+		sessionsMutex.Unlock()
+		return
+	}
+	session := sessions[mathrand.Intn(len(sessions))] //nolint:gosec
+	sessionsMutex.Unlock()
+	if session.collecting.Load() {
+		return
+	}
+
+	dryRuns.Inc()
+	if err := dryRunSession(session); err != nil {
+		dryRunFailures.Inc()
+		logf("ALERT: dry run restore of PeerConnection %s failed: %v\n", session.id, err)
+		recordHistory(session, historyRestore, "dry run restore failed: %v", err)
+	}
+}
+
+func dryRunSession(session *session) error {
+	state, err := snapshotSession(session)
+	if err != nil {
+		return err
+	}
+
+	// Go through -snapshot-encoding like a real snapshot does.
+	buffer, err := encodeSnapshot(GlobalState{Version: snapshotVersion, PeerConnectionState: []PeerConnectionState{state}})
+	if err != nil {
+		return err
+	}
+	decoded, err := decodeSnapshot(buffer)
+	if err != nil {
+		return err
+	}
+	restored := decoded.PeerConnectionState[0]
+	if err = validatePeerConnectionState(restored); err != nil {
+		return err
+	}
+
+	live := pionadapter.Pion.DTLSConn(session.peerConnection).ConnectionState()
+
+	// The SRTCP indexes keep moving, take them from when the snapshot was.
+	liveContext, err := dryRunContext(&live, state.SRTPState)
+	if err != nil {
+		return fmt.Errorf("live state: %w", err)
+	}
+	restoredContext, err := dryRunContext(&restored.DTLSConnectionState, restored.SRTPState)
+	if err != nil {
+		return fmt.Errorf("restored state: %w", err)
+	}
+
+	ssrc := restored.SSRCVideo
+	if ssrc == 0 {
+		ssrc = restored.SSRCAudio
+	}
+	return dryRunPackets(liveContext, restoredContext, uint32(ssrc), restored.SRTPState)
+}
+
+// dryRunContext builds the context we protect outgoing packets with from a
+// DTLS state, with the SRTCP indexes of srtpState.
+func dryRunContext(state *dtls.State, srtpState map[uint32]uint32) (*srtp.Context, error) {
+	srtpConfig := &srtp.Config{}
+	switch pionadapter.Pion.SRTPProfile(state) {
+	case dtls.SRTP_AEAD_AES_128_GCM:
+		srtpConfig.Profile = srtp.ProtectionProfileAeadAes128Gcm
+	case dtls.SRTP_AES128_CM_HMAC_SHA1_80:
+		srtpConfig.Profile = srtp.ProtectionProfileAes128CmHmacSha1_80
+	default:
+		return nil, webrtc.ErrNoSRTPProtectionProfile
+	}
+
+	if err := srtpConfig.ExtractSessionKeysFromDTLS(state, pionadapter.Pion.DTLSIsClient(state)); err != nil {
+		return nil, err
+	}
+
+	srtpContext, err := srtp.CreateContext(srtpConfig.Keys.LocalMasterKey, srtpConfig.Keys.LocalMasterSalt, srtpConfig.Profile)
+	if err != nil {
+		return nil, err
+	}
+	for ssrc, index := range srtpState {
+		srtpContext.SetIndex(ssrc, index)
+	}
+	return srtpContext, nil
+}
+
+// dryRunPackets protects the same RTP and RTCP packet with both contexts.
+// The RTP packet has to decrypt with the restored context, and the RTCP
+// packets have to come out identical, which only happens if the SRTCP index
+// survived as well. The RTCP packet is sent from an SSRC in srtpState so
+// there is an index to compare.
+func dryRunPackets(live, restored *srtp.Context, ssrc uint32, srtpState map[uint32]uint32) error {
+	if ssrc == 0 {
+		ssrc = mathrand.Uint32() //nolint:gosec
+	}
+
+	payload := make([]byte, 100)
+	if _, err := rand.Read(payload); err != nil {
+		return err
+	}
+	packet := &rtp.Packet{
+		Header:  rtp.Header{Version: 2, SSRC: ssrc, SequenceNumber: uint16(mathrand.Uint32())}, //nolint:gosec
+		Payload: payload,
+	}
+	plaintext, err := packet.Marshal()
+	if err != nil {
+		return err
+	}
+
+	encrypted, err := live.EncryptRTP(nil, plaintext, nil)
+	if err != nil {
+		return err
+	}
+	decrypted, err := restored.DecryptRTP(nil, encrypted, nil)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errDryRunMismatch, err)
+	} else if !bytes.Equal(decrypted, plaintext) {
+		return fmt.Errorf("%w: RTP payload differs", errDryRunMismatch)
+	}
+
+	senderSSRC := ssrc
+	for s := range srtpState {
+		senderSSRC = s
+		break
+	}
+	report, err := (&rtcp.PictureLossIndication{SenderSSRC: senderSSRC, MediaSSRC: ssrc}).Marshal()
+	if err != nil {
+		return err
+	}
+	liveReport, err := live.EncryptRTCP(nil, report, nil)
+	if err != nil {
+		return err
+	}
+	restoredReport, err := restored.EncryptRTCP(nil, report, nil)
+	if err != nil {
+		return err
+	} else if !bytes.Equal(liveReport, restoredReport) {
+		return fmt.Errorf("%w: SRTCP index differs", errDryRunMismatch)
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/transport/v2"
+)
+
+// Traffic classes packets are marked by.
+const (
+	dscpAudio   = "audio"
+	dscpVideo   = "video"
+	dscpControl = "control"
+)
+
+var (
+	errInvalidDSCP = errors.New("invalid DSCP marking")
+
+	// dscpNames are the per-hop behaviors -dscp takes by name, besides
+	// plain code points.
+	dscpNames = map[string]int{
+		"be": 0, "cs0": 0, "cs1": 8, "cs2": 16, "cs3": 24, "cs4": 32, "cs5": 40, "cs6": 48, "cs7": 56,
+		"af11": 10, "af12": 12, "af13": 14, "af21": 18, "af22": 20, "af23": 22,
+		"af31": 26, "af32": 28, "af33": 30, "af41": 34, "af42": 36, "af43": 38,
+		"ef": 46,
+	}
+
+	// dscpMarks are the code points of -dscp, by traffic class.
+	dscpMarks = map[string]int{}
+
+	dscpErrors = newCounter("dscp_mark_errors_total", "Sockets whose packets couldn't be marked with DSCP.")
+)
+
+// parseDSCP parses the comma separated class=mark list of -dscp, like
+// audio=EF,video=AF41. Marks are per-hop behavior names or code points from
+// 0 to 63.
+func parseDSCP(list string) (map[string]int, error) {
+	out := map[string]int{}
+	for _, entry := range strings.Split(list, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+
+		class, mark, _ := strings.Cut(entry, "=")
+		switch class {
+		case dscpAudio, dscpVideo, dscpControl:
+		default:
+			return nil, fmt.Errorf("%w: %q has unknown class %q", errInvalidDSCP, entry, class)
+		}
+
+		dscp, ok := dscpNames[strings.ToLower(mark)]
+		if !ok {
+			n, err := strconv.Atoi(mark)
+			if err != nil || n < 0 || n > 63 {
+				return nil, fmt.Errorf("%w: %q", errInvalidDSCP, entry)
+			}
+			dscp = n
+		}
+		out[class] = dscp
+	}
+	return out, nil
+}
+
+// useDSCP makes the sockets of the PeerConnection created on n mark what
+// they send with -dscp, wrapping n. Every socket of a session is created
+// through it, the ones a restore binds again included, so they are all
+// marked the same.
+func useDSCP(n *transport.Net, i *interceptor.Registry) {
+	if len(dscpMarks) == 0 {
+		return
+	}
+
+	kinds := &ssrcKinds{kinds: map[uint32]string{}}
+	*n = &dscpNet{Net: *n, kinds: kinds}
+	i.Add(&dscpInterceptorFactory{kinds: kinds})
+}
+
+// ssrcKinds are the classes of the streams a PeerConnection sends, by SSRC.
+type ssrcKinds struct {
+	mu    sync.RWMutex
+	kinds map[uint32]string
+}
+
+// classify returns the traffic class of a packet about to be sent. Packets
+// are told apart as in RFC 7983, RTP by the SSRC in its header, which SRTP
+// leaves in the clear. RTP of streams that weren't bound, like
+// retransmissions, is taken for video.
+func (k *ssrcKinds) classify(packet []byte) string {
+	if len(packet) < 12 || packet[0] < 128 || packet[0] > 191 || (packet[1] >= 192 && packet[1] <= 223) {
+		return dscpControl
+	}
+
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	if kind, ok := k.kinds[binary.BigEndian.Uint32(packet[8:12])]; ok {
+		return kind
+	}
+	return dscpVideo
+}
+
+type dscpInterceptorFactory struct {
+	kinds *ssrcKinds
+}
+
+func (f *dscpInterceptorFactory) NewInterceptor(string) (interceptor.Interceptor, error) {
+	return &dscpInterceptor{kinds: f.kinds}, nil
+}
+
+// dscpInterceptor learns the class of every stream the PeerConnection sends.
+type dscpInterceptor struct {
+	interceptor.NoOp
+	kinds *ssrcKinds
+}
+
+func (i *dscpInterceptor) BindLocalStream(info *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	kind := dscpVideo
+	if strings.HasPrefix(strings.ToLower(info.MimeType), "audio/") {
+		kind = dscpAudio
+	}
+
+	i.kinds.mu.Lock()
+	i.kinds.kinds[info.SSRC] = kind
+	i.kinds.mu.Unlock()
+	return writer
+}
+
+func (i *dscpInterceptor) UnbindLocalStream(info *interceptor.StreamInfo) {
+	i.kinds.mu.Lock()
+	delete(i.kinds.kinds, info.SSRC)
+	i.kinds.mu.Unlock()
+}
+
+// dscpNet hands pion/ice sockets that mark what they send.
+type dscpNet struct {
+	transport.Net
+	kinds *ssrcKinds
+}
+
+func (n *dscpNet) ListenUDP(network string, addr *net.UDPAddr) (transport.UDPConn, error) {
+	conn, err := n.Net.ListenUDP(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if udp, ok := conn.(*net.UDPConn); ok {
+		return &dscpConn{UDPConn: udp, kinds: n.kinds, mark: -1}, nil
+	}
+	return conn, nil
+}
+
+func (n *dscpNet) ListenPacket(network, address string) (net.PacketConn, error) {
+	conn, err := n.Net.ListenPacket(network, address)
+	if err != nil {
+		return nil, err
+	}
+	if udp, ok := conn.(*net.UDPConn); ok {
+		return &dscpConn{UDPConn: udp, kinds: n.kinds, mark: -1}, nil
+	}
+	return conn, nil
+}
+
+// dscpConn marks every packet with the code point of its class. A socket has
+// a single mark at a time, so it is changed whenever the class does, and
+// writes are serialized for it to stick to the packet.
+type dscpConn struct {
+	*net.UDPConn
+	kinds *ssrcKinds
+
+	mu     sync.Mutex
+	mark   int
+	failed bool
+}
+
+func (c *dscpConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.setMark(p)
+	return c.UDPConn.WriteTo(p, addr)
+}
+
+func (c *dscpConn) WriteToUDP(p []byte, addr *net.UDPAddr) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.setMark(p)
+	return c.UDPConn.WriteToUDP(p, addr)
+}
+
+func (c *dscpConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.setMark(p)
+	return c.UDPConn.Write(p)
+}
+
+// setMark marks the socket for packet p. A socket that can't be marked
+// sends unmarked from then on. c.mu must be held.
+func (c *dscpConn) setMark(p []byte) {
+	mark := dscpMarks[c.kinds.classify(p)]
+	if c.failed || mark == c.mark {
+		return
+	}
+
+	if err := setDSCP(c.UDPConn, mark); err != nil {
+		logf("Failed to mark packets from %s with DSCP %d, sending them unmarked: %v\n", c.LocalAddr(), mark, err)
+		dscpErrors.Inc()
+		c.failed = true
+		return
+	}
+	c.mark = mark
+}
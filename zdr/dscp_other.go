@@ -0,0 +1,13 @@
+//go:build !js && windows
+// +build !js,windows
+
+package zdr
+
+import (
+	"errors"
+	"net"
+)
+
+func setDSCP(*net.UDPConn, int) error {
+	return errors.New("zdr: DSCP marking isn't supported on this platform, use a QoS policy instead")
+}
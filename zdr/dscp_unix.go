@@ -0,0 +1,33 @@
+//go:build !js && !windows
+// +build !js,!windows
+
+package zdr
+
+import (
+	"net"
+	"syscall"
+)
+
+// setDSCP sets the code point of what conn sends from then on.
+func setDSCP(conn *net.UDPConn, dscp int) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	ipv6 := false
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok {
+		ipv6 = addr.IP.To4() == nil
+	}
+	var setErr error
+	if err = raw.Control(func(fd uintptr) {
+		if ipv6 {
+			setErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, dscp<<2)
+		} else {
+			setErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, dscp<<2)
+		}
+	}); err != nil {
+		return err
+	}
+	return setErr
+}
@@ -0,0 +1,103 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"strings"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// Frames encrypted end-to-end with insertable streams are relayed untouched,
+// nothing here looks into a payload. Only the header extension carrying the
+// key ID or counter needs care: the broadcaster and each viewer may have
+// negotiated a different ID for it.
+
+// registerE2EEHeaderExtension offers the configured extension to every
+// PeerConnection. Restored ones negotiate it again from the saved offer.
+func registerE2EEHeaderExtension(m *webrtc.MediaEngine) error {
+	if config.E2EEHeaderExtension == "" {
+		return nil
+	}
+
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeAudio, webrtc.RTPCodecTypeVideo} {
+		if err := m.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: config.E2EEHeaderExtension}, kind); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordIngestE2EEExtension remembers the extension ID the broadcaster uses
+// for track in room.
+func recordIngestE2EEExtension(room *room, track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+	if config.E2EEHeaderExtension == "" {
+		return
+	}
+
+	id := uint32(0)
+	for _, extension := range receiver.GetParameters().HeaderExtensions {
+		if extension.URI == config.E2EEHeaderExtension {
+			id = uint32(extension.ID)
+		}
+	}
+
+	if track.Kind() == webrtc.RTPCodecTypeAudio {
+		room.ingestE2EEAudio.Store(id)
+	} else {
+		room.ingestE2EEVideo.Store(id)
+	}
+}
+
+type e2eeInterceptorFactory struct {
+	room *room
+}
+
+func (f *e2eeInterceptorFactory) NewInterceptor(string) (interceptor.Interceptor, error) {
+	return &e2eeInterceptor{room: f.room}, nil
+}
+
+// e2eeInterceptor moves the extension from the ID of the broadcaster to the
+// ID negotiated with the viewer.
+type e2eeInterceptor struct {
+	interceptor.NoOp
+	room *room
+}
+
+func (i *e2eeInterceptor) BindLocalStream(info *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	local := uint8(0)
+	for _, extension := range info.RTPHeaderExtensions {
+		if extension.URI == config.E2EEHeaderExtension {
+			local = uint8(extension.ID)
+		}
+	}
+	if local == 0 {
+		return writer
+	}
+
+	ingest := &i.room.ingestE2EEVideo
+	if strings.HasPrefix(strings.ToLower(info.MimeType), "audio/") {
+		ingest = &i.room.ingestE2EEAudio
+	}
+
+	return interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, attributes interceptor.Attributes) (int, error) {
+		id := uint8(ingest.Load())
+		value := header.GetExtension(id)
+		if id == 0 || id == local || value == nil {
+			return writer.Write(header, payload, attributes)
+		}
+
+		// The header and its extensions are shared with every other viewer.
+		moved := *header
+		moved.Extensions = append([]rtp.Extension(nil), header.Extensions...)
+		if err := moved.DelExtension(id); err != nil {
+			return 0, err
+		} else if err = moved.SetExtension(local, value); err != nil {
+			return 0, err
+		}
+		return writer.Write(&moved, payload, attributes)
+	})
+}
@@ -0,0 +1,313 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// snapshotSealedMagic starts every encrypted snapshot, telling it from a
+// plain one.
+const snapshotSealedMagic = "ZDRE"
+
+const (
+	// sealedWithKey is a snapshot encrypted with the key of -snapshot-key,
+	// identified by the first bytes of its SHA-256.
+	sealedWithKey = 1
+
+	// sealedWithKMS is a snapshot encrypted with a data key of KMS, saved
+	// with it as encrypted by KMS.
+	sealedWithKMS = 2
+
+	// snapshotKeyIDLength is how many bytes of the SHA-256 of a key identify
+	// it.
+	snapshotKeyIDLength = 8
+
+	// kmsTimeout bounds a call to KMS.
+	kmsTimeout = 10 * time.Second
+)
+
+var (
+	errSnapshotKey       = errors.New("invalid snapshot key")
+	errSnapshotEncrypted = errors.New("snapshot is encrypted")
+	errKMS               = errors.New("kms")
+
+	// snapshotCipher encrypts snapshots, nil without -snapshot-key.
+	snapshotCipher *sealer
+)
+
+// sealer encrypts snapshots with AES-256-GCM, and decrypts them.
+type sealer struct {
+	aead cipher.AEAD
+
+	// header starts every snapshot it encrypts, and is authenticated along
+	// with it: the kind, then the key ID or the data key encrypted by KMS.
+	header []byte
+
+	// kms decrypts the data keys of snapshots sealed with KMS, nil for a key
+	// of -snapshot-key.
+	kms *kmsClient
+
+	// dataKeys caches the data keys kms decrypted, by their encrypted form.
+	dataKeys sync.Map
+}
+
+// newSealer returns the sealer of -snapshot-key: env:NAME for a base64 key of
+// 32 bytes in the variable NAME, file:path for one in a file, or
+// aws-kms:key-id to encrypt with a data key generated by KMS for the key.
+func newSealer(ctx context.Context, spec string) (*sealer, error) {
+	kind, target, ok := strings.Cut(spec, ":")
+	if !ok || target == "" {
+		return nil, fmt.Errorf("%w: %q", errSnapshotKey, spec)
+	}
+
+	switch kind {
+	case "env", "file":
+		encoded := os.Getenv(target)
+		if kind == "file" {
+			data, err := os.ReadFile(target)
+			if err != nil {
+				return nil, err
+			}
+			encoded = string(data)
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("%w: %s must hold 32 bytes in base64", errSnapshotKey, spec)
+		}
+		id := sha256.Sum256(key)
+		return newSealerWithKey(key, append([]byte{sealedWithKey}, id[:snapshotKeyIDLength]...), nil)
+	case "aws-kms":
+		kms, err := newKMSClient(target)
+		if err != nil {
+			return nil, err
+		}
+		ctx, cancel := context.WithTimeout(ctx, kmsTimeout)
+		defer cancel()
+		key, wrapped, err := kms.generateDataKey(ctx)
+		if err != nil {
+			return nil, err
+		}
+		header := binary.AppendUvarint([]byte{sealedWithKMS}, uint64(len(wrapped)))
+		s, err := newSealerWithKey(key, append(header, wrapped...), kms)
+		if err != nil {
+			return nil, err
+		}
+		s.dataKeys.Store(string(wrapped), s.aead)
+		return s, nil
+	}
+	return nil, fmt.Errorf("%w: %q", errSnapshotKey, spec)
+}
+
+func newSealerWithKey(key, header []byte, kms *kmsClient) (*sealer, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return &sealer{aead: aead, header: header, kms: kms}, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts a snapshot: the magic and header, a random nonce, then the
+// ciphertext, authenticating the magic and header as well.
+func (s *sealer) seal(data []byte) ([]byte, error) {
+	aad := append([]byte(snapshotSealedMagic), s.header...)
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	out := append(append([]byte{}, aad...), nonce...)
+	return append(out, s.aead.Seal(nil, nonce, data, aad)...), nil
+}
+
+// open decrypts a snapshot sealed by this process or another one with the
+// same -snapshot-key. Anything that was altered fails to decrypt.
+func (s *sealer) open(sealed []byte) ([]byte, error) {
+	rest := sealed[len(snapshotSealedMagic):]
+	if len(rest) == 0 {
+		return nil, fmt.Errorf("%w: truncated", errSnapshotEncrypted)
+	}
+
+	aead := s.aead
+	switch rest[0] {
+	case sealedWithKey:
+		if len(rest) < 1+snapshotKeyIDLength {
+			return nil, fmt.Errorf("%w: truncated", errSnapshotEncrypted)
+		} else if s.header[0] != sealedWithKey || !bytes.Equal(rest[1:1+snapshotKeyIDLength], s.header[1:]) {
+			return nil, fmt.Errorf("%w with another key than -snapshot-key", errSnapshotEncrypted)
+		}
+		rest = rest[1+snapshotKeyIDLength:]
+	case sealedWithKMS:
+		length, n := binary.Uvarint(rest[1:])
+		if n <= 0 || uint64(len(rest)-1-n) < length {
+			return nil, fmt.Errorf("%w: truncated", errSnapshotEncrypted)
+		}
+		wrapped := rest[1+n : 1+n+int(length)]
+		rest = rest[1+n+int(length):]
+
+		var err error
+		if aead, err = s.kmsAEAD(wrapped); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("%w: unknown kind %d", errSnapshotEncrypted, rest[0])
+	}
+
+	if len(rest) < aead.NonceSize() {
+		return nil, fmt.Errorf("%w: truncated", errSnapshotEncrypted)
+	}
+	aad := len(sealed) - len(rest)
+	return aead.Open(nil, rest[:aead.NonceSize()], rest[aead.NonceSize():], sealed[:aad])
+}
+
+// kmsAEAD returns the cipher of a data key encrypted by KMS, asking KMS to
+// decrypt it the first time. Each process generates its own, so a new one
+// decrypts that of the previous one once.
+func (s *sealer) kmsAEAD(wrapped []byte) (cipher.AEAD, error) {
+	if s.kms == nil {
+		return nil, fmt.Errorf("%w with KMS, -snapshot-key must be aws-kms", errSnapshotEncrypted)
+	} else if aead, ok := s.dataKeys.Load(string(wrapped)); ok {
+		return aead.(cipher.AEAD), nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), kmsTimeout)
+	defer cancel()
+	key, err := s.kms.decrypt(ctx, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	s.dataKeys.Store(string(wrapped), aead)
+	return aead, nil
+}
+
+// sealSnapshot encrypts an encoded snapshot if -snapshot-key is set.
+func sealSnapshot(data []byte) ([]byte, error) {
+	if snapshotCipher == nil {
+		return data, nil
+	}
+	return snapshotCipher.seal(data)
+}
+
+// openSnapshot decrypts an encoded snapshot if it is encrypted, and returns
+// it as is otherwise.
+func openSnapshot(buffer []byte) ([]byte, error) {
+	if !bytes.HasPrefix(buffer, []byte(snapshotSealedMagic)) {
+		return buffer, nil
+	} else if snapshotCipher == nil {
+		return nil, fmt.Errorf("%w, set -snapshot-key", errSnapshotEncrypted)
+	}
+	return snapshotCipher.open(buffer)
+}
+
+// kmsClient calls the AWS KMS API for a key, with the credentials of
+// awsCredentialsFromEnv.
+type kmsClient struct {
+	keyID       string
+	region      string
+	endpoint    string
+	credentials awsCredentials
+	client      *http.Client
+}
+
+// newKMSClient returns the client of keyID, an ARN or an ID or alias in the
+// region of AWS_REGION.
+func newKMSClient(keyID string) (*kmsClient, error) {
+	region := os.Getenv("AWS_REGION")
+	if strings.HasPrefix(keyID, "arn:") {
+		if parts := strings.Split(keyID, ":"); len(parts) > 3 {
+			region = parts[3]
+		}
+	}
+	credentials := awsCredentialsFromEnv()
+	if region == "" {
+		return nil, fmt.Errorf("%w: no region for %s, use an ARN or set AWS_REGION", errSnapshotKey, keyID)
+	} else if credentials.accessKey == "" || credentials.secretKey == "" {
+		return nil, fmt.Errorf("%w: no AWS credentials for KMS", errSnapshotKey)
+	}
+	return &kmsClient{
+		keyID:       keyID,
+		region:      region,
+		endpoint:    fmt.Sprintf("https://kms.%s.amazonaws.com/", region),
+		credentials: credentials,
+		client:      &http.Client{},
+	}, nil
+}
+
+// generateDataKey returns a new AES-256 key and the same key encrypted by
+// KMS.
+func (k *kmsClient) generateDataKey(ctx context.Context) (key, wrapped []byte, err error) {
+	var out struct {
+		Plaintext      []byte
+		CiphertextBlob []byte
+	}
+	if err = k.call(ctx, "GenerateDataKey", map[string]string{"KeyId": k.keyID, "KeySpec": "AES_256"}, &out); err != nil {
+		return nil, nil, err
+	}
+	return out.Plaintext, out.CiphertextBlob, nil
+}
+
+// decrypt returns a data key generateDataKey returned encrypted.
+func (k *kmsClient) decrypt(ctx context.Context, wrapped []byte) ([]byte, error) {
+	var out struct {
+		Plaintext []byte
+	}
+	if err := k.call(ctx, "Decrypt", map[string]any{"KeyId": k.keyID, "CiphertextBlob": wrapped}, &out); err != nil {
+		return nil, err
+	}
+	return out.Plaintext, nil
+}
+
+// call runs action with in as its JSON request and decodes the response
+// into out. Binary fields are base64 both ways, as encoding/json does.
+func (k *kmsClient) call(ctx context.Context, action string, in, out any) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, k.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	request.Header.Set("X-Amz-Target", "TrentService."+action)
+	signAWS(request, body, "kms", k.region, k.credentials, time.Now())
+
+	response, err := k.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		return fmt.Errorf("%w: %s: %s: %s", errKMS, action, response.Status, bytes.TrimSpace(message))
+	}
+	return json.NewDecoder(response.Body).Decode(out)
+}
@@ -0,0 +1,153 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+// testSealer returns the sealer of -snapshot-key env: with a random key.
+func testSealer(t *testing.T) *sealer {
+	t.Helper()
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("ZDR_TEST_SNAPSHOT_KEY", base64.StdEncoding.EncodeToString(key))
+	s, err := newSealer(context.Background(), "env:ZDR_TEST_SNAPSHOT_KEY")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// testKMSSealer returns a sealer like that of aws-kms:, whose data key is
+// already known so KMS is never called.
+func testKMSSealer(t *testing.T) *sealer {
+	t.Helper()
+
+	key, wrapped := make([]byte, 32), []byte("data key encrypted by KMS")
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	header := binary.AppendUvarint([]byte{sealedWithKMS}, uint64(len(wrapped)))
+	s, err := newSealerWithKey(key, append(header, wrapped...), &kmsClient{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.dataKeys.Store(string(wrapped), s.aead)
+	return s
+}
+
+func TestSealerRoundTrip(t *testing.T) {
+	data := appendChecksum([]byte("snapshot"))
+	for _, tc := range []struct {
+		name   string
+		sealer *sealer
+	}{
+		{"key", testSealer(t)},
+		{"kms", testKMSSealer(t)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sealed, err := tc.sealer.seal(data)
+			if err != nil {
+				t.Fatal(err)
+			} else if !bytes.HasPrefix(sealed, []byte(snapshotSealedMagic)) {
+				t.Fatal("sealed snapshot doesn't start with the magic")
+			} else if bytes.Contains(sealed, []byte("snapshot")) {
+				t.Fatal("sealed snapshot holds the plaintext")
+			}
+			again, err := tc.sealer.seal(data)
+			if err != nil {
+				t.Fatal(err)
+			} else if bytes.Equal(sealed, again) {
+				t.Fatal("sealing twice gave the same ciphertext")
+			}
+
+			opened, err := tc.sealer.open(sealed)
+			if err != nil {
+				t.Fatal(err)
+			} else if !bytes.Equal(opened, data) {
+				t.Fatalf("got %q, want %q", opened, data)
+			}
+		})
+	}
+}
+
+// TestSealerTamper checks a sealed snapshot altered anywhere, cut short or
+// sealed with another key fails to open.
+func TestSealerTamper(t *testing.T) {
+	s, other, kms := testSealer(t), testSealer(t), testKMSSealer(t)
+	sealed, err := s.seal([]byte("snapshot"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := len(snapshotSealedMagic) + len(s.header)
+
+	for _, tc := range []struct {
+		name   string
+		sealer *sealer
+		sealed []byte
+		err    error
+	}{
+		{"magic", s, flipByte(sealed, 0), nil},
+		{"kind", s, flipByte(sealed, len(snapshotSealedMagic)), errSnapshotEncrypted},
+		{"key ID", s, flipByte(sealed, len(snapshotSealedMagic)+1), errSnapshotEncrypted},
+		{"nonce", s, flipByte(sealed, nonce), nil},
+		{"ciphertext", s, flipByte(sealed, nonce+s.aead.NonceSize()), nil},
+		{"tag", s, flipByte(sealed, len(sealed)-1), nil},
+		{"truncated", s, sealed[:len(sealed)-1], nil},
+		{"truncated header", s, sealed[:len(snapshotSealedMagic)+3], errSnapshotEncrypted},
+		{"truncated nonce", s, sealed[:nonce+1], errSnapshotEncrypted},
+		{"magic only", s, sealed[:len(snapshotSealedMagic)], errSnapshotEncrypted},
+		{"another key", other, sealed, errSnapshotEncrypted},
+		{"KMS sealer", kms, sealed, errSnapshotEncrypted},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			opened, err := tc.sealer.open(tc.sealed)
+			if err == nil {
+				t.Fatalf("opened %q", opened)
+			} else if tc.err != nil && !errors.Is(err, tc.err) {
+				t.Fatalf("got %v, want %v", err, tc.err)
+			}
+		})
+	}
+
+	sealedWithKMS, err := kms.seal([]byte("snapshot"))
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err = s.open(sealedWithKMS); !errors.Is(err, errSnapshotEncrypted) {
+		t.Fatalf("opened a KMS snapshot without KMS: %v", err)
+	}
+}
+
+// TestOpenSnapshot checks plain snapshots are read as they are and encrypted
+// ones need -snapshot-key.
+func TestOpenSnapshot(t *testing.T) {
+	cipher := snapshotCipher
+	t.Cleanup(func() { snapshotCipher = cipher })
+	snapshotCipher = testSealer(t)
+	data := appendChecksum([]byte("snapshot"))
+
+	sealed, err := sealSnapshot(data)
+	if err != nil {
+		t.Fatal(err)
+	} else if opened, err := openSnapshot(sealed); err != nil || !bytes.Equal(opened, data) {
+		t.Fatalf("got %q, %v", opened, err)
+	} else if opened, err = openSnapshot(data); err != nil || !bytes.Equal(opened, data) {
+		t.Fatalf("plain snapshot: got %q, %v", opened, err)
+	}
+
+	snapshotCipher = nil
+	if _, err = openSnapshot(sealed); !errors.Is(err, errSnapshotEncrypted) {
+		t.Fatalf("opened without -snapshot-key: %v", err)
+	}
+}
@@ -0,0 +1,56 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"errors"
+	"fmt"
+
+	"webrtc-zero-downtime-reload/pcmigrate"
+)
+
+// Errors returned when taking or resuming from a snapshot. They are wrapped
+// with details, so compare them with errors.Is. Those pcmigrate returns too
+// are its own, so an error from either package matches.
+var (
+	// ErrSnapshotVersion is returned for a snapshot written by a newer binary
+	// than this one.
+	ErrSnapshotVersion = pcmigrate.ErrSnapshotVersion
+
+	// ErrSnapshotChecksum is returned for a snapshot that doesn't match the
+	// checksum it was written with, because it was corrupted or cut short.
+	ErrSnapshotChecksum = errors.New("snapshot checksum mismatch")
+
+	// ErrPortUnavailable is returned when a session's ICE port is still in
+	// use by another process.
+	ErrPortUnavailable = pcmigrate.ErrPortUnavailable
+
+	// ErrDTLSStateMismatch is returned when the saved DTLS state doesn't
+	// belong to the remote description it was saved with.
+	ErrDTLSStateMismatch = pcmigrate.ErrDTLSStateMismatch
+
+	// ErrRestoreValidation is returned when a PeerConnectionState is
+	// missing something it needs to be resumed.
+	ErrRestoreValidation = pcmigrate.ErrRestoreValidation
+)
+
+var (
+	errInvalidOffer      = errors.New("invalid offer")
+	errNoEncodings       = errors.New("sender has no encodings")
+	errNoLocalCandidates = errors.New("no local candidates")
+)
+
+// validatePeerConnectionState checks state before any resources are spent
+// on resuming it.
+func validatePeerConnectionState(state PeerConnectionState) error {
+	if state.ICEPort == 0 {
+		return fmt.Errorf("%w: no ICE port", ErrRestoreValidation)
+	}
+	return pcmigrate.Validate(pcmigrate.State{
+		RemoteDescription:   state.RemoteDescription,
+		ICEUsernameFragment: state.ICEUsernameFragment,
+		ICEPassword:         state.ICEPassword,
+		DTLSConnectionState: state.DTLSConnectionState,
+	})
+}
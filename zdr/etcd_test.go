@@ -0,0 +1,109 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeEtcd answers the requests of etcdStore.Save, the transaction going
+// through on attempt succeed, never if 0. It counts the requests to every
+// path and records the leases revoked.
+type fakeEtcd struct {
+	mu      sync.Mutex
+	succeed int
+	calls   map[string]int
+	revoked []string
+}
+
+func (f *fakeEtcd) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls[r.URL.Path]++
+
+	switch r.URL.Path {
+	case "/v3/lease/grant":
+		w.Write([]byte(`{"ID":"42"}`))
+	case "/v3/lease/revoke":
+		var in struct {
+			ID json.Number
+		}
+		json.NewDecoder(r.Body).Decode(&in)
+		f.revoked = append(f.revoked, in.ID.String())
+		w.Write([]byte(`{}`))
+	case "/v3/kv/range":
+		w.Write([]byte(`{}`))
+	case "/v3/kv/txn":
+		json.NewEncoder(w).Encode(map[string]bool{"succeeded": f.calls[r.URL.Path] == f.succeed})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// TestEtcdStoreSaveLease checks a save grants one lease whatever the number
+// of attempts, and revokes it unless it was put.
+func TestEtcdStoreSaveLease(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		succeed int
+		cancel  bool
+		want    error
+		revoked []string
+	}{
+		{name: "first attempt", succeed: 1},
+		{name: "last attempt", succeed: etcdSaveAttempts},
+		{name: "conflict", want: errEtcdConflict, revoked: []string{"42"}},
+		{name: "cancelled", succeed: 1, cancel: true, want: context.Canceled, revoked: []string{"42"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fake := &fakeEtcd{succeed: tc.succeed, calls: map[string]int{}}
+			server := httptest.NewServer(fake)
+			defer server.Close()
+
+			store := &etcdStore{endpoint: server.URL, prefix: "zdr", ttl: time.Hour, client: server.Client()}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tc.cancel {
+				// The lease is granted before the context is seen to be
+				// cancelled by the first range.
+				store.client = &http.Client{Transport: cancelAfter{server.Client().Transport, "/v3/lease/grant", cancel}}
+			}
+
+			if err := store.Save(ctx, "", []byte("snapshot")); !errors.Is(err, tc.want) {
+				t.Fatalf("got %v, want %v", err, tc.want)
+			}
+			fake.mu.Lock()
+			defer fake.mu.Unlock()
+			if grants := fake.calls["/v3/lease/grant"]; grants != 1 {
+				t.Errorf("granted %d leases, want 1", grants)
+			}
+			if len(fake.revoked) != len(tc.revoked) || len(tc.revoked) > 0 && fake.revoked[0] != tc.revoked[0] {
+				t.Errorf("revoked %v, want %v", fake.revoked, tc.revoked)
+			}
+		})
+	}
+}
+
+// cancelAfter is a transport calling cancel once a request to path got its
+// response.
+type cancelAfter struct {
+	http.RoundTripper
+	path   string
+	cancel context.CancelFunc
+}
+
+func (c cancelAfter) RoundTrip(request *http.Request) (*http.Response, error) {
+	response, err := c.RoundTripper.RoundTrip(request)
+	if request.URL.Path == c.path {
+		c.cancel()
+	}
+	return response, err
+}
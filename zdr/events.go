@@ -0,0 +1,148 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// maxPendingEvents bounds how many events are kept for a session that has no
+// stream open, e.g. because its client hasn't reconnected since a restart.
+const maxPendingEvents = 16
+
+type event struct {
+	Name string
+	Data any
+}
+
+var (
+	eventStreams  = map[string]chan event{}
+	pendingEvents = map[string][]event{}
+	eventsMutex   sync.Mutex
+)
+
+// handleEvents streams server-sent events for the session in the id query
+// parameter. Browsers reconnect an EventSource on their own, which makes this
+// the one channel to a client that survives a restart of the server.
+func handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		http.Error(w, "missing id", http.StatusBadRequest)
+		return
+	}
+
+	if err := authorizeEvents(r, id); err != nil {
+		authError(w, err)
+		return
+	}
+	events, stop := listenEvents(id)
+	defer stop()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e := <-events:
+			data, err := json.Marshal(e.Data)
+			if err != nil {
+				logf("Failed to marshal event %s: %v\n", e.Name, err)
+				continue
+			}
+			if _, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Name, data); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// authorizeEvents validates a request for the events of id. Events of a
+// session that is gone, like restoreFailed, only need credentials for some
+// room.
+func authorizeEvents(r *http.Request, id string) error {
+	if session := findSession(id); session != nil {
+		return authorizeSession(r, session)
+	}
+	return authorizeAny(r, "")
+}
+
+// listenEvents returns the stream of the events of id, starting with those
+// held for it, until stop is called.
+func listenEvents(id string) (events chan event, stop func()) {
+	events = make(chan event, maxPendingEvents)
+	eventsMutex.Lock()
+	for _, e := range pendingEvents[id] {
+		events <- e
+	}
+	delete(pendingEvents, id)
+	eventStreams[id] = events
+	eventsMutex.Unlock()
+
+	return events, func() {
+		eventsMutex.Lock()
+		if eventStreams[id] == events {
+			delete(eventStreams, id)
+		}
+		eventsMutex.Unlock()
+	}
+}
+
+// publishEvent sends an event to the client of a session. If the client isn't
+// listening right now the event is held until it reconnects. Once the
+// sessions were handed over nothing is sent, the process they were handed to
+// tells their clients.
+func publishEvent(id string, e event) {
+	if handedOver.Load() {
+		return
+	}
+
+	eventsMutex.Lock()
+	defer eventsMutex.Unlock()
+
+	if events, ok := eventStreams[id]; ok {
+		select {
+		case events <- e:
+		default:
+			logf("Dropping event %s for %s, client isn't keeping up\n", e.Name, id)
+		}
+		return
+	}
+
+	pending := append(pendingEvents[id], e)
+	if len(pending) > maxPendingEvents {
+		pending = pending[len(pending)-maxPendingEvents:]
+	}
+	pendingEvents[id] = pending
+}
+
+// forgetEvents drops the events held for id, whose client is gone for good.
+func forgetEvents(id string) {
+	eventsMutex.Lock()
+	defer eventsMutex.Unlock()
+
+	delete(pendingEvents, id)
+}
+
+// hasEventStream reports whether the client of id is listening right now.
+func hasEventStream(id string) bool {
+	eventsMutex.Lock()
+	defer eventsMutex.Unlock()
+
+	_, ok := eventStreams[id]
+	return ok
+}
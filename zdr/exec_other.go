@@ -0,0 +1,10 @@
+//go:build !js && windows
+// +build !js,windows
+
+package zdr
+
+import "errors"
+
+func execBinary(string) error {
+	return errors.New("zdr: replacing the process isn't supported on this platform")
+}
@@ -0,0 +1,15 @@
+//go:build !js && !windows
+// +build !js,!windows
+
+package zdr
+
+import (
+	"os"
+	"syscall"
+)
+
+// execBinary replaces the running process with binary. Every file descriptor
+// is close-on-exec, so the ICE ports are free for the new process to take.
+func execBinary(binary string) error {
+	return syscall.Exec(binary, append([]string{binary}, os.Args[1:]...), os.Environ())
+}
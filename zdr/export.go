@@ -0,0 +1,122 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+)
+
+var (
+	errNoAdminAuth = errors.New("snapshot export and import require -admin-token or an auth provider")
+	errNotFresh    = errors.New("snapshots can only be imported by a server without sessions")
+
+	snapshotExports = newCounter("snapshot_exports_total", "Snapshots pulled through the admin API.")
+	snapshotImports = newCounter("snapshot_imports_total", "Snapshots pushed through the admin API.")
+)
+
+// handleAdminSnapshot serves /admin/snapshot. GET streams a snapshot of the
+// running server, POST resumes the sessions of one in a server that has
+// none. Snapshots carry the DTLS keys of every session, so both are refused
+// unless admin requests are authenticated.
+func handleAdminSnapshot(w http.ResponseWriter, r *http.Request) {
+	if !adminAuthenticated() {
+		http.Error(w, errNoAdminAuth.Error(), http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		handleSnapshotExport(w, r)
+	case http.MethodPost:
+		handleSnapshotImport(w, r)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleSnapshotExport streams the snapshot in the encoding of
+// -snapshot-encoding, like the stored ones but without checksum or
+// encryption. With ?handoff=true new sessions are refused from then on, like
+// Handoff, so none are missing from the snapshot when moving to another host.
+func handleSnapshotExport(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("handoff") == "true" {
+		handingOff.Store(true)
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), config.SnapshotTimeout)
+	defer cancel()
+
+	sessionsMutex.Lock()
+	state, err := snapshotState(ctx)
+	sessionsMutex.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	snapshotExports.Inc()
+	logf("Exporting %d sessions\n", len(state.PeerConnectionState))
+	buffer, err := encodeSnapshot(state)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if _, err = w.Write(buffer); err != nil {
+		logf("Failed to export snapshot: %v\n", err)
+	}
+}
+
+// handleSnapshotImport provisions and resumes the snapshot in the body, then
+// returns the restore report. New sessions are refused with 503 meanwhile,
+// as they are at startup.
+func handleSnapshotImport(w http.ResponseWriter, r *http.Request) {
+	if !phase.CompareAndSwap(phaseServing, phaseProvisioning) {
+		http.Error(w, errNotServing.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer phase.Store(phaseServing)
+
+	sessionsMutex.Lock()
+	fresh := len(sessions) == 0
+	sessionsMutex.Unlock()
+	if !fresh {
+		http.Error(w, errNotFresh.Error(), http.StatusConflict)
+		return
+	}
+
+	buffer, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	state, err := decodeSnapshot(buffer)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.RestoreTimeout)
+	defer cancel()
+
+	snapshotImports.Inc()
+	state = provision(state)
+	phase.Store(phaseRestoring)
+	report := deserialize(ctx, state, "the snapshot imported")
+	lastRestoreReport = report
+	markRestored()
+
+	sessionsMutex.Lock()
+	if err = serialize(context.Background()); err != nil {
+		logf("Failed to serialize: %v\n", err)
+	}
+	sessionsMutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,124 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"strings"
+
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	engineFirefox   = "firefox"
+	engineSafari    = "safari"
+	engineChromium  = "chromium"
+	engineLibWebRTC = "libwebrtc"
+	engineUnknown   = "unknown"
+
+	// quirkH264Only is set for clients that offer H.264 but not VP8, like
+	// older Safari. They are served H.264, or audio alone if the room
+	// doesn't relay it.
+	quirkH264Only = "h264-only"
+
+	// quirkNoTWCC is set for Firefox broadcasters. Firefox stops applying
+	// REMB once transport-cc feedback is negotiated, which would leave them
+	// without bitrate caps.
+	quirkNoTWCC = "no-twcc"
+)
+
+// Fingerprint is what a client's offer, and its User-Agent where there is
+// one, tells about it. It is saved with the session, so a restart resumes
+// it with the same interceptors and answer even if the heuristics here have
+// changed since.
+type Fingerprint struct {
+	Engine      string
+	VideoCodecs []string `json:",omitempty"`
+
+	// TWCC and REMB are set if the offer negotiates the transport-cc header
+	// extension and goog-remb feedback.
+	TWCC bool
+	REMB bool
+
+	Quirks []string `json:",omitempty"`
+
+	// SDPShim is the translation of the SDP of a legacy client, applied
+	// again to every offer and answer after a restore.
+	SDPShim string `json:",omitempty"`
+}
+
+// fingerprintOffer works out the Fingerprint of the client that sent offer.
+func fingerprintOffer(offer webrtc.SessionDescription, userAgent string) Fingerprint {
+	fingerprint := Fingerprint{Engine: engineUnknown, VideoCodecs: offeredVideoCodecs(offer)}
+
+	parsed := &sdp.SessionDescription{}
+	if err := parsed.Unmarshal([]byte(offer.SDP)); err != nil {
+		return fingerprint
+	}
+
+	switch {
+	case strings.HasPrefix(parsed.Origin.Username, "mozilla"):
+		fingerprint.Engine = engineFirefox
+	case strings.Contains(userAgent, "Chrome/") || strings.Contains(userAgent, "Chromium/"):
+		fingerprint.Engine = engineChromium
+	case strings.Contains(userAgent, "Safari/"):
+		fingerprint.Engine = engineSafari
+	case parsed.Origin.Username == "-":
+		fingerprint.Engine = engineLibWebRTC
+	}
+
+	for _, media := range parsed.MediaDescriptions {
+		for _, attribute := range media.Attributes {
+			switch {
+			case attribute.Key == sdp.AttrKeyExtMap && strings.Contains(attribute.Value, sdp.TransportCCURI):
+				fingerprint.TWCC = true
+			case attribute.Key == "rtcp-fb" && strings.HasSuffix(attribute.Value, " goog-remb"):
+				fingerprint.REMB = true
+			}
+		}
+	}
+
+	if len(fingerprint.VideoCodecs) > 0 && !fingerprint.offers(webrtc.MimeTypeVP8) && fingerprint.offers(webrtc.MimeTypeH264) {
+		fingerprint.Quirks = append(fingerprint.Quirks, quirkH264Only)
+	}
+	if fingerprint.Engine == engineFirefox && !isViewerOffer(offer) {
+		fingerprint.Quirks = append(fingerprint.Quirks, quirkNoTWCC)
+	}
+	return fingerprint
+}
+
+// restoredFingerprint returns the fingerprint saved with a session. Sessions
+// saved before fingerprints were get one worked out from their offer, without
+// quirks since they were negotiated without adapting to any.
+func restoredFingerprint(saved Fingerprint, offer webrtc.SessionDescription) Fingerprint {
+	if saved.Engine == "" {
+		saved = fingerprintOffer(offer, "")
+		saved.Quirks = nil
+	}
+	return saved
+}
+
+func (f Fingerprint) offers(mimeType string) bool {
+	for _, codec := range f.VideoCodecs {
+		if strings.EqualFold(codec, mimeType) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f Fingerprint) has(quirk string) bool {
+	for _, q := range f.Quirks {
+		if q == quirk {
+			return true
+		}
+	}
+	return false
+}
+
+// useTWCC reports whether the twcc interceptor, if enabled for the role, is
+// used with the client.
+func (f Fingerprint) useTWCC() bool {
+	return f.TWCC && !f.has(quirkNoTWCC)
+}
@@ -0,0 +1,10 @@
+//go:build !js && windows
+// +build !js,windows
+
+package zdr
+
+// syncDir does nothing, directories can't be synced on Windows where
+// renames are written through.
+func syncDir(string) error {
+	return nil
+}
@@ -0,0 +1,17 @@
+//go:build !js && !windows
+// +build !js,!windows
+
+package zdr
+
+import "os"
+
+// syncDir syncs the directory at path, so the renames in it survive a
+// crash.
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
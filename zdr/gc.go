@@ -0,0 +1,196 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// maxTombstones bounds how many ended sessions are remembered.
+	maxTombstones = 1024
+
+	// tombstoneLeft is the reason recorded for a session its client ended,
+	// tombstoneHandedBack for a guest whose grant ended and
+	// tombstoneSRTPFailed for one whose SRTP couldn't be repaired and
+	// tombstoneRehandshakeFailed for one whose DTLS couldn't be redone and
+	// tombstoneClosedByServer for one closed through Participant.Close, the
+	// others are the connection state.
+	tombstoneLeft              = "left"
+	tombstoneHandedBack        = "handed back"
+	tombstoneSRTPFailed        = "srtp failed"
+	tombstoneRehandshakeFailed = "rehandshake failed"
+	tombstoneClosedByServer    = "closed by the server"
+)
+
+// Tombstone records a session that ended, so a restart can't bring it back
+// from the journal or a state that still lists it. Acknowledged is set if
+// the client confirmed it was told.
+type Tombstone struct {
+	ID           string
+	Room         string `json:",omitempty"`
+	Time         time.Time
+	Reason       string
+	Acknowledged bool
+}
+
+var (
+	tombstones      = []Tombstone{}
+	tombstonesMutex sync.Mutex
+
+	acks      = map[string]chan struct{}{}
+	acksMutex sync.Mutex
+)
+
+// collectSession removes a session whose PeerConnection failed or was
+// closed. A client that is still listening is sent sessionEnded first and
+// given -session-ack-timeout to acknowledge it, meanwhile the session is
+// left out of snapshots. Only the first call for a session does anything.
+func collectSession(session *session, reason string) {
+	if !session.collecting.CompareAndSwap(false, true) {
+		return
+	}
+
+	acknowledged := false
+	if reason != tombstoneLeft && hasEventStream(session.id) {
+		acknowledged = awaitAck(session.id, reason)
+	}
+
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+
+	journalAbort(session.id)
+	n := 0
+	for _, savedSession := range sessions {
+		if savedSession != session {
+			sessions[n] = savedSession
+			n++
+		}
+	}
+	if n < len(sessions) {
+		runDisconnectHooks(session.info())
+	}
+	sessions = sessions[:n]
+	if capture := session.capture.Swap(nil); capture != nil {
+		capture.stop()
+	}
+	closeAccounting(session)
+	countEnd(session, reason)
+	if session.latch != nil {
+		session.latch.ended.Store(true)
+	}
+	retireHistory(session.id, session.room.id, sessionHistory(session))
+	releaseSSRCs(session.id)
+	addTombstone(Tombstone{ID: session.id, Room: session.room.id, Time: time.Now(), Reason: reason, Acknowledged: acknowledged})
+	if err := session.peerConnection.Close(); err != nil {
+		logf("Failed to close PeerConnection %s: %v\n", session.id, err)
+	}
+
+	if err := serialize(context.Background()); err != nil {
+		logf("Failed to serialize: %v\n", err)
+	}
+}
+
+// awaitAck tells the client of id that its session ended and waits for it to
+// acknowledge.
+func awaitAck(id, reason string) bool {
+	ack := make(chan struct{})
+	acksMutex.Lock()
+	acks[id] = ack
+	acksMutex.Unlock()
+
+	defer func() {
+		acksMutex.Lock()
+		delete(acks, id)
+		acksMutex.Unlock()
+	}()
+
+	publishEvent(id, event{Name: "sessionEnded", Data: reason})
+	select {
+	case <-ack:
+		return true
+	case <-time.After(config.SessionAckTimeout):
+		return false
+	}
+}
+
+// handleAck serves POST /sessions/{id}/ack, sent by a client after it was
+// told its session ended.
+func handleAck(w http.ResponseWriter, r *http.Request, session *session) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	acksMutex.Lock()
+	if ack, ok := acks[session.id]; ok {
+		close(ack)
+		delete(acks, session.id)
+	}
+	acksMutex.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleLeave serves DELETE /sessions/{id}, sent by a client that is going
+// away. The session is ended right away and never resumed.
+func handleLeave(w http.ResponseWriter, r *http.Request, session *session) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	recordHistory(session, historyControl, "left by the client")
+	collectSession(session, tombstoneLeft)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func addTombstone(tombstone Tombstone) {
+	tombstonesMutex.Lock()
+	defer tombstonesMutex.Unlock()
+
+	tombstones = append(tombstones, tombstone)
+	if len(tombstones) > maxTombstones {
+		tombstones = tombstones[len(tombstones)-maxTombstones:]
+	}
+}
+
+func isTombstoned(id string) bool {
+	tombstonesMutex.Lock()
+	defer tombstonesMutex.Unlock()
+
+	for _, tombstone := range tombstones {
+		if tombstone.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+func snapshotTombstones() []Tombstone {
+	tombstonesMutex.Lock()
+	defer tombstonesMutex.Unlock()
+	return append([]Tombstone{}, tombstones...)
+}
+
+// restoreTombstones brings back the tombstones of a snapshot and drops the
+// sessions they name from it.
+func restoreTombstones(state GlobalState) GlobalState {
+	tombstonesMutex.Lock()
+	tombstones = append([]Tombstone{}, state.Tombstones...)
+	tombstonesMutex.Unlock()
+
+	kept := []PeerConnectionState{}
+	for _, sessionState := range state.PeerConnectionState {
+		if isTombstoned(sessionState.ID) {
+			logf("Not resuming PeerConnection %s, it has ended\n", sessionState.ID)
+			continue
+		}
+		kept = append(kept, sessionState)
+	}
+	state.PeerConnectionState = kept
+	return state
+}
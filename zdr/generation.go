@@ -0,0 +1,20 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// generation counts the restarts of the server, it is one more than the
+// generation that wrote the snapshot we resumed from. Logs, metrics, the
+// restore report and signaling responses carry it, so anything can be told
+// apart by the deploy it happened in.
+var generation atomic.Uint64
+
+// logf prints a log line stamped with the generation.
+func logf(format string, args ...any) {
+	fmt.Printf("[generation %d] "+format, append([]any{generation.Load()}, args...)...)
+}
@@ -0,0 +1,241 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// guestSubject is the subject of the principal a guest broadcasts as.
+const guestSubject = "guest"
+
+var (
+	errGuestActive  = errors.New("the room already has a guest")
+	errInvalidGuest = errors.New("invalid guest grant")
+
+	guestGrants    = newCounter("guest_grants_total", "Guests granted to broadcast in a room.")
+	guestHandbacks = newCounter("guest_handbacks_total", "Rooms handed back to their broadcaster after a guest.")
+)
+
+// GuestGrant lets a second participant broadcast in a room until Deadline,
+// for a Q&A or the like. The guest sends its requests with Token, and
+// once it connects it replaces the broadcaster for the viewers, who stays
+// connected but off air. At Deadline, when the grant is revoked or when the
+// guest leaves, the guest is disconnected and the broadcaster is back on
+// air. Grants are saved with their room, Deadline is kept as it is across a
+// restart.
+type GuestGrant struct {
+	Token             string
+	Granted, Deadline time.Time
+
+	// Session is the session of the guest once it joined.
+	Session string `json:",omitempty"`
+}
+
+// active reports whether g lets its guest broadcast at now.
+func (g *GuestGrant) active(now time.Time) bool {
+	return g != nil && now.Before(g.Deadline)
+}
+
+// grantGuest lets a guest broadcast in room for duration.
+func grantGuest(room *room, duration time.Duration) (GuestGrant, error) {
+	if duration <= 0 {
+		return GuestGrant{}, fmt.Errorf("%w: duration must be positive", errInvalidGuest)
+	}
+
+	now := time.Now()
+	grant := &GuestGrant{Token: randomToken(), Granted: now, Deadline: now.Add(duration)}
+	if !room.guest.CompareAndSwap(nil, grant) {
+		return GuestGrant{}, errGuestActive
+	}
+	guestGrants.Inc()
+	logf("Granted a guest room %s until %s\n", room.id, grant.Deadline.Format(time.RFC3339))
+
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	return *grant, serialize(context.Background())
+}
+
+// guestJoined makes session the guest of room, replacing any session the
+// guest joined with before, which is disconnected.
+func guestJoined(room *room, session *session) {
+	for {
+		current := room.guest.Load()
+		if !current.active(time.Now()) {
+			return
+		}
+
+		grant := *current
+		grant.Session = session.id
+		if !room.guest.CompareAndSwap(current, &grant) {
+			continue
+		}
+
+		recordHistory(session, historyControl, "on air as the guest until %s", grant.Deadline.Format(time.RFC3339))
+		if previous := findSession(current.Session); previous != nil && previous != session {
+			go collectSession(previous, tombstoneHandedBack)
+		}
+		room.publish(event{Name: "guestOnAir", Data: grant.Deadline})
+		room.requestKeyframe()
+		return
+	}
+}
+
+// handBack ends the grant of room, if any, disconnecting the guest and
+// putting the broadcaster back on air.
+func handBack(room *room, reason string) {
+	grant := room.guest.Swap(nil)
+	if grant == nil {
+		return
+	}
+
+	logf("Handing room %s back to its broadcaster: %s\n", room.id, reason)
+	guestHandbacks.Inc()
+	if guest := findSession(grant.Session); guest != nil {
+		recordHistory(guest, historyControl, "handed back: %s", reason)
+		go collectSession(guest, tombstoneHandedBack)
+	}
+	room.publish(event{Name: "guestEnded"})
+	room.requestKeyframe()
+
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	if err := serialize(context.Background()); err != nil {
+		logf("Failed to serialize: %v\n", err)
+	}
+}
+
+// publish sends e to every session of r.
+func (r *room) publish(e event) {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	for _, session := range sessions {
+		if session.room == r {
+			publishEvent(session.id, e)
+		}
+	}
+}
+
+// onAir reports whether the media session broadcasts should reach the
+// viewers of its room. While a guest that joined is on air, the broadcaster
+// is not, and a guest whose grant ended never is. Otherwise the ingest on
+// air is, see ingestState.
+func (r *room) onAir(session *session) bool {
+	grant := r.guest.Load()
+	if grant == nil || grant.Session == "" {
+		return !isGuest(session) && r.ingest.onAir(session)
+	} else if grant.active(time.Now()) {
+		return session.id == grant.Session
+	}
+	return session.id != grant.Session && r.ingest.onAir(session)
+}
+
+// isGuest reports whether session joined with a guest grant.
+func isGuest(session *session) bool {
+	return session.principal.Subject == guestSubject
+}
+
+// restoreGuest puts back the grant of a snapshot. One that expired while
+// the server was down is handed back by watchGuests right away.
+func (r *room) restoreGuest(grant *GuestGrant) {
+	if grant != nil {
+		r.guest.Store(grant)
+	}
+}
+
+// guestGrant returns the grant of r to save, nil if none.
+func (r *room) guestGrant() *GuestGrant {
+	return r.guest.Load()
+}
+
+// authorizeRoomJoin is authorizeJoin for room, except that a broadcaster
+// with the token of the active guest grant of the room, in ?guest= or the
+// X-Guest-Token header, may join as the guest.
+func authorizeRoomJoin(r *http.Request, room *room, broadcaster bool) (Principal, error) {
+	token := r.URL.Query().Get("guest")
+	if token == "" {
+		token = r.Header.Get("X-Guest-Token")
+	}
+	if !broadcaster || token == "" {
+		return authorizeJoin(r, room.id, broadcaster)
+	}
+
+	grant := room.guest.Load()
+	if !grant.active(time.Now()) || subtle.ConstantTimeCompare([]byte(token), []byte(grant.Token)) != 1 {
+		return Principal{}, fmt.Errorf("%w: no guest grant for this token", errForbidden)
+	}
+	return Principal{Subject: guestSubject, Roles: []string{roleBroadcaster}, Rooms: []string{room.id}}, nil
+}
+
+// watchGuests hands rooms back to their broadcaster once the grant of their
+// guest runs out or the guest left.
+func watchGuests(ctx context.Context) {
+	every(ctx, time.Second, func(now time.Time) {
+		for _, room := range allRooms() {
+			grant := room.guest.Load()
+			switch {
+			case grant == nil:
+			case !grant.active(now):
+				handBack(room, "the grant ran out")
+			case grant.Session != "" && isTombstoned(grant.Session):
+				handBack(room, "the guest left")
+			}
+		}
+	})
+}
+
+// handleAdminRoomGuest serves /admin/rooms/{id}/guest, returning the grant
+// of the room on GET. POST ?duration=10m grants a guest and returns the
+// grant, whose Token the guest sends its offer with, DELETE hands the room
+// back right away.
+func handleAdminRoomGuest(w http.ResponseWriter, r *http.Request, room *room) {
+	switch r.Method {
+	case http.MethodGet:
+		grant := room.guestGrant()
+		if grant == nil {
+			http.Error(w, "the room has no guest", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(grant)
+	case http.MethodPost:
+		duration, err := time.ParseDuration(r.URL.Query().Get("duration"))
+		if err != nil {
+			http.Error(w, "invalid duration", http.StatusBadRequest)
+			return
+		}
+
+		grant, err := grantGuest(room, duration)
+		if errors.Is(err, errInvalidGuest) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if errors.Is(err, errGuestActive) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(&grant)
+	case http.MethodDelete:
+		if room.guestGrant() == nil {
+			http.Error(w, "the room has no guest", http.StatusNotFound)
+			return
+		}
+		handBack(room, "revoked")
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,184 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	errReleased = errors.New("the sessions were already handed to another instance")
+
+	handoffsServed  = newCounter("handoffs_served_total", "Instances that took the sessions of this one over through /handoff.")
+	handoffsTaken   = newCounter("handoffs_taken_total", "Startups that resumed the sessions of the instance at -handoff-from.")
+	handoffsExpired = newCounter("handoffs_expired_total", "Handoffs taken back because the instance taking over didn't finish in time.")
+)
+
+// handleHandoff serves /handoff, for an instance started with -handoff-from
+// to take the sessions of this one over. GET refuses new sessions and
+// returns a snapshot, like GET /admin/snapshot?handoff=true. POST releases
+// the ICE sockets of every session once the other instance is about to bind
+// them, then Released is closed. DELETE takes a handoff that failed back and
+// serves new sessions again, as happens on its own if no POST comes within
+// -restore-timeout and -snapshot-timeout, as long as the other instance may
+// take to resume the sessions. The snapshot carries the DTLS keys of every
+// session, so all of them are refused unless admin requests are
+// authenticated.
+func (s *Server) handleHandoff(w http.ResponseWriter, r *http.Request) {
+	if !adminAuthenticated() {
+		http.Error(w, errNoAdminAuth.Error(), http.StatusForbidden)
+		return
+	} else if handedOver.Load() && r.Method != http.MethodPost {
+		http.Error(w, errReleased.Error(), http.StatusConflict)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		handingOff.Store(true)
+		logf("Handing the sessions off to %s\n", r.RemoteAddr)
+		handleSnapshotExport(w, r)
+		s.armHandoff(r.RemoteAddr, config.RestoreTimeout+config.SnapshotTimeout)
+	case http.MethodPost:
+		s.armHandoff("", 0)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct{ Sockets int }{s.release()})
+	case http.MethodDelete:
+		s.armHandoff("", 0)
+		handingOff.Store(false)
+		logf("Handoff to %s taken back, serving new sessions again\n", r.RemoteAddr)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// armHandoff takes the handoff to addr back after timeout unless the
+// sockets were released by then, so an instance that died or hung while
+// taking over doesn't leave this one refusing new sessions forever. A
+// timeout of 0 only stops the timer of the previous handoff.
+func (s *Server) armHandoff(addr string, timeout time.Duration) {
+	s.handoffMu.Lock()
+	defer s.handoffMu.Unlock()
+	if s.handoffTimer != nil {
+		s.handoffTimer.Stop()
+		s.handoffTimer = nil
+	}
+	if timeout <= 0 {
+		return
+	}
+
+	s.handoffTimer = time.AfterFunc(timeout, func() {
+		if !handedOver.Load() && handingOff.CompareAndSwap(true, false) {
+			handoffsExpired.Inc()
+			logf("Handoff to %s not finished within %v, serving new sessions again\n", addr, timeout)
+		}
+	})
+}
+
+// release closes the ICE sockets of every session, so the instance taking
+// them over can bind their ports, and stops saving snapshots, which that one
+// saves from then on. It returns how many were closed.
+func (s *Server) release() int {
+	handedOver.Store(true)
+
+	sessionsMutex.Lock()
+	released := 0
+	for _, session := range sessions {
+		for _, conn := range session.buffers.open() {
+			if err := conn.Close(); err != nil {
+				logf("Warning: failed to release %s: %v\n", conn.LocalAddr(), err)
+				continue
+			}
+			released++
+		}
+	}
+	sessionsMutex.Unlock()
+
+	handoffsServed.Inc()
+	logf("Released %d ICE sockets to the next instance\n", released)
+	s.releaseOnce.Do(func() { close(s.released) })
+	return released
+}
+
+// Released is closed once an instance started with -handoff-from took the
+// sessions of this one over through /handoff. The process should exit then,
+// the other instance is serving them.
+func (s *Server) Released() <-chan struct{} {
+	return s.released
+}
+
+// fetchHandoff requests the sessions of the instance at -handoff-from, and
+// returns false if there is none or they don't decode, the store is then
+// used.
+func fetchHandoff(ctx context.Context) (GlobalState, bool) {
+	if config.HandoffFrom == "" {
+		return GlobalState{}, false
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, config.RestoreTimeout)
+	defer cancel()
+	res, err := requestHandoff(ctx, http.MethodGet)
+	if err != nil {
+		logf("Warning: not taking over from %s, resuming from the store: %v\n", config.HandoffFrom, err)
+		return GlobalState{}, false
+	}
+
+	buffer, err := io.ReadAll(res.Body)
+	res.Body.Close() //nolint:errcheck
+	state := GlobalState{}
+	if err == nil {
+		state, err = decodeSnapshot(buffer)
+	}
+	if err != nil {
+		logf("Warning: skipping the sessions of %s, resuming from the store: %v\n", config.HandoffFrom, err)
+		finishHandoff(ctx, http.MethodDelete)
+		return GlobalState{}, false
+	}
+
+	handoffsTaken.Inc()
+	logf("Taking %d sessions over from %s\n", len(state.PeerConnectionState), config.HandoffFrom)
+	return state, true
+}
+
+// finishHandoff tells the instance at -handoff-from to release its sockets,
+// with POST, or to take the handoff back, with DELETE.
+func finishHandoff(ctx context.Context, method string) {
+	res, err := requestHandoff(ctx, method)
+	if err != nil {
+		logf("Warning: %s %s/handoff failed: %v\n", method, config.HandoffFrom, err)
+		return
+	}
+	res.Body.Close() //nolint:errcheck
+}
+
+// requestHandoff sends a request to /handoff of the instance at
+// -handoff-from, authenticated with -admin-token, and fails unless it
+// succeeds.
+func requestHandoff(ctx context.Context, method string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(config.HandoffFrom, "/")+"/handoff", nil)
+	if err != nil {
+		return nil, err
+	} else if config.AdminToken != "" {
+		req.Header.Set("Authorization", "Bearer "+config.AdminToken)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	} else if res.StatusCode/100 != 2 {
+		message, _ := io.ReadAll(io.LimitReader(res.Body, 1<<10))
+		res.Body.Close() //nolint:errcheck
+		return nil, fmt.Errorf("%s: %s", res.Status, bytes.TrimSpace(message))
+	}
+	return res, nil
+}
@@ -0,0 +1,100 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// handoffServer returns a Server serving /handoff with an admin token, and
+// puts the handoff state back once t is done.
+func handoffServer(t *testing.T) *Server {
+	t.Helper()
+
+	cfg := config
+	t.Cleanup(func() {
+		config = cfg
+		handingOff.Store(false)
+		handedOver.Store(false)
+	})
+	config.AdminToken = "token"
+	config.RestoreTimeout, config.SnapshotTimeout = 50*time.Millisecond, 50*time.Millisecond
+	return &Server{released: make(chan struct{})}
+}
+
+func requestHandoffFrom(t *testing.T, s *Server, method string) {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	s.handleHandoff(w, httptest.NewRequest(method, "/handoff", nil))
+	if w.Code/100 != 2 {
+		t.Fatalf("%s /handoff: %d %s", method, w.Code, w.Body)
+	}
+}
+
+// TestHandoffExpires checks a handoff that isn't finished in time is taken
+// back, and one that is isn't.
+func TestHandoffExpires(t *testing.T) {
+	s := handoffServer(t)
+
+	expired := handoffsExpired.value.Load()
+	requestHandoffFrom(t, s, http.MethodGet)
+	if !handingOff.Load() {
+		t.Fatal("new sessions accepted while handing off")
+	}
+	time.Sleep(200 * time.Millisecond)
+	if handingOff.Load() {
+		t.Fatal("handoff not taken back")
+	} else if handoffsExpired.value.Load() != expired+1 {
+		t.Fatal("expired handoff not counted")
+	}
+
+	requestHandoffFrom(t, s, http.MethodGet)
+	requestHandoffFrom(t, s, http.MethodPost)
+	time.Sleep(200 * time.Millisecond)
+	if !handingOff.Load() || !handedOver.Load() {
+		t.Fatal("finished handoff taken back")
+	}
+	select {
+	case <-s.Released():
+	default:
+		t.Fatal("Released not closed")
+	}
+}
+
+// TestHandedOverSessionFails checks a session failing once handed over, as
+// its sockets are released, is neither collected nor its client told.
+func TestHandedOverSessionFails(t *testing.T) {
+	handoffServer(t)
+	room, err := newRoom(RoomState{ID: "handed-over"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := newSessionState("handed-over", room, viewerOffer(t))
+	t.Cleanup(func() { forgetEvents(session.id) })
+	handedOver.Store(true)
+
+	onConnectionStateChangeHandler(session, webrtc.PeerConnectionStateFailed)
+	if session.collecting.Load() {
+		t.Fatal("session collected")
+	}
+	tombstonesMutex.Lock()
+	for _, tombstone := range tombstones {
+		if tombstone.ID == session.id {
+			t.Error("session tombstoned")
+		}
+	}
+	tombstonesMutex.Unlock()
+	eventsMutex.Lock()
+	pending := len(pendingEvents[session.id])
+	eventsMutex.Unlock()
+	if pending != 0 {
+		t.Fatalf("client sent %d events", pending)
+	}
+}
@@ -0,0 +1,463 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media/ivfreader"
+	"github.com/pion/webrtc/v3/pkg/media/oggreader"
+)
+
+const (
+	sourceFile    = "file"
+	sourcePattern = "pattern"
+	sourceRTP     = "rtp"
+	sourceReplay  = "replay"
+
+	sourceRetryDelay   = time.Second
+	patternFrameRate   = 30
+	opusFrameDuration  = 20 * time.Millisecond
+	sourceReadDeadline = time.Second
+)
+
+var (
+	errUnknownSource   = errors.New("source is not configured")
+	errInvalidSource   = errors.New("invalid source")
+	errUnsupportedFile = errors.New("file can't be played")
+
+	// opusSilence is a 20ms Opus frame of silence.
+	opusSilence = []byte{0xf8, 0xff, 0xfe}
+
+	// sourceConfigs are the headless sources of -sources, by name.
+	sourceConfigs = map[string]sourceConfig{}
+)
+
+// sourceConfig is a non-WebRTC source a room can be attached to in place of
+// a broadcaster, one of:
+//
+//	file:clip.ivf+clip.ogg  IVF video (VP8 or H.264) and Ogg Opus audio, looped
+//	pattern:still.ivf       the first frame of an IVF file at 30fps, with silence
+//	rtp:127.0.0.1:5004/vp8  RTP of the given codec received on a UDP port
+//	replay:ingest.pcap      the ingest of a broadcaster captured by
+//	                        /admin/sessions/{id}/pcap, played once
+type sourceConfig struct {
+	name, kind, target string
+}
+
+// parseSources parses the comma separated name=kind:target list of -sources.
+func parseSources(list string) (map[string]sourceConfig, error) {
+	out := map[string]sourceConfig{}
+	for _, entry := range strings.Split(list, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+
+		name, spec, _ := strings.Cut(entry, "=")
+		kind, target, _ := strings.Cut(spec, ":")
+		if name == "" || target == "" {
+			return nil, fmt.Errorf("%w: %q", errInvalidSource, entry)
+		}
+
+		switch kind {
+		case sourceFile, sourcePattern, sourceReplay:
+		case sourceRTP:
+			if _, codec, _ := strings.Cut(target, "/"); !strings.EqualFold(codec, "opus") && !isVideoCodec("video/"+codec) {
+				return nil, fmt.Errorf("%w: %q has no codec the rooms relay", errInvalidSource, entry)
+			}
+		default:
+			return nil, fmt.Errorf("%w: %q has unknown kind %q", errInvalidSource, entry, kind)
+		}
+		out[name] = sourceConfig{name: name, kind: kind, target: target}
+	}
+	return out, nil
+}
+
+func isVideoCodec(mimeType string) bool {
+	for _, videoCodec := range videoCodecs {
+		if strings.EqualFold(videoCodec, mimeType) {
+			return true
+		}
+	}
+	return false
+}
+
+// attachment is a headless source playing into a room.
+type attachment struct {
+	name   string
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// attachedSource returns the name of the source attached to r, "" if none.
+func (r *room) attachedSource() string {
+	r.attachedMutex.Lock()
+	defer r.attachedMutex.Unlock()
+
+	if r.attached == nil {
+		return ""
+	}
+	return r.attached.name
+}
+
+// attachSource makes the source called name the broadcaster of room,
+// replacing any source attached before. A live WebRTC broadcaster is never
+// replaced. An empty name detaches the source.
+func attachSource(room *room, name string) error {
+	if name == "" {
+		detachSource(room)
+		return nil
+	}
+
+	source, ok := sourceConfigs[name]
+	if !ok {
+		return fmt.Errorf("%w: %s", errUnknownSource, name)
+	} else if config.E2EEHeaderExtension != "" {
+		// Viewers would fail to decrypt media we didn't receive encrypted.
+		return errE2EEInject
+	}
+
+	room.attachedMutex.Lock()
+	defer room.attachedMutex.Unlock()
+
+	if room.attached != nil && room.attached.name == name {
+		return nil
+	} else if room.attached == nil && broadcasterLive(room) {
+		return errBroadcasterLive
+	}
+	room.stopAttachment()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	room.attached = &attachment{name: name, cancel: cancel, done: make(chan struct{})}
+	go runSource(ctx, room, source, room.attached.done)
+	logf("Attached source %s to room %s\n", name, room.id)
+	return nil
+}
+
+// detachSource stops the source attached to room, if any, and lets viewers
+// know the broadcaster is gone without waiting for -broadcaster-timeout.
+func detachSource(room *room) {
+	room.attachedMutex.Lock()
+	attached := room.attached != nil
+	room.stopAttachment()
+	room.attachedMutex.Unlock()
+	if !attached || !room.haveBroadcaster.CompareAndSwap(true, false) {
+		return
+	}
+
+	logf("Detached the source of room %s\n", room.id)
+	sessionsMutex.Lock()
+	for _, session := range sessions {
+		if session.room == room {
+			publishEvent(session.id, event{Name: "broadcasterLost"})
+		}
+	}
+	sessionsMutex.Unlock()
+}
+
+// stopAttachment stops the source attached to r and waits for it to return.
+// attachedMutex must be held.
+func (r *room) stopAttachment() {
+	if r.attached == nil {
+		return
+	}
+
+	r.attached.cancel()
+	<-r.attached.done
+	r.attached = nil
+}
+
+// restoreSource attaches the source a room had in the snapshot. It is
+// dropped if it is no longer configured.
+func restoreSource(room *room, name string) {
+	if name == "" {
+		return
+	}
+	if err := attachSource(room, name); err != nil {
+		logf("Failed to reattach source %s to room %s: %v\n", name, room.id, err)
+	}
+}
+
+// runSource plays source into room until ctx is done, starting over after
+// any error.
+func runSource(ctx context.Context, room *room, source sourceConfig, done chan struct{}) {
+	defer close(done)
+
+	for {
+		var err error
+		switch source.kind {
+		case sourceFile:
+			err = playFiles(ctx, room, strings.Split(source.target, "+"))
+		case sourcePattern:
+			err = playPattern(ctx, room, source.target)
+		case sourceRTP:
+			err = receiveRTP(ctx, room, source.target)
+		case sourceReplay:
+			err = replayCapture(ctx, room, source.target)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		logf("Source %s of room %s stopped, restarting: %v\n", source.name, room.id, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(sourceRetryDelay):
+		}
+	}
+}
+
+// playFiles loops every file of paths in parallel until ctx is done.
+func playFiles(ctx context.Context, room *room, paths []string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errs := make(chan error, len(paths))
+	var wg sync.WaitGroup
+	for _, path := range paths {
+		wg.Add(1)
+		go func(path string) {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				if err := playFile(ctx, room, path); err != nil {
+					errs <- err
+					cancel()
+					return
+				}
+			}
+		}(path)
+	}
+	wg.Wait()
+
+	select {
+	case err := <-errs:
+		return err
+	default:
+		return ctx.Err()
+	}
+}
+
+// playFile plays path once, paced by its timing.
+func playFile(ctx context.Context, room *room, path string) error {
+	file, err := os.Open(path) //nolint:gosec
+	if err != nil {
+		return err
+	}
+	defer file.Close() //nolint:errcheck
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".ivf":
+		reader, header, err := ivfreader.NewWith(file)
+		if err != nil {
+			return err
+		}
+		track, err := ivfTrack(room, header)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		room.addSource(track.Codec().MimeType)
+		defer room.removeSource(track.Codec().MimeType)
+
+		interval := time.Duration(0)
+		if header.TimebaseDenominator != 0 {
+			interval = time.Duration(float64(time.Second) * float64(header.TimebaseNumerator) / float64(header.TimebaseDenominator))
+		}
+		return pace(ctx, interval, func() error {
+			frame, _, err := reader.ParseNextFrame()
+			if err != nil {
+				return err
+			}
+			return sendFrame(room, track, frame)
+		})
+	case ".ogg", ".opus":
+		reader, _, err := oggreader.NewWith(file)
+		if err != nil {
+			return err
+		}
+
+		return pace(ctx, opusFrameDuration, func() error {
+			for {
+				page, header, err := reader.ParseNextPage()
+				if err != nil {
+					return err
+				}
+				// Pages without a granule position carry the Opus tags.
+				if header.GranulePosition != 0 {
+					return sendFrame(room, room.audioTrack, page)
+				}
+			}
+		})
+	default:
+		return fmt.Errorf("%w: %s", errUnsupportedFile, path)
+	}
+}
+
+// playPattern repeats the first frame of the IVF file at path, along with
+// silence, until ctx is done. The frame should be a keyframe.
+func playPattern(ctx context.Context, room *room, path string) error {
+	frame, mimeType, err := readIVFFrame(path)
+	if err != nil {
+		return err
+	}
+
+	track := room.videoTrack(mimeType)
+	if track == nil {
+		return fmt.Errorf("%s: %w: %q", path, errUnsupportedCodec, mimeType)
+	}
+	room.addSource(track.Codec().MimeType)
+	defer room.removeSource(track.Codec().MimeType)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go pace(ctx, opusFrameDuration, func() error { //nolint:errcheck
+		return sendFrame(room, room.audioTrack, opusSilence)
+	})
+	return pace(ctx, time.Second/patternFrameRate, func() error {
+		return sendFrame(room, track, frame)
+	})
+}
+
+// receiveRTP forwards the RTP received on the UDP address of target, given
+// as host:port/codec, to the track of that codec.
+func receiveRTP(ctx context.Context, room *room, target string) error {
+	address, codec, _ := strings.Cut(target, "/")
+	track := sourceRTPTrack(room, codec)
+	if track == nil {
+		return fmt.Errorf("%w: %s", errUnsupportedCodec, codec)
+	}
+
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close() //nolint:errcheck
+
+	if track != room.audioTrack {
+		room.addSource(track.Codec().MimeType)
+		defer room.removeSource(track.Codec().MimeType)
+	}
+
+	buf := make([]byte, 1500)
+	for ctx.Err() == nil {
+		if err = conn.SetReadDeadline(time.Now().Add(sourceReadDeadline)); err != nil {
+			return err
+		}
+		n, _, err := conn.ReadFrom(buf)
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		packet := &rtp.Packet{}
+		if err = packet.Unmarshal(buf[:n]); err != nil {
+			continue
+		}
+
+		start := time.Now()
+		markBroadcasterAlive(room)
+		markTrackAlive(room, track.Kind())
+		fanout(track, packet, ingestStage.done(start))
+	}
+	return ctx.Err()
+}
+
+// sourceRTPTrack returns the output track of room for a codec name like
+// vp8 or opus, nil if the room doesn't relay it.
+func sourceRTPTrack(room *room, codec string) *webrtc.TrackLocalStaticRTP {
+	if strings.EqualFold(codec, "opus") {
+		return room.audioTrack
+	}
+	return room.videoTrack("video/" + codec)
+}
+
+// ivfMimeType returns the mime type of the codec of an IVF file, "" for
+// codecs rooms don't relay.
+func ivfMimeType(header *ivfreader.IVFFileHeader) string {
+	switch header.FourCC {
+	case "VP80":
+		return webrtc.MimeTypeVP8
+	case "H264":
+		return webrtc.MimeTypeH264
+	}
+	return ""
+}
+
+// ivfTrack returns the output track of room for the codec of an IVF file.
+func ivfTrack(room *room, header *ivfreader.IVFFileHeader) (*webrtc.TrackLocalStaticRTP, error) {
+	if track := room.videoTrack(ivfMimeType(header)); track != nil {
+		return track, nil
+	}
+	return nil, fmt.Errorf("%w: %q", errUnsupportedCodec, header.FourCC)
+}
+
+// readIVFFrame returns the first frame of the IVF file at path, along with
+// the mime type of its codec.
+func readIVFFrame(path string) ([]byte, string, error) {
+	file, err := os.Open(path) //nolint:gosec
+	if err != nil {
+		return nil, "", err
+	}
+	defer file.Close() //nolint:errcheck
+
+	reader, header, err := ivfreader.NewWith(file)
+	if err != nil {
+		return nil, "", err
+	}
+	frame, _, err := reader.ParseNextFrame()
+	if err != nil {
+		return nil, "", err
+	} else if ivfMimeType(header) == "" {
+		return nil, "", fmt.Errorf("%s: %w: %q", path, errUnsupportedCodec, header.FourCC)
+	}
+	return frame, ivfMimeType(header), nil
+}
+
+// sendFrame writes a frame of a headless source to track.
+func sendFrame(room *room, track *webrtc.TrackLocalStaticRTP, frame []byte) error {
+	markBroadcasterAlive(room)
+	markTrackAlive(room, track.Kind())
+	if err := injectFrame(track, frame); err != nil && errors.Is(err, errUnsupportedCodec) {
+		return err
+	} else if err != nil {
+		logf("Failed to write to track %s: %v\n", track.ID(), err)
+	}
+	return nil
+}
+
+// pace calls fn every interval until it fails or ctx is done. io.EOF ends
+// it without an error, so files can be looped.
+func pace(ctx context.Context, interval time.Duration, fn func() error) error {
+	if interval <= 0 {
+		interval = time.Second / patternFrameRate
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if err := fn(); errors.Is(err, io.EOF) {
+				return nil
+			} else if err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,233 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	sessionHistoryLength = 64
+
+	// retiredHistoryLength is how many sessions that are gone we keep the
+	// history of, so a session lost in a restart can still be looked into.
+	retiredHistoryLength = 128
+
+	// rtcpAnomalyInterval limits how often RTCP anomalies are recorded.
+	rtcpAnomalyInterval = 5 * time.Second
+
+	// highFractionLost is a reported loss of 25%, in 1/256ths.
+	highFractionLost = 64
+)
+
+// Kinds of history entry.
+const (
+	historyState         = "state"
+	historyRenegotiation = "renegotiation"
+	historyRestore       = "restore"
+	historyRTCP          = "rtcp"
+	historyControl       = "control"
+)
+
+// HistoryEntry is one thing that happened to a session.
+type HistoryEntry struct {
+	Time    time.Time
+	Kind    string
+	Message string
+}
+
+// SessionHistory is the history of a session that is gone.
+type SessionHistory struct {
+	ID      string
+	Room    string `json:",omitempty"`
+	Retired time.Time
+	Entries []HistoryEntry
+}
+
+var (
+	retiredHistories      = []SessionHistory{}
+	retiredHistoriesMutex sync.Mutex
+)
+
+// recordHistory adds an entry to the history of session, dropping the oldest
+// once there are sessionHistoryLength.
+func recordHistory(session *session, kind, format string, args ...any) {
+	session.historyMutex.Lock()
+	defer session.historyMutex.Unlock()
+
+	session.history = appendHistory(session.history, HistoryEntry{Time: time.Now(), Kind: kind, Message: fmt.Sprintf(format, args...)})
+}
+
+func appendHistory(history []HistoryEntry, entry HistoryEntry) []HistoryEntry {
+	history = append(history, entry)
+	if len(history) > sessionHistoryLength {
+		history = append([]HistoryEntry(nil), history[len(history)-sessionHistoryLength:]...)
+	}
+	return history
+}
+
+// sessionHistory returns a copy of the history of session.
+func sessionHistory(session *session) []HistoryEntry {
+	session.historyMutex.Lock()
+	defer session.historyMutex.Unlock()
+
+	return append([]HistoryEntry{}, session.history...)
+}
+
+// retireHistory keeps the history of a session that is going away.
+func retireHistory(id, room string, history []HistoryEntry) {
+	retiredHistoriesMutex.Lock()
+	defer retiredHistoriesMutex.Unlock()
+
+	for i := range retiredHistories {
+		if retiredHistories[i].ID == id {
+			retiredHistories = append(retiredHistories[:i], retiredHistories[i+1:]...)
+			break
+		}
+	}
+
+	retiredHistories = append(retiredHistories, SessionHistory{ID: id, Room: room, Retired: time.Now(), Entries: history})
+	if len(retiredHistories) > retiredHistoryLength {
+		retiredHistories = append([]SessionHistory(nil), retiredHistories[len(retiredHistories)-retiredHistoryLength:]...)
+	}
+}
+
+// snapshotRetiredHistories returns a copy of the retired histories to save.
+func snapshotRetiredHistories() []SessionHistory {
+	retiredHistoriesMutex.Lock()
+	defer retiredHistoriesMutex.Unlock()
+
+	return append([]SessionHistory{}, retiredHistories...)
+}
+
+func restoreRetiredHistories(histories []SessionHistory) {
+	retiredHistoriesMutex.Lock()
+	defer retiredHistoriesMutex.Unlock()
+
+	retiredHistories = append([]SessionHistory{}, histories...)
+}
+
+// findHistory returns the history of a live or retired session.
+func findHistory(id string) ([]HistoryEntry, bool) {
+	if session := findSession(id); session != nil {
+		return sessionHistory(session), true
+	}
+
+	retiredHistoriesMutex.Lock()
+	defer retiredHistoriesMutex.Unlock()
+
+	for _, history := range retiredHistories {
+		if history.ID == id {
+			return history.Entries, true
+		}
+	}
+	return nil, false
+}
+
+// handleAdminHistory returns the history of a session, also after it is gone.
+func handleAdminHistory(w http.ResponseWriter, r *http.Request, id string) {
+	history, ok := findHistory(id)
+	if !ok {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(history)
+}
+
+// readRTCP reads the RTCP of every sender of session, receivers are read once
+// their track arrives. Pion only runs RTCP through interceptors when it is
+// read, and nothing else here does. Keyframe requests of viewers are passed
+// on to rooms that only ask the broadcaster for keyframes on request.
+func readRTCP(session *session) {
+	for _, transceiver := range session.peerConnection.GetTransceivers() {
+		if sender := transceiver.Sender(); sender != nil {
+			kind := transceiver.Kind()
+			supervise("RTCP reader", session, func() {
+				for {
+					packets, _, err := sender.ReadRTCP()
+					if err != nil {
+						return
+					} else if asksForKeyframe(packets) {
+						session.room.requestKeyframe()
+						if kind == webrtc.RTPCodecTypeVideo {
+							noteKeyframeRequest(session)
+						}
+					}
+				}
+			})
+		}
+	}
+}
+
+type historyInterceptorFactory struct {
+	session *session
+}
+
+func (f *historyInterceptorFactory) NewInterceptor(string) (interceptor.Interceptor, error) {
+	return &historyInterceptor{session: f.session}, nil
+}
+
+// historyInterceptor records RTCP that suggests something is wrong: packets
+// that can't be parsed and reports of heavy loss.
+type historyInterceptor struct {
+	interceptor.NoOp
+	session *session
+
+	mu          sync.Mutex
+	lastAnomaly time.Time
+}
+
+func (i *historyInterceptor) BindRTCPReader(reader interceptor.RTCPReader) interceptor.RTCPReader {
+	return interceptor.RTCPReaderFunc(func(b []byte, attributes interceptor.Attributes) (int, interceptor.Attributes, error) {
+		n, attributes, err := reader.Read(b, attributes)
+		if err != nil {
+			return n, attributes, err
+		}
+
+		pkts, unmarshalErr := rtcp.Unmarshal(b[:n])
+		if unmarshalErr != nil {
+			i.anomaly("malformed RTCP: %v", unmarshalErr)
+			return n, attributes, err
+		}
+
+		for _, pkt := range pkts {
+			var reports []rtcp.ReceptionReport
+			switch pkt := pkt.(type) {
+			case *rtcp.ReceiverReport:
+				reports = pkt.Reports
+			case *rtcp.SenderReport:
+				reports = pkt.Reports
+			}
+
+			for _, report := range reports {
+				if report.FractionLost >= highFractionLost {
+					i.anomaly("%d%% loss reported for SSRC %d", int(report.FractionLost)*100/256, report.SSRC)
+				}
+			}
+		}
+		return n, attributes, err
+	})
+}
+
+func (i *historyInterceptor) anomaly(format string, args ...any) {
+	i.mu.Lock()
+	if time.Since(i.lastAnomaly) < rtcpAnomalyInterval {
+		i.mu.Unlock()
+		return
+	}
+	i.lastAnomaly = time.Now()
+	i.mu.Unlock()
+
+	recordHistory(i.session, historyRTCP, format, args...)
+}
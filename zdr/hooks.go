@@ -0,0 +1,181 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// SessionInfo describes a session to hooks.
+type SessionInfo struct {
+	ID          string
+	Room        string
+	Broadcaster bool
+
+	// Principal is who created the session, empty without an auth provider.
+	Principal Principal
+}
+
+// HookError rejects a request from a hook with an HTTP status code, like 401
+// for failed authentication or 429 for an exceeded quota. Any other error
+// returned by a hook is answered with 403.
+type HookError struct {
+	Code    int
+	Message string
+}
+
+func (e *HookError) Error() string {
+	return e.Message
+}
+
+// PreOfferHook runs before a session is created for offer. It may change
+// the offer, or return an error to refuse it.
+type PreOfferHook func(r *http.Request, room string, offer *webrtc.SessionDescription) error
+
+// PostAnswerHook runs before the answer is sent. It may change the answer
+// the client receives, or return an error to close the session instead.
+type PostAnswerHook func(r *http.Request, info SessionInfo, answer *webrtc.SessionDescription) error
+
+// SessionHook runs when a session connects or disconnects.
+type SessionHook func(info SessionInfo)
+
+// PreCheckpointHook runs before every snapshot is written. An error skips
+// writing it.
+type PreCheckpointHook func(ctx context.Context) error
+
+// PostRestoreHook runs for every session found in the snapshot or journal at
+// startup, err is nil if it was resumed.
+type PostRestoreHook func(info SessionInfo, err error)
+
+// hooks are run in the order they were added, the first error stops the
+// chain. Connect, disconnect and checkpoint hooks run while sessions are
+// locked, so they must not block or call back into the Server.
+var hooks struct {
+	sync.RWMutex
+	preOffer      []PreOfferHook
+	postAnswer    []PostAnswerHook
+	connect       []SessionHook
+	disconnect    []SessionHook
+	preCheckpoint []PreCheckpointHook
+	postRestore   []PostRestoreHook
+}
+
+// OnPreOffer adds a hook run before a session is created.
+func (s *Server) OnPreOffer(hook PreOfferHook) {
+	hooks.Lock()
+	defer hooks.Unlock()
+	hooks.preOffer = append(hooks.preOffer, hook)
+}
+
+// OnPostAnswer adds a hook run before an answer is sent.
+func (s *Server) OnPostAnswer(hook PostAnswerHook) {
+	hooks.Lock()
+	defer hooks.Unlock()
+	hooks.postAnswer = append(hooks.postAnswer, hook)
+}
+
+// OnConnect adds a hook run when a session connects.
+func (s *Server) OnConnect(hook SessionHook) {
+	hooks.Lock()
+	defer hooks.Unlock()
+	hooks.connect = append(hooks.connect, hook)
+}
+
+// OnDisconnect adds a hook run when a connected session fails or is closed.
+func (s *Server) OnDisconnect(hook SessionHook) {
+	hooks.Lock()
+	defer hooks.Unlock()
+	hooks.disconnect = append(hooks.disconnect, hook)
+}
+
+// OnPreCheckpoint adds a hook run before a snapshot is written.
+func (s *Server) OnPreCheckpoint(hook PreCheckpointHook) {
+	hooks.Lock()
+	defer hooks.Unlock()
+	hooks.preCheckpoint = append(hooks.preCheckpoint, hook)
+}
+
+// OnPostRestore adds a hook run for every session resumed at startup. It
+// must be added before Start.
+func (s *Server) OnPostRestore(hook PostRestoreHook) {
+	hooks.Lock()
+	defer hooks.Unlock()
+	hooks.postRestore = append(hooks.postRestore, hook)
+}
+
+func (s *session) info() SessionInfo {
+	return SessionInfo{ID: s.id, Room: s.room.id, Broadcaster: s.broadcaster, Principal: s.principal}
+}
+
+func runPreOfferHooks(r *http.Request, room string, offer *webrtc.SessionDescription) error {
+	hooks.RLock()
+	defer hooks.RUnlock()
+	for _, hook := range hooks.preOffer {
+		if err := hook(r, room, offer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runPostAnswerHooks(r *http.Request, info SessionInfo, answer *webrtc.SessionDescription) error {
+	hooks.RLock()
+	defer hooks.RUnlock()
+	for _, hook := range hooks.postAnswer {
+		if err := hook(r, info, answer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runConnectHooks(info SessionInfo) {
+	hooks.RLock()
+	defer hooks.RUnlock()
+	for _, hook := range hooks.connect {
+		hook(info)
+	}
+}
+
+func runDisconnectHooks(info SessionInfo) {
+	hooks.RLock()
+	defer hooks.RUnlock()
+	for _, hook := range hooks.disconnect {
+		hook(info)
+	}
+}
+
+func runPreCheckpointHooks(ctx context.Context) error {
+	hooks.RLock()
+	defer hooks.RUnlock()
+	for _, hook := range hooks.preCheckpoint {
+		if err := hook(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runPostRestoreHooks(info SessionInfo, err error) {
+	hooks.RLock()
+	defer hooks.RUnlock()
+	for _, hook := range hooks.postRestore {
+		hook(info, err)
+	}
+}
+
+// hookError answers a request refused by a hook.
+func hookError(w http.ResponseWriter, err error) {
+	var hookErr *HookError
+	if errors.As(err, &hookErr) {
+		http.Error(w, hookErr.Message, hookErr.Code)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusForbidden)
+}
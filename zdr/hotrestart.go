@@ -0,0 +1,473 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// hotRestartEnv is set in the environment of a process started by a hot
+	// restart, which then takes over what its parent hands it on
+	// hotRestartControlFD and hotRestartStateFD.
+	hotRestartEnv = "ZDR_HOT_RESTART"
+
+	// hotRestartControlFD is a datagram socket the parent sends the sockets
+	// over, the child acknowledges on it once it resumed the sessions.
+	hotRestartControlFD = 3
+
+	// hotRestartStateFD is a pipe the parent writes the snapshot to.
+	hotRestartStateFD = 4
+
+	// hotRestartMaxFiles is how many sockets go in one message, below the
+	// limit of the kernel on descriptors in one.
+	hotRestartMaxFiles = 64
+
+	// hotRestartAck is what the child acknowledges with, anything else is
+	// why it failed.
+	hotRestartAck = "ok"
+)
+
+var (
+	// ErrHotRestart is returned by HotRestart when the new process failed to
+	// take over, this one then carries on serving.
+	ErrHotRestart = errors.New("zdr: hot restart failed")
+
+	errHotRestartUnsupported = errors.New("hot restarts aren't supported on this platform")
+
+	hotRestarts      = newCounter("hot_restarts_total", "Hot restarts this process handed its sessions over in.")
+	inheritedSockets = newCounter("hot_restart_sockets_total", "Sockets taken over from the previous process by a hot restart.")
+
+	// handedOver is set once a hot restart handed the state over or a
+	// drain with -reuseport-drain started, the new process saves the
+	// snapshots from then on.
+	handedOver atomic.Bool
+
+	// inherited is what the previous process handed over, empty unless this
+	// one was started by a hot restart.
+	inherited = &inheritance{conns: map[string]*net.UDPConn{}, listeners: map[string]net.Listener{}}
+
+	// listeners are those of Server.Listen, handed over in turn.
+	listeners      []listenedSocket
+	listenersMutex sync.Mutex
+)
+
+// hotRestartSocket describes a socket sent along with a hotRestartMessage.
+type hotRestartSocket struct {
+	Network string
+	Address string
+
+	// Listener is set for the listeners of Server.Listen, the others are
+	// ICE sockets.
+	Listener bool
+
+	// Activated is set for the UDP sockets systemd passed, see activation.
+	Activated bool
+}
+
+// hotRestartMessage is a datagram of the control socket, its sockets
+// attached in the same order.
+type hotRestartMessage struct {
+	Sockets []hotRestartSocket
+
+	// Done is set on the last one, the snapshot follows on the pipe.
+	Done bool
+}
+
+type listenedSocket struct {
+	network, address string
+	listener         net.Listener
+}
+
+// inheritance holds what a hot restart handed over until it is taken.
+type inheritance struct {
+	mu        sync.Mutex
+	conns     map[string]*net.UDPConn
+	listeners map[string]net.Listener
+	state     []byte
+	control   io.WriteCloser
+}
+
+// HotRestart hands every session over to a new process running binary with
+// the arguments and environment of this one, without the ports being
+// unbound in between: the ICE sockets and the listeners of Listen are passed
+// to it with SCM_RIGHTS and the snapshot over a pipe. binary is probed first,
+// like for Upgrade. It returns nil once the new process resumed the sessions
+// and this one should exit right away, until then both read from the same
+// sockets. If the new process fails, it is killed and this one carries on.
+func (s *Server) HotRestart(ctx context.Context, binary string) error {
+	if err := s.Checkpoint(); err != nil {
+		return err
+	} else if err = probeBinary(ctx, binary); err != nil {
+		return err
+	} else if err = s.Handoff(); err != nil {
+		handingOff.Store(false)
+		return err
+	}
+
+	if err := hotRestart(ctx, binary); err != nil {
+		handedOver.Store(false)
+		handingOff.Store(false)
+		return fmt.Errorf("%w: %v", ErrHotRestart, err)
+	}
+	hotRestarts.Inc()
+	return nil
+}
+
+func hotRestart(ctx context.Context, binary string) error {
+	sessionsMutex.Lock()
+	state, err := snapshotState(ctx)
+	var data []byte
+	if err == nil {
+		data, err = encodeSnapshot(state)
+	}
+	var sockets []hotRestartSocket
+	var files []*os.File
+	if err == nil {
+		sockets, files, err = handedSockets()
+	}
+	if err == nil {
+		handedOver.Store(true)
+	}
+	sessionsMutex.Unlock()
+	defer closeFiles(files)
+	if err != nil {
+		return err
+	}
+
+	control, childControl, err := newControlPair()
+	if err != nil {
+		return err
+	}
+	defer control.Close()
+	stateReader, stateWriter, err := os.Pipe()
+	if err != nil {
+		childControl.Close()
+		return err
+	}
+
+	cmd := exec.Command(binary, os.Args[1:]...) //nolint:gosec
+	cmd.Env = append(os.Environ(), hotRestartEnv+"=1")
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.ExtraFiles = []*os.File{childControl, stateReader}
+	err = cmd.Start()
+	childControl.Close()
+	stateReader.Close()
+	if err != nil {
+		stateWriter.Close()
+		return err
+	}
+
+	logf("Hot restarting into %s, process %d, handing over %d sockets\n", binary, cmd.Process.Pid, len(sockets))
+	if err = handOver(control, stateWriter, sockets, files, data); err != nil {
+		if killErr := cmd.Process.Kill(); killErr != nil {
+			logf("Failed to kill process %d: %v\n", cmd.Process.Pid, killErr)
+		}
+		_ = cmd.Wait()
+		return err
+	}
+	return nil
+}
+
+// handedSockets returns the ICE sockets of every session and the listeners
+// of Listen, duplicated to be sent. sessionsMutex must be held.
+func handedSockets() ([]hotRestartSocket, []*os.File, error) {
+	var sockets []hotRestartSocket
+	var files []*os.File
+	for _, session := range sessions {
+		for _, conn := range session.buffers.open() {
+			file, err := conn.File()
+			if err != nil {
+				closeFiles(files)
+				return nil, nil, err
+			}
+			sockets = append(sockets, hotRestartSocket{Network: "udp", Address: conn.LocalAddr().String()})
+			files = append(files, file)
+		}
+	}
+
+	activated.mu.Lock()
+	for _, conn := range activated.conns {
+		file, err := conn.File()
+		if err != nil {
+			activated.mu.Unlock()
+			closeFiles(files)
+			return nil, nil, err
+		}
+		sockets = append(sockets, hotRestartSocket{Network: "udp", Address: conn.LocalAddr().String(), Activated: true})
+		files = append(files, file)
+	}
+	activated.mu.Unlock()
+
+	listenersMutex.Lock()
+	defer listenersMutex.Unlock()
+	for _, l := range listeners {
+		filer, ok := l.listener.(interface{ File() (*os.File, error) })
+		if !ok {
+			logf("Warning: not handing over the listener on %s, it has no file\n", l.address)
+			continue
+		}
+		file, err := filer.File()
+		if err != nil {
+			closeFiles(files)
+			return nil, nil, err
+		}
+		sockets = append(sockets, hotRestartSocket{Network: l.network, Address: l.address, Listener: true})
+		files = append(files, file)
+	}
+	return sockets, files, nil
+}
+
+// handOver sends the sockets over control, writes data to the pipe, then
+// waits for the new process to acknowledge it resumed the sessions, which
+// takes up to its -restore-timeout.
+func handOver(control *net.UnixConn, stateWriter *os.File, sockets []hotRestartSocket, files []*os.File, data []byte) error {
+	written := make(chan error, 1)
+	go func() {
+		_, err := stateWriter.Write(data)
+		if closeErr := stateWriter.Close(); err == nil {
+			err = closeErr
+		}
+		written <- err
+	}()
+
+	for first := true; first || len(sockets) > 0; first = false {
+		n := len(sockets)
+		if n > hotRestartMaxFiles {
+			n = hotRestartMaxFiles
+		}
+		message, err := json.Marshal(hotRestartMessage{Sockets: sockets[:n], Done: n == len(sockets)})
+		if err != nil {
+			return err
+		} else if err = sendFiles(control, message, files[:n]); err != nil {
+			return err
+		}
+		sockets, files = sockets[n:], files[n:]
+	}
+
+	if err := control.SetReadDeadline(time.Now().Add(config.RestoreTimeout + handoffProbeTimeout)); err != nil {
+		return err
+	}
+	ack := make([]byte, 1024)
+	n, err := control.Read(ack)
+	if err != nil {
+		return fmt.Errorf("no acknowledgement from the new process: %v", err)
+	} else if string(ack[:n]) != hotRestartAck {
+		return fmt.Errorf("new process failed: %s", ack[:n])
+	}
+	return <-written
+}
+
+func closeFiles(files []*os.File) {
+	for _, file := range files {
+		file.Close()
+	}
+}
+
+// receiveHotRestart takes over what the previous process hands over if this
+// one was started by a hot restart. The snapshot is then resumed by Start in
+// place of the one in the store.
+func receiveHotRestart() error {
+	if os.Getenv(hotRestartEnv) == "" {
+		return nil
+	}
+	// A later hot restart or upgrade must not take itself for one.
+	os.Unsetenv(hotRestartEnv)
+
+	control, err := openControl()
+	if err != nil {
+		return err
+	}
+
+	inherited.mu.Lock()
+	defer inherited.mu.Unlock()
+	for done := false; !done; {
+		data, files, err := receiveFiles(control)
+		if err != nil {
+			return err
+		}
+		message := hotRestartMessage{}
+		if err = json.Unmarshal(data, &message); err != nil {
+			closeFiles(files)
+			return err
+		} else if len(files) != len(message.Sockets) {
+			closeFiles(files)
+			return fmt.Errorf("hot restart sent %d sockets, described %d", len(files), len(message.Sockets))
+		}
+
+		for i, socket := range message.Sockets {
+			if err = inherit(socket, files[i]); err != nil {
+				logf("Warning: not taking over %s %s: %v\n", socket.Network, socket.Address, err)
+			}
+		}
+		closeFiles(files)
+		done = message.Done
+	}
+
+	stateFile := os.NewFile(hotRestartStateFD, "hot restart state")
+	defer stateFile.Close()
+	if inherited.state, err = io.ReadAll(stateFile); err != nil {
+		return err
+	}
+	inherited.control = control
+	logf("Hot restarted, took over %d sockets and %d listeners\n", len(inherited.conns), len(inherited.listeners))
+	return nil
+}
+
+// inherit keeps the socket of file to be taken over. inherited.mu must be
+// held.
+func inherit(socket hotRestartSocket, file *os.File) error {
+	if socket.Listener {
+		listener, err := net.FileListener(file)
+		if err != nil {
+			return err
+		}
+		inherited.listeners[socket.Network+" "+socket.Address] = listener
+		return nil
+	}
+
+	if socket.Activated {
+		activated.mu.Lock()
+		defer activated.mu.Unlock()
+		return activated.add(file)
+	}
+
+	conn, err := net.FilePacketConn(file)
+	if err != nil {
+		return err
+	}
+	udp, ok := conn.(*net.UDPConn)
+	if !ok {
+		conn.Close()
+		return fmt.Errorf("not a UDP socket")
+	}
+	inherited.conns[socketKey(udp.LocalAddr().(*net.UDPAddr))] = udp
+	return nil
+}
+
+// socketKey identifies a UDP socket by the address it is bound to, any
+// unspecified address being the same.
+func socketKey(addr *net.UDPAddr) string {
+	ip := ""
+	if addr.IP != nil && !addr.IP.IsUnspecified() {
+		ip = addr.IP.String()
+	}
+	return net.JoinHostPort(ip, strconv.Itoa(addr.Port))
+}
+
+// takeInheritedConn returns the socket the previous process handed over
+// for addr, or bound to any address on its port, nil if there is none. Each
+// is taken once.
+func takeInheritedConn(addr *net.UDPAddr) *net.UDPConn {
+	if addr == nil {
+		return nil
+	}
+	inherited.mu.Lock()
+	defer inherited.mu.Unlock()
+	for _, key := range []string{socketKey(addr), socketKey(&net.UDPAddr{Port: addr.Port})} {
+		if conn := inherited.conns[key]; conn != nil {
+			delete(inherited.conns, key)
+			inheritedSockets.Inc()
+			return conn
+		}
+	}
+	return nil
+}
+
+// inheritedPort tells whether a session can be resumed on port while a hot
+// restart takes over: nil if a socket handed over is bound to it, an error
+// if none is, the previous process holding the port until it exits. ok is
+// false outside of a hot restart.
+func inheritedPort(port uint16) (ok bool, err error) {
+	inherited.mu.Lock()
+	defer inherited.mu.Unlock()
+	if inherited.control == nil {
+		return false, nil
+	}
+	for _, conn := range inherited.conns {
+		if conn.LocalAddr().(*net.UDPAddr).Port == int(port) {
+			return true, nil
+		}
+	}
+	return true, fmt.Errorf("%w: %d: held by the previous process", ErrPortUnavailable, port)
+}
+
+// inheritedState returns the snapshot the previous process handed over, and
+// false if there is none or it doesn't decode, the store is then used.
+func inheritedState() (GlobalState, bool) {
+	inherited.mu.Lock()
+	buffer := inherited.state
+	inherited.state = nil
+	inherited.mu.Unlock()
+	if buffer == nil {
+		return GlobalState{}, false
+	}
+
+	state, err := decodeSnapshot(buffer)
+	if err != nil {
+		logf("Warning: skipping the snapshot handed over, resuming from the store: %v\n", err)
+		return GlobalState{}, false
+	}
+	return state, true
+}
+
+// ackHotRestart tells the previous process the sessions are resumed, so it
+// exits, and closes the sockets no session took over. It reports whether
+// this process was started by a hot restart.
+func ackHotRestart() bool {
+	inherited.mu.Lock()
+	defer inherited.mu.Unlock()
+	if inherited.control == nil {
+		return false
+	}
+
+	for key, conn := range inherited.conns {
+		conn.Close()
+		delete(inherited.conns, key)
+	}
+	if _, err := inherited.control.Write([]byte(hotRestartAck)); err != nil {
+		logf("Failed to acknowledge the hot restart: %v\n", err)
+	}
+	inherited.control.Close()
+	inherited.control = nil
+	return true
+}
+
+// Listen returns a listener on address for the handlers to be served on.
+// In a process started by HotRestart it is the one the previous process
+// listened on, so connections keep being accepted throughout, and in one
+// started by systemd socket activation the first stream socket it passed for
+// network, whatever address. Listeners it returns are handed over in turn.
+func (s *Server) Listen(network, address string) (net.Listener, error) {
+	inherited.mu.Lock()
+	listener := inherited.listeners[network+" "+address]
+	delete(inherited.listeners, network+" "+address)
+	inherited.mu.Unlock()
+
+	if listener == nil {
+		listener = takeActivatedListener(network)
+	}
+	if listener == nil {
+		var err error
+		if listener, err = net.Listen(network, address); err != nil {
+			return nil, err
+		}
+	}
+
+	listenersMutex.Lock()
+	defer listenersMutex.Unlock()
+	listeners = append(listeners, listenedSocket{network: network, address: address, listener: listener})
+	return listener, nil
+}
@@ -0,0 +1,28 @@
+//go:build !js && windows
+// +build !js,windows
+
+package zdr
+
+import (
+	"net"
+	"os"
+)
+
+// HotRestartSignal is nil, hot restarts need SCM_RIGHTS.
+var HotRestartSignal os.Signal
+
+func newControlPair() (*net.UnixConn, *os.File, error) {
+	return nil, nil, errHotRestartUnsupported
+}
+
+func openControl() (*net.UnixConn, error) {
+	return nil, errHotRestartUnsupported
+}
+
+func sendFiles(*net.UnixConn, []byte, []*os.File) error {
+	return errHotRestartUnsupported
+}
+
+func receiveFiles(*net.UnixConn) ([]byte, []*os.File, error) {
+	return nil, nil, errHotRestartUnsupported
+}
@@ -0,0 +1,94 @@
+//go:build !js && !windows
+// +build !js,!windows
+
+package zdr
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+)
+
+// HotRestartSignal is the signal the command hot restarts on, nil where
+// hot restarts aren't supported.
+var HotRestartSignal os.Signal = syscall.SIGUSR2
+
+// newControlPair returns the control socket of a hot restart, and its other
+// end for the new process.
+func newControlPair() (*net.UnixConn, *os.File, error) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	syscall.CloseOnExec(fds[0])
+	syscall.CloseOnExec(fds[1])
+
+	control, err := fileUnixConn(os.NewFile(uintptr(fds[0]), "hot restart control"))
+	if err != nil {
+		syscall.Close(fds[1])
+		return nil, nil, err
+	}
+	return control, os.NewFile(uintptr(fds[1]), "hot restart control"), nil
+}
+
+// openControl returns the control socket a hot restart started this process
+// with.
+func openControl() (*net.UnixConn, error) {
+	return fileUnixConn(os.NewFile(hotRestartControlFD, "hot restart control"))
+}
+
+func fileUnixConn(file *os.File) (*net.UnixConn, error) {
+	defer file.Close()
+	conn, err := net.FileConn(file)
+	if err != nil {
+		return nil, err
+	}
+	unix, ok := conn.(*net.UnixConn)
+	if !ok {
+		conn.Close()
+		return nil, fmt.Errorf("%s is not a unix socket", file.Name())
+	}
+	return unix, nil
+}
+
+// sendFiles sends data with files attached as SCM_RIGHTS.
+func sendFiles(conn *net.UnixConn, data []byte, files []*os.File) error {
+	fds := make([]int, len(files))
+	for i, file := range files {
+		fds[i] = int(file.Fd())
+	}
+	var oob []byte
+	if len(fds) > 0 {
+		oob = syscall.UnixRights(fds...)
+	}
+	_, _, err := conn.WriteMsgUnix(data, oob, nil)
+	return err
+}
+
+// receiveFiles receives what sendFiles sent.
+func receiveFiles(conn *net.UnixConn) ([]byte, []*os.File, error) {
+	data := make([]byte, 64<<10)
+	oob := make([]byte, syscall.CmsgSpace(hotRestartMaxFiles*4))
+	n, oobn, _, _, err := conn.ReadMsgUnix(data, oob)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	messages, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return nil, nil, err
+	}
+	var files []*os.File
+	for i := range messages {
+		fds, err := syscall.ParseUnixRights(&messages[i])
+		if err != nil {
+			closeFiles(files)
+			return nil, nil, err
+		}
+		for _, fd := range fds {
+			files = append(files, os.NewFile(uintptr(fd), "hot restart socket"))
+		}
+	}
+	return data[:n], files, nil
+}
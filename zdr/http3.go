@@ -0,0 +1,205 @@
+//go:build !js && http3
+// +build !js,http3
+
+package zdr
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/webtransport-go"
+)
+
+// webTransportMaxOffer bounds the offer a signaling stream may send.
+const webTransportMaxOffer = 1 << 20
+
+var (
+	webTransportSessions = newCounter("webtransport_sessions_total", "WebTransport signaling channels opened.")
+	webTransportOffers   = newCounter("webtransport_offers_total", "Offers answered over WebTransport signaling channels.")
+)
+
+// webTransportAnswer is what a signaling stream of /webtransport is sent
+// back, the answer of /doSignaling or the error it failed with.
+type webTransportAnswer struct {
+	Status     int
+	Session    string          `json:",omitempty"`
+	Generation uint64          `json:",omitempty"`
+	Answer     json.RawMessage `json:",omitempty"`
+	Error      string          `json:",omitempty"`
+}
+
+// ServeHTTP3 serves every endpoint over HTTP/3 on the UDP address addr,
+// with the certificate and key of certFile and keyFile, along with the
+// WebTransport signaling channel of /webtransport. The port is bound once
+// the previous process released it, for up to Config.PortReacquireWindow.
+// It only returns on failure.
+func (s *Server) ServeHTTP3(addr, certFile, keyFile string) error {
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("zdr: http3: %w", err)
+	}
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return fmt.Errorf("zdr: http3: %w", err)
+	} else if err = waitForPort(context.Background(), uint16(udpAddr.Port)); err != nil {
+		return fmt.Errorf("zdr: http3: %w", err)
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return fmt.Errorf("zdr: http3: %w", err)
+	}
+
+	server := &webtransport.Server{
+		H3: http3.Server{TLSConfig: http3.ConfigureTLSConfig(&tls.Config{
+			Certificates: []tls.Certificate{certificate},
+			MinVersion:   tls.VersionTLS13,
+		})},
+		// Channels are authorized like /doSignaling and /events, pages
+		// served over HTTP/1.1 are another origin.
+		CheckOrigin: func(*http.Request) bool { return true },
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/", s.mux)
+	mux.HandleFunc("/webtransport", func(w http.ResponseWriter, r *http.Request) {
+		handleWebTransport(server, w, r)
+	})
+	server.H3.Handler = recoverHandler(mux)
+
+	logf("Serving HTTP/3 on %s\n", conn.LocalAddr())
+	return server.Serve(conn)
+}
+
+// handleWebTransport serves /webtransport, a signaling channel over
+// WebTransport. Every bidirectional stream the client opens carries an offer
+// as /doSignaling takes it and is sent back a webTransportAnswer. The events
+// of the session created, or of the session in the id query parameter when
+// reconnecting after a restart, are pushed on a unidirectional stream as
+// lines of JSON, {"Name": "reconnect", "Data": null}.
+func handleWebTransport(server *webtransport.Server, w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if id != "" {
+		if err := authorizeEvents(r, id); err != nil {
+			authError(w, err)
+			return
+		}
+	}
+
+	channel, err := server.Upgrade(w, r)
+	if err != nil {
+		logf("Failed to open WebTransport channel: %v\n", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	webTransportSessions.Inc()
+	ctx := channel.Context()
+	if id != "" {
+		go pushEvents(ctx, channel, id)
+	}
+
+	for {
+		stream, err := channel.AcceptStream(ctx)
+		if err != nil {
+			return
+		}
+		if created := answerStream(r, stream, id); created != "" && created != id {
+			id = created
+			go pushEvents(ctx, channel, id)
+		}
+	}
+}
+
+// answerStream answers the offer of stream through doSignaling, with the
+// headers of the request that opened the channel, and returns the session
+// it answered for. Offers after the first renegotiate the session of the
+// channel, like those sent with X-Session-ID.
+func answerStream(connect *http.Request, stream webtransport.Stream, id string) string {
+	defer stream.Close()
+
+	r, err := http.NewRequestWithContext(connect.Context(), http.MethodPost, "/doSignaling?"+connect.URL.RawQuery, io.LimitReader(stream, webTransportMaxOffer))
+	if err != nil {
+		return ""
+	}
+	r.Header = connect.Header.Clone()
+	r.RemoteAddr = connect.RemoteAddr
+	if id != "" {
+		r.Header.Set("X-Session-ID", id)
+	}
+
+	response := &streamResponse{header: http.Header{}, status: http.StatusOK}
+	runRecovered("answering WebTransport offer", func() { doSignaling(response, r) })
+	webTransportOffers.Inc()
+
+	answer := webTransportAnswer{Status: response.status}
+	if response.status/100 == 2 {
+		answer.Session = response.header.Get("X-Session-ID")
+		answer.Generation, _ = strconv.ParseUint(response.header.Get("X-Restart-Generation"), 10, 64)
+		answer.Answer = response.body.Bytes()
+	} else {
+		answer.Error = string(bytes.TrimSpace(response.body.Bytes()))
+	}
+	if err = json.NewEncoder(stream).Encode(&answer); err != nil {
+		logf("Failed to write WebTransport answer: %v\n", err)
+	}
+	return answer.Session
+}
+
+// pushEvents writes the events of id to a stream of channel until it
+// closes.
+func pushEvents(ctx context.Context, channel *webtransport.Session, id string) {
+	events, stop := listenEvents(id)
+	defer stop()
+
+	stream, err := channel.OpenUniStreamSync(ctx)
+	if err != nil {
+		return
+	}
+	defer stream.Close()
+	// A stream is only announced with its first write, the client can't
+	// tell it's listening before then.
+	if _, err = stream.Write(nil); err != nil {
+		return
+	}
+
+	encoder := json.NewEncoder(stream)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-events:
+			if err := encoder.Encode(&e); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// streamResponse collects what a handler writes, for answering on a stream.
+type streamResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+	wrote  bool
+}
+
+func (r *streamResponse) Header() http.Header {
+	return r.header
+}
+
+func (r *streamResponse) WriteHeader(status int) {
+	if !r.wrote {
+		r.status, r.wrote = status, true
+	}
+}
+
+func (r *streamResponse) Write(b []byte) (int, error) {
+	r.wrote = true
+	return r.body.Write(b)
+}
@@ -0,0 +1,15 @@
+//go:build !js && !http3
+// +build !js,!http3
+
+package zdr
+
+import "errors"
+
+var errHTTP3Unsupported = errors.New("zdr: http3: built without HTTP/3, build with -tags http3")
+
+// ServeHTTP3 serves every endpoint over HTTP/3, along with a WebTransport
+// signaling channel, in binaries built with the http3 tag. This one wasn't,
+// so it fails right away.
+func (s *Server) ServeHTTP3(addr, certFile, keyFile string) error {
+	return errHTTP3Unsupported
+}
@@ -0,0 +1,154 @@
+//go:build !js && http3
+// +build !js,http3
+
+package zdr
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/webtransport-go"
+)
+
+// writeCertificate writes a self-signed certificate for 127.0.0.1 and its
+// key to dir.
+func writeCertificate(t *testing.T, dir string) (string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	} else if err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// freeUDPPort returns a port nothing is bound to right now.
+func freeUDPPort(t *testing.T) int {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// TestWebTransportSignaling signals a viewer over /webtransport and checks
+// the events of its session are pushed on the channel.
+func TestWebTransportSignaling(t *testing.T) {
+	roomsMutex.Lock()
+	if rooms[defaultRoomID] == nil {
+		room, err := newRoom(RoomState{ID: defaultRoomID})
+		if err != nil {
+			roomsMutex.Unlock()
+			t.Fatal(err)
+		}
+		rooms[defaultRoomID] = room
+	}
+	roomsMutex.Unlock()
+	phase.Store(phaseServing)
+	t.Cleanup(func() { phase.Store(phaseStopped) })
+
+	certFile, keyFile := writeCertificate(t, t.TempDir())
+	addr := "127.0.0.1:" + strconv.Itoa(freeUDPPort(t))
+	server := &Server{mux: http.NewServeMux()}
+	served := make(chan error, 1)
+	go func() { served <- server.ServeHTTP3(addr, certFile, keyFile) }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	dialer := &webtransport.Dialer{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true, NextProtos: []string{http3.NextProtoH3}}, //nolint:gosec
+		QUICConfig:      &quic.Config{EnableDatagrams: true},
+	}
+	defer dialer.Close()
+	var channel *webtransport.Session
+	for channel == nil {
+		select {
+		case err := <-served:
+			t.Fatal(err)
+		case <-ctx.Done():
+			t.Fatal("WebTransport channel not opened")
+		case <-time.After(50 * time.Millisecond):
+		}
+		_, channel, _ = dialer.Dial(ctx, "https://"+addr+"/webtransport", nil)
+	}
+	defer channel.CloseWithError(0, "")
+
+	stream, err := channel.OpenStreamSync(ctx)
+	if err != nil {
+		t.Fatal(err)
+	} else if err = json.NewEncoder(stream).Encode(viewerOffer(t)); err != nil {
+		t.Fatal(err)
+	}
+	answer := webTransportAnswer{}
+	if err = json.NewDecoder(stream).Decode(&answer); err != nil {
+		t.Fatal(err)
+	} else if answer.Status != http.StatusOK || answer.Session == "" {
+		t.Fatalf("got status %d, session %q: %s", answer.Status, answer.Session, answer.Error)
+	}
+	description := webrtc.SessionDescription{}
+	if err = json.Unmarshal(answer.Answer, &description); err != nil {
+		t.Fatal(err)
+	} else if description.Type != webrtc.SDPTypeAnswer {
+		t.Fatalf("got a description of type %s", description.Type)
+	}
+	if session := findSession(answer.Session); session != nil {
+		t.Cleanup(func() { session.peerConnection.Close() })
+	}
+
+	events, err := channel.AcceptUniStream(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publishEvent(answer.Session, event{Name: "reconnect"})
+	received := event{}
+	line, err := bufio.NewReader(events).ReadBytes('\n')
+	if err != nil {
+		t.Fatal(err)
+	} else if err = json.Unmarshal(line, &received); err != nil {
+		t.Fatal(err)
+	} else if received.Name != "reconnect" {
+		t.Fatalf("got event %q", received.Name)
+	}
+}
@@ -0,0 +1,169 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// ingestPrimary and ingestBackup are the ingests a broadcaster can join a
+// room as, with ?ingest= on /doSignaling.
+const (
+	ingestPrimary = "primary"
+	ingestBackup  = "backup"
+)
+
+var (
+	errInvalidIngest = fmt.Errorf("ingest must be %q or %q", ingestPrimary, ingestBackup)
+
+	ingestFailovers = newCounter("ingest_failovers_total", "Rooms that put their other ingest on air after a gap in the media of the one on air.")
+)
+
+// ingestState is which of the primary and the backup broadcaster of a room
+// is on air. Both send all along, the one off air is dropped like the
+// broadcaster while a guest is on air. Once the one on air sent nothing for
+// -failover-gap while the other one sends, the other one goes on air: its
+// packets carry on from the last ones forwarded, on the outgoing SSRCs of
+// every viewer, and the choice is saved with the room.
+type ingestState struct {
+	backup atomic.Bool
+
+	// last is when media last came from the primary and the backup, in Unix
+	// nanoseconds.
+	last [2]atomic.Int64
+}
+
+// ingestName returns the ingest session joined as.
+func ingestName(backup bool) string {
+	if backup {
+		return ingestBackup
+	}
+	return ingestPrimary
+}
+
+// parseIngest returns whether name is the backup ingest, the primary one
+// if empty.
+func parseIngest(name string) (bool, error) {
+	switch name {
+	case "", ingestPrimary:
+		return false, nil
+	case ingestBackup:
+		return true, nil
+	}
+	return false, errInvalidIngest
+}
+
+// onAir reports whether the ingest of session is on air.
+func (i *ingestState) onAir(session *session) bool {
+	return session.backup == i.backup.Load()
+}
+
+// active returns the ingest on air.
+func (i *ingestState) active() string {
+	return ingestName(i.backup.Load())
+}
+
+// restore puts back the ingest on air of a snapshot. Neither has sent yet,
+// so the gap is counted from now and the other one doesn't take over before
+// the one on air had the time to reconnect.
+func (i *ingestState) restore(active string) {
+	i.backup.Store(active == ingestBackup)
+	now := time.Now().UnixNano()
+	i.last[0].Store(now)
+	i.last[1].Store(now)
+}
+
+// received is called for every packet of a broadcaster of room, it puts
+// session on air if the other ingest is past -failover-gap.
+func (i *ingestState) received(room *room, session *session, now time.Time) {
+	self, other := 0, 1
+	if session.backup {
+		self, other = 1, 0
+	}
+	i.last[self].Store(now.UnixNano())
+	if i.onAir(session) {
+		return
+	}
+
+	gap := now.Sub(time.Unix(0, i.last[other].Load()))
+	if gap < config.FailoverGap || !i.backup.CompareAndSwap(!session.backup, session.backup) {
+		return
+	}
+	failover(room, session, fmt.Sprintf("no media from the %s for %s", ingestName(!session.backup), gap.Round(time.Millisecond)))
+}
+
+// failover tells the room that the ingest of session is on air now.
+func failover(room *room, session *session, reason string) {
+	ingestFailovers.Inc()
+	logf("Room %s is on its %s ingest: %s\n", room.id, ingestName(session.backup), reason)
+	recordHistory(session, historyControl, "on air as the %s ingest: %s", ingestName(session.backup), reason)
+	room.publish(event{Name: "ingestFailover", Data: ingestName(session.backup)})
+	room.requestKeyframe()
+
+	// Packets keep coming in while it is saved.
+	go func() {
+		sessionsMutex.Lock()
+		defer sessionsMutex.Unlock()
+		if err := serialize(context.Background()); err != nil {
+			logf("Failed to serialize: %v\n", err)
+		}
+	}()
+}
+
+// handleAdminRoomIngest serves /admin/rooms/{id}/ingest, returning the ingest
+// on air and when each last sent media on GET. PUT or POST with a body like
+// {"Active": "backup"} puts that ingest on air.
+func handleAdminRoomIngest(w http.ResponseWriter, r *http.Request, room *room) {
+	switch r.Method {
+	case http.MethodGet:
+		last := func(i int) *time.Time {
+			if t := room.ingest.last[i].Load(); t != 0 {
+				at := time.Unix(0, t)
+				return &at
+			}
+			return nil
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Active                  string
+			LastPrimary, LastBackup *time.Time `json:",omitempty"`
+		}{room.ingest.active(), last(0), last(1)})
+	case http.MethodPut, http.MethodPost:
+		var in struct {
+			Active string
+		}
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		backup, err := parseIngest(in.Active)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if room.ingest.backup.Swap(backup) != backup {
+			logf("Room %s is on its %s ingest, as asked\n", room.id, ingestName(backup))
+			room.publish(event{Name: "ingestFailover", Data: ingestName(backup)})
+			room.requestKeyframe()
+		}
+
+		sessionsMutex.Lock()
+		err = serialize(r.Context())
+		sessionsMutex.Unlock()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,229 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+)
+
+const injectMTU = 1200
+
+var (
+	errBroadcasterLive  = errors.New("the broadcaster is sending media")
+	errUnsupportedCodec = errors.New("codec can't be packetized")
+	errE2EEInject       = errors.New("frames can't be injected into end-to-end encrypted media")
+
+	injectorsMutex sync.Mutex
+	injectors      = map[*webrtc.TrackLocalStaticRTP]*injector{}
+)
+
+// injector writes server generated frames, like a slate or an announcement,
+// into an output track. Packets carry on from the last sequence number and
+// timestamp the track sent so viewers see a single continuous stream.
+type injector struct {
+	mu        sync.Mutex
+	payloader rtp.Payloader
+	clockRate uint32
+
+	started   bool
+	seq       uint16
+	timestamp uint32
+	at        time.Time
+
+	// rebase is set once frames were injected. The next packet forwarded
+	// from the broadcaster is moved to carry on after them, and the offsets
+	// that takes are added to every packet forwarded from then on.
+	rebase          bool
+	seqOffset       uint16
+	timestampOffset uint32
+}
+
+func injectorFor(track *webrtc.TrackLocalStaticRTP) (*injector, error) {
+	injectorsMutex.Lock()
+	defer injectorsMutex.Unlock()
+
+	if i, ok := injectors[track]; ok {
+		return i, nil
+	}
+
+	var (
+		payloader rtp.Payloader
+		clockRate uint32
+	)
+	switch strings.ToLower(track.Codec().MimeType) {
+	case strings.ToLower(webrtc.MimeTypeVP8):
+		payloader, clockRate = &codecs.VP8Payloader{EnablePictureID: true}, 90000
+	case strings.ToLower(webrtc.MimeTypeVP9):
+		payloader, clockRate = &codecs.VP9Payloader{}, 90000
+	case strings.ToLower(webrtc.MimeTypeH264):
+		payloader, clockRate = &codecs.H264Payloader{}, 90000
+	case strings.ToLower(webrtc.MimeTypeOpus):
+		payloader, clockRate = &codecs.OpusPayloader{}, 48000
+	case strings.ToLower(webrtc.MimeTypePCMU), strings.ToLower(webrtc.MimeTypePCMA):
+		payloader, clockRate = &codecs.G711Payloader{}, 8000
+	case strings.ToLower(webrtc.MimeTypeG722):
+		payloader, clockRate = &codecs.G722Payloader{}, 8000
+	default:
+		return nil, fmt.Errorf("%w: %s", errUnsupportedCodec, track.Codec().MimeType)
+	}
+
+	i := &injector{payloader: payloader, clockRate: clockRate}
+	injectors[track] = i
+	return i, nil
+}
+
+// rewriteForwarded is called for a packet about to be forwarded from the
+// broadcaster. It moves the packet past any injected frames and remembers
+// its position so injected frames continue from it.
+func rewriteForwarded(track *webrtc.TrackLocalStaticRTP, packet *rtp.Packet) {
+	i, err := injectorFor(track)
+	if err != nil {
+		return
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	now := time.Now()
+	if i.rebase {
+		i.seqOffset = i.seq + 1 - packet.SequenceNumber
+		i.timestampOffset = i.timestamp + uint32(now.Sub(i.at).Seconds()*float64(i.clockRate)) - packet.Timestamp
+		i.rebase = false
+	}
+	packet.SequenceNumber += i.seqOffset
+	packet.Timestamp += i.timestampOffset
+	i.started, i.seq, i.timestamp, i.at = true, packet.SequenceNumber, packet.Timestamp, now
+}
+
+// rebaseForwarded makes the next packet forwarded to track carry on from the
+// last one sent, as the media comes from another sender from then on.
+func rebaseForwarded(track *webrtc.TrackLocalStaticRTP) {
+	i, err := injectorFor(track)
+	if err != nil {
+		return
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.rebase = i.started
+}
+
+// injectFrame packetizes a single encoded frame for the codec of track and
+// writes it. The timestamp follows the wall clock since the last packet.
+func injectFrame(track *webrtc.TrackLocalStaticRTP, frame []byte) error {
+	i, err := injectorFor(track)
+	if err != nil {
+		return err
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	now := time.Now()
+	if !i.started {
+		i.started, i.seq, i.timestamp = true, uint16(rand.Uint32()), rand.Uint32()
+	} else {
+		i.timestamp += uint32(now.Sub(i.at).Seconds() * float64(i.clockRate))
+	}
+	i.at, i.rebase = now, true
+
+	payloads := i.payloader.Payload(injectMTU, frame)
+	for n, payload := range payloads {
+		i.seq++
+		packet := &rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				Marker:         n == len(payloads)-1,
+				SequenceNumber: i.seq,
+				Timestamp:      i.timestamp,
+			},
+			Payload: payload,
+		}
+		recordSent(track, packet)
+		tapSent(track, packet)
+		if err = track.WriteRTP(packet); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// broadcasterLive reports whether the broadcaster of room sent media in the
+// last second. Injected frames would interleave with it.
+func broadcasterLive(room *room) bool {
+	return room.haveBroadcaster.Load() && time.Since(time.Unix(0, room.lastBroadcasterPacket.Load())) < time.Second
+}
+
+// handleAdminInject serves POST /admin/inject/{audio,video}?room={id}. The
+// body is one encoded frame in the codec of the track, sent to every viewer
+// of the room while its broadcaster is absent or still being restored. Video
+// goes to the viewers of the codec given with &codec=, by default the first
+// the room relays.
+func handleAdminInject(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	room := findRoom(r.URL.Query().Get("room"))
+	if room == nil {
+		http.Error(w, errRoomNotFound.Error(), http.StatusNotFound)
+		return
+	}
+
+	var track *webrtc.TrackLocalStaticRTP
+	switch strings.TrimPrefix(r.URL.Path, "/admin/inject/") {
+	case webrtc.RTPCodecTypeVideo.String():
+		codec := r.URL.Query().Get("codec")
+		if codec == "" {
+			codec = strings.TrimPrefix(room.defaultVideoCodec(), "video/")
+		}
+		if track = room.videoTrack("video/" + codec); track == nil {
+			http.Error(w, fmt.Sprintf("%v: %s", errUnsupportedCodec, codec), http.StatusNotImplemented)
+			return
+		}
+	case webrtc.RTPCodecTypeAudio.String():
+		track = room.audioTrack
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	if broadcasterLive(room) {
+		http.Error(w, errBroadcasterLive.Error(), http.StatusConflict)
+		return
+	} else if config.E2EEHeaderExtension != "" {
+		// Viewers would fail to decrypt frames we generated.
+		http.Error(w, errE2EEInject.Error(), http.StatusConflict)
+		return
+	}
+
+	frame, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = injectFrame(track, frame)
+	if errors.Is(err, errUnsupportedCodec) {
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	} else if err != nil {
+		// As with forwarding, a write error only affects some viewers.
+		logf("Failed to inject into track %s: %v\n", track.ID(), err)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,215 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/stats"
+	"github.com/pion/interceptor/pkg/twcc"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+
+	"webrtc-zero-downtime-reload/internal/pionadapter"
+)
+
+// Interceptors that can be enabled per role. "twcc" means sending feedback
+// to broadcasters and adding transport wide sequence numbers for viewers.
+// "gcc" estimates the bandwidth of viewers from their TWCC feedback, it
+// needs "twcc" and is for viewers only, as is "abs-send-time".
+const (
+	interceptorNACK        = "nack"
+	interceptorReports     = "reports"
+	interceptorTWCC        = "twcc"
+	interceptorStats       = "stats"
+	interceptorGCC         = "gcc"
+	interceptorAbsSendTime = "abs-send-time"
+)
+
+// parseInterceptors splits a -*-interceptors flag and rejects unknown names.
+func parseInterceptors(list string) ([]string, error) {
+	names := []string{}
+	for _, name := range strings.Split(list, ",") {
+		switch name = strings.TrimSpace(name); name {
+		case "":
+		case interceptorNACK, interceptorReports, interceptorTWCC, interceptorStats, interceptorGCC, interceptorAbsSendTime:
+			names = append(names, name)
+		default:
+			return nil, fmt.Errorf("unknown interceptor %q", name)
+		}
+	}
+	return names, nil
+}
+
+// hasInterceptor reports whether names enables name.
+func hasInterceptor(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// validateInterceptors checks the -*-interceptors flags.
+func validateInterceptors(broadcaster, viewer string) error {
+	names, err := parseInterceptors(broadcaster)
+	if err != nil {
+		return err
+	}
+	for _, name := range []string{interceptorGCC, interceptorAbsSendTime} {
+		if hasInterceptor(names, name) {
+			return fmt.Errorf("interceptor %q is for viewers only", name)
+		}
+	}
+
+	if names, err = parseInterceptors(viewer); err != nil {
+		return err
+	} else if hasInterceptor(names, interceptorGCC) && !hasInterceptor(names, interceptorTWCC) {
+		return fmt.Errorf("interceptor %q needs %q", interceptorGCC, interceptorTWCC)
+	}
+	return nil
+}
+
+// configureInterceptors adds the interceptors enabled for the role of
+// session, leaving out twcc for clients whose fingerprint rules it out.
+// Flags are validated at startup, errors here come from pion.
+func configureInterceptors(session *session, m *webrtc.MediaEngine, i *interceptor.Registry) error {
+	list := config.ViewerInterceptors
+	if session.broadcaster {
+		list = config.BroadcasterInterceptors
+	}
+
+	names, err := parseInterceptors(list)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		switch name {
+		case interceptorNACK:
+			err = webrtc.ConfigureNack(m, i)
+		case interceptorReports:
+			err = webrtc.ConfigureRTCPReports(i)
+		case interceptorTWCC:
+			if !session.fingerprint.useTWCC() {
+				continue
+			} else if session.broadcaster {
+				err = webrtc.ConfigureTWCCSender(m, i)
+			} else {
+				err = configureTWCCHeaderExtension(session, m, i, hasInterceptor(names, interceptorGCC))
+			}
+		case interceptorGCC:
+			// Added with the TWCC header extension.
+		case interceptorAbsSendTime:
+			err = configureAbsSendTime(m, i)
+		case interceptorStats:
+			var factory *stats.InterceptorFactory
+			if factory, err = stats.NewInterceptor(); err == nil {
+				factory.OnNewPeerConnection(func(_ string, getter stats.Getter) {
+					session.stats.Store(&getter)
+				})
+				i.Add(factory)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// configureTWCCHeaderExtension is webrtc.ConfigureTWCCHeaderExtensionSender,
+// except that it keeps hold of the sequence number so it can be saved. A
+// viewer seeing transport wide sequence numbers start over after a restart
+// would throw off its bandwidth estimation. With estimate set the bandwidth
+// estimator is added before it.
+func configureTWCCHeaderExtension(session *session, m *webrtc.MediaEngine, i *interceptor.Registry, estimate bool) error {
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio} {
+		if err := m.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: sdp.TransportCCURI}, kind); err != nil {
+			return err
+		}
+	}
+
+	if estimate {
+		estimator, err := configureGCC(session)
+		if err != nil {
+			return err
+		}
+		i.Add(estimator)
+	}
+
+	factory, err := twcc.NewHeaderExtensionInterceptor()
+	if err != nil {
+		return err
+	}
+
+	i.Add(&twccStateFactory{session: session, factory: factory})
+	return nil
+}
+
+type twccStateFactory struct {
+	session *session
+	factory *twcc.HeaderExtensionInterceptorFactory
+}
+
+func (f *twccStateFactory) NewInterceptor(id string) (interceptor.Interceptor, error) {
+	i, err := f.factory.NewInterceptor(id)
+	if err != nil {
+		return nil, err
+	}
+
+	next := pionadapter.Pion.TWCCSequence(i)
+	atomic.StoreUint32(next, f.session.twccRestored)
+	f.session.twccNext.Store(next)
+	return i, nil
+}
+
+// twccSequence returns the next transport wide sequence number of session,
+// 0 if it doesn't send any.
+func twccSequence(session *session) uint32 {
+	if next := session.twccNext.Load(); next != nil {
+		return atomic.LoadUint32(next)
+	}
+	return 0
+}
+
+// handleAdminStats returns the stats interceptor's view of every stream of a
+// session, keyed by SSRC.
+func handleAdminStats(w http.ResponseWriter, r *http.Request, session *session) {
+	getter := session.stats.Load()
+	if getter == nil {
+		http.Error(w, "stats are not enabled for this session", http.StatusNotFound)
+		return
+	}
+
+	out := map[uint32]*stats.Stats{}
+	for _, transceiver := range session.peerConnection.GetTransceivers() {
+		ssrcs := []uint32{}
+		if sender := transceiver.Sender(); sender != nil {
+			for _, encoding := range sender.GetParameters().Encodings {
+				ssrcs = append(ssrcs, uint32(encoding.SSRC))
+			}
+		}
+		if receiver := transceiver.Receiver(); receiver != nil {
+			for _, track := range receiver.Tracks() {
+				ssrcs = append(ssrcs, uint32(track.SSRC()))
+			}
+		}
+
+		for _, ssrc := range ssrcs {
+			if s := (*getter).Get(ssrc); s != nil {
+				out[ssrc] = s
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
@@ -0,0 +1,188 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media/samplebuilder"
+)
+
+var (
+	jitterLatePackets    = newCounter("jitter_buffer_late_packets_total", "Broadcaster packets dropped by the jitter buffer for arriving after the ones following them were forwarded.")
+	jitterSkippedPackets = newCounter("jitter_buffer_skipped_packets_total", "Broadcaster packets the jitter buffer gave up waiting for.")
+)
+
+// jitterState holds the jitter buffers of the tracks of a broadcaster, see
+// jitterBuffer. restored is the next sequence number of each SSRC saved in
+// the snapshot, so packets forwarded before the restart that are sent
+// again aren't forwarded a second time, in a burst out of order.
+type jitterState struct {
+	mu       sync.Mutex
+	buffers  map[uint32]*jitterBuffer
+	restored map[uint32]uint16
+}
+
+// buffer returns the jitter buffer of track, nil when jitter buffering is
+// off or the codec of the track can't be depacketized.
+func (j *jitterState) buffer(track *webrtc.TrackRemote) *jitterBuffer {
+	if config.JitterBuffer <= 0 {
+		return nil
+	}
+
+	var depacketizer rtp.Depacketizer
+	switch mimeType := track.Codec().MimeType; {
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP8):
+		depacketizer = &codecs.VP8Packet{}
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP9):
+		depacketizer = &codecs.VP9Packet{}
+	case strings.EqualFold(mimeType, webrtc.MimeTypeH264):
+		depacketizer = &codecs.H264Packet{}
+	case track.Kind() == webrtc.RTPCodecTypeAudio:
+		// Every audio packet is a frame of its own.
+		depacketizer = &codecs.OpusPacket{}
+	default:
+		return nil
+	}
+
+	b := &jitterBuffer{depth: uint16(config.JitterBuffer), pending: map[uint16]*rtp.Packet{}}
+	clockRate := track.Codec().ClockRate
+	b.newBuilder = func() *samplebuilder.SampleBuilder {
+		return samplebuilder.New(b.depth, depacketizer, clockRate, samplebuilder.WithPacketReleaseHandler(b.released))
+	}
+	b.builder = b.newBuilder()
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if next, ok := j.restored[uint32(track.SSRC())]; ok {
+		b.next, b.highest, b.started = next, next-1, true
+		b.save()
+	}
+	if j.buffers == nil {
+		j.buffers = map[uint32]*jitterBuffer{}
+	}
+	j.buffers[uint32(track.SSRC())] = b
+	return b
+}
+
+// persisted returns the next sequence number of every jitter buffer to save.
+func (j *jitterState) persisted() map[uint32]uint16 {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	out := map[uint32]uint16{}
+	for ssrc, next := range j.restored {
+		out[ssrc] = next
+	}
+	for ssrc, b := range j.buffers {
+		if sequence := b.sequence.Load(); sequence != 0 {
+			out[ssrc] = uint16(sequence)
+		}
+	}
+	return out
+}
+
+func (j *jitterState) restore(next map[uint32]uint16) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.restored = next
+}
+
+// jitterBuffer puts the packets of a broadcaster track back in order before
+// they are forwarded, waiting for up to -jitter-buffer packets for one that
+// is missing. The samplebuilder decides when to stop waiting: a packet is
+// forwarded once the frame it belongs to is complete or the samplebuilder
+// drops it, in order of sequence numbers either way. Packets arriving after
+// that are dropped as late. Only the goroutine forwarding the track uses it,
+// except for sequence.
+type jitterBuffer struct {
+	depth      uint16
+	newBuilder func() *samplebuilder.SampleBuilder
+	builder    *samplebuilder.SampleBuilder
+	pending    map[uint16]*rtp.Packet
+
+	// next is the sequence number of the next packet to forward, highest
+	// the highest one pushed.
+	next, highest uint16
+	started       bool
+	out           []*rtp.Packet
+
+	// sequence is next for saving, with bit 16 set once started.
+	sequence atomic.Uint32
+}
+
+func (b *jitterBuffer) save() {
+	b.sequence.Store(1<<16 | uint32(b.next))
+}
+
+// push adds packet and returns those that can be forwarded now, in order.
+// The returned slice is only valid until the next push.
+func (b *jitterBuffer) push(packet *rtp.Packet) []*rtp.Packet {
+	b.out = b.out[:0]
+	seq := packet.SequenceNumber
+	if !b.started {
+		b.next, b.highest, b.started = seq, seq, true
+	} else if int16(seq-b.next) < 0 && b.next-seq <= b.depth {
+		jitterLatePackets.Inc()
+		return b.out
+	} else if int16(seq-b.next) < 0 {
+		// Too far back to be late, the stream jumped. What is pending
+		// goes out as it is and the stream starts over from packet.
+		b.forwardThrough(b.highest)
+		b.builder = b.newBuilder()
+		b.next, b.highest = seq, seq
+	}
+	if int16(seq-b.highest) > 0 {
+		b.highest = seq
+	}
+
+	b.pending[seq] = packet
+	b.builder.Push(packet)
+	for sample, timestamp := b.builder.PopWithTimestamp(); sample != nil; sample, timestamp = b.builder.PopWithTimestamp() {
+		b.frameCompleted(timestamp)
+	}
+	b.save()
+	return b.out
+}
+
+// frameCompleted forwards the packets of the frame at timestamp, along with
+// every packet before them, which the samplebuilder is done with.
+func (b *jitterBuffer) frameCompleted(timestamp uint32) {
+	last, found := b.next, false
+	for seq := b.next; seq != b.highest+1; seq++ {
+		if packet := b.pending[seq]; packet != nil && packet.Timestamp == timestamp {
+			last, found = seq, true
+		}
+	}
+	if found {
+		b.forwardThrough(last)
+	}
+}
+
+// released is called by the samplebuilder for every packet it lets go of,
+// in order, whether its frame was completed or dropped.
+func (b *jitterBuffer) released(packet *rtp.Packet) {
+	if int16(packet.SequenceNumber-b.next) >= 0 {
+		b.forwardThrough(packet.SequenceNumber)
+	}
+}
+
+// forwardThrough forwards the pending packets up to and including seq.
+// Missing ones are given up on.
+func (b *jitterBuffer) forwardThrough(seq uint16) {
+	for ; b.next != seq+1; b.next++ {
+		packet, ok := b.pending[b.next]
+		if !ok {
+			jitterSkippedPackets.Inc()
+			continue
+		}
+		delete(b.pending, b.next)
+		b.out = append(b.out, packet)
+	}
+}
@@ -0,0 +1,373 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/pion/webrtc/v3"
+
+	"webrtc-zero-downtime-reload/internal/pionadapter"
+)
+
+// Phases a negotiation goes through in the journal. A session is only
+// journaled until it connects, from then on it is in the snapshot.
+const (
+	journalOffered   = "offered"
+	journalAnswered  = "answered"
+	journalCommitted = "committed"
+	journalAborted   = "aborted"
+)
+
+// journalCompactThreshold is how many records may be appended before the
+// journal is rewritten with only the pending negotiations.
+const journalCompactThreshold = 256
+
+// journalRecord is one line of the journal. Answered records carry everything
+// needed to finish the negotiation in a new process: the client already has
+// our answer, so we must come back with the same ICE credentials, port and
+// certificate.
+type journalRecord struct {
+	ID    string
+	Phase string
+	Room  string `json:",omitempty"`
+
+	Offer               webrtc.SessionDescription
+	ICEPort             uint16 `json:",omitempty"`
+	ICEUsernameFragment string `json:",omitempty"`
+	ICEPassword         string `json:",omitempty"`
+	Certificate         string `json:",omitempty"`
+
+	SSRCAudio, SSRCVideo webrtc.SSRC `json:",omitempty"`
+	VideoCodec           string      `json:",omitempty"`
+	MaxBitrate           uint64      `json:",omitempty"`
+	Fingerprint          Fingerprint
+	Principal            Principal
+	TURN                 TURNCredential
+	Backup               bool                 `json:",omitempty"`
+	PayloadTypes         []PayloadTypeMapping `json:",omitempty"`
+}
+
+var (
+	journalPending  = map[string]journalRecord{}
+	journalFile     *os.File
+	journalAppended int
+	journalMutex    sync.Mutex
+
+	journalRollbacks = newCounter("journal_rollbacks_total", "Negotiations rolled back at startup because their answer was never sent.")
+	journalResumes   = newCounter("journal_resumes_total", "Negotiations resumed from the journal at startup.")
+)
+
+func generateCertificate() (*webrtc.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return webrtc.GenerateCertificate(key)
+}
+
+// journalOffer records that we are about to answer offer.
+func journalOffer(id string, offer webrtc.SessionDescription) error {
+	return appendJournal(journalRecord{ID: id, Phase: journalOffered, Offer: offer})
+}
+
+// journalAnswer records everything needed to bring back session. It must be
+// durable before the answer is sent to the client.
+func journalAnswer(session *session, offer webrtc.SessionDescription, certificate *webrtc.Certificate) error {
+	_, iceGatherer, iceAgent := pionadapter.Pion.ICE(session.peerConnection)
+	localUfrag, localPwd, err := iceAgent.GetLocalUserCredentials()
+	if err != nil {
+		return err
+	}
+
+	localCandidates, err := iceGatherer.GetLocalCandidates()
+	if err != nil {
+		return err
+	}
+
+	port := uint16(0)
+	for _, candidate := range localCandidates {
+		if candidate.Typ == webrtc.ICECandidateTypeHost && candidate.Protocol == webrtc.ICEProtocolUDP {
+			port = candidate.Port
+			break
+		}
+	}
+	if port == 0 {
+		return errNoLocalCandidates
+	}
+
+	SSRCVideo, SSRCAudio, err := senderSSRCs(session.peerConnection)
+	if err != nil {
+		return err
+	}
+
+	pem, err := certificate.PEM()
+	if err != nil {
+		return err
+	}
+
+	return appendJournal(journalRecord{
+		ID:                  session.id,
+		Phase:               journalAnswered,
+		Room:                session.room.id,
+		Offer:               offer,
+		ICEPort:             port,
+		ICEUsernameFragment: localUfrag,
+		ICEPassword:         localPwd,
+		Certificate:         pem,
+		SSRCAudio:           SSRCAudio,
+		SSRCVideo:           SSRCVideo,
+		VideoCodec:          session.videoCodec,
+		MaxBitrate:          session.maxBitrate.Load(),
+		Fingerprint:         session.fingerprint,
+		Principal:           session.principal,
+		TURN:                session.turn,
+		Backup:              session.backup,
+		PayloadTypes:        session.payloadTypes.clientPayloadTypes(),
+	})
+}
+
+// journalCommit marks the negotiation of id as done, the session is in the
+// snapshot now.
+func journalCommit(id string) {
+	resolveJournal(id, journalCommitted)
+}
+
+// journalAbort marks the negotiation of id as failed.
+func journalAbort(id string) {
+	resolveJournal(id, journalAborted)
+}
+
+func resolveJournal(id, phase string) {
+	journalMutex.Lock()
+	_, pending := journalPending[id]
+	journalMutex.Unlock()
+	if !pending {
+		return
+	}
+
+	if err := appendJournal(journalRecord{ID: id, Phase: phase}); err != nil {
+		logf("Failed to journal %s for %s: %v\n", phase, id, err)
+	}
+}
+
+// appendJournal writes record and syncs it to disk before returning.
+func appendJournal(record journalRecord) error {
+	journalMutex.Lock()
+	defer journalMutex.Unlock()
+
+	if record.Phase == journalCommitted || record.Phase == journalAborted {
+		delete(journalPending, record.ID)
+	} else {
+		journalPending[record.ID] = record
+	}
+
+	if journalAppended >= journalCompactThreshold {
+		return compactJournal()
+	}
+
+	if journalFile == nil {
+		var err error
+		if journalFile, err = os.OpenFile(config.JournalPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600); err != nil {
+			return err
+		}
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	} else if _, err = journalFile.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	journalAppended++
+	return journalFile.Sync()
+}
+
+// compactJournal replaces the journal with one holding only the pending
+// negotiations. journalMutex must be held by the caller.
+func compactJournal() error {
+	tmpPath := config.JournalPath + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(tmp)
+	for _, record := range journalPending {
+		if err = enc.Encode(record); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	} else if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	if journalFile != nil {
+		journalFile.Close()
+		journalFile = nil
+	}
+	journalAppended = 0
+	return os.Rename(tmpPath, config.JournalPath)
+}
+
+// readJournal returns the last record of every negotiation in the journal,
+// in the order they were started.
+func readJournal() ([]journalRecord, error) {
+	file, err := os.Open(config.JournalPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	order := []string{}
+	latest := map[string]journalRecord{}
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		record := journalRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			// A crash mid-append leaves a torn last line, nothing after it
+			// was ever synced.
+			logf("Warning: ignoring torn journal record: %v\n", err)
+			break
+		}
+
+		if _, ok := latest[record.ID]; !ok {
+			order = append(order, record.ID)
+		}
+		latest[record.ID] = record
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	records := []journalRecord{}
+	for _, id := range order {
+		records = append(records, latest[id])
+	}
+	return records, nil
+}
+
+// recoverJournal finishes or rolls back every negotiation a previous process
+// left pending. If we crashed after journaling the answer the client may
+// already be using it, so the session is brought back exactly as answered.
+// Otherwise the client never got an answer and the negotiation is dropped.
+func recoverJournal(ctx context.Context, report *restoreReport) {
+	records, err := readJournal()
+	if err != nil {
+		logf("Warning: failed to read journal '%s': %v\n", config.JournalPath, err)
+		return
+	}
+
+	restored := map[string]bool{}
+	for _, result := range report.Sessions {
+		restored[result.ID] = true
+	}
+
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+
+	journalMutex.Lock()
+	defer journalMutex.Unlock()
+
+	for _, record := range records {
+		if restored[record.ID] || isTombstoned(record.ID) {
+			continue
+		}
+
+		result := restoreResult{ID: record.ID, FromJournal: true}
+		switch record.Phase {
+		case journalOffered:
+			logf("Rolling back negotiation %s, its answer was never sent\n", record.ID)
+			journalRollbacks.Inc()
+			result.Err, result.Error = errRolledBack, errRolledBack.Error()
+		case journalAnswered:
+			err := restoreRecovered("resuming negotiation "+record.ID, func() error {
+				return resumeJournaledSession(ctx, record)
+			})
+			runPostRestoreHooks(SessionInfo{ID: record.ID, Room: record.Room, Broadcaster: !isViewerOffer(record.Offer), Principal: record.Principal}, err)
+			if err != nil {
+				logf("Failed to resume negotiation %s: %v\n", record.ID, err)
+				result.Err, result.Error = err, err.Error()
+				publishEvent(record.ID, event{Name: "restoreFailed"})
+			} else {
+				journalResumes.Inc()
+				journalPending[record.ID] = record
+			}
+		default:
+			continue
+		}
+		report.Sessions = append(report.Sessions, result)
+	}
+
+	if err := compactJournal(); err != nil {
+		logf("Warning: failed to compact journal '%s': %v\n", config.JournalPath, err)
+	}
+}
+
+func resumeJournaledSession(ctx context.Context, record journalRecord) error {
+	certificate, err := webrtc.CertificateFromPEM(record.Certificate)
+	if err != nil {
+		return err
+	}
+
+	s := webrtc.SettingEngine{}
+	s.SetICECredentials(record.ICEUsernameFragment, record.ICEPassword)
+	if err = waitForPort(ctx, record.ICEPort); err != nil {
+		return err
+	} else if err = s.SetEphemeralUDPPortRange(record.ICEPort, record.ICEPort); err != nil {
+		return err
+	}
+
+	room := findRoom(record.Room)
+	if room == nil {
+		return fmt.Errorf("%w: %s", errRoomNotFound, record.Room)
+	}
+
+	session := newSessionState(record.ID, room, record.Offer)
+	session.maxBitrate.Store(record.MaxBitrate)
+	session.fingerprint = restoredFingerprint(record.Fingerprint, record.Offer)
+	session.principal = record.Principal
+	session.backup = record.Backup
+	if err = newPeerConnection(session, s, webrtc.Configuration{
+		Certificates: []webrtc.Certificate{*certificate},
+		ICEServers:   useTURN(session, record.TURN),
+	}); err != nil {
+		return err
+	}
+
+	reserveSSRCs(session.id, record.SSRCAudio, record.SSRCVideo)
+	if err = resumeNegotiation(session, PeerConnectionState{
+		RemoteDescription: record.Offer,
+		SSRCAudio:         record.SSRCAudio,
+		SSRCVideo:         record.SSRCVideo,
+		VideoCodec:        record.VideoCodec,
+		PayloadTypes:      record.PayloadTypes,
+	}); err != nil {
+		recordHistory(session, historyRestore, "failed to resume from journal: %v", err)
+		if closeErr := session.peerConnection.Close(); closeErr != nil {
+			logf("Failed to close PeerConnection %s: %v\n", session.id, closeErr)
+		}
+		return err
+	}
+
+	recordHistory(session, historyRestore, "resumed from journal on port %d", record.ICEPort)
+	return nil
+}
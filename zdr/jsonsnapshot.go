@@ -0,0 +1,215 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+)
+
+var (
+	jsonMarshalerType   = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+)
+
+// marshalSnapshotJSON encodes v as indented JSON, for -snapshot-encoding
+// json. Unlike encoding/json it encodes types with a MarshalBinary, such as
+// the DTLS state, through it as base64, as gob does, rather than losing
+// their unexported fields. Fields keep the order of their struct.
+func marshalSnapshotJSON(v any) ([]byte, error) {
+	var compact bytes.Buffer
+	if err := appendSnapshotJSON(&compact, reflect.ValueOf(v)); err != nil {
+		return nil, err
+	}
+	var indented bytes.Buffer
+	if err := json.Indent(&indented, compact.Bytes(), "", "\t"); err != nil {
+		return nil, err
+	}
+	indented.WriteByte('\n')
+	return indented.Bytes(), nil
+}
+
+func appendSnapshotJSON(b *bytes.Buffer, v reflect.Value) error {
+	t := v.Type()
+	switch {
+	case t.Implements(jsonMarshalerType):
+		data, err := json.Marshal(v.Interface())
+		b.Write(data)
+		return err
+	case isBinaryMarshaler(t):
+		p := reflect.New(t)
+		p.Elem().Set(v)
+		data, err := p.Interface().(encoding.BinaryMarshaler).MarshalBinary()
+		if err != nil {
+			return err
+		}
+		b.WriteString(strconv.Quote(base64.StdEncoding.EncodeToString(data)))
+		return nil
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		b.WriteByte('{')
+		first := true
+		for i := 0; i < t.NumField(); i++ {
+			if !t.Field(i).IsExported() {
+				continue
+			}
+			if !first {
+				b.WriteByte(',')
+			}
+			first = false
+			b.WriteString(strconv.Quote(t.Field(i).Name) + ":")
+			if err := appendSnapshotJSON(b, v.Field(i)); err != nil {
+				return fmt.Errorf("%s.%s: %w", t.Name(), t.Field(i).Name, err)
+			}
+		}
+		b.WriteByte('}')
+		return nil
+	case reflect.Pointer:
+		if v.IsNil() {
+			b.WriteString("null")
+			return nil
+		}
+		return appendSnapshotJSON(b, v.Elem())
+	case reflect.Slice:
+		if isProtoBytes(t) || v.IsNil() {
+			break
+		}
+		b.WriteByte('[')
+		for i := 0; i < v.Len(); i++ {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			if err := appendSnapshotJSON(b, v.Index(i)); err != nil {
+				return err
+			}
+		}
+		b.WriteByte(']')
+		return nil
+	case reflect.Map:
+		if v.IsNil() {
+			break
+		}
+		keys := make([]string, 0, v.Len())
+		values := map[string]reflect.Value{}
+		for _, key := range v.MapKeys() {
+			text := fmt.Sprint(key.Interface())
+			keys = append(keys, text)
+			values[text] = v.MapIndex(key)
+		}
+		sort.Strings(keys)
+		b.WriteByte('{')
+		for i, key := range keys {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(strconv.Quote(key) + ":")
+			if err := appendSnapshotJSON(b, values[key]); err != nil {
+				return err
+			}
+		}
+		b.WriteByte('}')
+		return nil
+	}
+
+	data, err := json.Marshal(v.Interface())
+	b.Write(data)
+	return err
+}
+
+// unmarshalSnapshotJSON decodes what marshalSnapshotJSON encoded into v, a
+// pointer. Fields it doesn't know are skipped, fields it doesn't find stay
+// zero.
+func unmarshalSnapshotJSON(data []byte, v any) error {
+	return decodeSnapshotJSON(data, reflect.ValueOf(v).Elem())
+}
+
+func decodeSnapshotJSON(data []byte, v reflect.Value) error {
+	if string(bytes.TrimSpace(data)) == "null" {
+		return nil
+	}
+
+	t := v.Type()
+	switch {
+	case reflect.PointerTo(t).Implements(jsonUnmarshalerType):
+		return v.Addr().Interface().(json.Unmarshaler).UnmarshalJSON(data)
+	case isBinaryMarshaler(t):
+		var text string
+		if err := json.Unmarshal(data, &text); err != nil {
+			return err
+		}
+		decoded, err := base64.StdEncoding.DecodeString(text)
+		if err != nil {
+			return err
+		}
+		unmarshaler, ok := v.Addr().Interface().(encoding.BinaryUnmarshaler)
+		if !ok {
+			return fmt.Errorf("%s can't be decoded", t)
+		}
+		return unmarshaler.UnmarshalBinary(decoded)
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		fields := map[string]json.RawMessage{}
+		if err := json.Unmarshal(data, &fields); err != nil {
+			return err
+		}
+		for i := 0; i < t.NumField(); i++ {
+			if field, ok := fields[t.Field(i).Name]; ok && t.Field(i).IsExported() {
+				if err := decodeSnapshotJSON(field, v.Field(i)); err != nil {
+					return fmt.Errorf("%s.%s: %w", t.Name(), t.Field(i).Name, err)
+				}
+			}
+		}
+		return nil
+	case reflect.Pointer:
+		v.Set(reflect.New(t.Elem()))
+		return decodeSnapshotJSON(data, v.Elem())
+	case reflect.Slice:
+		if isProtoBytes(t) {
+			break
+		}
+		var elems []json.RawMessage
+		if err := json.Unmarshal(data, &elems); err != nil {
+			return err
+		}
+		v.Set(reflect.MakeSlice(t, len(elems), len(elems)))
+		for i, elem := range elems {
+			if err := decodeSnapshotJSON(elem, v.Index(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	case reflect.Map:
+		var entries map[string]json.RawMessage
+		if err := json.Unmarshal(data, &entries); err != nil {
+			return err
+		}
+		v.Set(reflect.MakeMapWithSize(t, len(entries)))
+		for text, entry := range entries {
+			key := reflect.New(t.Key()).Elem()
+			if err := json.Unmarshal([]byte(strconv.Quote(text)), key.Addr().Interface()); err != nil {
+				// Numeric keys are quoted in JSON but not in Go.
+				if err = json.Unmarshal([]byte(text), key.Addr().Interface()); err != nil {
+					return fmt.Errorf("map key %q: %w", text, err)
+				}
+			}
+			value := reflect.New(t.Elem()).Elem()
+			if err := decodeSnapshotJSON(entry, value); err != nil {
+				return err
+			}
+			v.SetMapIndex(key, value)
+		}
+		return nil
+	}
+	return json.Unmarshal(data, v.Addr().Interface())
+}
@@ -0,0 +1,242 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// kvLabel is the label of the DataChannel clients read and write the store of
+// their session over.
+const kvLabel = "kv"
+
+var (
+	errKVFull   = errors.New("session store full")
+	errKVNoKey  = errors.New("key missing")
+	errKVOpName = errors.New("unknown op")
+
+	kvWrites = newCounter("session_kv_writes_total", "Keys set or deleted in the stores of sessions.")
+)
+
+// kvStore is a small store of strings an application keeps with a session,
+// like its layout, the preferences of a viewer or moderation flags. It is
+// saved in the snapshot, so it lasts as long as the session does, restarts
+// included, without a store of its own.
+type kvStore struct {
+	mu     sync.Mutex
+	values map[string]string
+}
+
+// get returns the value of key and whether it is set.
+func (s *kvStore) get(key string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	value, ok := s.values[key]
+	return value, ok
+}
+
+// set sets key to value, refusing to go over -kv-max-bytes of keys and
+// values.
+func (s *kvStore) set(key, value string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	size := len(key) + len(value)
+	for k, v := range s.values {
+		if k != key {
+			size += len(k) + len(v)
+		}
+	}
+	if size > config.KVMaxBytes {
+		return fmt.Errorf("%w: %d bytes, at most %d", errKVFull, size, config.KVMaxBytes)
+	}
+
+	if s.values == nil {
+		s.values = map[string]string{}
+	}
+	s.values[key] = value
+	return nil
+}
+
+func (s *kvStore) delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.values, key)
+}
+
+// persisted returns a copy of the store to save.
+func (s *kvStore) persisted() map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.values) == 0 {
+		return nil
+	}
+	out := make(map[string]string, len(s.values))
+	for key, value := range s.values {
+		out[key] = value
+	}
+	return out
+}
+
+func (s *kvStore) restore(values map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values = values
+}
+
+// writeKV sets key of the store of session to value, or deletes it if value
+// is nil, and persists it. The client hears of it with a kvChanged event.
+func writeKV(ctx context.Context, session *session, key string, value *string) error {
+	if key == "" {
+		return errKVNoKey
+	}
+	if value == nil {
+		session.kv.delete(key)
+		recordHistory(session, historyControl, "deleted %q from the store", key)
+	} else if err := session.kv.set(key, *value); err != nil {
+		return err
+	} else {
+		recordHistory(session, historyControl, "set %q in the store", key)
+	}
+	kvWrites.Inc()
+	publishEvent(session.id, event{Name: "kvChanged", Data: key})
+
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	return serialize(ctx)
+}
+
+// kvMessage is a request sent over the "kv" DataChannel, answered with the
+// key, its value and whether it is set, or an error.
+type kvMessage struct {
+	Op    string
+	Key   string
+	Value string `json:",omitempty"`
+}
+
+type kvAnswer struct {
+	Key   string
+	Value string `json:",omitempty"`
+	Found bool   `json:",omitempty"`
+	Error string `json:",omitempty"`
+}
+
+// onKVChannel serves the store of session over a "kv" DataChannel. Messages
+// are like {"Op": "set", "Key": "layout", "Value": "grid"}, with the ops get,
+// set and delete.
+func onKVChannel(session *session, dataChannel *webrtc.DataChannel) {
+	dataChannel.OnMessage(func(msg webrtc.DataChannelMessage) {
+		var in kvMessage
+		if err := json.Unmarshal(msg.Data, &in); err != nil {
+			answerKV(session, dataChannel, kvAnswer{Error: err.Error()})
+			return
+		}
+
+		var err error
+		switch in.Op {
+		case "get":
+		case "set":
+			err = writeKV(context.Background(), session, in.Key, &in.Value)
+		case "delete":
+			err = writeKV(context.Background(), session, in.Key, nil)
+		default:
+			err = fmt.Errorf("%w: %q", errKVOpName, in.Op)
+		}
+
+		out := kvAnswer{Key: in.Key}
+		if err != nil {
+			out.Error = err.Error()
+		} else {
+			out.Value, out.Found = session.kv.get(in.Key)
+		}
+		answerKV(session, dataChannel, out)
+	})
+}
+
+func answerKV(session *session, dataChannel *webrtc.DataChannel, out kvAnswer) {
+	data, err := json.Marshal(out)
+	if err == nil {
+		err = dataChannel.SendText(string(data))
+	}
+	if err != nil {
+		logf("Failed to answer the store request of %s: %v\n", session.id, err)
+	}
+}
+
+// handleAdminKV serves /admin/sessions/{id}/kv, returning the whole store of
+// the session on GET, and /admin/sessions/{id}/kv/{key}, returning the value
+// of key on GET, setting it to the body on PUT or POST and deleting it on
+// DELETE.
+func handleAdminKV(w http.ResponseWriter, r *http.Request, session *session, key string) {
+	if key == "" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		values := session.kv.persisted()
+		keys := make([]string, 0, len(values))
+		for key := range values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		out := make([]kvAnswer, 0, len(keys))
+		for _, key := range keys {
+			out = append(out, kvAnswer{Key: key, Value: values[key], Found: true})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&out)
+		return
+	}
+
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		value, ok := session.kv.get(key)
+		if !ok {
+			http.Error(w, "key not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte(value)) //nolint:errcheck
+		return
+	case http.MethodPut, http.MethodPost:
+		body, readErr := io.ReadAll(http.MaxBytesReader(w, r.Body, int64(config.KVMaxBytes)))
+		var tooLarge *http.MaxBytesError
+		if errors.As(readErr, &tooLarge) {
+			http.Error(w, errKVFull.Error(), http.StatusRequestEntityTooLarge)
+			return
+		} else if readErr != nil {
+			http.Error(w, readErr.Error(), http.StatusBadRequest)
+			return
+		}
+		value := string(body)
+		err = writeKV(r.Context(), session, key, &value)
+	case http.MethodDelete:
+		err = writeKV(r.Context(), session, key, nil)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch {
+	case errors.Is(err, errKVFull):
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,261 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/logging"
+	"github.com/pion/transport/v2"
+	"github.com/pion/webrtc/v3"
+)
+
+// Stages a restored session latches again in, in order. Until the last one
+// its viewer sees a frozen or black picture.
+const (
+	latchICE  = "ice"
+	latchDTLS = "dtls"
+	latchSRTP = "srtp"
+)
+
+// dtlsDecryptFailure is what pion/dtls logs for a record that fails to
+// decrypt, the only way it reports one.
+const dtlsDecryptFailure = "decrypt failed"
+
+var (
+	latchDurations = newHistogram("restore_latch_seconds", "Time restored sessions took from being resumed to latching again at each stage.", "stage",
+		[]string{latchICE, latchDTLS, latchSRTP},
+		[]time.Duration{
+			10 * time.Millisecond, 50 * time.Millisecond, 100 * time.Millisecond, 250 * time.Millisecond, 500 * time.Millisecond,
+			time.Second, 2 * time.Second, 5 * time.Second, 10 * time.Second, 30 * time.Second,
+		})
+
+	// DTLS is left out, most clients never send a record after the
+	// handshake.
+	_ = newGaugeVec("restored_sessions_unlatched", "Sessions of the last restore still live that didn't latch again at ICE or SRTP yet.", "stage", func() map[string]float64 {
+		out := map[string]float64{latchICE: 0, latchSRTP: 0}
+		latchesMutex.Lock()
+		defer latchesMutex.Unlock()
+		for _, latch := range latches {
+			if latch.ended.Load() {
+				continue
+			}
+			for stage, at := range map[string]*atomic.Int64{latchICE: &latch.iceLatched, latchSRTP: &latch.srtpAuthenticated} {
+				if at.Load() == 0 {
+					out[stage]++
+				}
+			}
+		}
+		return out
+	})
+
+	// latches follow the sessions of the last restore, by ID.
+	latches      = map[string]*latchState{}
+	latchesMutex sync.Mutex
+)
+
+// LatchDiagnostics tell how far a restored session got in picking up the
+// connection of the previous process, for a viewer that stays black after a
+// restart. Times are nil until reached.
+type LatchDiagnostics struct {
+	ResumedAt time.Time
+
+	// FirstSTUN is when the first connectivity check of the client came in,
+	// ICELatched when a candidate pair was selected, RemoteCandidate the
+	// remote side of it.
+	FirstSTUN       *time.Time `json:",omitempty"`
+	ICELatched      *time.Time `json:",omitempty"`
+	RemoteCandidate string     `json:",omitempty"`
+
+	// FirstDTLSRecord is when the first DTLS record came in. Only clients
+	// with a data channel, or that send an alert, send any after the
+	// handshake.
+	FirstDTLSRecord     *time.Time `json:",omitempty"`
+	DTLSDecryptFailures uint64     `json:",omitempty"`
+
+	// FirstSRTP is when the first SRTP or SRTCP packet came in,
+	// SRTPAuthenticated when one first passed authentication.
+	FirstSRTP         *time.Time `json:",omitempty"`
+	SRTPAuthenticated *time.Time `json:",omitempty"`
+	SRTPAuthFailures  uint64     `json:",omitempty"`
+
+	// Stalled is the stage the session is stuck at, "ice" or "srtp", empty
+	// once SRTP authenticated.
+	Stalled string `json:",omitempty"`
+}
+
+// latchState records when a restored session latched again at each stage,
+// in Unix nanoseconds, 0 until then.
+type latchState struct {
+	resumed           int64
+	firstSTUN         atomic.Int64
+	iceLatched        atomic.Int64
+	firstDTLS         atomic.Int64
+	firstSRTP         atomic.Int64
+	srtpAuthenticated atomic.Int64
+
+	remoteCandidate            atomic.Pointer[string]
+	dtlsFailures, srtpFailures atomic.Uint64
+	ended                      atomic.Bool
+}
+
+// resetLatches forgets the sessions of the previous restore.
+func resetLatches() {
+	latchesMutex.Lock()
+	defer latchesMutex.Unlock()
+	latches = map[string]*latchState{}
+}
+
+// followLatch starts following a session being restored.
+func followLatch(session *session) {
+	session.latch = &latchState{resumed: time.Now().UnixNano()}
+
+	latchesMutex.Lock()
+	defer latchesMutex.Unlock()
+	latches[session.id] = session.latch
+}
+
+// reach records at as reached now if it wasn't already, timing stage if not
+// empty.
+func (l *latchState) reach(at *atomic.Int64, stage string) {
+	now := time.Now()
+	if !at.CompareAndSwap(0, now.UnixNano()) || stage == "" {
+		return
+	}
+	latchDurations.with(stage).Observe(now.Sub(time.Unix(0, l.resumed)))
+}
+
+// received classifies a packet that came in on an ICE socket by its first
+// byte, as in RFC 7983.
+func (l *latchState) received(packet []byte) {
+	if len(packet) == 0 {
+		return
+	}
+	switch b := packet[0]; {
+	case b <= 3:
+		l.reach(&l.firstSTUN, "")
+	case b >= 20 && b <= 63:
+		l.reach(&l.firstDTLS, latchDTLS)
+	case b >= 128 && b <= 191:
+		l.reach(&l.firstSRTP, "")
+	}
+}
+
+// watchLatch records when the ICE agent of a restored session selects a
+// candidate pair again.
+func watchLatch(session *session) {
+	latch := session.latch
+	if latch == nil {
+		return
+	}
+
+	session.peerConnection.SCTP().Transport().ICETransport().OnSelectedCandidatePairChange(func(pair *webrtc.ICECandidatePair) {
+		if pair != nil && pair.Remote != nil {
+			remote := net.JoinHostPort(pair.Remote.Address, strconv.Itoa(int(pair.Remote.Port)))
+			latch.remoteCandidate.Store(&remote)
+		}
+		latch.reach(&latch.iceLatched, latchICE)
+		recordHistory(session, historyRestore, "ICE latched again after %s", time.Since(time.Unix(0, latch.resumed)).Round(time.Millisecond))
+	})
+}
+
+// diagnostics returns what l recorded.
+func (l *latchState) diagnostics() LatchDiagnostics {
+	at := func(v *atomic.Int64) *time.Time {
+		if n := v.Load(); n != 0 {
+			t := time.Unix(0, n)
+			return &t
+		}
+		return nil
+	}
+
+	out := LatchDiagnostics{
+		ResumedAt:           time.Unix(0, l.resumed),
+		FirstSTUN:           at(&l.firstSTUN),
+		ICELatched:          at(&l.iceLatched),
+		FirstDTLSRecord:     at(&l.firstDTLS),
+		DTLSDecryptFailures: l.dtlsFailures.Load(),
+		FirstSRTP:           at(&l.firstSRTP),
+		SRTPAuthenticated:   at(&l.srtpAuthenticated),
+		SRTPAuthFailures:    l.srtpFailures.Load(),
+	}
+	if remote := l.remoteCandidate.Load(); remote != nil {
+		out.RemoteCandidate = *remote
+	}
+	switch {
+	case out.ICELatched == nil:
+		out.Stalled = latchICE
+	case out.SRTPAuthenticated == nil:
+		out.Stalled = latchSRTP
+	}
+	return out
+}
+
+// latchReport returns report with the latch diagnostics of its sessions as
+// they are now.
+func latchReport(report *restoreReport) *restoreReport {
+	if report == nil {
+		return nil
+	}
+
+	out := *report
+	out.Sessions = make([]restoreResult, len(report.Sessions))
+	latchesMutex.Lock()
+	defer latchesMutex.Unlock()
+	for i, result := range report.Sessions {
+		if latch, ok := latches[result.ID]; ok && result.Err == nil {
+			diagnostics := latch.diagnostics()
+			result.Latch = &diagnostics
+		}
+		out.Sessions[i] = result
+	}
+	return &out
+}
+
+// latchNet hands pion/ice sockets that tell the latch of a restored session
+// what comes in.
+type latchNet struct {
+	transport.Net
+	latch *latchState
+}
+
+func (n *latchNet) ListenUDP(network string, addr *net.UDPAddr) (transport.UDPConn, error) {
+	conn, err := n.Net.ListenUDP(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &latchConn{UDPConn: conn, latch: n.latch}, nil
+}
+
+type latchConn struct {
+	transport.UDPConn
+	latch *latchState
+}
+
+func (c *latchConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.UDPConn.ReadFrom(b)
+	if n > 0 {
+		c.latch.received(b[:n])
+	}
+	return n, addr, err
+}
+
+// dtlsLogger is the logger of the DTLS connection of a restored session, it
+// counts the records that failed to decrypt.
+type dtlsLogger struct {
+	logging.LeveledLogger
+	session *session
+}
+
+func (l *dtlsLogger) Debugf(format string, args ...interface{}) {
+	if strings.Contains(format, dtlsDecryptFailure) && l.session.latch != nil {
+		l.session.latch.dtlsFailures.Add(1)
+	}
+	l.LeveledLogger.Debugf(format, args...)
+}
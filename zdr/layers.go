@@ -0,0 +1,341 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// The layer controller steps a viewer down a simulcast layer once it has
+// reported more than layerDownLoss for layerDownHold, and up again after
+// layerUpHold below layerUpLoss. The gap between both keeps a viewer on the
+// edge from flapping between layers.
+const (
+	layerInterval = time.Second
+	layerDownLoss = 0.10
+	layerUpLoss   = 0.02
+	layerDownHold = 2 * time.Second
+	layerUpHold   = 10 * time.Second
+)
+
+var layerSwitches = newCounter("simulcast_layer_switches_total", "Viewers moved to another simulcast layer by the layer controller.")
+
+// LayerShift is what the sequence numbers and timestamps of the layer a
+// viewer receives are moved by, so they carry on from those of the layers it
+// received before.
+type LayerShift struct {
+	Seq       uint16
+	Timestamp uint32
+}
+
+// layerState is the simulcast layer a viewer receives and the feedback the
+// controller picks it by.
+type layerState struct {
+	mu  sync.Mutex
+	rid string
+
+	// rebase is set when the viewer was moved to another layer, the next
+	// packet works out new shifts from the last packet sent.
+	rebase bool
+	shifts map[uint32]LayerShift
+	last   map[uint32]sentPosition
+
+	// lost and reported add up the loss reported since the controller last
+	// looked, estimate is the last REMB of the viewer.
+	lost, reported float64
+	estimate       uint64
+
+	badSince, goodSince time.Time
+}
+
+type sentPosition struct {
+	seq       uint16
+	timestamp uint32
+	at        time.Time
+}
+
+// current returns the RID of the layer the viewer receives, "" for the top
+// one.
+func (s *layerState) current() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rid
+}
+
+// layerShifts returns a copy of the shifts to persist.
+func (s *layerState) layerShifts() map[uint32]LayerShift {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := make(map[uint32]LayerShift, len(s.shifts))
+	for ssrc, shift := range s.shifts {
+		out[ssrc] = shift
+	}
+	return out
+}
+
+// rebaseNext makes the next packet carry on from the last one sent. Nothing
+// of the previous layer may be sent after it is called.
+func (s *layerState) rebaseNext() {
+	s.mu.Lock()
+	s.rebase = true
+	s.mu.Unlock()
+}
+
+// shift returns the shift applied to ssrc.
+func (s *layerState) shift(ssrc uint32) LayerShift {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.shifts[ssrc]
+}
+
+// videoTrack returns the room track session receives video from, that of
+// its simulcast layer, nil if there is none.
+func (s *session) videoTrack() *webrtc.TrackLocalStaticRTP {
+	if track := s.room.layerTrack(s.videoCodec, s.layer.current()); track != nil {
+		return track
+	}
+	return s.room.videoTrack(s.videoCodec)
+}
+
+// switchLayer moves session to the simulcast layer rid. The new layer is
+// saved with the next snapshot, so a restart resumes the viewer on it rather
+// than on the top layer.
+func switchLayer(session *session, rid string) error {
+	session.layer.mu.Lock()
+	from := session.layer.rid
+	session.layer.rid = rid
+	session.layer.mu.Unlock()
+
+	if err := applySubscriptions(session); err != nil {
+		return err
+	}
+	// The viewer can't decode the new layer before its next keyframe.
+	session.room.requestKeyframe()
+
+	layerSwitches.Inc()
+	recordHistory(session, historyControl, "switched from simulcast layer %q to %q", from, rid)
+	return nil
+}
+
+// controlLayers runs the layer controller of a viewer in a simulcast room
+// until its PeerConnection is closed.
+func controlLayers(session *session) {
+	layers := session.room.policy.layers()
+	if session.broadcaster || len(layers) < 2 || session.room.policy.AudioOnly {
+		return
+	}
+
+	supervise("layer controller", session, func() {
+		ticker := time.NewTicker(layerInterval)
+		defer ticker.Stop()
+
+		for now := range ticker.C {
+			if session.peerConnection.ConnectionState() == webrtc.PeerConnectionStateClosed {
+				return
+			}
+			confirmed := uint64(math.MaxUint64)
+			if config.Probing {
+				confirmed = session.probe.confirmedBitrate()
+			}
+			if rid, ok := session.layer.next(layers, confirmed, session.bandwidth.estimate(), now); ok {
+				if err := switchLayer(session, rid); err != nil {
+					logf("Failed to switch %s to simulcast layer %s: %v\n", session.id, rid, err)
+				}
+				// A viewer moved down can't be trusted with more until
+				// probed again.
+				for _, layer := range layers {
+					if layer.RID == rid && layer.MaxBitrate != 0 {
+						session.probe.lower(layer.MaxBitrate)
+					}
+				}
+			}
+		}
+	})
+}
+
+// next works out the layer the viewer should be on from the feedback since
+// the last call, ok is set if it should move. The viewer is only moved up to
+// a layer of at most confirmed, the bitrate its prober confirmed, and kept on
+// layers that fit its REMB and estimated, the target bitrate of its
+// bandwidth estimator, when it has them.
+func (s *layerState) next(layers []SimulcastEncoding, confirmed, estimated uint64, now time.Time) (rid string, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current := len(layers) - 1
+	for i, layer := range layers {
+		if layer.RID == s.rid {
+			current = i
+		}
+	}
+
+	// Without any report there is nothing to go by.
+	if s.reported == 0 {
+		return "", false
+	}
+	loss := s.lost / s.reported
+	s.lost, s.reported = 0, 0
+
+	fits := func(i int) bool {
+		return (s.estimate == 0 || layers[i].MaxBitrate <= s.estimate) &&
+			(estimated == 0 || layers[i].MaxBitrate <= estimated)
+	}
+	switch {
+	case current > 0 && (loss > layerDownLoss || !fits(current)):
+		s.goodSince = time.Time{}
+		if s.badSince.IsZero() {
+			s.badSince = now
+		} else if now.Sub(s.badSince) >= layerDownHold {
+			s.badSince = time.Time{}
+			return layers[current-1].RID, true
+		}
+	case current < len(layers)-1 && loss < layerUpLoss && fits(current+1) && layers[current+1].MaxBitrate <= confirmed:
+		s.badSince = time.Time{}
+		if s.goodSince.IsZero() {
+			s.goodSince = now
+		} else if now.Sub(s.goodSince) >= layerUpHold {
+			s.goodSince = time.Time{}
+			return layers[current+1].RID, true
+		}
+	default:
+		s.badSince, s.goodSince = time.Time{}, time.Time{}
+	}
+	return "", false
+}
+
+type layerInterceptorFactory struct {
+	session *session
+}
+
+func (f *layerInterceptorFactory) NewInterceptor(string) (interceptor.Interceptor, error) {
+	return &layerInterceptor{state: &f.session.layer, video: map[uint32]bool{}}, nil
+}
+
+// layerInterceptor keeps the video of a viewer continuous across simulcast
+// layers, each of which has sequence numbers and timestamps of its own, and
+// collects the feedback of the viewer for the layer controller. Loss comes
+// from receiver reports and, for viewers sending them, TWCC feedback.
+type layerInterceptor struct {
+	interceptor.NoOp
+	state *layerState
+
+	mu    sync.Mutex
+	video map[uint32]bool
+}
+
+func (i *layerInterceptor) BindLocalStream(info *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	if !strings.HasPrefix(strings.ToLower(info.MimeType), "video/") {
+		return writer
+	}
+	i.mu.Lock()
+	i.video[info.SSRC] = true
+	i.mu.Unlock()
+
+	return interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, attributes interceptor.Attributes) (int, error) {
+		s, now := i.state, time.Now()
+		s.mu.Lock()
+		if last, ok := s.last[info.SSRC]; s.rebase && ok {
+			elapsed := uint32(now.Sub(last.at).Seconds() * float64(info.ClockRate))
+			s.shifts[info.SSRC] = LayerShift{
+				Seq:       last.seq + 1 - header.SequenceNumber,
+				Timestamp: last.timestamp + elapsed - header.Timestamp,
+			}
+		}
+		s.rebase = false
+		shift := s.shifts[info.SSRC]
+
+		// The header is shared with every other viewer of the track.
+		shifted := *header
+		shifted.SequenceNumber += shift.Seq
+		shifted.Timestamp += shift.Timestamp
+		s.last[info.SSRC] = sentPosition{seq: shifted.SequenceNumber, timestamp: shifted.Timestamp, at: now}
+		s.mu.Unlock()
+
+		return writer.Write(&shifted, payload, attributes)
+	})
+}
+
+func (i *layerInterceptor) BindRTCPReader(reader interceptor.RTCPReader) interceptor.RTCPReader {
+	return interceptor.RTCPReaderFunc(func(b []byte, attributes interceptor.Attributes) (int, interceptor.Attributes, error) {
+		n, attributes, err := reader.Read(b, attributes)
+		if err != nil {
+			return n, attributes, err
+		}
+		if attributes == nil {
+			attributes = interceptor.Attributes{}
+		}
+
+		packets, unmarshalErr := attributes.GetRTCPPackets(b[:n])
+		if unmarshalErr != nil {
+			return n, attributes, err
+		}
+		for _, packet := range packets {
+			i.observe(packet)
+		}
+		return n, attributes, err
+	})
+}
+
+func (i *layerInterceptor) observe(packet rtcp.Packet) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	s := i.state
+
+	lost, reports := reportedLoss(packet, func(ssrc uint32) bool { return i.video[ssrc] })
+	s.mu.Lock()
+	s.lost += lost
+	s.reported += float64(reports)
+	if remb, ok := packet.(*rtcp.ReceiverEstimatedMaximumBitrate); ok {
+		s.estimate = uint64(remb.Bitrate)
+	}
+	s.mu.Unlock()
+}
+
+// reportedLoss adds up the fractions lost in the reports of packet, receiver
+// reports about the SSRCs video is true for or TWCC feedback, and returns
+// how many reports there were.
+func reportedLoss(packet rtcp.Packet, video func(ssrc uint32) bool) (lost float64, reports int) {
+	switch packet := packet.(type) {
+	case *rtcp.ReceiverReport:
+		for _, report := range packet.Reports {
+			if video(report.SSRC) {
+				lost += float64(report.FractionLost) / 256
+				reports++
+			}
+		}
+	case *rtcp.TransportLayerCC:
+		if packet.PacketStatusCount == 0 {
+			return 0, 0
+		}
+		missing := 0
+		for _, chunk := range packet.PacketChunks {
+			switch chunk := chunk.(type) {
+			case *rtcp.RunLengthChunk:
+				if chunk.PacketStatusSymbol == rtcp.TypeTCCPacketNotReceived {
+					missing += int(chunk.RunLength)
+				}
+			case *rtcp.StatusVectorChunk:
+				for _, symbol := range chunk.SymbolList {
+					if symbol == rtcp.TypeTCCPacketNotReceived {
+						missing++
+					}
+				}
+			}
+		}
+		if missing > int(packet.PacketStatusCount) {
+			missing = int(packet.PacketStatusCount)
+		}
+		return float64(missing) / float64(packet.PacketStatusCount), 1
+	}
+	return lost, reports
+}
@@ -0,0 +1,93 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"context"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// Values of Config.ShedPolicy.
+const (
+	shedNewest = "newest"
+	shedOldest = "oldest"
+	shedNone   = "none"
+)
+
+var (
+	overloaded atomic.Bool
+
+	shedSessions = newCounter("load_shed_sessions_total", "Sessions closed to bring the server back under its watermarks.")
+	_            = newGauge("overloaded", "1 while the server is above a watermark and refusing viewers.", func() float64 {
+		if overloaded.Load() {
+			return 1
+		}
+		return 0
+	})
+	_ = newGauge("goroutines", "Number of goroutines.", func() float64 {
+		return float64(runtime.NumGoroutine())
+	})
+)
+
+// watchLoad compares memory and goroutine usage against their watermarks every
+// second. While above one, new viewers are refused and one viewer is closed
+// per tick according to -shed-policy. The broadcaster is never shed since
+// every viewer depends on it.
+func watchLoad(ctx context.Context) {
+	if config.MemoryHighWatermark == 0 && config.GoroutineHighWatermark == 0 {
+		return
+	}
+
+	memStats := runtime.MemStats{}
+	every(ctx, time.Second, func(time.Time) {
+		runtime.ReadMemStats(&memStats)
+		goroutines := runtime.NumGoroutine()
+
+		isOverloaded := (config.MemoryHighWatermark != 0 && memStats.HeapAlloc > config.MemoryHighWatermark) ||
+			(config.GoroutineHighWatermark != 0 && goroutines > config.GoroutineHighWatermark)
+		if overloaded.Swap(isOverloaded) != isOverloaded {
+			if isOverloaded {
+				logf("ALERT: over watermark (heap %d bytes, %d goroutines), refusing new viewers\n", memStats.HeapAlloc, goroutines)
+			} else {
+				logf("Back under watermarks, admitting viewers again\n")
+			}
+		}
+
+		if isOverloaded {
+			shedSession()
+		}
+	})
+}
+
+func shedSession() {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+
+	var victim *session
+	for _, session := range sessions {
+		if session.broadcaster {
+			continue
+		}
+
+		switch config.ShedPolicy {
+		case shedNewest:
+			victim = session
+		case shedOldest:
+			if victim == nil {
+				victim = session
+			}
+		}
+	}
+	if victim == nil {
+		return
+	}
+
+	logf("ALERT: shedding PeerConnection %s\n", victim.id)
+	shedSessions.Inc()
+	if err := victim.peerConnection.Close(); err != nil {
+		logf("Failed to close PeerConnection %s: %v\n", victim.id, err)
+	}
+}
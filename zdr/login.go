@@ -0,0 +1,381 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	loginCookie = "zdr-login"
+
+	// loginAttemptTimeout is how long a user has at the identity provider.
+	loginAttemptTimeout = 10 * time.Minute
+	oidcTimeout         = 10 * time.Second
+)
+
+var (
+	errLoginConfig   = errors.New("-oidc-issuer requires -oidc-client and -oidc-redirect-url")
+	errLoginAttempt  = errors.New("unknown or expired login attempt")
+	errIDTokenClaims = errors.New("ID token wasn't issued for us")
+
+	logins      = map[string]Login{}
+	loginsMutex sync.Mutex
+
+	// loginAttempts are logins waiting for the identity provider, by state.
+	// They aren't saved, a user caught by a restart just logs in again.
+	loginAttempts      = map[string]loginAttempt{}
+	loginAttemptsMutex sync.Mutex
+
+	oidcClient         = &http.Client{Timeout: oidcTimeout}
+	oidcDiscovery      *oidcEndpoints
+	oidcDiscoveryMutex sync.Mutex
+	oidcLogins         = newCounter("oidc_logins_total", "Users that logged in to the demo page.")
+	oidcLoginFailures  = newCounter("oidc_login_failures_total", "Logins to the demo page that failed.")
+	_                  = newGauge("oidc_active_logins", "Logins to the demo page that haven't expired.", func() float64 { return float64(len(snapshotLogins())) })
+)
+
+// Login is a user logged in to the demo page with -oidc-issuer, its ID is
+// the value of their login cookie. Logins are saved in the snapshot, so a
+// restart doesn't log anyone out.
+type Login struct {
+	ID        string
+	Principal Principal
+	Expires   time.Time
+}
+
+type loginAttempt struct {
+	verifier, returnTo string
+	expires            time.Time
+}
+
+type oidcEndpoints struct {
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+}
+
+func loginsEnabled() bool {
+	return config.OIDCIssuer != ""
+}
+
+// validateLoginConfig checks the -oidc- settings of cfg.
+func validateLoginConfig(cfg Config) error {
+	if cfg.OIDCIssuer != "" && (cfg.OIDCClient == "" || cfg.OIDCRedirectURL == "") {
+		return errLoginConfig
+	}
+	return nil
+}
+
+// handleOIDC serves /oidc/login, /oidc/callback and /oidc/logout, the
+// authorization code flow (with PKCE) logging users in to the demo page.
+func handleOIDC(w http.ResponseWriter, r *http.Request) {
+	if !loginsEnabled() {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/oidc/login":
+		handleLogin(w, r)
+	case "/oidc/callback":
+		handleLoginCallback(w, r)
+	case "/oidc/logout":
+		handleLogout(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// handleLogin sends the user to the identity provider. They are brought back
+// to the return query parameter, a path on this server, once logged in.
+func handleLogin(w http.ResponseWriter, r *http.Request) {
+	returnTo := r.URL.Query().Get("return")
+	if !strings.HasPrefix(returnTo, "/") || strings.HasPrefix(returnTo, "//") {
+		returnTo = "/"
+	}
+
+	endpoints, err := discoverOIDC(r.Context())
+	if err != nil {
+		logf("Failed to discover OIDC endpoints: %v\n", err)
+		http.Error(w, "identity provider unavailable", http.StatusBadGateway)
+		return
+	}
+
+	state, verifier := randomToken(), randomToken()
+	now := time.Now()
+	loginAttemptsMutex.Lock()
+	for key, attempt := range loginAttempts {
+		if !now.Before(attempt.expires) {
+			delete(loginAttempts, key)
+		}
+	}
+	loginAttempts[state] = loginAttempt{verifier: verifier, returnTo: returnTo, expires: now.Add(loginAttemptTimeout)}
+	loginAttemptsMutex.Unlock()
+
+	challenge := sha256.Sum256([]byte(verifier))
+	clientID, _, _ := strings.Cut(config.OIDCClient, ":")
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {clientID},
+		"redirect_uri":          {config.OIDCRedirectURL},
+		"scope":                 {config.OIDCScopes},
+		"state":                 {state},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	http.Redirect(w, r, endpoints.AuthorizationEndpoint+"?"+query.Encode(), http.StatusFound)
+}
+
+// handleLoginCallback is where the identity provider sends the user back to.
+// The code is exchanged for an ID token, whose subject and groups become the
+// principal of the login.
+func handleLoginCallback(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	loginAttemptsMutex.Lock()
+	attempt, ok := loginAttempts[query.Get("state")]
+	delete(loginAttempts, query.Get("state"))
+	loginAttemptsMutex.Unlock()
+	if !ok || !time.Now().Before(attempt.expires) {
+		oidcLoginFailures.Inc()
+		http.Error(w, errLoginAttempt.Error(), http.StatusBadRequest)
+		return
+	} else if query.Get("error") != "" {
+		oidcLoginFailures.Inc()
+		http.Error(w, fmt.Sprintf("login failed: %s %s", query.Get("error"), query.Get("error_description")), http.StatusForbidden)
+		return
+	}
+
+	principal, err := exchangeLoginCode(r.Context(), query.Get("code"), attempt.verifier)
+	if err != nil {
+		oidcLoginFailures.Inc()
+		logf("Failed to log in: %v\n", err)
+		http.Error(w, "login failed", http.StatusBadGateway)
+		return
+	}
+
+	login := Login{ID: randomToken(), Principal: principal, Expires: time.Now().Add(config.OIDCLoginTTL)}
+	loginsMutex.Lock()
+	logins[login.ID] = login
+	loginsMutex.Unlock()
+	oidcLogins.Inc()
+	logf("%s logged in with roles %v\n", principal.Subject, principal.Roles)
+
+	sessionsMutex.Lock()
+	if err = serialize(context.Background()); err != nil {
+		logf("Failed to serialize: %v\n", err)
+	}
+	sessionsMutex.Unlock()
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     loginCookie,
+		Value:    login.ID,
+		Path:     "/",
+		Expires:  login.Expires,
+		Secure:   strings.HasPrefix(config.OIDCRedirectURL, "https://"),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, attempt.returnTo, http.StatusFound)
+}
+
+// exchangeLoginCode redeems code at the token endpoint and returns who the
+// ID token is for. The ID token comes straight from the identity provider
+// over TLS, so its signature needn't be checked (OpenID Connect Core
+// 3.1.3.7), its issuer and audience still are.
+func exchangeLoginCode(ctx context.Context, code, verifier string) (Principal, error) {
+	endpoints, err := discoverOIDC(ctx)
+	if err != nil {
+		return Principal{}, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {config.OIDCRedirectURL},
+		"code_verifier": {verifier},
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoints.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return Principal{}, err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	clientID, clientSecret, _ := strings.Cut(config.OIDCClient, ":")
+	request.SetBasicAuth(url.QueryEscape(clientID), url.QueryEscape(clientSecret))
+
+	response, err := oidcClient.Do(request)
+	if err != nil {
+		return Principal{}, err
+	}
+	defer response.Body.Close() //nolint:errcheck
+	if response.StatusCode != http.StatusOK {
+		return Principal{}, fmt.Errorf("token endpoint: %s", response.Status)
+	}
+
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err = json.NewDecoder(response.Body).Decode(&tokens); err != nil {
+		return Principal{}, err
+	}
+	parts := strings.Split(tokens.IDToken, ".")
+	if len(parts) != 3 {
+		return Principal{}, fmt.Errorf("%w: malformed", errIDTokenClaims)
+	}
+
+	var claims struct {
+		Issuer   string          `json:"iss"`
+		Audience json.RawMessage `json:"aud"`
+		Subject  string          `json:"sub"`
+		Groups   []string        `json:"groups"`
+	}
+	if err = decodeJWTPart(parts[1], &claims); err != nil {
+		return Principal{}, err
+	} else if strings.TrimSuffix(claims.Issuer, "/") != strings.TrimSuffix(config.OIDCIssuer, "/") {
+		return Principal{}, fmt.Errorf("%w: issuer %s", errIDTokenClaims, claims.Issuer)
+	} else if !hasAudience(claims.Audience, clientID) {
+		return Principal{}, fmt.Errorf("%w: audience %s", errIDTokenClaims, claims.Audience)
+	}
+
+	principal := Principal{Subject: claims.Subject, Roles: []string{roleViewer}}
+	if config.OIDCBroadcasterGroup == "" {
+		principal.Roles = append(principal.Roles, roleBroadcaster)
+	}
+	for _, group := range claims.Groups {
+		if group == config.OIDCBroadcasterGroup {
+			principal.Roles = append(principal.Roles, roleBroadcaster)
+		}
+	}
+	return principal, nil
+}
+
+// hasAudience reports whether the aud claim, a string or an array of them,
+// names clientID.
+func hasAudience(aud json.RawMessage, clientID string) bool {
+	var one string
+	if json.Unmarshal(aud, &one) == nil {
+		return one == clientID
+	}
+	var many []string
+	if json.Unmarshal(aud, &many) == nil {
+		for _, a := range many {
+			if a == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// handleLogout ends the login of the user and sends them to the demo page.
+// Sessions they started keep running.
+func handleLogout(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(loginCookie); err == nil {
+		loginsMutex.Lock()
+		delete(logins, cookie.Value)
+		loginsMutex.Unlock()
+
+		sessionsMutex.Lock()
+		if err = serialize(context.Background()); err != nil {
+			logf("Failed to serialize: %v\n", err)
+		}
+		sessionsMutex.Unlock()
+	}
+
+	http.SetCookie(w, &http.Cookie{Name: loginCookie, Path: "/", MaxAge: -1})
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// discoverOIDC returns the endpoints of -oidc-issuer, fetching them once.
+func discoverOIDC(ctx context.Context) (oidcEndpoints, error) {
+	oidcDiscoveryMutex.Lock()
+	defer oidcDiscoveryMutex.Unlock()
+	if oidcDiscovery != nil {
+		return *oidcDiscovery, nil
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(config.OIDCIssuer, "/")+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return oidcEndpoints{}, err
+	}
+	response, err := oidcClient.Do(request)
+	if err != nil {
+		return oidcEndpoints{}, err
+	}
+	defer response.Body.Close() //nolint:errcheck
+	if response.StatusCode != http.StatusOK {
+		return oidcEndpoints{}, fmt.Errorf("discovery: %s", response.Status)
+	}
+
+	endpoints := oidcEndpoints{}
+	if err = json.NewDecoder(response.Body).Decode(&endpoints); err != nil {
+		return oidcEndpoints{}, err
+	}
+	oidcDiscovery = &endpoints
+	return endpoints, nil
+}
+
+// loginPrincipal returns the principal of the login cookie of r, if it has
+// one that hasn't expired.
+func loginPrincipal(r *http.Request) (Principal, bool) {
+	if !loginsEnabled() {
+		return Principal{}, false
+	}
+	cookie, err := r.Cookie(loginCookie)
+	if err != nil {
+		return Principal{}, false
+	}
+
+	loginsMutex.Lock()
+	defer loginsMutex.Unlock()
+	login, ok := logins[cookie.Value]
+	if !ok || !time.Now().Before(login.Expires) {
+		return Principal{}, false
+	}
+	return login.Principal, true
+}
+
+// snapshotLogins returns the logins that haven't expired, dropping the others.
+func snapshotLogins() []Login {
+	loginsMutex.Lock()
+	defer loginsMutex.Unlock()
+
+	now := time.Now()
+	out := []Login{}
+	for id, login := range logins {
+		if !now.Before(login.Expires) {
+			delete(logins, id)
+			continue
+		}
+		out = append(out, login)
+	}
+	return out
+}
+
+func restoreLogins(saved []Login) {
+	loginsMutex.Lock()
+	defer loginsMutex.Unlock()
+
+	for _, login := range saved {
+		logins[login.ID] = login
+	}
+}
+
+func randomToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,27 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestMain keeps the snapshots, journal and captures tests write out of the
+// source tree.
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "zdr")
+	if err != nil {
+		panic(err)
+	}
+	config.SnapshotPath = filepath.Join(dir, "peerConnections.gob")
+	config.JournalPath = filepath.Join(dir, "negotiations.journal")
+	config.PcapDir = dir
+	config.RecorderAuditLog = filepath.Join(dir, "key-exports.log")
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
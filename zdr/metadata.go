@@ -0,0 +1,125 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// maxMetadataBytes bounds the title, description and now playing of a room
+// together, they are sent to every viewer.
+const maxMetadataBytes = 4 << 10
+
+var (
+	errMetadataTooLarge = errors.New("metadata too large")
+
+	metadataUpdates = newCounter("room_metadata_updates_total", "Titles, descriptions and now playing of rooms set or cleared.")
+)
+
+// RoomMetadata is what viewers display about a broadcast. It is saved with
+// its room, so viewers reloading the page and restarts of the server keep
+// showing it.
+type RoomMetadata struct {
+	Title       string `json:",omitempty"`
+	Description string `json:",omitempty"`
+	NowPlaying  string `json:",omitempty"`
+
+	// Updated is when it was last set.
+	Updated time.Time
+}
+
+// setMetadata replaces the metadata of room, clearing it if metadata is nil,
+// tells its sessions with a metadata event and persists it.
+func setMetadata(ctx context.Context, room *room, metadata *RoomMetadata) error {
+	if metadata != nil {
+		if size := len(metadata.Title) + len(metadata.Description) + len(metadata.NowPlaying); size > maxMetadataBytes {
+			return fmt.Errorf("%w: %d bytes, at most %d", errMetadataTooLarge, size, maxMetadataBytes)
+		}
+		metadata.Updated = time.Now()
+	}
+
+	room.metadata.Store(metadata)
+	metadataUpdates.Inc()
+	room.publish(event{Name: "metadata", Data: metadataEvent(metadata)})
+
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	return serialize(ctx)
+}
+
+// metadataEvent is the data of a metadata event, an empty RoomMetadata once
+// it is cleared.
+func metadataEvent(metadata *RoomMetadata) RoomMetadata {
+	if metadata == nil {
+		return RoomMetadata{}
+	}
+	return *metadata
+}
+
+// publishMetadata tells a session that just joined room of its metadata, if
+// any.
+func publishMetadata(room *room, session *session) {
+	if metadata := room.metadata.Load(); metadata != nil {
+		publishEvent(session.id, event{Name: "metadata", Data: *metadata})
+	}
+}
+
+// roomMetadata returns the metadata of r to save, nil if none.
+func (r *room) roomMetadata() *RoomMetadata {
+	return r.metadata.Load()
+}
+
+// handleMetadata serves /sessions/{id}/metadata, returning the metadata of
+// the room of the session on GET. Broadcasters set it on PUT or POST with a
+// body like {"Title": "Town hall", "NowPlaying": "Q&A"} and clear it on
+// DELETE.
+func handleMetadata(w http.ResponseWriter, r *http.Request, session *session) {
+	if r.Method != http.MethodGet && !session.broadcaster {
+		http.Error(w, "only broadcasters may set metadata", http.StatusForbidden)
+		return
+	}
+	serveMetadata(w, r, session.room)
+}
+
+// handleAdminRoomMetadata serves /admin/rooms/{id}/metadata like
+// /sessions/{id}/metadata serves broadcasters.
+func handleAdminRoomMetadata(w http.ResponseWriter, r *http.Request, room *room) {
+	serveMetadata(w, r, room)
+}
+
+func serveMetadata(w http.ResponseWriter, r *http.Request, room *room) {
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(metadataEvent(room.roomMetadata()))
+		return
+	case http.MethodPut, http.MethodPost:
+		var in RoomMetadata
+		if err = json.NewDecoder(r.Body).Decode(&in); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = setMetadata(r.Context(), room, &in)
+	case http.MethodDelete:
+		err = setMetadata(r.Context(), room, nil)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch {
+	case errors.Is(err, errMetadataTooLarge):
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,157 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+type metric interface {
+	write(w io.Writer)
+}
+
+// counter is a monotonically increasing metric exposed on /metrics.
+type counter struct {
+	name, help string
+	value      atomic.Uint64
+}
+
+// gauge is a metric whose value is read when /metrics is scraped.
+type gauge struct {
+	name, help string
+	value      func() float64
+}
+
+// gaugeVec is a gauge with a series for every value of its label, read
+// when /metrics is scraped.
+type gaugeVec struct {
+	name, help, label string
+	values            func() map[string]float64
+}
+
+// histogram is a distribution of durations exposed on /metrics, with a
+// series for every value of its label.
+type histogram struct {
+	name, help, label string
+	buckets           []time.Duration
+	series            []*histogramSeries
+}
+
+// histogramSeries is the series of a histogram for one value of its label.
+type histogramSeries struct {
+	value string
+	// counts has the observations of every bucket and of +Inf last, not
+	// cumulated, sum is in nanoseconds.
+	counts []atomic.Uint64
+	sum    atomic.Int64
+	h      *histogram
+}
+
+var metrics = []metric{}
+
+func newCounter(name, help string) *counter {
+	c := &counter{name: name, help: help}
+	metrics = append(metrics, c)
+	return c
+}
+
+func newGauge(name, help string, value func() float64) *gauge {
+	g := &gauge{name: name, help: help, value: value}
+	metrics = append(metrics, g)
+	return g
+}
+
+func newGaugeVec(name, help, label string, values func() map[string]float64) *gaugeVec {
+	g := &gaugeVec{name: name, help: help, label: label, values: values}
+	metrics = append(metrics, g)
+	return g
+}
+
+// newHistogram registers a histogram with a series for each of values of
+// label, buckets are the upper bounds of its buckets in ascending order.
+func newHistogram(name, help, label string, values []string, buckets []time.Duration) *histogram {
+	h := &histogram{name: name, help: help, label: label, buckets: buckets}
+	for _, value := range values {
+		h.series = append(h.series, &histogramSeries{value: value, counts: make([]atomic.Uint64, len(buckets)+1), h: h})
+	}
+	metrics = append(metrics, h)
+	return h
+}
+
+// with returns the series for value of the label of h, nil if it has none.
+func (h *histogram) with(value string) *histogramSeries {
+	for _, s := range h.series {
+		if s.value == value {
+			return s
+		}
+	}
+	return nil
+}
+
+func (s *histogramSeries) Observe(d time.Duration) {
+	i := 0
+	for i < len(s.h.buckets) && d > s.h.buckets[i] {
+		i++
+	}
+	s.counts[i].Add(1)
+	s.sum.Add(int64(d))
+}
+
+func (c *counter) Inc() {
+	c.value.Add(1)
+}
+
+func (c *counter) Add(n uint64) {
+	c.value.Add(n)
+}
+
+func (c *counter) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s{generation=\"%d\"} %d\n", c.name, c.help, c.name, c.name, generation.Load(), c.value.Load())
+}
+
+func (g *gauge) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s{generation=\"%d\"} %g\n", g.name, g.help, g.name, g.name, generation.Load(), g.value())
+}
+
+func (g *gaugeVec) write(w io.Writer) {
+	values := g.values()
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s{generation=\"%d\",%s=%q} %g\n", g.name, generation.Load(), g.label, key, values[key])
+	}
+}
+
+func (h *histogram) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for _, s := range h.series {
+		labels := fmt.Sprintf("generation=\"%d\",%s=%q", generation.Load(), h.label, s.value)
+		var count uint64
+		for i, bucket := range h.buckets {
+			count += s.counts[i].Load()
+			fmt.Fprintf(w, "%s_bucket{%s,le=\"%g\"} %d\n", h.name, labels, bucket.Seconds(), count)
+		}
+		count += s.counts[len(h.buckets)].Load()
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", h.name, labels, count)
+		fmt.Fprintf(w, "%s_sum{%s} %g\n%s_count{%s} %d\n", h.name, labels, time.Duration(s.sum.Load()).Seconds(), h.name, labels, count)
+	}
+}
+
+// handleMetrics writes every metric in the Prometheus text format.
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
@@ -0,0 +1,77 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import "fmt"
+
+var (
+	// snapshotDecoders decode snapshots of a version gob can't decode into
+	// the current GlobalState, because a field changed type. They are
+	// usually a copy of the old types decoded with unmarshalSnapshot and
+	// converted field by field.
+	snapshotDecoders = map[int]func(buffer []byte) (GlobalState, error){}
+
+	// snapshotMigrations[v] upgrades a GlobalState decoded from a snapshot of
+	// version v to version v+1, filling in what the old binary saved
+	// elsewhere or not at all. Adding or removing a field needs no
+	// migration, gob leaves it zero or skips it. Every version below
+	// snapshotVersion needs one, so bumping it takes adding one.
+	snapshotMigrations = map[int]func(state *GlobalState) error{
+		// Version 0 is a snapshot written before GlobalState had a version,
+		// laid out like version 1.
+		0: func(*GlobalState) error { return nil },
+	}
+
+	snapshotMigrationsApplied = newCounter("snapshot_migrations_total", "Snapshots of an older version migrated to the current one when decoded.")
+)
+
+// snapshotHeader is the part of GlobalState decoded first, to pick the
+// decoder and migrations of the rest.
+type snapshotHeader struct {
+	Version int
+}
+
+// decodeSnapshot decrypts, verifies and decodes a snapshot written by this or
+// an older binary and migrates it to snapshotVersion.
+func decodeSnapshot(buffer []byte) (GlobalState, error) {
+	buffer, err := openSnapshot(buffer)
+	if err == nil {
+		buffer, err = verifyChecksum(buffer)
+	}
+	if err != nil {
+		return GlobalState{}, err
+	}
+
+	// A snapshot that predates the version has nothing to decode the header
+	// from, which is version 0.
+	header := snapshotHeader{}
+	_ = unmarshalSnapshot(buffer, &header)
+	if header.Version > snapshotVersion {
+		return GlobalState{}, fmt.Errorf("%w: %d, newest supported is %d", ErrSnapshotVersion, header.Version, snapshotVersion)
+	}
+
+	state := GlobalState{}
+	if decode, ok := snapshotDecoders[header.Version]; ok {
+		if state, err = decode(buffer); err != nil {
+			return GlobalState{}, fmt.Errorf("decoding version %d: %w", header.Version, err)
+		}
+	} else if err := unmarshalSnapshot(buffer, &state); err != nil {
+		return GlobalState{}, fmt.Errorf("decoding version %d: %w", header.Version, err)
+	}
+
+	if header.Version == snapshotVersion {
+		return state, nil
+	}
+	for version := header.Version; version < snapshotVersion; version++ {
+		migrate, ok := snapshotMigrations[version]
+		if !ok {
+			return GlobalState{}, fmt.Errorf("%w: no migration from %d to %d", ErrSnapshotVersion, version, version+1)
+		} else if err := migrate(&state); err != nil {
+			return GlobalState{}, fmt.Errorf("migrating from version %d to %d: %w", version, version+1, err)
+		}
+	}
+	state.Version = snapshotVersion
+	snapshotMigrationsApplied.Inc()
+	return state, nil
+}
@@ -0,0 +1,114 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"testing"
+)
+
+// TestDecodeSnapshotMigrations decodes snapshots of version 0, written
+// before GlobalState had a version, and checks they are brought to
+// snapshotVersion through snapshotMigrations in every encoding.
+func TestDecodeSnapshotMigrations(t *testing.T) {
+	current := snapshotFixture(t)
+	old := current
+	old.Version = 0
+	encoding, migration := config.SnapshotEncoding, snapshotMigrations[0]
+	t.Cleanup(func() { config.SnapshotEncoding, snapshotMigrations[0] = encoding, migration })
+
+	for _, name := range []string{snapshotEncodingGob, snapshotEncodingProtobuf, snapshotEncodingJSON} {
+		t.Run(name, func(t *testing.T) {
+			config.SnapshotEncoding = name
+			data, err := encodeSnapshot(old)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			migrated := 0
+			snapshotMigrations[0] = func(state *GlobalState) error {
+				migrated++
+				return migration(state)
+			}
+			applied := snapshotMigrationsApplied.value.Load()
+			state, err := decodeSnapshot(appendChecksum(data))
+			if err != nil {
+				t.Fatal(err)
+			} else if migrated != 1 {
+				t.Fatalf("migration ran %d times", migrated)
+			} else if snapshotMigrationsApplied.value.Load() != applied+1 {
+				t.Fatal("migration not counted")
+			}
+			assertSnapshotsEqual(t, state, current)
+
+			// A snapshot of the current version isn't migrated.
+			if data, err = encodeSnapshot(current); err != nil {
+				t.Fatal(err)
+			} else if _, err = decodeSnapshot(appendChecksum(data)); err != nil {
+				t.Fatal(err)
+			} else if migrated != 1 {
+				t.Fatal("current snapshot migrated")
+			}
+		})
+	}
+}
+
+func TestDecodeSnapshotMigrationErrors(t *testing.T) {
+	migration := snapshotMigrations[0]
+	t.Cleanup(func() { snapshotMigrations[0] = migration })
+	errMigration := errors.New("migration failed")
+
+	for _, tc := range []struct {
+		name      string
+		version   int
+		migration func(*GlobalState) error
+		err       error
+	}{
+		{"newer version", snapshotVersion + 1, migration, ErrSnapshotVersion},
+		{"missing migration", 0, nil, ErrSnapshotVersion},
+		{"failed migration", 0, func(*GlobalState) error { return errMigration }, errMigration},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.migration == nil {
+				delete(snapshotMigrations, 0)
+			} else {
+				snapshotMigrations[0] = tc.migration
+			}
+			data, err := encodeSnapshot(GlobalState{Version: tc.version, Generation: 3})
+			if err != nil {
+				t.Fatal(err)
+			} else if _, err = decodeSnapshot(appendChecksum(data)); !errors.Is(err, tc.err) {
+				t.Fatalf("got %v, want %v", err, tc.err)
+			}
+		})
+	}
+}
+
+// TestDecodeSnapshotDecoder checks a snapshot of a version with a decoder of
+// its own is decoded with it before being migrated.
+func TestDecodeSnapshotDecoder(t *testing.T) {
+	t.Cleanup(func() { delete(snapshotDecoders, 0) })
+	snapshotDecoders[0] = func(buffer []byte) (GlobalState, error) {
+		old := struct{ Generation int32 }{}
+		if err := unmarshalSnapshot(buffer, &old); err != nil {
+			return GlobalState{}, err
+		}
+		return GlobalState{Generation: uint64(old.Generation) * 2}, nil
+	}
+
+	// A gob snapshot whose Generation was signed, gob can't decode it into
+	// an uint64.
+	var data bytes.Buffer
+	if err := gob.NewEncoder(&data).Encode(struct{ Generation int32 }{21}); err != nil {
+		t.Fatal(err)
+	}
+	state, err := decodeSnapshot(appendChecksum(data.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	} else if state.Generation != 42 || state.Version != snapshotVersion {
+		t.Fatalf("got generation %d, version %d", state.Generation, state.Version)
+	}
+}
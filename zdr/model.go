@@ -0,0 +1,252 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pion/webrtc/v3"
+)
+
+var (
+	// ErrDefaultRoom is returned when closing the default room, which
+	// always exists.
+	ErrDefaultRoom = errors.New("the default room can't be closed")
+
+	// ErrNotViewer is returned when changing the subscriptions of a
+	// broadcaster, which receives nothing.
+	ErrNotViewer = errors.New("broadcasters have no subscriptions")
+
+	// ErrUnknownTrackKind is returned for a kind of track other than
+	// "audio" and "video".
+	ErrUnknownTrackKind = errors.New("unknown track kind")
+)
+
+// Room is a broadcast, for programs embedding the server. It is a handle on
+// the room the handlers, admin API and snapshots work with, so changes made
+// through it are saved and survive restarts like theirs. A Room whose room
+// was closed stays usable, its methods see no participants and Close returns
+// an error.
+type Room struct {
+	room *room
+}
+
+// Participant is a session in a Room, a broadcaster or a viewer.
+type Participant struct {
+	session *session
+}
+
+// PublishedTrack is a track the broadcaster of a Room publishes right now,
+// the simulcast layer it carries in RID, empty for the top one.
+type PublishedTrack struct {
+	Kind     string
+	MimeType string
+	RID      string `json:",omitempty"`
+}
+
+// Rooms returns every room, ordered by ID.
+func (s *Server) Rooms() []*Room {
+	roomsMutex.Lock()
+	out := make([]*Room, 0, len(rooms))
+	for _, room := range rooms {
+		out = append(out, &Room{room})
+	}
+	roomsMutex.Unlock()
+
+	sort.Slice(out, func(i, j int) bool { return out[i].room.id < out[j].room.id })
+	return out
+}
+
+// Room returns the room called id, the default room if id is empty, or nil
+// if there is none.
+func (s *Server) Room(id string) *Room {
+	if room := findRoom(id); room != nil {
+		return &Room{room}
+	}
+	return nil
+}
+
+// CreateRoom adds a room like POST /admin/rooms, from the ID, schedule,
+// policy, tenant and recording policy of state.
+func (s *Server) CreateRoom(state RoomState) (*Room, error) {
+	if state.ID == "" || strings.Contains(state.ID, "/") {
+		return nil, fmt.Errorf("invalid room ID %q", state.ID)
+	}
+
+	room, err := createRoom(RoomState{ID: state.ID, OpensAt: state.OpensAt, ClosesAt: state.ClosesAt, Policy: state.Policy, Recording: state.Recording, Tenant: state.Tenant})
+	if err != nil {
+		return nil, err
+	}
+	return &Room{room}, nil
+}
+
+// Participant returns the session called id, nil if there is none.
+func (s *Server) Participant(id string) *Participant {
+	if session := findSession(id); session != nil {
+		return &Participant{session}
+	}
+	return nil
+}
+
+// ID returns the ID of r.
+func (r *Room) ID() string {
+	return r.room.id
+}
+
+// Tenant returns the tenant r belongs to, empty if none.
+func (r *Room) Tenant() string {
+	return r.room.tenant
+}
+
+// Policy returns the policy profile of r.
+func (r *Room) Policy() Policy {
+	return r.room.policy
+}
+
+// Metadata returns what viewers display about r, nil if nothing was set.
+func (r *Room) Metadata() *RoomMetadata {
+	return r.room.roomMetadata()
+}
+
+// SetMetadata sets what viewers display about r, like PUT
+// /admin/rooms/{id}/metadata.
+func (r *Room) SetMetadata(ctx context.Context, metadata RoomMetadata) error {
+	return setMetadata(ctx, r.room, &metadata)
+}
+
+// Participants returns the sessions of r, the broadcaster first.
+func (r *Room) Participants() []*Participant {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+
+	out := []*Participant{}
+	for _, session := range sessions {
+		if session.room != r.room || session.collecting.Load() {
+			continue
+		}
+		if session.broadcaster {
+			out = append([]*Participant{{session}}, out...)
+		} else {
+			out = append(out, &Participant{session})
+		}
+	}
+	return out
+}
+
+// Broadcaster returns the broadcaster on air in r, the primary or backup
+// ingest, nil if that one isn't connected.
+func (r *Room) Broadcaster() *Participant {
+	backup := r.room.ingest.backup.Load()
+	for _, participant := range r.Participants() {
+		if participant.Broadcaster() && participant.session.backup == backup {
+			return participant
+		}
+	}
+	return nil
+}
+
+// Tracks returns what the broadcaster of r, a WebRTC broadcaster or a
+// headless source, publishes right now.
+func (r *Room) Tracks() []PublishedTrack {
+	out := []PublishedTrack{}
+	if !r.room.haveBroadcaster.Load() {
+		return out
+	}
+
+	out = append(out, PublishedTrack{Kind: webrtc.RTPCodecTypeAudio.String(), MimeType: r.room.audioTrack.Codec().MimeType})
+	for _, mimeType := range videoCodecs {
+		track := r.room.videoTrack(mimeType)
+		if track == nil || !r.room.hasSource(mimeType) {
+			continue
+		}
+		out = append(out, PublishedTrack{Kind: webrtc.RTPCodecTypeVideo.String(), MimeType: track.Codec().MimeType})
+
+		rids := []string{}
+		for rid := range r.room.layerTracks[strings.ToLower(mimeType)] {
+			rids = append(rids, rid)
+		}
+		sort.Strings(rids)
+		for _, rid := range rids {
+			out = append(out, PublishedTrack{Kind: webrtc.RTPCodecTypeVideo.String(), MimeType: track.Codec().MimeType, RID: rid})
+		}
+	}
+	return out
+}
+
+// Publish attaches the headless source called name of Config.Sources to r as
+// its broadcaster, like POST /admin/rooms/{id}/source. A live WebRTC
+// broadcaster is never replaced.
+func (r *Room) Publish(name string) error {
+	if err := attachSource(r.room, name); err != nil {
+		return err
+	}
+
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	return serialize(context.Background())
+}
+
+// Unpublish detaches the headless source of r, if any.
+func (r *Room) Unpublish() error {
+	detachSource(r.room)
+
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	return serialize(context.Background())
+}
+
+// Close removes r, telling its participants and closing their sessions.
+func (r *Room) Close() error {
+	if r.room.id == defaultRoomID {
+		return ErrDefaultRoom
+	}
+	return closeRoom(r.room)
+}
+
+// ID returns the session ID of p.
+func (p *Participant) ID() string {
+	return p.session.id
+}
+
+// Room returns the room p joined.
+func (p *Participant) Room() *Room {
+	return &Room{p.session.room}
+}
+
+// Broadcaster reports whether p broadcasts, as the primary or backup ingest.
+func (p *Participant) Broadcaster() bool {
+	return p.session.broadcaster
+}
+
+// Principal returns who created p, empty without an auth provider.
+func (p *Participant) Principal() Principal {
+	return p.session.principal
+}
+
+// Subscriptions returns the kinds of track p receives.
+func (p *Participant) Subscriptions() []string {
+	return subscribedKinds(p.session)
+}
+
+// Subscribe makes p receive the tracks of kinds, "audio" or "video", of its
+// room. Its client is asked over /events to renegotiate.
+func (p *Participant) Subscribe(ctx context.Context, kinds ...string) error {
+	return changeSubscriptions(ctx, p.session, kinds, nil)
+}
+
+// Unsubscribe stops sending p the tracks of kinds of its room.
+func (p *Participant) Unsubscribe(ctx context.Context, kinds ...string) error {
+	return changeSubscriptions(ctx, p.session, nil, kinds)
+}
+
+// Close ends the session of p, it is never resumed. Its client is told
+// first, like for any session the server ends.
+func (p *Participant) Close() {
+	recordHistory(p.session, historyControl, "closed by the server")
+	collectSession(p.session, tombstoneClosedByServer)
+}
@@ -0,0 +1,203 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	muteCheckInterval = 250 * time.Millisecond
+	muteFillFrameRate = 10
+)
+
+var (
+	trackMutes = newCounter("track_mutes_total", "Broadcaster tracks that stopped sending while the broadcaster was still there.")
+
+	// muteFillFrame is the first frame of -mute-fill-frame, sent in place of
+	// muted video. muteFillMimeType is its codec.
+	muteFillFrame    []byte
+	muteFillMimeType string
+)
+
+// trackActivity follows one kind of broadcaster track of a room. A track is
+// muted when the broadcaster is there but it sent nothing for -mute-timeout,
+// like when the broadcaster replaced it with nothing or turned off a camera
+// in a way that stops packets.
+type trackActivity struct {
+	lastPacket atomic.Int64
+	muted      atomic.Bool
+
+	fillMutex sync.Mutex
+	fill      *attachment
+}
+
+func newTrackActivities() map[string]*trackActivity {
+	out := map[string]*trackActivity{}
+	for _, kind := range trackKinds {
+		out[kind] = &trackActivity{}
+	}
+	return out
+}
+
+// markTrackAlive is called for every packet forwarded to room of kind.
+func markTrackAlive(room *room, kind webrtc.RTPCodecType) {
+	if activity, ok := room.activity[kind.String()]; ok {
+		activity.lastPacket.Store(time.Now().UnixNano())
+	}
+}
+
+// mutedKinds returns the kinds of track of r that are muted.
+func (r *room) mutedKinds() []string {
+	out := []string{}
+	for _, kind := range trackKinds {
+		if r.activity[kind].muted.Load() {
+			out = append(out, kind)
+		}
+	}
+	return out
+}
+
+// restoreMutes brings back the muted tracks of a snapshot, filling in for
+// them right away.
+func (r *room) restoreMutes(muted []string) {
+	if config.MuteTimeout <= 0 {
+		return
+	}
+	for _, kind := range muted {
+		if activity, ok := r.activity[kind]; ok {
+			activity.muted.Store(true)
+			r.startFill(kind)
+		}
+	}
+}
+
+// watchMutes tells viewers when a track of their broadcaster goes quiet or
+// comes back, and fills in for it with -mute-fill.
+func watchMutes(ctx context.Context) {
+	every(ctx, muteCheckInterval, func(now time.Time) {
+		roomsMutex.Lock()
+		all := []*room{}
+		for _, room := range rooms {
+			all = append(all, room)
+		}
+		roomsMutex.Unlock()
+
+		changed := false
+		for _, room := range all {
+			for _, kind := range trackKinds {
+				if kind == webrtc.RTPCodecTypeVideo.String() && room.defaultVideoCodec() == "" {
+					continue
+				}
+
+				// A broadcaster that just arrived is given -mute-timeout to
+				// start sending, a track that is muted stays so until it does.
+				activity := room.activity[kind]
+				quiet := now.Sub(time.Unix(0, activity.lastPacket.Load())) >= config.MuteTimeout
+				if !activity.muted.Load() {
+					quiet = quiet && now.Sub(time.Unix(0, room.broadcasterSince.Load())) >= config.MuteTimeout
+				}
+				muted := room.haveBroadcaster.Load() && quiet
+				if activity.muted.CompareAndSwap(!muted, muted) {
+					setMuted(room, kind, muted)
+					changed = true
+				}
+			}
+		}
+
+		if changed {
+			sessionsMutex.Lock()
+			if err := serialize(context.Background()); err != nil {
+				logf("Failed to serialize: %v\n", err)
+			}
+			sessionsMutex.Unlock()
+		}
+	})
+}
+
+// setMuted tells the viewers of room that a track was muted or unmuted, and
+// starts or stops filling in for it. A broadcaster that is gone altogether
+// has its tracks unmuted without telling anyone, viewers are told the
+// broadcaster was lost instead.
+func setMuted(room *room, kind string, muted bool) {
+	name := "trackUnmuted"
+	if muted {
+		name = "trackMuted"
+		trackMutes.Inc()
+		logf("The %s of the broadcaster of room %s is muted\n", kind, room.id)
+		room.startFill(kind)
+	} else {
+		logf("The %s of the broadcaster of room %s is unmuted\n", kind, room.id)
+		room.stopFill(kind)
+		if !room.haveBroadcaster.Load() {
+			return
+		}
+	}
+
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	for _, session := range sessions {
+		if session.room == room && !session.broadcaster {
+			publishEvent(session.id, event{Name: name, Data: kind})
+		}
+	}
+}
+
+// startFill sends silence or -mute-fill-frame in place of the muted track of
+// kind, so jitter buffers and recordings of viewers keep going. Frames are
+// injected, so the broadcaster's packets carry on after them once it sends
+// again.
+func (r *room) startFill(kind string) {
+	if !config.MuteFill {
+		return
+	} else if config.E2EEHeaderExtension != "" {
+		// Viewers would fail to decrypt frames we generated.
+		return
+	}
+
+	track, frame, interval := r.audioTrack, opusSilence, opusFrameDuration
+	if kind == webrtc.RTPCodecTypeVideo.String() {
+		track, frame, interval = r.videoTrack(muteFillMimeType), muteFillFrame, time.Second/muteFillFrameRate
+	}
+	if track == nil || frame == nil {
+		return
+	}
+
+	activity := r.activity[kind]
+	activity.fillMutex.Lock()
+	defer activity.fillMutex.Unlock()
+	if activity.fill != nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	activity.fill = &attachment{cancel: cancel, done: make(chan struct{})}
+	go func(done chan struct{}) {
+		defer close(done)
+		pace(ctx, interval, func() error { //nolint:errcheck
+			if err := injectFrame(track, frame); err != nil {
+				logf("Failed to fill in for track %s: %v\n", track.ID(), err)
+			}
+			return nil
+		})
+	}(activity.fill.done)
+}
+
+// stopFill stops filling in for the track of kind and waits for it.
+func (r *room) stopFill(kind string) {
+	activity := r.activity[kind]
+	activity.fillMutex.Lock()
+	defer activity.fillMutex.Unlock()
+
+	if activity.fill != nil {
+		activity.fill.cancel()
+		<-activity.fill.done
+		activity.fill = nil
+	}
+}
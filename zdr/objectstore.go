@@ -0,0 +1,237 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// objectWatchInterval is how often an object store looks for a new snapshot
+// saved by another process, each look is a HEAD request.
+const objectWatchInterval = time.Second
+
+var errObjectStore = errors.New("object store")
+
+// objectStore is a StateStore keeping snapshots in an S3 bucket, or any
+// store speaking its API such as Google Cloud Storage or MinIO, for
+// containers without a persistent volume. Generation n of a partition is the
+// object prefix/snapshot.n, or prefix/snapshot.tenant-id.n for a tenant.
+// Requests are signed with AWS Signature Version 4, see signAWS.
+type objectStore struct {
+	// endpoint is the scheme and host requests are sent to, with the bucket
+	// as the first path segment if pathStyle.
+	endpoint  string
+	pathStyle bool
+	bucket    string
+	prefix    string
+	region    string
+
+	credentials awsCredentials
+
+	client *http.Client
+}
+
+// newObjectStore returns the store of a URL like
+// s3://bucket/prefix?region=eu-west-1 or gs://bucket/prefix. Credentials come
+// from the user and password of the URL, or the AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN variables. Google Cloud Storage
+// takes the HMAC keys of a service account. ?endpoint= sends requests to
+// another S3 compatible store, with the bucket in the path.
+func newObjectStore(spec string) (*objectStore, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, err
+	} else if u.Scheme != "s3" && u.Scheme != "gs" || u.Host == "" {
+		return nil, fmt.Errorf("%w: %q is not an s3:// or gs:// URL", errInvalidStateStore, spec)
+	}
+
+	query := u.Query()
+	store := &objectStore{
+		bucket:      u.Host,
+		prefix:      strings.Trim(u.Path, "/"),
+		region:      query.Get("region"),
+		credentials: awsCredentialsFromEnv(),
+		client:      &http.Client{},
+	}
+	if store.prefix == "" {
+		store.prefix = "zdr"
+	}
+	if u.User != nil {
+		store.credentials = awsCredentials{accessKey: u.User.Username()}
+		store.credentials.secretKey, _ = u.User.Password()
+	}
+	if store.credentials.accessKey == "" || store.credentials.secretKey == "" {
+		return nil, fmt.Errorf("%w: no credentials for %s://%s", errInvalidStateStore, u.Scheme, u.Host)
+	}
+
+	switch endpoint := query.Get("endpoint"); {
+	case endpoint != "":
+		e, err := url.Parse(endpoint)
+		if err != nil || e.Scheme != "http" && e.Scheme != "https" || e.Host == "" {
+			return nil, fmt.Errorf("%w: endpoint %q", errInvalidStateStore, endpoint)
+		}
+		store.endpoint, store.pathStyle = e.Scheme+"://"+e.Host, true
+	case u.Scheme == "gs":
+		store.endpoint, store.pathStyle = "https://storage.googleapis.com", true
+	default:
+		if store.region == "" {
+			store.region = "us-east-1"
+		}
+		store.endpoint = fmt.Sprintf("https://%s.s3.%s.amazonaws.com", store.bucket, store.region)
+	}
+	if store.region == "" {
+		store.region = "auto"
+	}
+	return store, nil
+}
+
+func (o *objectStore) key(partition string, n int) string {
+	if partition == "" {
+		return fmt.Sprintf("%s/snapshot.%d", o.prefix, n)
+	}
+	return fmt.Sprintf("%s/snapshot.tenant-%s.%d", o.prefix, partition, n)
+}
+
+// Save copies every generation of partition one back, oldest first, then
+// uploads data as the newest. Objects can't be renamed, so unlike the other
+// stores a reader may see a generation twice while the copies run, never a
+// half written one.
+func (o *objectStore) Save(ctx context.Context, partition string, data []byte) error {
+	for n := config.SnapshotGenerations - 1; n > 0; n-- {
+		source := "/" + o.bucket + "/" + objectEscape(o.key(partition, n-1))
+		response, err := o.do(ctx, http.MethodPut, o.key(partition, n), nil, map[string]string{"x-amz-copy-source": source})
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		// A copy can fail after the 200 is sent, with the error in the body.
+		body, err := io.ReadAll(response.Body)
+		response.Body.Close()
+		if err != nil {
+			return err
+		} else if bytes.Contains(body, []byte("<Error>")) {
+			return fmt.Errorf("%w: copying %s: %s", errObjectStore, o.key(partition, n-1), body)
+		}
+	}
+
+	response, err := o.do(ctx, http.MethodPut, o.key(partition, 0), data, nil)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	return nil
+}
+
+func (o *objectStore) Load(ctx context.Context, partition string, n int) ([]byte, error) {
+	response, err := o.do(ctx, http.MethodGet, o.key(partition, n), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	return io.ReadAll(response.Body)
+}
+
+// Watch polls the ETag of the newest generation of partition, object stores
+// don't push changes without setting up notifications.
+func (o *objectStore) Watch(ctx context.Context, partition string) (<-chan struct{}, error) {
+	etag, err := o.etag(ctx, partition)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	saved := make(chan struct{}, 1)
+	go func() {
+		defer close(saved)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(objectWatchInterval):
+			}
+
+			// Errors are retried on the next look, like a missing file.
+			current, err := o.etag(ctx, partition)
+			if err != nil || current == etag {
+				continue
+			}
+			etag = current
+			select {
+			case saved <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return saved, nil
+}
+
+// etag returns the ETag of the newest generation of partition.
+func (o *objectStore) etag(ctx context.Context, partition string) (string, error) {
+	response, err := o.do(ctx, http.MethodHead, o.key(partition, 0), nil, nil)
+	if err != nil {
+		return "", err
+	}
+	response.Body.Close()
+	return response.Header.Get("ETag"), nil
+}
+
+// do sends a signed request for key with body and the extra headers. A 404
+// is reported as fs.ErrNotExist, any other status but 200 as an error.
+func (o *objectStore) do(ctx context.Context, method, key string, body []byte, headers map[string]string) (*http.Response, error) {
+	path := "/" + objectEscape(key)
+	if o.pathStyle {
+		path = "/" + o.bucket + path
+	}
+	request, err := http.NewRequestWithContext(ctx, method, o.endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request.URL.RawPath = path
+	if body == nil {
+		request.Body, request.ContentLength = http.NoBody, 0
+	}
+	for name, value := range headers {
+		request.Header.Set(name, value)
+	}
+	signAWS(request, body, "s3", o.region, o.credentials, time.Now())
+
+	response, err := o.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	switch response.StatusCode {
+	case http.StatusOK:
+		return response, nil
+	case http.StatusNotFound:
+		response.Body.Close()
+		return nil, fmt.Errorf("%w: %s", fs.ErrNotExist, key)
+	}
+	message, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+	response.Body.Close()
+	return nil, fmt.Errorf("%w: %s %s: %s: %s", errObjectStore, method, key, response.Status, bytes.TrimSpace(message))
+}
+
+// objectEscape escapes an object key the way Signature Version 4 expects,
+// everything but unreserved characters and the slashes between segments.
+func objectEscape(key string) string {
+	var escaped strings.Builder
+	for _, c := range []byte(key) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', strings.IndexByte("-_.~/", c) >= 0:
+			escaped.WriteByte(c)
+		default:
+			fmt.Fprintf(&escaped, "%%%02X", c)
+		}
+	}
+	return escaped.String()
+}
@@ -0,0 +1,267 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// pacerMaxQueue is how many packets a pacer holds at most, packets beyond
+// it are dropped rather than delayed any further.
+const pacerMaxQueue = 1024
+
+var (
+	pacerDroppedPackets = newCounter("pacer_dropped_packets_total", "Packets to viewers dropped for overflowing their pacer.")
+	_                   = newGauge("pacer_queued_bytes", "Bytes held by the pacers of viewers.", func() float64 {
+		sessionsMutex.Lock()
+		defer sessionsMutex.Unlock()
+
+		n := 0
+		for _, session := range sessions {
+			session.pacer.mu.Lock()
+			n += session.pacer.queuedBytes
+			session.pacer.mu.Unlock()
+		}
+		return float64(n)
+	})
+)
+
+// PacerState is the pacer of a viewer as saved in the snapshot, so a restart
+// carries on with the settings it was given and what it still owes rather
+// than letting a full burst through.
+type PacerState struct {
+	// Rate in bits per second and Burst in bytes override -pacing-rate and
+	// -pacing-burst when set.
+	Rate  uint64 `json:",omitempty"`
+	Burst int    `json:",omitempty"`
+
+	// Tokens is how many bytes can be sent right away, negative when the
+	// last packets sent went over.
+	Tokens int
+}
+
+// pacerState spreads what a viewer is sent over time, so a keyframe goes
+// out at the pacing rate instead of as one burst a constrained link drops
+// half of. Tokens refill at the rate every -pacing-interval up to the
+// burst, and queued packets are sent while there are tokens left. The
+// packet that goes over is sent anyway, and the debt is paid off first.
+// Without a rate packets go straight through.
+type pacerState struct {
+	mu          sync.Mutex
+	rate        uint64
+	burst       int
+	tokens      int
+	refilled    time.Time
+	queue       []pacedPacket
+	queuedBytes int
+
+	// running is set while a goroutine drains the queue, packets are
+	// queued behind the ones it is sending until it stops.
+	running bool
+}
+
+type pacedPacket struct {
+	writer  interceptor.RTPWriter
+	header  rtp.Header
+	payload []byte
+}
+
+// settings returns the rate and burst the pacer applies, its own or the
+// configured ones.
+func (p *pacerState) settings() (uint64, int) {
+	rate, burst := p.rate, p.burst
+	if rate == 0 {
+		rate = config.PacingRate
+	}
+	if burst == 0 {
+		burst = config.PacingBurst
+	}
+	return rate, burst
+}
+
+// persisted returns the pacer to save.
+func (p *pacerState) persisted() PacerState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return PacerState{Rate: p.rate, Burst: p.burst, Tokens: p.tokens}
+}
+
+func (p *pacerState) restore(state PacerState) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rate, p.burst, p.tokens = state.Rate, state.Burst, state.Tokens
+	p.refilled = time.Now()
+}
+
+// refill adds the tokens earned since the last refill and returns the rate,
+// p.mu must be held. A pacer that wasn't used for long refills up to the
+// burst, as does a new one.
+func (p *pacerState) refill(now time.Time) uint64 {
+	rate, burst := p.settings()
+	elapsed := now.Sub(p.refilled)
+	if p.refilled.IsZero() || elapsed > time.Second {
+		elapsed = time.Second
+	}
+	p.tokens += int(rate * uint64(elapsed) / 8 / uint64(time.Second))
+	if p.tokens > burst {
+		p.tokens = burst
+	}
+	p.refilled = now
+	return rate
+}
+
+// set changes the rate and burst of the pacer, 0 for the configured ones.
+func (p *pacerState) set(rate uint64, burst int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rate, p.burst = rate, burst
+}
+
+// write sends the packet right away or queues it for run to send.
+func (p *pacerState) write(session *session, writer interceptor.RTPWriter, header *rtp.Header, payload []byte, attributes interceptor.Attributes) (int, error) {
+	size := header.MarshalSize() + len(payload)
+
+	p.mu.Lock()
+	if rate := p.refill(time.Now()); !p.running && (rate == 0 || p.tokens > 0) {
+		if rate != 0 {
+			p.tokens -= size
+		}
+		p.mu.Unlock()
+		return writer.Write(header, payload, attributes)
+	} else if len(p.queue) >= pacerMaxQueue {
+		p.mu.Unlock()
+		pacerDroppedPackets.Inc()
+		return size, nil
+	}
+
+	// Both are shared with every other viewer of the track.
+	p.queue = append(p.queue, pacedPacket{writer: writer, header: header.Clone(), payload: append([]byte{}, payload...)})
+	p.queuedBytes += size
+	start := !p.running
+	p.running = true
+	p.mu.Unlock()
+
+	if start {
+		supervise("pacer", session, func() { p.run(session) })
+	}
+	return size, nil
+}
+
+// run sends what is queued as tokens allow until nothing is left or the
+// PeerConnection is closed.
+func (p *pacerState) run(session *session) {
+	ticker := time.NewTicker(config.PacingInterval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		closed := session.peerConnection.ConnectionState() == webrtc.PeerConnectionStateClosed
+
+		p.mu.Lock()
+		rate := p.refill(now)
+		sent := 0
+		for sent < len(p.queue) && (rate == 0 || p.tokens > 0) && !closed {
+			size := p.queue[sent].header.MarshalSize() + len(p.queue[sent].payload)
+			p.tokens -= size
+			p.queuedBytes -= size
+			sent++
+		}
+		send := p.queue[:sent:sent]
+		p.queue = p.queue[sent:]
+		if closed {
+			p.queue, p.queuedBytes = nil, 0
+		}
+		p.mu.Unlock()
+
+		for _, packet := range send {
+			if _, err := packet.writer.Write(&packet.header, packet.payload, interceptor.Attributes{}); err != nil {
+				logf("Failed to write paced packet of PeerConnection %s: %v\n", session.id, err)
+			}
+		}
+
+		// Packets written from now on may skip the queue, so it only stops
+		// once what it took is out.
+		p.mu.Lock()
+		idle := len(p.queue) == 0
+		if idle {
+			p.running, p.queue = false, nil
+		}
+		p.mu.Unlock()
+		if idle {
+			return
+		}
+	}
+}
+
+type pacerInterceptorFactory struct {
+	session *session
+}
+
+func (f *pacerInterceptorFactory) NewInterceptor(string) (interceptor.Interceptor, error) {
+	return &pacerInterceptor{session: f.session}, nil
+}
+
+type pacerInterceptor struct {
+	interceptor.NoOp
+	session *session
+}
+
+func (i *pacerInterceptor) BindLocalStream(_ *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	return interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, attributes interceptor.Attributes) (int, error) {
+		return i.session.pacer.write(i.session, writer, header, payload, attributes)
+	})
+}
+
+// handleAdminPacer returns the pacer of a viewer on GET, PUT or POST set its
+// rate in bits per second and its burst in bytes, 0 for the configured ones.
+func handleAdminPacer(w http.ResponseWriter, r *http.Request, session *session) {
+	switch r.Method {
+	case http.MethodGet:
+		state := session.pacer.persisted()
+		session.pacer.mu.Lock()
+		rate, burst := session.pacer.settings()
+		queued := len(session.pacer.queue)
+		session.pacer.mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			PacerState
+			EffectiveRate  uint64
+			EffectiveBurst int
+			Queued         int
+		}{state, rate, burst, queued})
+	case http.MethodPut, http.MethodPost:
+		var in struct {
+			Rate  uint64
+			Burst int
+		}
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if in.Burst < 0 {
+			http.Error(w, "burst can't be negative", http.StatusBadRequest)
+			return
+		}
+
+		session.pacer.set(in.Rate, in.Burst)
+		recordHistory(session, historyControl, "pacing set to %d bps with bursts of %d bytes", in.Rate, in.Burst)
+		sessionsMutex.Lock()
+		err := serialize(r.Context())
+		sessionsMutex.Unlock()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,138 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// pauseState stops forwarding to a single viewer while keeping its transport
+// alive. Every viewer shares the same output tracks, so packets are dropped
+// per PeerConnection by pauseInterceptor instead.
+type pauseState struct {
+	paused atomic.Bool
+
+	// dropped counts the packets dropped per SSRC. Sequence numbers are
+	// shifted by it so the viewer doesn't see a gap and ask for packets that
+	// were never sent. Timestamps are left alone, they still follow the
+	// broadcaster clock and so jump by exactly the time spent paused.
+	droppedMutex sync.Mutex
+	dropped      map[uint32]uint16
+}
+
+type pauseInterceptorFactory struct {
+	state *pauseState
+}
+
+func (f *pauseInterceptorFactory) NewInterceptor(string) (interceptor.Interceptor, error) {
+	return &pauseInterceptor{state: f.state}, nil
+}
+
+type pauseInterceptor struct {
+	interceptor.NoOp
+	state *pauseState
+}
+
+func (i *pauseInterceptor) BindLocalStream(info *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	return interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, attributes interceptor.Attributes) (int, error) {
+		i.state.droppedMutex.Lock()
+		if i.state.paused.Load() {
+			i.state.dropped[info.SSRC]++
+			i.state.droppedMutex.Unlock()
+			return header.MarshalSize() + len(payload), nil
+		}
+		dropped := i.state.dropped[info.SSRC]
+		i.state.droppedMutex.Unlock()
+
+		// The header is shared with every other viewer of the track.
+		shifted := *header
+		shifted.SequenceNumber -= dropped
+		return writer.Write(&shifted, payload, attributes)
+	})
+}
+
+// droppedPackets returns a copy of the sequence number shifts to persist.
+func (s *pauseState) droppedPackets() map[uint32]uint16 {
+	s.droppedMutex.Lock()
+	defer s.droppedMutex.Unlock()
+
+	out := make(map[uint32]uint16, len(s.dropped))
+	for ssrc, dropped := range s.dropped {
+		out[ssrc] = dropped
+	}
+	return out
+}
+
+// setPaused pauses or resumes forwarding to session and persists it. Video
+// resumes on the next keyframe, which the PLI sender asks for every 200ms.
+func setPaused(ctx context.Context, session *session, paused bool) error {
+	session.pause.paused.Store(paused)
+	if paused {
+		recordHistory(session, historyControl, "paused")
+	} else {
+		recordHistory(session, historyControl, "resumed")
+	}
+
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	return serialize(ctx)
+}
+
+// handlePause serves /sessions/{id}/pause and /sessions/{id}/resume.
+func handlePause(w http.ResponseWriter, r *http.Request, session *session, paused bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	} else if session.broadcaster {
+		http.Error(w, "broadcasters can't be paused", http.StatusBadRequest)
+		return
+	}
+
+	if err := setPaused(r.Context(), session, paused); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// onDataChannelHandler accepts "pause" and "resume" commands from viewers
+// over any DataChannel they open, except the ones logs are uploaded and the
+// store of the session is used over.
+func onDataChannelHandler(session *session, dataChannel *webrtc.DataChannel) {
+	switch dataChannel.Label() {
+	case clientLogLabel:
+		onClientLogChannel(session, dataChannel)
+		return
+	case kvLabel:
+		onKVChannel(session, dataChannel)
+		return
+	}
+
+	dataChannel.OnMessage(func(msg webrtc.DataChannelMessage) {
+		if !msg.IsString || session.broadcaster {
+			return
+		}
+
+		var paused bool
+		switch string(msg.Data) {
+		case "pause":
+			paused = true
+		case "resume":
+		default:
+			return
+		}
+
+		if err := setPaused(context.Background(), session, paused); err != nil {
+			logf("Failed to persist pause of %s: %v\n", session.id, err)
+		}
+	})
+}
@@ -0,0 +1,218 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+var payloadTypeRemaps = newCounter("payload_type_remaps_total", "Resumed sessions whose client uses other payload types than the resumed PeerConnection.")
+
+// PayloadTypeMapping is the payload type a client uses for a codec, as
+// answered to it.
+type PayloadTypeMapping struct {
+	MimeType    string
+	SDPFmtpLine string `json:",omitempty"`
+	PayloadType uint8
+}
+
+// payloadTypes are the payload types the client of a session uses. A
+// session resumed by another version of the server may answer with other
+// payload types than the client was answered with, since the client never
+// sees that answer both are mapped on the fly: out from the PeerConnection
+// to the client, in the other way round.
+type payloadTypes struct {
+	mu      sync.RWMutex
+	client  []PayloadTypeMapping
+	out, in map[uint8]uint8
+}
+
+// negotiated records the payload types of an answer sent to the client, no
+// mapping is needed anymore.
+func (p *payloadTypes) negotiated(answer webrtc.SessionDescription) {
+	client := answeredPayloadTypes(answer)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.client, p.out, p.in = client, nil, nil
+}
+
+// resume maps the payload types of answer, which the client never sees, to
+// those of client, the mapping it was answered with before. It returns the
+// payload types mapped, none for snapshots from before they were saved.
+func (p *payloadTypes) resume(client []PayloadTypeMapping, answer webrtc.SessionDescription) map[uint8]uint8 {
+	ours := answeredPayloadTypes(answer)
+	if len(client) == 0 {
+		client = ours
+	}
+
+	theirs := payloadTypeKeys(client)
+	out, in := map[uint8]uint8{}, map[uint8]uint8{}
+	for key, pt := range payloadTypeKeys(ours) {
+		if clientPT, ok := theirs[key]; ok && clientPT != pt {
+			out[pt], in[clientPT] = clientPT, pt
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.client, p.out, p.in = client, out, in
+	return out
+}
+
+// clientPayloadTypes returns the payload types to save.
+func (p *payloadTypes) clientPayloadTypes() []PayloadTypeMapping {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return append([]PayloadTypeMapping{}, p.client...)
+}
+
+func (p *payloadTypes) outgoing(pt uint8) (uint8, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	mapped, ok := p.out[pt]
+	return mapped, ok
+}
+
+func (p *payloadTypes) incoming(pt uint8) (uint8, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	mapped, ok := p.in[pt]
+	return mapped, ok
+}
+
+// answeredPayloadTypes returns the payload type of every codec of answer.
+func answeredPayloadTypes(answer webrtc.SessionDescription) []PayloadTypeMapping {
+	parsed := &sdp.SessionDescription{}
+	if err := parsed.Unmarshal([]byte(answer.SDP)); err != nil {
+		return nil
+	}
+
+	out, seen := []PayloadTypeMapping{}, map[uint8]bool{}
+	for _, media := range parsed.MediaDescriptions {
+		for _, format := range media.MediaName.Formats {
+			pt, err := strconv.ParseUint(format, 10, 7)
+			if err != nil || seen[uint8(pt)] {
+				continue
+			}
+			codec, err := parsed.GetCodecForPayloadType(uint8(pt))
+			if err != nil {
+				continue
+			}
+			seen[uint8(pt)] = true
+			out = append(out, PayloadTypeMapping{
+				MimeType:    media.MediaName.Media + "/" + strings.ToLower(codec.Name),
+				SDPFmtpLine: codec.Fmtp,
+				PayloadType: uint8(pt),
+			})
+		}
+	}
+	return out
+}
+
+// payloadTypeKeys returns the payload types of mappings by what tells their
+// codecs apart across versions: the mime type and fmtp line, or the mime
+// type alone where it is unique, as versions may differ in the fmtp lines
+// they answer. Retransmissions are told apart by the codec they carry, whose
+// payload type is in their fmtp line.
+func payloadTypeKeys(mappings []PayloadTypeMapping) map[string]uint8 {
+	sorted := append([]PayloadTypeMapping{}, mappings...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return strings.HasSuffix(sorted[j].MimeType, "/rtx") && !strings.HasSuffix(sorted[i].MimeType, "/rtx")
+	})
+
+	perMimeType := map[string]int{}
+	for _, mapping := range sorted {
+		perMimeType[mapping.MimeType]++
+	}
+
+	keys, byPT := map[string]uint8{}, map[uint8]string{}
+	for _, mapping := range sorted {
+		key := mapping.MimeType + ";" + mapping.SDPFmtpLine
+		if strings.HasSuffix(mapping.MimeType, "/rtx") {
+			apt, err := strconv.ParseUint(strings.TrimPrefix(mapping.SDPFmtpLine, "apt="), 10, 7)
+			if err != nil || byPT[uint8(apt)] == "" {
+				continue
+			}
+			key = mapping.MimeType + ";" + byPT[uint8(apt)]
+		} else if perMimeType[mapping.MimeType] == 1 {
+			key = mapping.MimeType
+		}
+		keys[key], byPT[mapping.PayloadType] = mapping.PayloadType, key
+	}
+	return keys
+}
+
+// describePayloadTypes formats mapped payload types for the session history.
+func describePayloadTypes(mapped map[uint8]uint8) string {
+	pts := []int{}
+	for pt := range mapped {
+		pts = append(pts, int(pt))
+	}
+	sort.Ints(pts)
+
+	out := []string{}
+	for _, pt := range pts {
+		out = append(out, fmt.Sprintf("%d to %d", pt, mapped[uint8(pt)]))
+	}
+	return strings.Join(out, ", ")
+}
+
+type payloadTypeInterceptorFactory struct {
+	session *session
+}
+
+func (f *payloadTypeInterceptorFactory) NewInterceptor(string) (interceptor.Interceptor, error) {
+	return &payloadTypeInterceptor{types: &f.session.payloadTypes}, nil
+}
+
+// payloadTypeInterceptor maps the payload types of a resumed session, see
+// payloadTypes. It sits right above the capture, so captures show what the
+// client actually gets and everything above works with the payload types
+// of the PeerConnection.
+type payloadTypeInterceptor struct {
+	interceptor.NoOp
+	types *payloadTypes
+}
+
+func (i *payloadTypeInterceptor) BindLocalStream(_ *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	return interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, attributes interceptor.Attributes) (int, error) {
+		if pt, ok := i.types.outgoing(header.PayloadType); ok {
+			// The header is shared with every other viewer of the track.
+			mapped := *header
+			mapped.PayloadType = pt
+			header = &mapped
+		}
+		return writer.Write(header, payload, attributes)
+	})
+}
+
+func (i *payloadTypeInterceptor) BindRemoteStream(_ *interceptor.StreamInfo, reader interceptor.RTPReader) interceptor.RTPReader {
+	return interceptor.RTPReaderFunc(func(b []byte, attributes interceptor.Attributes) (int, interceptor.Attributes, error) {
+		n, attributes, err := reader.Read(b, attributes)
+		if err != nil || n < 2 {
+			return n, attributes, err
+		}
+		if pt, ok := i.types.incoming(b[1] & 0x7f); ok {
+			b[1] = b[1]&0x80 | pt
+			// A header unmarshaled by the interceptors below is kept in
+			// attributes and would still carry the payload type of the client.
+			if attributes != nil {
+				if header, headerErr := attributes.GetRTPHeader(b[:n]); headerErr == nil {
+					header.PayloadType = pt
+				}
+			}
+		}
+		return n, attributes, err
+	})
+}
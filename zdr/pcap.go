@@ -0,0 +1,278 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+)
+
+var errCaptureRunning = errors.New("a capture is already running for this session")
+
+// Captured packets are wrapped in made up IPv4/UDP headers so Wireshark can
+// decode them with "Decode As RTP". The direction is told apart by address.
+const (
+	linkTypeRaw = 101
+	captureLen  = 65535
+	capturePort = 5004
+)
+
+var (
+	captureRemoteAddr = [4]byte{10, 0, 0, 1}
+	captureLocalAddr  = [4]byte{10, 0, 0, 2}
+)
+
+// packetCapture writes the RTP and RTCP of one session to a pcap file before
+// SRTP encryption and after decryption. It stops by itself at its limits.
+type packetCapture struct {
+	path string
+
+	mu       sync.Mutex
+	file     *os.File
+	written  int64
+	maxBytes int64
+	timer    *time.Timer
+}
+
+func newPacketCapture(session *session, maxBytes int64, maxDuration time.Duration) (*packetCapture, error) {
+	path := filepath.Join(config.PcapDir, fmt.Sprintf("%s-%d.pcap", session.id, time.Now().Unix()))
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(header[4:], 2)
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], captureLen)
+	binary.LittleEndian.PutUint32(header[20:], linkTypeRaw)
+	if _, err = file.Write(header); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	capture := &packetCapture{path: path, file: file, written: int64(len(header)), maxBytes: maxBytes}
+	capture.timer = time.AfterFunc(maxDuration, func() {
+		session.capture.CompareAndSwap(capture, nil)
+		capture.stop()
+	})
+	return capture, nil
+}
+
+// write adds a single packet, inbound tells which side sent it.
+func (c *packetCapture) write(packet []byte, inbound bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.file == nil {
+		return
+	}
+
+	src, dst := captureLocalAddr, captureRemoteAddr
+	if inbound {
+		src, dst = dst, src
+	}
+
+	record := make([]byte, 16+28, 16+28+len(packet))
+	now := time.Now()
+	binary.LittleEndian.PutUint32(record[0:], uint32(now.Unix()))
+	binary.LittleEndian.PutUint32(record[4:], uint32(now.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(record[8:], uint32(28+len(packet)))
+	binary.LittleEndian.PutUint32(record[12:], uint32(28+len(packet)))
+
+	ip := record[16:36]
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:], uint16(28+len(packet)))
+	ip[8] = 64
+	ip[9] = 17
+	copy(ip[12:], src[:])
+	copy(ip[16:], dst[:])
+	binary.BigEndian.PutUint16(ip[10:], ipv4Checksum(ip))
+
+	udp := record[36:44]
+	binary.BigEndian.PutUint16(udp[0:], capturePort)
+	binary.BigEndian.PutUint16(udp[2:], capturePort)
+	binary.BigEndian.PutUint16(udp[4:], uint16(8+len(packet)))
+
+	record = append(record, packet...)
+	if c.written+int64(len(record)) > c.maxBytes {
+		c.closeLocked()
+		return
+	}
+
+	n, err := c.file.Write(record)
+	c.written += int64(n)
+	if err != nil {
+		logf("Failed to write packet capture %s: %v\n", c.path, err)
+		c.closeLocked()
+	}
+}
+
+func (c *packetCapture) stop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closeLocked()
+}
+
+func (c *packetCapture) closeLocked() {
+	if c.file == nil {
+		return
+	}
+
+	c.timer.Stop()
+	if err := c.file.Close(); err != nil {
+		logf("Failed to close packet capture %s: %v\n", c.path, err)
+	}
+	c.file = nil
+}
+
+func ipv4Checksum(header []byte) uint16 {
+	sum := uint32(0)
+	for i := 0; i < len(header); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(header[i:]))
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+type captureInterceptorFactory struct {
+	session *session
+}
+
+func (f *captureInterceptorFactory) NewInterceptor(string) (interceptor.Interceptor, error) {
+	return &captureInterceptor{session: f.session}, nil
+}
+
+// captureInterceptor hands every packet of a session to its running capture,
+// if there is one.
+type captureInterceptor struct {
+	interceptor.NoOp
+	session *session
+}
+
+func (i *captureInterceptor) BindLocalStream(_ *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	return interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, attributes interceptor.Attributes) (int, error) {
+		if capture := i.session.capture.Load(); capture != nil {
+			if raw, err := (&rtp.Packet{Header: *header, Payload: payload}).Marshal(); err == nil {
+				capture.write(raw, false)
+			}
+		}
+		return writer.Write(header, payload, attributes)
+	})
+}
+
+func (i *captureInterceptor) BindRemoteStream(_ *interceptor.StreamInfo, reader interceptor.RTPReader) interceptor.RTPReader {
+	return interceptor.RTPReaderFunc(func(b []byte, attributes interceptor.Attributes) (int, interceptor.Attributes, error) {
+		n, attributes, err := reader.Read(b, attributes)
+		if capture := i.session.capture.Load(); capture != nil && err == nil {
+			capture.write(b[:n], true)
+		}
+		return n, attributes, err
+	})
+}
+
+func (i *captureInterceptor) BindRTCPWriter(writer interceptor.RTCPWriter) interceptor.RTCPWriter {
+	return interceptor.RTCPWriterFunc(func(pkts []rtcp.Packet, attributes interceptor.Attributes) (int, error) {
+		if capture := i.session.capture.Load(); capture != nil {
+			if raw, err := rtcp.Marshal(pkts); err == nil {
+				capture.write(raw, false)
+			}
+		}
+		return writer.Write(pkts, attributes)
+	})
+}
+
+func (i *captureInterceptor) BindRTCPReader(reader interceptor.RTCPReader) interceptor.RTCPReader {
+	return interceptor.RTCPReaderFunc(func(b []byte, attributes interceptor.Attributes) (int, interceptor.Attributes, error) {
+		n, attributes, err := reader.Read(b, attributes)
+		if capture := i.session.capture.Load(); capture != nil && err == nil {
+			capture.write(b[:n], true)
+		}
+		return n, attributes, err
+	})
+}
+
+// handleAdminCapture starts a packet capture of a session on POST, with an
+// optional body of {"MaxBytes": n, "MaxDuration": "30s"}, and stops it on DELETE.
+// Only rooms whose recording policy allows it can be captured.
+func handleAdminCapture(w http.ResponseWriter, r *http.Request, session *session) {
+	switch r.Method {
+	case http.MethodPost:
+		var in struct {
+			MaxBytes    int64
+			MaxDuration string
+		}
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil && !errors.Is(err, io.EOF) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if in.MaxBytes <= 0 {
+			in.MaxBytes = config.PcapMaxBytes
+		}
+
+		maxDuration := config.PcapMaxDuration
+		if in.MaxDuration != "" {
+			var err error
+			if maxDuration, err = time.ParseDuration(in.MaxDuration); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		if !session.room.recordingPolicy().Allowed {
+			http.Error(w, errRecordingNotAllowed.Error(), http.StatusForbidden)
+			return
+		} else if session.capture.Load() != nil {
+			http.Error(w, errCaptureRunning.Error(), http.StatusConflict)
+			return
+		}
+
+		capture, err := newPacketCapture(session, in.MaxBytes, maxDuration)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		} else if !session.capture.CompareAndSwap(nil, capture) {
+			capture.stop()
+			os.Remove(capture.path)
+			http.Error(w, errCaptureRunning.Error(), http.StatusConflict)
+			return
+		}
+
+		// The capture is tracked by its room from now on, so it is deleted
+		// in time even if the server restarts before.
+		session.room.addRecording(session, capture.path, time.Now())
+		sessionsMutex.Lock()
+		err = serialize(r.Context())
+		sessionsMutex.Unlock()
+		if err != nil {
+			logf("Failed to serialize: %v\n", err)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct{ Path string }{capture.path})
+	case http.MethodDelete:
+		if capture := session.capture.Swap(nil); capture != nil {
+			capture.stop()
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
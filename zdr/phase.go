@@ -0,0 +1,60 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// Startup runs in phases. Everything sessions share is provisioned from the
+// snapshot first, then sessions are resumed, and only then are new sessions
+// accepted. A new broadcaster can't take the slot of one that is being
+// resumed, nor can a viewer bind to a room that doesn't exist yet.
+const (
+	phaseStopped int32 = iota
+	phaseProvisioning
+	phaseRestoring
+	phaseServing
+)
+
+var (
+	errNotServing = errors.New("server is still restoring sessions")
+
+	phase atomic.Int32
+
+	// failedRooms are the rooms provision couldn't recreate, reported by
+	// the deserialize that follows.
+	failedRooms []restoreResult
+)
+
+// provision recreates the rooms with their output tracks and timelines, the
+// totals, histories, tombstones, analytics and SSRC allocations of state, and returns
+// it without the sessions that have ended. It holds the broadcaster
+// slot of every room whose broadcaster is about to be resumed. The slot is
+// held as if media had just arrived, so it is released after
+// -broadcaster-timeout if the broadcaster doesn't come back.
+func provision(state GlobalState) GlobalState {
+	generation.Store(state.Generation + 1)
+	state = restoreTombstones(state)
+
+	closedBytesSent.Store(state.ClosedBytesSent)
+	closedBytesReceived.Store(state.ClosedBytesReceived)
+	failedRooms = restoreRooms(state.Rooms, clockShift(state.SavedAt, time.Now()))
+	restoreRetiredHistories(state.RetiredHistories)
+	restoreSSRCs(state)
+	restoreLogins(state.Logins)
+	restoreAnalytics(state.Analytics)
+
+	for _, sessionState := range state.PeerConnectionState {
+		if isViewerOffer(sessionState.RemoteDescription) {
+			continue
+		}
+		if room := findRoom(sessionState.Room); room != nil {
+			markBroadcasterAlive(room)
+		}
+	}
+	return state
+}
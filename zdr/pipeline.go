@@ -0,0 +1,82 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// The stages a packet goes through from a broadcaster or a headless source
+// to the viewers of its room, in order:
+//
+//   - ingest marks the room and the track alive and, for broadcasters, keeps
+//     track of which ingest is on air.
+//   - jitter reorders broadcaster packets, the time packets are held isn't
+//     counted, only that spent pushing them.
+//   - rewrite gates what isn't on air and moves packets past injected frames.
+//   - history keeps packets for the restore warm-up.
+//   - taps hands packets to the taps of the track.
+//   - egress writes to the track, through the interceptors of every viewer.
+const (
+	stageIngest  = "ingest"
+	stageJitter  = "jitter"
+	stageRewrite = "rewrite"
+	stageHistory = "history"
+	stageTaps    = "taps"
+	stageEgress  = "egress"
+)
+
+var (
+	stageDurations = newHistogram("forwarding_stage_duration_seconds", "Time packets spend in each stage of the forwarding path.", "stage",
+		[]string{stageIngest, stageJitter, stageRewrite, stageHistory, stageTaps, stageEgress},
+		[]time.Duration{
+			time.Microsecond, 5 * time.Microsecond, 10 * time.Microsecond, 50 * time.Microsecond, 100 * time.Microsecond,
+			500 * time.Microsecond, time.Millisecond, 5 * time.Millisecond, 10 * time.Millisecond, 50 * time.Millisecond,
+		})
+
+	ingestStage  = pipelineStage{stageDurations.with(stageIngest)}
+	jitterStage  = pipelineStage{stageDurations.with(stageJitter)}
+	rewriteStage = pipelineStage{stageDurations.with(stageRewrite)}
+	historyStage = pipelineStage{stageDurations.with(stageHistory)}
+	tapsStage    = pipelineStage{stageDurations.with(stageTaps)}
+	egressStage  = pipelineStage{stageDurations.with(stageEgress)}
+)
+
+// pipelineStage times a stage of the forwarding path.
+type pipelineStage struct {
+	duration *histogramSeries
+}
+
+// done records the stage as having run from start until now and returns
+// now, when the next stage starts.
+func (s pipelineStage) done(start time.Time) time.Time {
+	now := time.Now()
+	s.duration.Observe(now.Sub(start))
+	return now
+}
+
+// fanout runs packet from the rewrite stage, started at start, up to the
+// viewers of track and returns when it was done. Callers gate packets that
+// aren't on air before, in the rewrite stage.
+func fanout(track *webrtc.TrackLocalStaticRTP, packet *rtp.Packet, start time.Time) time.Time {
+	rewriteForwarded(track, packet)
+	start = rewriteStage.done(start)
+
+	recordSent(track, packet)
+	start = historyStage.done(start)
+
+	tapSent(track, packet)
+	start = tapsStage.done(start)
+
+	// A failed write only affects the viewer it was meant for, the
+	// remaining viewers still need this packet.
+	if err := track.WriteRTP(packet); err != nil {
+		logf("Failed to write to track %s: %v\n", track.ID(), err)
+	}
+	forwardedPackets.Inc()
+	return egressStage.done(start)
+}
@@ -0,0 +1,338 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	// defaultPolicy is the policy of rooms created without one, it relays
+	// everything the way rooms did before they had policies.
+	defaultPolicy = "default"
+
+	// pliPeriodic asks the broadcaster for a keyframe every pliInterval,
+	// pliOnRequest only when a viewer joins or asks for one.
+	pliPeriodic  = "periodic"
+	pliOnRequest = "on-request"
+	pliInterval  = 200 * time.Millisecond
+)
+
+var (
+	errUnknownPolicy = errors.New("policy profile is not configured")
+	errInvalidPolicy = errors.New("invalid policy profile")
+
+	// policies are the profiles rooms can be created with, the built-in ones
+	// along with those of -policy-profiles.
+	policies = builtinPolicies()
+)
+
+// Policy is a named profile of what a room relays. Rooms are given one when
+// they are created, so screen shares, webcams and audio-only rooms with
+// different needs can share a server.
+type Policy struct {
+	// Codecs are the video codecs the room relays, all of them if empty.
+	Codecs []string `json:",omitempty"`
+
+	// AudioOnly rooms relay no video at all.
+	AudioOnly bool `json:",omitempty"`
+
+	// MaxWidth and MaxHeight are applied by the broadcaster when capturing,
+	// media is relayed as it is received.
+	MaxWidth  int `json:",omitempty"`
+	MaxHeight int `json:",omitempty"`
+
+	// MaxBitrate caps every session of the room, on top of
+	// -default-max-bitrate and the caps of the admin API.
+	MaxBitrate uint64 `json:",omitempty"`
+
+	// FEC offers ULPFEC for video and Opus in-band FEC for audio.
+	FEC bool
+
+	// PLI is when keyframes are requested from the broadcaster, periodic
+	// unless set to on-request.
+	PLI string `json:",omitempty"`
+
+	// KeyExport lets the recorder export the SRTP keys of sessions of the
+	// room, for deployments that must archive decrypted media.
+	KeyExport bool `json:",omitempty"`
+
+	// MaxViewers caps the viewers of the room, those joining once it is
+	// full wait in its queue. 0 doesn't cap it.
+	MaxViewers int `json:",omitempty"`
+
+	// Simulcast are the encodings the broadcaster sends video in, a single
+	// one if empty.
+	Simulcast []SimulcastEncoding `json:",omitempty"`
+}
+
+// SimulcastEncoding is a simulcast layer the broadcaster sends. It is named
+// like RTCRtpEncodingParameters, so browsers can be given it as is.
+type SimulcastEncoding struct {
+	RID                   string  `json:"rid"`
+	ScaleResolutionDownBy float64 `json:"scaleResolutionDownBy,omitempty"`
+	MaxBitrate            uint64  `json:"maxBitrate,omitempty"`
+}
+
+func builtinPolicies() map[string]Policy {
+	return map[string]Policy{
+		defaultPolicy: {FEC: true},
+		"webcam": {MaxWidth: 1280, MaxHeight: 720, MaxBitrate: 2_500_000, FEC: true, Simulcast: []SimulcastEncoding{
+			{RID: "q", ScaleResolutionDownBy: 4, MaxBitrate: 150_000},
+			{RID: "h", ScaleResolutionDownBy: 2, MaxBitrate: 500_000},
+			{RID: "f", ScaleResolutionDownBy: 1, MaxBitrate: 1_800_000},
+		}},
+		"screenshare": {MaxWidth: 1920, MaxHeight: 1080, MaxBitrate: 1_500_000, PLI: pliOnRequest},
+		"audio-only":  {AudioOnly: true, FEC: true},
+	}
+}
+
+// loadPolicies returns the built-in policies along with those of the JSON
+// file at path, an object of profiles by name. Profiles of the file replace
+// built-in ones of the same name.
+func loadPolicies(path string) (map[string]Policy, error) {
+	out := builtinPolicies()
+	if path == "" {
+		return out, nil
+	}
+
+	data, err := os.ReadFile(path) //nolint:gosec
+	if err != nil {
+		return nil, err
+	}
+	loaded := map[string]Policy{}
+	if err = json.Unmarshal(data, &loaded); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	for name, policy := range loaded {
+		if err = policy.validate(); err != nil {
+			return nil, fmt.Errorf("%w %q: %v", errInvalidPolicy, name, err)
+		}
+		out[name] = policy
+	}
+	return out, nil
+}
+
+func (p Policy) validate() error {
+	for _, codec := range p.Codecs {
+		if !isVideoCodec(codec) {
+			return fmt.Errorf("%w: %s", errUnsupportedCodec, codec)
+		}
+	}
+
+	if p.MaxViewers < 0 {
+		return fmt.Errorf("negative MaxViewers %d", p.MaxViewers)
+	}
+
+	switch p.PLI {
+	case "", pliPeriodic, pliOnRequest:
+	default:
+		return fmt.Errorf("unknown PLI policy %q", p.PLI)
+	}
+
+	// Browsers drop the top layers when they are short of bandwidth, so they
+	// must all fit within the cap the broadcaster is sent.
+	rids, total := map[string]bool{}, uint64(0)
+	for _, encoding := range p.Simulcast {
+		if !validRID(encoding.RID) {
+			return fmt.Errorf("invalid simulcast rid %q", encoding.RID)
+		} else if rids[encoding.RID] {
+			return fmt.Errorf("duplicate simulcast rid %q", encoding.RID)
+		} else if encoding.ScaleResolutionDownBy != 0 && encoding.ScaleResolutionDownBy < 1 {
+			return fmt.Errorf("simulcast layer %q is scaled up", encoding.RID)
+		}
+		rids[encoding.RID] = true
+		total += encoding.MaxBitrate
+	}
+	if p.MaxBitrate != 0 && total > p.MaxBitrate {
+		return fmt.Errorf("simulcast layers add up to %d bps, above MaxBitrate", total)
+	}
+	return nil
+}
+
+// validRID reports whether rid is a valid RtpStreamId of RFC 8852.
+func validRID(rid string) bool {
+	if rid == "" || len(rid) > 16 {
+		return false
+	}
+	for _, c := range rid {
+		if (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (c < '0' || c > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// layers returns the simulcast layers of p from the lowest resolution to the
+// highest.
+func (p Policy) layers() []SimulcastEncoding {
+	scale := func(encoding SimulcastEncoding) float64 {
+		if encoding.ScaleResolutionDownBy == 0 {
+			return 1
+		}
+		return encoding.ScaleResolutionDownBy
+	}
+
+	out := append([]SimulcastEncoding{}, p.Simulcast...)
+	sort.SliceStable(out, func(i, j int) bool { return scale(out[i]) > scale(out[j]) })
+	return out
+}
+
+// forwardedRID returns the simulcast layer with the highest resolution. It is
+// relayed on the room's video tracks, where injected frames and mute fills go,
+// and viewers start out on it.
+func (p Policy) forwardedRID() string {
+	layers := p.layers()
+	if len(layers) == 0 {
+		return ""
+	}
+	return layers[len(layers)-1].RID
+}
+
+// allowsVideo reports whether rooms of p relay video of mimeType.
+func (p Policy) allowsVideo(mimeType string) bool {
+	if p.AudioOnly {
+		return false
+	} else if len(p.Codecs) == 0 {
+		return true
+	}
+
+	for _, codec := range p.Codecs {
+		if strings.EqualFold(codec, mimeType) {
+			return true
+		}
+	}
+	return false
+}
+
+// bitrateCap returns the lower of p's cap and bitrate, either may be zero
+// for no cap.
+func (p Policy) bitrateCap(bitrate uint64) uint64 {
+	if p.MaxBitrate != 0 && (bitrate == 0 || p.MaxBitrate < bitrate) {
+		return p.MaxBitrate
+	}
+	return bitrate
+}
+
+// findPolicy returns the policy called name, the default one if name is
+// empty.
+func findPolicy(name string) (Policy, error) {
+	if name == "" {
+		name = defaultPolicy
+	}
+
+	policy, ok := policies[name]
+	if !ok {
+		return Policy{}, fmt.Errorf("%w: %s", errUnknownPolicy, name)
+	}
+	return policy, nil
+}
+
+// registerPolicyCodecs registers the default codecs of Pion that policy
+// allows. Payload types are left as they are, so sessions resumed under
+// a policy negotiate the same ones.
+func registerPolicyCodecs(m *webrtc.MediaEngine, policy Policy) error {
+	audio, video, err := defaultCodecs()
+	if err != nil {
+		return err
+	}
+
+	for _, codec := range audio {
+		if !policy.FEC {
+			codec.SDPFmtpLine = strings.ReplaceAll(codec.SDPFmtpLine, ";useinbandfec=1", "")
+		}
+		if err := m.RegisterCodec(codec, webrtc.RTPCodecTypeAudio); err != nil {
+			return err
+		}
+	}
+
+	// Simulcast layers are told apart by their RID, sent with the MID in
+	// header extensions since their SSRCs aren't signaled.
+	if len(policy.Simulcast) > 0 && !policy.AudioOnly {
+		for _, uri := range []string{sdp.SDESMidURI, sdp.SDESRTPStreamIDURI} {
+			if err := m.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: uri}, webrtc.RTPCodecTypeVideo); err != nil {
+				return err
+			}
+		}
+	}
+
+	kept := map[string]bool{}
+	for _, codec := range video {
+		switch mimeType := strings.ToLower(codec.MimeType); {
+		case mimeType == "video/rtx":
+			// Retransmissions of a codec we dropped would never be used.
+			if !kept[strings.TrimPrefix(codec.SDPFmtpLine, "apt=")] {
+				continue
+			}
+		case mimeType == "video/ulpfec":
+			if !policy.FEC || policy.AudioOnly {
+				continue
+			}
+		case !policy.allowsVideo(mimeType):
+			continue
+		}
+
+		kept[strconv.Itoa(int(codec.PayloadType))] = true
+		if err := m.RegisterCodec(codec, webrtc.RTPCodecTypeVideo); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// requestKeyframe asks the broadcaster of r for a keyframe, for rooms that
+// only do so on request.
+func (r *room) requestKeyframe() {
+	r.keyframeRequests.Add(1)
+}
+
+// sendKeyframeRequests sends PLIs for track to the broadcaster of room, every
+// pliInterval or, under the on-request policy, at most that often while
+// viewers ask for keyframes.
+func sendKeyframeRequests(room *room, peerConnection *webrtc.PeerConnection, track *webrtc.TrackRemote) {
+	ticker := time.NewTicker(pliInterval)
+	defer ticker.Stop()
+
+	seen := room.keyframeRequests.Load()
+	for range ticker.C {
+		if peerConnection.ConnectionState() == webrtc.PeerConnectionStateClosed {
+			return
+		}
+
+		if room.policy.PLI == pliOnRequest {
+			requests := room.keyframeRequests.Load()
+			if requests == seen {
+				continue
+			}
+			seen = requests
+		}
+
+		if err := peerConnection.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(track.SSRC())}}); err != nil {
+			return
+		}
+	}
+}
+
+// asksForKeyframe reports whether RTCP from a viewer asks for a keyframe.
+func asksForKeyframe(packets []rtcp.Packet) bool {
+	for _, packet := range packets {
+		switch packet.(type) {
+		case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+			return true
+		}
+	}
+	return false
+}
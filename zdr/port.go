@@ -0,0 +1,60 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	portRetryInitialBackoff = 50 * time.Millisecond
+	portRetryMaxBackoff     = time.Second
+)
+
+var portFallbacks = newCounter("port_fallbacks_total", "Sessions resumed on a new ICE port because their old one stayed in use.")
+
+// waitForPort blocks until port can be bound. The previous process may still
+// be holding it while it shuts down, so binding is retried with backoff for up
+// to -port-reacquire-window. During a hot restart it doesn't wait, a port
+// the previous process handed over is taken over as it is and the others
+// are only freed once this one acknowledged. A port systemd passed is
+// taken over too. With -reuseport-drain the port is bound alongside the
+// previous process, so it is probed with SO_REUSEPORT.
+func waitForPort(ctx context.Context, port uint16) error {
+	if activatedPort(port) {
+		return nil
+	} else if ok, err := inheritedPort(port); ok {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, config.PortReacquireWindow)
+	defer cancel()
+
+	backoff := portRetryInitialBackoff
+	for {
+		var conn *net.UDPConn
+		var err error
+		if config.ReusePortDrain > 0 {
+			conn, err = listenReusePort("udp", &net.UDPAddr{Port: int(port)})
+		} else {
+			conn, err = net.ListenUDP("udp", &net.UDPAddr{Port: int(port)})
+		}
+		if err == nil {
+			return conn.Close()
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w: %d: %v", ErrPortUnavailable, port, err)
+		case <-time.After(backoff):
+		}
+
+		if backoff *= 2; backoff > portRetryMaxBackoff {
+			backoff = portRetryMaxBackoff
+		}
+	}
+}
@@ -0,0 +1,122 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+
+	"webrtc-zero-downtime-reload/internal/pionadapter"
+)
+
+// prewarmedMaxAge is how long a pre-generated certificate is handed out
+// for. Pion makes them valid for a month, one taken from a pool left idle
+// that long is generated again.
+const prewarmedMaxAge = 24 * time.Hour
+
+var (
+	prewarmHits   = newCounter("prewarm_pool_hits_total", "New sessions given a certificate generated ahead of time.")
+	prewarmMisses = newCounter("prewarm_pool_misses_total", "New sessions that generated their certificate because the pool was empty.")
+
+	_ = newGauge("prewarm_pool_size", "Certificates generated ahead of time, waiting for a new session.", func() float64 {
+		return float64(len(certificatePool))
+	})
+
+	// certificatePool holds up to -prewarm-pool certificates for new
+	// sessions, nil if disabled.
+	certificatePool chan prewarmedCertificate
+
+	defaultCodecsOnce          sync.Once
+	defaultAudio, defaultVideo []webrtc.RTPCodecParameters
+	defaultCodecsErr           error
+)
+
+type prewarmedCertificate struct {
+	certificate *webrtc.Certificate
+	created     time.Time
+}
+
+// prewarm keeps certificatePool full until ctx is done. Generating the
+// certificate is the part of creating a PeerConnection that doesn't depend
+// on its session, everything else, the MediaEngine, interceptors and ICE
+// sockets, is built for the session and its room. After a restart every
+// client whose session couldn't be resumed reconnects at once, the pool
+// takes that work out of their /doSignaling requests.
+func prewarm(ctx context.Context) {
+	if config.PrewarmPool <= 0 {
+		return
+	}
+	certificatePool = make(chan prewarmedCertificate, config.PrewarmPool)
+	go fillCertificatePool(ctx)
+}
+
+func fillCertificatePool(ctx context.Context) {
+	for {
+		certificate, err := generateCertificate()
+		if err != nil {
+			logf("Failed to pre-generate a certificate: %v\n", err)
+			select {
+			case <-time.After(time.Second):
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		select {
+		case certificatePool <- prewarmedCertificate{certificate, time.Now()}:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// newSessionCertificate returns a certificate for a new session, from the
+// pool if there is one left.
+func newSessionCertificate() (*webrtc.Certificate, error) {
+	if certificatePool == nil {
+		return generateCertificate()
+	}
+
+	for {
+		select {
+		case prewarmed := <-certificatePool:
+			if time.Since(prewarmed.created) > prewarmedMaxAge {
+				continue
+			}
+			prewarmHits.Inc()
+			return prewarmed.certificate, nil
+		default:
+			prewarmMisses.Inc()
+			return generateCertificate()
+		}
+	}
+}
+
+// defaultCodecs returns the default audio and video codecs of Pion. They are
+// looked up once rather than for every PeerConnection, each caller gets its
+// own copy since the MediaEngine they are registered with adds to their
+// feedback.
+func defaultCodecs() (audio, video []webrtc.RTPCodecParameters, err error) {
+	defaultCodecsOnce.Do(func() {
+		defaults := &webrtc.MediaEngine{}
+		if defaultCodecsErr = defaults.RegisterDefaultCodecs(); defaultCodecsErr == nil {
+			defaultAudio = pionadapter.Pion.DefaultCodecs(defaults, webrtc.RTPCodecTypeAudio)
+			defaultVideo = pionadapter.Pion.DefaultCodecs(defaults, webrtc.RTPCodecTypeVideo)
+		}
+	})
+	return copyCodecs(defaultAudio), copyCodecs(defaultVideo), defaultCodecsErr
+}
+
+func copyCodecs(codecs []webrtc.RTPCodecParameters) []webrtc.RTPCodecParameters {
+	out := make([]webrtc.RTPCodecParameters, len(codecs))
+	for i, codec := range codecs {
+		codec.RTCPFeedback = append([]webrtc.RTCPFeedback(nil), codec.RTCPFeedback...)
+		out[i] = codec
+	}
+	return out
+}
@@ -0,0 +1,421 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// The prober of a viewer finds out whether it can take the next simulcast
+// layer before the layer controller moves it there. For probeDuration it
+// sends padding on top of the media, enough to make up the bitrate of the
+// layer, and the probe succeeds if the viewer reported no more than
+// probeMaxLoss meanwhile. Failed probes are retried after a backoff that
+// doubles from probeBackoffMin up to probeBackoffMax.
+const (
+	probeInterval    = 250 * time.Millisecond
+	probeDuration    = time.Second
+	probeFeedback    = 500 * time.Millisecond
+	probePacing      = 20 * time.Millisecond
+	probeMaxLoss     = 0.05
+	probeBackoffMin  = 2 * time.Second
+	probeBackoffMax  = time.Minute
+	probePaddingSize = 255
+)
+
+// States of the prober.
+const (
+	probeIdle    = "idle"
+	probeProbing = "probing"
+	probeBackoff = "backoff"
+)
+
+var (
+	probesSent    = newCounter("probes_total", "Bandwidth probes sent to viewers.")
+	probeFailures = newCounter("probe_failures_total", "Bandwidth probes viewers didn't keep up with.")
+	probePadding  = newCounter("probe_padding_bytes_total", "Padding bytes sent to viewers to probe their bandwidth.")
+)
+
+// ProbeState is the prober of a viewer as saved in the snapshot, so a
+// restart carries on with the bitrate it confirmed and the backoff it was
+// in rather than probing again from scratch.
+type ProbeState struct {
+	State string
+
+	// Confirmed is the highest bitrate the viewer was shown to take, Target
+	// the bitrate of the current or last probe, both in bits per second.
+	Confirmed, Target uint64
+
+	// Failures counts the probes that failed in a row.
+	Failures  int
+	NextProbe time.Time
+
+	// Padding counts the padding packets sent per SSRC, media sequence
+	// numbers are shifted by it.
+	Padding map[uint32]uint16
+}
+
+// probeState is the prober of a viewer along with the feedback it goes by.
+type probeState struct {
+	mu sync.Mutex
+
+	state             string
+	confirmed, target uint64
+	failures          int
+	started           time.Time
+	nextProbe         time.Time
+	padding           map[uint32]uint16
+
+	// paddingRate is the padding sent while probing, in bits per second.
+	paddingRate uint64
+
+	// last is the last packet sent per SSRC, padding carries on from it.
+	last map[uint32]probePosition
+
+	// sent adds up the media bytes sent since the last tick, rate is the
+	// media bitrate worked out from it.
+	sent, rate uint64
+
+	lost, reported float64
+	estimate       uint64
+}
+
+type probePosition struct {
+	seq       uint16
+	timestamp uint32
+	marker    bool
+}
+
+// persisted returns the prober to save.
+func (s *probeState) persisted() ProbeState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := ProbeState{
+		State:     s.state,
+		Confirmed: s.confirmed,
+		Target:    s.target,
+		Failures:  s.failures,
+		NextProbe: s.nextProbe,
+		Padding:   make(map[uint32]uint16, len(s.padding)),
+	}
+	for ssrc, padding := range s.padding {
+		out.Padding[ssrc] = padding
+	}
+	return out
+}
+
+// restore puts back a saved prober. A probe cut short by the restart is
+// sent again right away, the feedback for it went with the old process.
+func (s *probeState) restore(state ProbeState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.state, s.confirmed, s.target = state.State, state.Confirmed, state.Target
+	s.failures, s.nextProbe = state.Failures, state.NextProbe
+	if s.state == probeProbing {
+		s.state, s.nextProbe = probeIdle, time.Time{}
+	}
+	for ssrc, padding := range state.Padding {
+		s.padding[ssrc] = padding
+	}
+}
+
+// confirmedBitrate returns the highest bitrate the viewer was shown to take.
+func (s *probeState) confirmedBitrate() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.confirmed
+}
+
+// paddingSent returns the padding packets sent on ssrc.
+func (s *probeState) paddingSent(ssrc uint32) uint16 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.padding[ssrc]
+}
+
+// lower caps the confirmed bitrate at bitrate, after the viewer had to be
+// moved down to a layer of that bitrate.
+func (s *probeState) lower(bitrate uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if bitrate < s.confirmed {
+		s.confirmed = bitrate
+	}
+}
+
+// step advances the prober towards goal, the bitrate the viewer should be
+// shown to take, and returns what happened for the session history.
+func (s *probeState) step(goal uint64, now time.Time) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rate := s.sent * 8 * uint64(time.Second) / uint64(probeInterval)
+	s.rate, s.sent = (s.rate*3+rate)/4, 0
+
+	switch s.state {
+	case probeProbing:
+		// A viewer that was paused or reached the top layer meanwhile has
+		// nothing left to probe for.
+		if goal == 0 {
+			s.state, s.paddingRate = probeIdle, 0
+			return ""
+		}
+
+		elapsed := now.Sub(s.started)
+		if elapsed >= probeDuration {
+			s.paddingRate = 0
+		}
+		if elapsed < probeDuration+probeFeedback {
+			return ""
+		}
+
+		if s.reported > 0 && s.lost/s.reported <= probeMaxLoss && (s.estimate == 0 || s.estimate >= s.target) {
+			s.state, s.confirmed, s.failures = probeIdle, s.target, 0
+			return fmt.Sprintf("probe of %d bps succeeded", s.target)
+		}
+
+		s.failures++
+		backoff := probeBackoffMin << (s.failures - 1)
+		if backoff > probeBackoffMax || backoff <= 0 {
+			backoff = probeBackoffMax
+		}
+		s.state, s.nextProbe = probeBackoff, now.Add(backoff)
+		probeFailures.Inc()
+		return fmt.Sprintf("probe of %d bps failed, next one in %s", s.target, backoff)
+	case probeBackoff:
+		if now.Before(s.nextProbe) {
+			return ""
+		}
+	}
+
+	s.state = probeIdle
+	if goal == 0 || s.confirmed >= goal || now.Before(s.nextProbe) {
+		return ""
+	}
+
+	// Media alone may already make up the goal.
+	if s.rate >= goal {
+		s.confirmed = goal
+		return ""
+	}
+	s.state, s.target, s.started = probeProbing, goal, now
+	s.paddingRate = goal - s.rate
+	s.lost, s.reported = 0, 0
+	probesSent.Inc()
+	return fmt.Sprintf("probing %d bps", goal)
+}
+
+// probeGoal returns the bitrate of the layer above the one session receives,
+// 0 if it is on the top layer or that layer has no bitrate to probe for.
+func probeGoal(session *session, layers []SimulcastEncoding) uint64 {
+	rid := session.layer.current()
+	for i, layer := range layers {
+		if layer.RID == rid && i+1 < len(layers) {
+			return layers[i+1].MaxBitrate
+		}
+	}
+	return 0
+}
+
+// controlProbing runs the prober of a viewer in a simulcast room until its
+// PeerConnection is closed.
+func controlProbing(session *session) {
+	layers := session.room.policy.layers()
+	if !config.Probing || session.broadcaster || len(layers) < 2 || session.room.policy.AudioOnly {
+		return
+	}
+
+	supervise("prober", session, func() {
+		ticker := time.NewTicker(probeInterval)
+		defer ticker.Stop()
+
+		for now := range ticker.C {
+			if session.peerConnection.ConnectionState() == webrtc.PeerConnectionStateClosed {
+				return
+			}
+
+			goal := probeGoal(session, layers)
+			if session.pause.paused.Load() {
+				goal = 0
+			}
+			if step := session.probe.step(goal, now); step != "" {
+				recordHistory(session, historyControl, "%s", step)
+			}
+		}
+	})
+}
+
+type probeInterceptorFactory struct {
+	session *session
+}
+
+func (f *probeInterceptorFactory) NewInterceptor(string) (interceptor.Interceptor, error) {
+	return &probeInterceptor{state: &f.session.probe, video: map[uint32]chan struct{}{}}, nil
+}
+
+// probeInterceptor sends the padding of the prober. Padding goes out on the
+// video SSRC between frames, shifting the sequence numbers of the media
+// after it. It sits right below the pause interceptor and above the warm-up,
+// which shifts the packets it resends by the padding itself.
+type probeInterceptor struct {
+	interceptor.NoOp
+	state *probeState
+
+	mu    sync.Mutex
+	video map[uint32]chan struct{}
+}
+
+func (i *probeInterceptor) BindLocalStream(info *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	if !strings.HasPrefix(strings.ToLower(info.MimeType), "video/") {
+		return writer
+	}
+
+	done := make(chan struct{})
+	i.mu.Lock()
+	i.video[info.SSRC] = done
+	i.mu.Unlock()
+	go i.pad(info, writer, done)
+
+	return interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, attributes interceptor.Attributes) (int, error) {
+		s := i.state
+		s.mu.Lock()
+		// The header is shared with every other viewer of the track.
+		shifted := *header
+		shifted.SequenceNumber += s.padding[info.SSRC]
+		s.last[info.SSRC] = probePosition{seq: shifted.SequenceNumber, timestamp: shifted.Timestamp, marker: shifted.Marker}
+		s.sent += uint64(header.MarshalSize() + len(payload))
+		s.mu.Unlock()
+
+		return writer.Write(&shifted, payload, attributes)
+	})
+}
+
+func (i *probeInterceptor) UnbindLocalStream(info *interceptor.StreamInfo) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if done, ok := i.video[info.SSRC]; ok {
+		close(done)
+		delete(i.video, info.SSRC)
+	}
+}
+
+func (i *probeInterceptor) Close() error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	for ssrc, done := range i.video {
+		close(done)
+		delete(i.video, ssrc)
+	}
+	return nil
+}
+
+// pad sends padding on the stream of info at the padding rate of the prober,
+// right after the last packet of a frame so it never splits one.
+func (i *probeInterceptor) pad(info *interceptor.StreamInfo, writer interceptor.RTPWriter, done chan struct{}) {
+	ticker := time.NewTicker(probePacing)
+	defer ticker.Stop()
+
+	payload := make([]byte, probePaddingSize)
+	payload[probePaddingSize-1] = probePaddingSize
+	budget := uint64(0)
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		s := i.state
+		s.mu.Lock()
+		last, ok := s.last[info.SSRC]
+		if s.paddingRate == 0 || !ok {
+			budget = 0
+			s.mu.Unlock()
+			continue
+		}
+
+		// Budget left over while in the middle of a frame is sent once it
+		// ends, up to a pacing interval worth of it.
+		budget += s.paddingRate * uint64(probePacing) / uint64(time.Second) / 8
+		if limit := 2 * s.paddingRate * uint64(probePacing) / uint64(time.Second) / 8; budget > limit {
+			budget = limit
+		}
+		if !last.marker {
+			s.mu.Unlock()
+			continue
+		}
+
+		headers := []rtp.Header{}
+		for ; budget >= probePaddingSize; budget -= probePaddingSize {
+			last.seq++
+			s.padding[info.SSRC]++
+			headers = append(headers, rtp.Header{
+				Version:        2,
+				Padding:        true,
+				PayloadType:    info.PayloadType,
+				SequenceNumber: last.seq,
+				Timestamp:      last.timestamp,
+				SSRC:           info.SSRC,
+			})
+		}
+		s.last[info.SSRC] = last
+		s.mu.Unlock()
+
+		for j := range headers {
+			if _, err := writer.Write(&headers[j], payload, interceptor.Attributes{}); err != nil {
+				break
+			}
+			probePadding.Add(probePaddingSize)
+		}
+	}
+}
+
+func (i *probeInterceptor) BindRTCPReader(reader interceptor.RTCPReader) interceptor.RTCPReader {
+	return interceptor.RTCPReaderFunc(func(b []byte, attributes interceptor.Attributes) (int, interceptor.Attributes, error) {
+		n, attributes, err := reader.Read(b, attributes)
+		if err != nil {
+			return n, attributes, err
+		}
+		if attributes == nil {
+			attributes = interceptor.Attributes{}
+		}
+
+		packets, unmarshalErr := attributes.GetRTCPPackets(b[:n])
+		if unmarshalErr != nil {
+			return n, attributes, err
+		}
+		for _, packet := range packets {
+			i.observe(packet)
+		}
+		return n, attributes, err
+	})
+}
+
+func (i *probeInterceptor) observe(packet rtcp.Packet) {
+	i.mu.Lock()
+	lost, reports := reportedLoss(packet, func(ssrc uint32) bool {
+		_, ok := i.video[ssrc]
+		return ok
+	})
+	i.mu.Unlock()
+
+	s := i.state
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lost += lost
+	s.reported += float64(reports)
+	if remb, ok := packet.(*rtcp.ReceiverEstimatedMaximumBitrate); ok {
+		s.estimate = uint64(remb.Bitrate)
+	}
+}
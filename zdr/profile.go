@@ -0,0 +1,276 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"runtime/pprof"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	profileLabelSession = "session"
+	profileLabelTask    = "task"
+
+	profileDefaultDuration = 5 * time.Second
+	profileMaxDuration     = time.Minute
+)
+
+var (
+	errProfilingDisabled = errors.New("session profiling is disabled, start with -profile-sessions")
+	errProfileRunning    = errors.New("a CPU profile is already running")
+	errMalformedProfile  = errors.New("malformed profile")
+)
+
+// withSessionLabels runs fn with pprof labels naming session and task, so
+// CPU and goroutine profiles can be broken down per session. Goroutines fn
+// starts inherit them.
+func withSessionLabels(session *session, task string, fn func()) {
+	if !config.ProfileSessions {
+		fn()
+		return
+	}
+	pprof.Do(context.Background(), pprof.Labels(profileLabelSession, session.id, profileLabelTask, task), func(context.Context) {
+		fn()
+	})
+}
+
+type sessionProfile struct {
+	ID         string
+	CPU        time.Duration
+	Goroutines int64
+}
+
+// handleAdminProfile serves GET /admin/profile?seconds=N. It records a CPU
+// profile for N seconds and returns the CPU time and goroutines of every
+// session, busiest first. CPU a viewer causes, like answering NACKs, is
+// spent on its own RTCP readers, while forwarding to viewers is spent on
+// the forwarder of the broadcaster.
+func handleAdminProfile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	} else if !config.ProfileSessions {
+		http.Error(w, errProfilingDisabled.Error(), http.StatusConflict)
+		return
+	}
+
+	duration := profileDefaultDuration
+	if seconds := r.URL.Query().Get("seconds"); seconds != "" {
+		n, err := strconv.Atoi(seconds)
+		if err != nil || n <= 0 {
+			http.Error(w, "invalid seconds", http.StatusBadRequest)
+			return
+		}
+		if duration = time.Duration(n) * time.Second; duration > profileMaxDuration {
+			duration = profileMaxDuration
+		}
+	}
+
+	var cpuProfile bytes.Buffer
+	if err := pprof.StartCPUProfile(&cpuProfile); err != nil {
+		http.Error(w, errProfileRunning.Error(), http.StatusConflict)
+		return
+	}
+	select {
+	case <-time.After(duration):
+	case <-r.Context().Done():
+	}
+	pprof.StopCPUProfile()
+
+	cpu, err := profileByLabel(cpuProfile.Bytes(), "cpu", profileLabelSession)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var goroutineProfile bytes.Buffer
+	if err = pprof.Lookup("goroutine").WriteTo(&goroutineProfile, 0); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	goroutines, err := profileByLabel(goroutineProfile.Bytes(), "goroutine", profileLabelSession)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	out := struct {
+		Duration     time.Duration
+		Sessions     []sessionProfile
+		Unattributed time.Duration
+	}{Duration: duration, Sessions: []sessionProfile{}, Unattributed: time.Duration(cpu[""])}
+
+	sessionsMutex.Lock()
+	for _, session := range sessions {
+		out.Sessions = append(out.Sessions, sessionProfile{
+			ID:         session.id,
+			CPU:        time.Duration(cpu[session.id]),
+			Goroutines: goroutines[session.id],
+		})
+	}
+	sessionsMutex.Unlock()
+	sort.Slice(out.Sessions, func(i, j int) bool { return out.Sessions[i].CPU > out.Sessions[j].CPU })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&out)
+}
+
+// profileByLabel sums the sampleType values of a gzipped pprof profile by
+// the value of label, samples without it are summed under "". Only the few
+// fields of profile.proto needed for that are decoded.
+func profileByLabel(data []byte, sampleType, label string) (map[string]int64, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if data, err = io.ReadAll(reader); err != nil {
+		return nil, err
+	}
+
+	type sample struct {
+		values []int64
+		labels map[int64]int64
+	}
+	var (
+		types   []int64
+		samples []sample
+		strs    []string
+	)
+	err = protoFields(data, func(field int, v uint64, b []byte) error {
+		switch field {
+		case 1: // sample_type
+			return protoFields(b, func(field int, v uint64, _ []byte) error {
+				if field == 1 {
+					types = append(types, int64(v))
+				}
+				return nil
+			})
+		case 2: // sample
+			s := sample{labels: map[int64]int64{}}
+			err := protoFields(b, func(field int, v uint64, b []byte) error {
+				switch field {
+				case 2: // value, packed or not
+					if b == nil {
+						s.values = append(s.values, int64(v))
+					}
+					for len(b) > 0 {
+						n, size := binary.Uvarint(b)
+						if size <= 0 {
+							return errMalformedProfile
+						}
+						s.values, b = append(s.values, int64(n)), b[size:]
+					}
+				case 3: // label
+					var key, str int64
+					if err := protoFields(b, func(field int, v uint64, _ []byte) error {
+						if field == 1 {
+							key = int64(v)
+						} else if field == 2 {
+							str = int64(v)
+						}
+						return nil
+					}); err != nil {
+						return err
+					}
+					s.labels[key] = str
+				}
+				return nil
+			})
+			samples = append(samples, s)
+			return err
+		case 6: // string_table
+			strs = append(strs, string(b))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	index := -1
+	for i, t := range types {
+		if t >= 0 && t < int64(len(strs)) && strs[t] == sampleType {
+			index = i
+		}
+	}
+	if index < 0 {
+		return nil, errMalformedProfile
+	}
+
+	out := map[string]int64{}
+	for _, s := range samples {
+		if index >= len(s.values) {
+			continue
+		}
+
+		value := ""
+		for key, str := range s.labels {
+			if key < int64(len(strs)) && str < int64(len(strs)) && strs[key] == label {
+				value = strs[str]
+			}
+		}
+		out[value] += s.values[index]
+	}
+	return out, nil
+}
+
+// protoFields calls fn for every field of the protobuf message in data.
+// Varints are passed as v, length delimited fields as b. Fixed size fields
+// aren't used by profiles and are skipped.
+func protoFields(data []byte, fn func(field int, v uint64, b []byte) error) error {
+	for len(data) > 0 {
+		key, size := binary.Uvarint(data)
+		if size <= 0 {
+			return errMalformedProfile
+		}
+		data = data[size:]
+
+		var (
+			v uint64
+			b []byte
+		)
+		switch key & 7 {
+		case 0:
+			if v, size = binary.Uvarint(data); size <= 0 {
+				return errMalformedProfile
+			}
+			data = data[size:]
+		case 1:
+			if len(data) < 8 {
+				return errMalformedProfile
+			}
+			data = data[8:]
+			continue
+		case 2:
+			length, size := binary.Uvarint(data)
+			if size <= 0 || uint64(len(data)-size) < length {
+				return errMalformedProfile
+			}
+			b, data = data[size:size+int(length)], data[size+int(length):]
+		case 5:
+			if len(data) < 4 {
+				return errMalformedProfile
+			}
+			data = data[4:]
+			continue
+		default:
+			return errMalformedProfile
+		}
+
+		if err := fn(int(key>>3), v, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
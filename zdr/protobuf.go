@@ -0,0 +1,573 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"encoding"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// snapshotProtoMagic starts every snapshot encoded with protobuf, telling it
+// from gob. The message follows, protoc reads it after the first 4 bytes.
+const snapshotProtoMagic = "ZDRP"
+
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+	protoFixed32 = 5
+)
+
+var (
+	errProto = errors.New("protobuf")
+
+	timeType         = reflect.TypeOf(time.Time{})
+	marshalerType    = reflect.TypeOf((*encoding.BinaryMarshaler)(nil)).Elem()
+	protoFieldsCache sync.Map
+)
+
+// protoField is an exported field of a struct and its protobuf field number.
+type protoField struct {
+	index  int
+	number uint64
+	name   string
+}
+
+// protoStructFields returns the fields of struct type t. Their numbers are hashed
+// from their names, so like gob a field keeps its number when others are
+// added, removed or reordered, and only renaming it changes it.
+func protoStructFields(t reflect.Type) ([]protoField, error) {
+	if fields, ok := protoFieldsCache.Load(t); ok {
+		return fields.([]protoField), nil
+	}
+
+	fields := []protoField{}
+	numbers := map[uint64]string{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+
+		// Numbers go up to 2^29-1, skipping 19000 to 19999 which protobuf
+		// reserves.
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(f.Name))
+		number := uint64(h.Sum32())%(1<<29-1001) + 1
+		if number >= 19000 {
+			number += 1000
+		}
+		if other, ok := numbers[number]; ok {
+			return nil, fmt.Errorf("%w: fields %s and %s of %s have the same number", errProto, other, f.Name, t)
+		}
+		numbers[number] = f.Name
+		fields = append(fields, protoField{index: i, number: number, name: f.Name})
+	}
+	protoFieldsCache.Store(t, fields)
+	return fields, nil
+}
+
+// isBinaryMarshaler tells whether t is encoded through its MarshalBinary,
+// as gob does.
+func isBinaryMarshaler(t reflect.Type) bool {
+	return t != timeType && (t.Implements(marshalerType) || reflect.PointerTo(t).Implements(marshalerType))
+}
+
+// protoWireType returns the wire type values of t are encoded with.
+func protoWireType(t reflect.Type) int {
+	if t == timeType || isBinaryMarshaler(t) {
+		return protoBytes
+	}
+	switch t.Kind() {
+	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return protoVarint
+	case reflect.Float64:
+		return protoFixed64
+	case reflect.Float32:
+		return protoFixed32
+	case reflect.Pointer:
+		return protoWireType(t.Elem())
+	}
+	return protoBytes
+}
+
+// isProtoBytes tells whether t is a byte slice or array, a bytes field
+// rather than a repeated one.
+func isProtoBytes(t reflect.Type) bool {
+	return (t.Kind() == reflect.Slice || t.Kind() == reflect.Array) && t.Elem().Kind() == reflect.Uint8
+}
+
+// isProtoRepeated tells whether t is a repeated field or a map.
+func isProtoRepeated(t reflect.Type) bool {
+	return !isProtoBytes(t) && !isBinaryMarshaler(t) && (t.Kind() == reflect.Slice || t.Kind() == reflect.Map)
+}
+
+// marshalProto encodes v, a struct, as a protobuf message.
+func marshalProto(v any) ([]byte, error) {
+	return appendProtoMessage(nil, reflect.ValueOf(v))
+}
+
+func appendProtoMessage(b []byte, v reflect.Value) ([]byte, error) {
+	fields, err := protoStructFields(v.Type())
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range fields {
+		if b, err = appendProtoField(b, f.number, v.Field(f.index)); err != nil {
+			return nil, fmt.Errorf("%s.%s: %w", v.Type().Name(), f.name, err)
+		}
+	}
+	return b, nil
+}
+
+// appendProtoField appends field number with value v, nothing if v is zero
+// as proto3 does.
+func appendProtoField(b []byte, number uint64, v reflect.Value) ([]byte, error) {
+	if !isProtoRepeated(v.Type()) {
+		if v.IsZero() {
+			return b, nil
+		}
+		return appendProtoValue(b, number, v)
+	}
+
+	var err error
+	switch {
+	case v.Kind() == reflect.Map:
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j]) })
+		for _, key := range keys {
+			var entry []byte
+			if entry, err = appendProtoValue(nil, 1, key); err != nil {
+				return nil, err
+			} else if entry, err = appendProtoValue(entry, 2, v.MapIndex(key)); err != nil {
+				return nil, err
+			}
+			b = appendProtoLength(b, number, entry)
+		}
+	case protoWireType(v.Type().Elem()) != protoBytes:
+		// Numbers are packed, as proto3 does by default.
+		if v.Len() == 0 {
+			return b, nil
+		}
+		var packed []byte
+		for i := 0; i < v.Len(); i++ {
+			packed = appendProtoScalar(packed, v.Index(i))
+		}
+		b = appendProtoLength(b, number, packed)
+	default:
+		for i := 0; i < v.Len(); i++ {
+			if b, err = appendProtoValue(b, number, v.Index(i)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return b, nil
+}
+
+// appendProtoValue appends field number with value v, even if it is zero.
+func appendProtoValue(b []byte, number uint64, v reflect.Value) ([]byte, error) {
+	t := v.Type()
+	wireType := protoWireType(t)
+	if wireType != protoBytes {
+		if t.Kind() == reflect.Pointer {
+			if v.IsNil() {
+				return b, nil
+			}
+			v = v.Elem()
+		}
+		return appendProtoScalar(binary.AppendUvarint(b, number<<3|uint64(wireType)), v), nil
+	}
+
+	var data []byte
+	var err error
+	switch {
+	case t == timeType:
+		at := v.Interface().(time.Time)
+		data = binary.AppendUvarint(data, 1<<3|protoVarint)
+		data = binary.AppendUvarint(data, uint64(at.Unix()))
+		data = binary.AppendUvarint(data, 2<<3|protoVarint)
+		data = binary.AppendUvarint(data, uint64(at.Nanosecond()))
+	case isBinaryMarshaler(t):
+		p := reflect.New(t)
+		p.Elem().Set(v)
+		if data, err = p.Interface().(encoding.BinaryMarshaler).MarshalBinary(); err != nil {
+			return nil, err
+		}
+	case t.Kind() == reflect.String:
+		data = []byte(v.String())
+	case isProtoBytes(t):
+		data = make([]byte, v.Len())
+		reflect.Copy(reflect.ValueOf(data), v)
+	case t.Kind() == reflect.Struct:
+		if data, err = appendProtoMessage(nil, v); err != nil {
+			return nil, err
+		}
+	case t.Kind() == reflect.Pointer:
+		if v.IsNil() {
+			return b, nil
+		}
+		return appendProtoValue(b, number, v.Elem())
+	default:
+		return nil, fmt.Errorf("%w: can't encode %s", errProto, t)
+	}
+	return appendProtoLength(b, number, data), nil
+}
+
+func appendProtoLength(b []byte, number uint64, data []byte) []byte {
+	b = binary.AppendUvarint(b, number<<3|protoBytes)
+	b = binary.AppendUvarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+// appendProtoScalar appends the payload of a bool or number.
+func appendProtoScalar(b []byte, v reflect.Value) []byte {
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			return append(b, 1)
+		}
+		return append(b, 0)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return binary.AppendUvarint(b, uint64(v.Int()))
+	case reflect.Float64:
+		return binary.LittleEndian.AppendUint64(b, math.Float64bits(v.Float()))
+	case reflect.Float32:
+		return binary.LittleEndian.AppendUint32(b, math.Float32bits(float32(v.Float())))
+	}
+	return binary.AppendUvarint(b, v.Uint())
+}
+
+// unmarshalProto decodes a protobuf message into v, a pointer to a struct.
+// Fields it doesn't know are skipped, fields it doesn't find stay zero.
+func unmarshalProto(data []byte, v any) error {
+	return decodeProtoMessage(data, reflect.ValueOf(v).Elem())
+}
+
+func decodeProtoMessage(data []byte, v reflect.Value) error {
+	fields, err := protoStructFields(v.Type())
+	if err != nil {
+		return err
+	}
+	byNumber := make(map[uint64]protoField, len(fields))
+	for _, f := range fields {
+		byNumber[f.number] = f
+	}
+
+	for len(data) > 0 {
+		number, wireType, x, payload, rest, err := readProtoField(data)
+		if err != nil {
+			return err
+		}
+		data = rest
+
+		f, ok := byNumber[number]
+		if !ok {
+			continue
+		}
+		if err = decodeProtoField(v.Field(f.index), wireType, x, payload); err != nil {
+			return fmt.Errorf("%s.%s: %w", v.Type().Name(), f.name, err)
+		}
+	}
+	return nil
+}
+
+// readProtoField reads the field at the start of data, returning its
+// number, wire type and either its integer or its bytes, and what follows.
+func readProtoField(data []byte) (number uint64, wireType int, x uint64, payload, rest []byte, err error) {
+	tag, n := binary.Uvarint(data)
+	if n <= 0 {
+		return 0, 0, 0, nil, nil, fmt.Errorf("%w: truncated tag", errProto)
+	}
+	data = data[n:]
+	number, wireType = tag>>3, int(tag&7)
+
+	switch wireType {
+	case protoVarint:
+		if x, n = binary.Uvarint(data); n <= 0 {
+			return 0, 0, 0, nil, nil, fmt.Errorf("%w: truncated varint", errProto)
+		}
+		return number, wireType, x, nil, data[n:], nil
+	case protoFixed64:
+		if len(data) < 8 {
+			return 0, 0, 0, nil, nil, fmt.Errorf("%w: truncated fixed64", errProto)
+		}
+		return number, wireType, binary.LittleEndian.Uint64(data), nil, data[8:], nil
+	case protoFixed32:
+		if len(data) < 4 {
+			return 0, 0, 0, nil, nil, fmt.Errorf("%w: truncated fixed32", errProto)
+		}
+		return number, wireType, uint64(binary.LittleEndian.Uint32(data)), nil, data[4:], nil
+	case protoBytes:
+		length, n := binary.Uvarint(data)
+		if n <= 0 || uint64(len(data)-n) < length {
+			return 0, 0, 0, nil, nil, fmt.Errorf("%w: truncated field %d", errProto, number)
+		}
+		data = data[n:]
+		return number, wireType, 0, data[:length], data[length:], nil
+	}
+	return 0, 0, 0, nil, nil, fmt.Errorf("%w: unsupported wire type %d", errProto, wireType)
+}
+
+// decodeProtoField decodes one occurrence of a field into f, appending to it
+// if it is repeated.
+func decodeProtoField(f reflect.Value, wireType int, x uint64, payload []byte) error {
+	t := f.Type()
+	if !isProtoRepeated(t) {
+		return decodeProtoValue(f, wireType, x, payload)
+	}
+
+	switch {
+	case t.Kind() == reflect.Map:
+		if wireType != protoBytes {
+			return fmt.Errorf("%w: map entry sent as wire type %d", errProto, wireType)
+		}
+		key, value := reflect.New(t.Key()).Elem(), reflect.New(t.Elem()).Elem()
+		for len(payload) > 0 {
+			number, wireType, x, data, rest, err := readProtoField(payload)
+			if err != nil {
+				return err
+			}
+			payload = rest
+			if number == 1 {
+				err = decodeProtoValue(key, wireType, x, data)
+			} else if number == 2 {
+				err = decodeProtoValue(value, wireType, x, data)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if f.IsNil() {
+			f.Set(reflect.MakeMap(t))
+		}
+		f.SetMapIndex(key, value)
+	case wireType == protoBytes && protoWireType(t.Elem()) != protoBytes:
+		for len(payload) > 0 {
+			elem := reflect.New(t.Elem()).Elem()
+			var err error
+			if payload, err = decodeProtoScalar(elem, payload); err != nil {
+				return err
+			}
+			f.Set(reflect.Append(f, elem))
+		}
+	default:
+		elem := reflect.New(t.Elem()).Elem()
+		if err := decodeProtoValue(elem, wireType, x, payload); err != nil {
+			return err
+		}
+		f.Set(reflect.Append(f, elem))
+	}
+	return nil
+}
+
+// decodeProtoScalar decodes a packed element into f and returns what
+// follows it.
+func decodeProtoScalar(f reflect.Value, packed []byte) ([]byte, error) {
+	var x uint64
+	switch protoWireType(f.Type()) {
+	case protoFixed64:
+		if len(packed) < 8 {
+			return nil, fmt.Errorf("%w: truncated packed field", errProto)
+		}
+		x, packed = binary.LittleEndian.Uint64(packed), packed[8:]
+		return packed, decodeProtoValue(f, protoFixed64, x, nil)
+	case protoFixed32:
+		if len(packed) < 4 {
+			return nil, fmt.Errorf("%w: truncated packed field", errProto)
+		}
+		x, packed = uint64(binary.LittleEndian.Uint32(packed)), packed[4:]
+		return packed, decodeProtoValue(f, protoFixed32, x, nil)
+	}
+	x, n := binary.Uvarint(packed)
+	if n <= 0 {
+		return nil, fmt.Errorf("%w: truncated packed field", errProto)
+	}
+	return packed[n:], decodeProtoValue(f, protoVarint, x, nil)
+}
+
+// decodeProtoValue decodes a value of the wire type of f into it.
+func decodeProtoValue(f reflect.Value, wireType int, x uint64, payload []byte) error {
+	t := f.Type()
+	if expected := protoWireType(t); wireType != expected {
+		return fmt.Errorf("%w: %s sent as wire type %d", errProto, t, wireType)
+	}
+
+	switch {
+	case t == timeType:
+		var seconds, nanos uint64
+		for len(payload) > 0 {
+			number, _, x, _, rest, err := readProtoField(payload)
+			if err != nil {
+				return err
+			}
+			payload = rest
+			if number == 1 {
+				seconds = x
+			} else if number == 2 {
+				nanos = x
+			}
+		}
+		f.Set(reflect.ValueOf(time.Unix(int64(seconds), int64(nanos))))
+	case isBinaryMarshaler(t):
+		p := reflect.New(t)
+		unmarshaler, ok := p.Interface().(encoding.BinaryUnmarshaler)
+		if !ok {
+			return fmt.Errorf("%w: %s can't be decoded", errProto, t)
+		}
+		if err := unmarshaler.UnmarshalBinary(append([]byte{}, payload...)); err != nil {
+			return err
+		}
+		f.Set(p.Elem())
+	case t.Kind() == reflect.Pointer:
+		if f.IsNil() {
+			f.Set(reflect.New(t.Elem()))
+		}
+		return decodeProtoValue(f.Elem(), wireType, x, payload)
+	case t.Kind() == reflect.Bool:
+		f.SetBool(x != 0)
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Int64:
+		f.SetInt(int64(x))
+	case t.Kind() >= reflect.Uint && t.Kind() <= reflect.Uintptr:
+		f.SetUint(x)
+	case t.Kind() == reflect.Float64:
+		f.SetFloat(math.Float64frombits(x))
+	case t.Kind() == reflect.Float32:
+		f.SetFloat(float64(math.Float32frombits(uint32(x))))
+	case t.Kind() == reflect.String:
+		f.SetString(string(payload))
+	case t.Kind() == reflect.Slice && isProtoBytes(t):
+		f.SetBytes(append([]byte{}, payload...))
+	case t.Kind() == reflect.Array && isProtoBytes(t):
+		reflect.Copy(f, reflect.ValueOf(payload))
+	case t.Kind() == reflect.Struct:
+		return decodeProtoMessage(payload, f)
+	default:
+		return fmt.Errorf("%w: can't decode %s", errProto, t)
+	}
+	return nil
+}
+
+// SnapshotProto returns the protobuf schema of snapshots encoded with
+// -snapshot-encoding protobuf, for inspecting them without Go:
+//
+//	tail -c +5 peerConnections.gob | protoc --decode=zdr.GlobalState snapshot.proto
+func SnapshotProto() (string, error) {
+	s := &protoSchema{names: map[reflect.Type]string{}, taken: map[string]reflect.Type{}}
+	if _, err := s.message(reflect.TypeOf(GlobalState{})); err != nil {
+		return "", err
+	}
+
+	out := &strings.Builder{}
+	fmt.Fprintf(out, "// Snapshots of version %d, after the %q they start with.\n", snapshotVersion, snapshotProtoMagic)
+	out.WriteString("syntax = \"proto3\";\n\npackage zdr;\n\nimport \"google/protobuf/timestamp.proto\";\n")
+	for _, message := range s.messages {
+		out.WriteString("\n" + message)
+	}
+	return out.String(), nil
+}
+
+// protoSchema collects the messages of SnapshotProto.
+type protoSchema struct {
+	names    map[reflect.Type]string
+	taken    map[string]reflect.Type
+	messages []string
+}
+
+// message returns the name of the message of struct type t, adding it and
+// those of its fields to the schema the first time.
+func (s *protoSchema) message(t reflect.Type) (string, error) {
+	if name, ok := s.names[t]; ok {
+		return name, nil
+	}
+
+	name := t.Name()
+	if other, ok := s.taken[name]; ok && other != t || name == "" {
+		name = strings.ReplaceAll(path.Base(t.PkgPath()), "-", "_") + "_" + name
+	}
+	s.names[t], s.taken[name] = name, t
+
+	fields, err := protoStructFields(t)
+	if err != nil {
+		return "", err
+	}
+	out := &strings.Builder{}
+	fmt.Fprintf(out, "message %s {\n", name)
+	for _, f := range fields {
+		field, err := s.field(t.Field(f.index).Type)
+		if err != nil {
+			return "", fmt.Errorf("%s.%s: %w", name, f.name, err)
+		}
+		fmt.Fprintf(out, "  %s %s = %d;\n", field, f.name, f.number)
+	}
+	out.WriteString("}\n")
+	s.messages = append(s.messages, out.String())
+	return name, nil
+}
+
+// field returns the declared type of a field of type t.
+func (s *protoSchema) field(t reflect.Type) (string, error) {
+	switch {
+	case t.Kind() == reflect.Map:
+		key, err := s.scalar(t.Key())
+		if err != nil {
+			return "", err
+		}
+		value, err := s.scalar(t.Elem())
+		return fmt.Sprintf("map<%s, %s>", key, value), err
+	case isProtoRepeated(t):
+		elem, err := s.scalar(t.Elem())
+		return "repeated " + elem, err
+	case t.Kind() == reflect.Pointer && protoWireType(t) != protoBytes:
+		elem, err := s.scalar(t.Elem())
+		return "optional " + elem, err
+	}
+	return s.scalar(t)
+}
+
+// scalar returns the type of a value of type t, which can't be repeated.
+func (s *protoSchema) scalar(t reflect.Type) (string, error) {
+	switch {
+	case t == timeType:
+		return "google.protobuf.Timestamp", nil
+	case isBinaryMarshaler(t), isProtoBytes(t):
+		return "bytes", nil
+	case isProtoRepeated(t):
+		return "", fmt.Errorf("%w: nested %s", errProto, t)
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return "bool", nil
+	case reflect.Int, reflect.Int64:
+		return "int64", nil
+	case reflect.Int8, reflect.Int16, reflect.Int32:
+		return "int32", nil
+	case reflect.Uint, reflect.Uint64, reflect.Uintptr:
+		return "uint64", nil
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return "uint32", nil
+	case reflect.Float64:
+		return "double", nil
+	case reflect.Float32:
+		return "float", nil
+	case reflect.String:
+		return "string", nil
+	case reflect.Struct:
+		return s.message(t)
+	case reflect.Pointer:
+		return s.scalar(t.Elem())
+	}
+	return "", fmt.Errorf("%w: can't describe %s", errProto, t)
+}
@@ -0,0 +1,219 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/logging"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+
+	"webrtc-zero-downtime-reload/internal/pionadapter"
+)
+
+// srtpMaxROC is the highest rollover counter resynchronization tries, enough
+// for a stream of 268 million packets.
+const srtpMaxROC = 1 << 12
+
+// srtpAuthFailure is what pion/srtp logs for a packet that fails to
+// authenticate, the only way it reports one.
+const srtpAuthFailure = "failed to verify auth tag"
+
+var (
+	srtpAuthFailures = newCounter("srtp_auth_failures_total", "SRTP and SRTCP packets of restored sessions that failed to authenticate.")
+	srtpQuarantines  = newCounter("srtp_quarantines_total", "Restored sessions quarantined for SRTP authentication failures.")
+	srtpResyncs      = newCounter("srtp_resyncs_total", "SRTP streams whose rollover counter was resynchronized.")
+	srtpRepairs      = newCounter("srtp_repairs_total", "Quarantined sessions whose SRTP authentication failures stopped.")
+	srtpRenewals     = newCounter("srtp_renewals_total", "Quarantined sessions whose clients were asked for a new session.")
+	_                = newGauge("srtp_quarantined_sessions", "Sessions quarantined for SRTP authentication failures.", func() float64 {
+		sessionsMutex.Lock()
+		defer sessionsMutex.Unlock()
+
+		n := 0
+		for _, session := range sessions {
+			if session.srtp.repairing.Load() {
+				n++
+			}
+		}
+		return float64(n)
+	})
+)
+
+// srtpGuard follows the SRTP authentication failures of a restored session.
+// The snapshot only holds the SRTCP indexes, so the rollover counters of
+// streams that wrapped before the restart start over at 0, and every packet
+// of such a stream fails to authenticate while the connection looks fine.
+//
+// Once failures go past -srtp-failure-threshold in a second the session is
+// quarantined: each stream that fails next has its rollover counter found
+// by trying to decrypt the failing packet with each of them. Should failures
+// not stop within -srtp-repair-timeout, the client is asked for a new
+// session, whose fresh keys no resynchronization is needed for.
+type srtpGuard struct {
+	failures  atomic.Uint64
+	repairing atomic.Bool
+
+	// attempt counts quarantines, streams are only tried once per attempt.
+	attempt atomic.Uint64
+
+	// sniffer, tried and triedAttempt belong to the goroutine of pion/srtp
+	// decrypting packets.
+	sniffer      *srtpSniffer
+	tried        map[uint32]bool
+	triedAttempt uint64
+}
+
+// srtpSniffer keeps a copy of the last packet read by an SRTP session while
+// its session is quarantined, the one that failed when a failure is logged.
+type srtpSniffer struct {
+	net.Conn
+	repairing *atomic.Bool
+	last      []byte
+}
+
+func (s *srtpSniffer) Read(b []byte) (int, error) {
+	n, err := s.Conn.Read(b)
+	if n > 0 && s.repairing.Load() {
+		s.last = append(s.last[:0], b[:n]...)
+	}
+	return n, err
+}
+
+// srtpLoggerFactory is the default logger factory of pion, except that the
+// loggers of the SRTP and SRTCP sessions of session report authentication
+// failures to its guard, and that of its DTLS connection decryption failures
+// to its latch. Both sessions log as srtp, the SRTP one is created first.
+type srtpLoggerFactory struct {
+	logging.LoggerFactory
+	session *session
+	created int
+}
+
+func newSRTPLoggerFactory(session *session) *srtpLoggerFactory {
+	return &srtpLoggerFactory{LoggerFactory: logging.NewDefaultLoggerFactory(), session: session}
+}
+
+func (f *srtpLoggerFactory) NewLogger(scope string) logging.LeveledLogger {
+	logger := f.LoggerFactory.NewLogger(scope)
+	if scope == "dtls" {
+		return &dtlsLogger{LeveledLogger: logger, session: f.session}
+	} else if scope != "srtp" {
+		return logger
+	}
+	f.created++
+	return &srtpLogger{LeveledLogger: logger, session: f.session, rtcp: f.created > 1}
+}
+
+type srtpLogger struct {
+	logging.LeveledLogger
+	session *session
+	rtcp    bool
+}
+
+// Info is called from the goroutine decrypting packets, right after the one
+// that failed.
+func (l *srtpLogger) Info(msg string) {
+	if msg == srtpAuthFailure {
+		l.session.srtp.failures.Add(1)
+		srtpAuthFailures.Inc()
+		if l.session.latch != nil {
+			l.session.latch.srtpFailures.Add(1)
+		}
+		if !l.rtcp && l.session.srtp.repairing.Load() {
+			resyncSRTP(l.session)
+		}
+	}
+	l.LeveledLogger.Info(msg)
+}
+
+// resyncSRTP looks for the rollover counter of the stream of the packet that
+// just failed to authenticate. It runs on the goroutine decrypting packets,
+// the only one using the remote SRTP context, so the context is safe to
+// change. The first failure only installs the sniffer.
+func resyncSRTP(session *session) {
+	g := &session.srtp
+	srtpSession := pionadapter.Pion.SRTPSession(session.peerConnection)
+	if srtpSession == nil {
+		return
+	}
+
+	if g.sniffer == nil {
+		conn := pionadapter.Pion.SRTPConn(srtpSession)
+		g.sniffer = &srtpSniffer{Conn: *conn, repairing: &g.repairing}
+		*conn = g.sniffer
+		return
+	}
+	if attempt := g.attempt.Load(); g.triedAttempt != attempt {
+		g.tried, g.triedAttempt = map[uint32]bool{}, attempt
+	}
+
+	packet := g.sniffer.last
+	header := &rtp.Header{}
+	if _, err := header.Unmarshal(packet); err != nil || g.tried[header.SSRC] {
+		return
+	}
+	g.tried[header.SSRC] = true
+
+	remote := pionadapter.Pion.SRTPRemoteContext(srtpSession)
+	original, _ := remote.ROC(header.SSRC)
+	decrypted := make([]byte, len(packet))
+	for roc := uint32(0); roc <= srtpMaxROC; roc++ {
+		remote.SetROC(header.SSRC, roc)
+		if _, err := remote.DecryptRTP(decrypted, packet, nil); err == nil {
+			srtpResyncs.Inc()
+			recordHistory(session, historyControl, "resynchronized the SRTP rollover counter of SSRC %d from %d to %d", header.SSRC, original, roc)
+			return
+		}
+	}
+	remote.SetROC(header.SSRC, original)
+	recordHistory(session, historyControl, "found no SRTP rollover counter for SSRC %d", header.SSRC)
+}
+
+// guardSRTP quarantines a restored session whose packets fail to
+// authenticate and repairs it, see srtpGuard.
+func guardSRTP(session *session) {
+	if config.SRTPFailureThreshold <= 0 {
+		return
+	}
+
+	supervise("SRTP guard", session, func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+
+		g := &session.srtp
+		var quarantined time.Time
+		for now := range ticker.C {
+			if session.peerConnection.ConnectionState() == webrtc.PeerConnectionStateClosed {
+				return
+			}
+
+			failures := g.failures.Swap(0)
+			switch {
+			case quarantined.IsZero() && failures >= uint64(config.SRTPFailureThreshold):
+				quarantined = now
+				g.attempt.Add(1)
+				g.repairing.Store(true)
+				srtpQuarantines.Inc()
+				logf("Quarantining PeerConnection %s after %d SRTP authentication failures in a second\n", session.id, failures)
+				recordHistory(session, historyControl, "quarantined after %d SRTP authentication failures in a second", failures)
+			case quarantined.IsZero():
+			case failures < uint64(config.SRTPFailureThreshold):
+				quarantined = time.Time{}
+				g.repairing.Store(false)
+				srtpRepairs.Inc()
+				recordHistory(session, historyControl, "SRTP authentication failures stopped, out of quarantine")
+			case now.Sub(quarantined) >= config.SRTPRepairTimeout:
+				srtpRenewals.Inc()
+				logf("SRTP of PeerConnection %s couldn't be repaired, asking for a new session\n", session.id)
+				recordHistory(session, historyControl, "SRTP couldn't be repaired, asking the client for a new session")
+				publishEvent(session.id, event{Name: "restoreFailed"})
+				go collectSession(session, tombstoneSRTPFailed)
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,286 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// queueTimeout is how long a queued viewer may go without listening on
+// /events before it is dropped, and how long an admitted one has to join.
+const queueTimeout = 30 * time.Second
+
+var (
+	queueAdmissions = newCounter("queue_admissions_total", "Queued viewers admitted to their room.")
+	queueAbandoned  = newCounter("queue_abandoned_total", "Queued viewers dropped for going away or not joining once admitted.")
+	_               = newGauge("queued_viewers", "Viewers waiting for a room at capacity.", func() float64 {
+		n := 0
+		for _, room := range allRooms() {
+			room.queueMutex.Lock()
+			n += len(room.queue)
+			room.queueMutex.Unlock()
+		}
+		return float64(n)
+	})
+)
+
+// QueuedViewer is a viewer waiting for a room at capacity, as saved in the
+// snapshot. The client listens on /events with its ticket, a zero Admitted
+// means it is still waiting.
+type QueuedViewer struct {
+	Ticket   string
+	Joined   time.Time
+	Admitted time.Time `json:",omitempty"`
+}
+
+// queuedViewer is a QueuedViewer along with what its client was told last.
+// session is set once an admitted viewer sent its offer, it holds on to its
+// slot until the session connects.
+type queuedViewer struct {
+	QueuedViewer
+	session  string
+	seen     time.Time
+	position int
+	notified bool
+}
+
+// allRooms returns every room.
+func allRooms() []*room {
+	roomsMutex.Lock()
+	defer roomsMutex.Unlock()
+
+	out := make([]*room, 0, len(rooms))
+	for _, room := range rooms {
+		out = append(out, room)
+	}
+	return out
+}
+
+// viewers returns the number of viewers connected to room.
+// sessionsMutex must be held by the caller.
+func (r *room) viewers() int {
+	n := 0
+	for _, session := range sessions {
+		if session.room == r && !session.broadcaster {
+			n++
+		}
+	}
+	return n
+}
+
+// queuedViewers returns the queue of room to save.
+func (r *room) queuedViewers() []QueuedViewer {
+	r.queueMutex.Lock()
+	defer r.queueMutex.Unlock()
+
+	out := []QueuedViewer{}
+	for _, viewer := range r.queue {
+		out = append(out, viewer.QueuedViewer)
+	}
+	return out
+}
+
+// restoreQueue puts the viewers of a snapshot back in line in the same
+// order. They are given queueTimeout from now to reconnect, admitted ones to
+// join, and are told where they are again.
+func (r *room) restoreQueue(queue []QueuedViewer) {
+	now := time.Now()
+
+	r.queueMutex.Lock()
+	defer r.queueMutex.Unlock()
+	for _, viewer := range queue {
+		if !viewer.Admitted.IsZero() {
+			viewer.Admitted = now
+		}
+		r.queue = append(r.queue, &queuedViewer{QueuedViewer: viewer, seen: now})
+	}
+}
+
+// enqueue puts a viewer at the back of the line of room, unless it is below
+// capacity and nobody is waiting, in which case ok is false and the viewer
+// may join right away.
+func (r *room) enqueue() (viewer QueuedViewer, position int, ok bool) {
+	sessionsMutex.Lock()
+	viewers := r.viewers()
+	sessionsMutex.Unlock()
+
+	now := time.Now()
+	r.queueMutex.Lock()
+	for _, queued := range r.queue {
+		if queued.Admitted.IsZero() {
+			position++
+		} else {
+			// Admitted viewers hold on to their slot.
+			viewers++
+		}
+	}
+	if position == 0 && viewers < r.policy.MaxViewers {
+		r.queueMutex.Unlock()
+		return QueuedViewer{}, 0, false
+	}
+	queued := &queuedViewer{QueuedViewer: QueuedViewer{Ticket: randomToken(), Joined: now}, seen: now}
+	r.queue = append(r.queue, queued)
+	position++
+	queued.position = position
+	r.queueMutex.Unlock()
+
+	sessionsMutex.Lock()
+	if err := serialize(context.Background()); err != nil {
+		logf("Failed to serialize: %v\n", err)
+	}
+	sessionsMutex.Unlock()
+	return queued.QueuedViewer, position, true
+}
+
+// admitted reports whether ticket was admitted to room.
+func (r *room) admitted(ticket string) bool {
+	r.queueMutex.Lock()
+	defer r.queueMutex.Unlock()
+
+	for _, viewer := range r.queue {
+		if viewer.Ticket == ticket {
+			return !viewer.Admitted.IsZero()
+		}
+	}
+	return false
+}
+
+// joined holds the slot of ticket for session until it connects. A client
+// whose session fails before then may try again with the same ticket while
+// it is admitted.
+func (r *room) joined(ticket, session string) {
+	r.queueMutex.Lock()
+	defer r.queueMutex.Unlock()
+
+	for _, viewer := range r.queue {
+		if viewer.Ticket == ticket {
+			viewer.session = session
+		}
+	}
+}
+
+// closeQueue tells everybody waiting for room that it closed.
+func (r *room) closeQueue() {
+	r.queueMutex.Lock()
+	defer r.queueMutex.Unlock()
+
+	for _, viewer := range r.queue {
+		publishEvent(viewer.Ticket, event{Name: "roomClosed"})
+	}
+	r.queue = nil
+}
+
+// watchQueues admits queued viewers as slots free up, in the order they
+// joined, and keeps everybody in line told where they are. Admitted viewers
+// are sent admitted and join with their ticket, which holds on to a slot for
+// queueTimeout.
+func watchQueues(ctx context.Context) {
+	every(ctx, time.Second, func(now time.Time) {
+		changed := false
+		for _, room := range allRooms() {
+			if room.policy.MaxViewers == 0 {
+				continue
+			}
+
+			sessionsMutex.Lock()
+			viewers := room.viewers()
+			connected := map[string]bool{}
+			for _, session := range sessions {
+				connected[session.id] = true
+			}
+			sessionsMutex.Unlock()
+
+			if room.updateQueue(now, viewers, connected) {
+				changed = true
+			}
+		}
+
+		if changed {
+			sessionsMutex.Lock()
+			if err := serialize(ctx); err != nil {
+				logf("Failed to serialize: %v\n", err)
+			}
+			sessionsMutex.Unlock()
+		}
+	})
+}
+
+// updateQueue drops viewers that went away, admits as many as there are
+// free slots and tells the others where they are. It reports whether the
+// queue changed.
+func (r *room) updateQueue(now time.Time, viewers int, connected map[string]bool) bool {
+	r.queueMutex.Lock()
+	defer r.queueMutex.Unlock()
+
+	changed := false
+	kept := []*queuedViewer{}
+	for _, viewer := range r.queue {
+		if hasEventStream(viewer.Ticket) {
+			viewer.seen = now
+		}
+
+		switch {
+		case viewer.session != "" && connected[viewer.session]:
+			// Counted among the viewers from now on.
+			changed = true
+			continue
+		case viewer.Admitted.IsZero() && now.Sub(viewer.seen) > queueTimeout,
+			!viewer.Admitted.IsZero() && now.Sub(viewer.Admitted) > queueTimeout:
+			queueAbandoned.Inc()
+			forgetEvents(viewer.Ticket)
+			changed = true
+			continue
+		}
+		kept = append(kept, viewer)
+	}
+	r.queue = kept
+
+	free := r.policy.MaxViewers - viewers
+	position := 0
+	for _, viewer := range r.queue {
+		if !viewer.Admitted.IsZero() {
+			free--
+			continue
+		}
+		if free > 0 {
+			free--
+			viewer.Admitted = now
+			queueAdmissions.Inc()
+			changed = true
+			continue
+		}
+
+		position++
+		if viewer.position != position {
+			viewer.position = position
+			publishEvent(viewer.Ticket, event{Name: "queuePosition", Data: position})
+		}
+	}
+
+	for _, viewer := range r.queue {
+		if !viewer.Admitted.IsZero() && !viewer.notified {
+			viewer.notified = true
+			publishEvent(viewer.Ticket, event{Name: "admitted"})
+		}
+	}
+	return changed
+}
+
+// writeQueued tells a viewer that the room is full and where it is in line.
+// The client listens on /events with the ticket for queuePosition and
+// admitted, then sends its offer again with ?ticket=.
+func writeQueued(w http.ResponseWriter, viewer QueuedViewer, position int) {
+	out := struct {
+		Ticket   string
+		Position int
+	}{viewer.Ticket, position}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Queue-Ticket", viewer.Ticket)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(&out)
+}
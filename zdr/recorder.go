@@ -0,0 +1,280 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/dtls/v2"
+	"github.com/pion/srtp/v2"
+
+	"webrtc-zero-downtime-reload/internal/pionadapter"
+)
+
+var (
+	errKeyExportDisabled = errors.New("the policy of the room doesn't allow exporting keys")
+	errNoDTLS            = errors.New("session has no DTLS connection yet")
+	errMissingReason     = errors.New("a reason is required")
+
+	keyExports        = newCounter("srtp_key_exports_total", "SRTP keys handed to the recorder.")
+	keyExportRefusals = newCounter("srtp_key_export_refusals_total", "Requests for SRTP keys that were refused.")
+
+	// recorderNetworks are the networks of -recorder-networks, the recorder
+	// may connect from any if empty.
+	recorderNetworks []*net.IPNet
+
+	auditMutex sync.Mutex
+)
+
+// KeyExportAudit is an entry of -recorder-audit-log, written for every
+// request for keys whether it was granted or not.
+type KeyExportAudit struct {
+	Time      time.Time
+	Session   string
+	Room      string `json:",omitempty"`
+	Principal Principal
+	Recorder  string
+	Reason    string
+	Granted   bool
+	Error     string `json:",omitempty"`
+}
+
+// SRTPKeys are the master keys and salts of a session, as the recorder needs
+// them to decrypt what the server sent and received. Local keys encrypt what
+// the server sends, remote keys what the client sends.
+type SRTPKeys struct {
+	Session          string
+	Profile          string
+	LocalMasterKey   []byte
+	LocalMasterSalt  []byte
+	RemoteMasterKey  []byte
+	RemoteMasterSalt []byte
+	Tracks           []RecordedTrack
+
+	// RetainUntil is when what is recorded with the keys must be deleted
+	// by, according to the recording policy of the room. Never if zero.
+	RetainUntil time.Time `json:",omitempty"`
+}
+
+// RecordedTrack tells the recorder what is carried by an SSRC.
+type RecordedTrack struct {
+	SSRC      uint32
+	Kind      string
+	Direction string
+}
+
+// parseRecorderNetworks parses -recorder-networks, a comma separated list of
+// CIDRs.
+func parseRecorderNetworks(list string) ([]*net.IPNet, error) {
+	out := []*net.IPNet{}
+	for _, cidr := range strings.Split(list, ",") {
+		if cidr = strings.TrimSpace(cidr); cidr == "" {
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, network)
+	}
+	return out, nil
+}
+
+// handleRecorder serves POST /recorder/sessions/{id}/keys, which hands the
+// SRTP keys of a session to the recorder with a body like {"Reason": "case
+// 1234"}. It is only served with -recorder-token, to requests carrying it
+// from -recorder-networks, for sessions of rooms whose policy allows
+// KeyExport and whose recording policy allows recording. Every request is
+// written to -recorder-audit-log before keys are handed out, if that fails
+// they aren't.
+func handleRecorder(w http.ResponseWriter, r *http.Request) {
+	if config.RecorderToken == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	id, resource, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/recorder/sessions/"), "/")
+	if resource != "keys" {
+		http.NotFound(w, r)
+		return
+	} else if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	audit := KeyExportAudit{Time: time.Now(), Session: id, Recorder: r.RemoteAddr}
+	refuse := func(code int, err error) {
+		keyExportRefusals.Inc()
+		audit.Error = err.Error()
+		if auditErr := writeAudit(audit); auditErr != nil {
+			logf("Failed to write key export audit: %v\n", auditErr)
+		}
+		http.Error(w, err.Error(), code)
+	}
+
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !hmac.Equal([]byte(token), []byte(config.RecorderToken)) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		refuse(http.StatusUnauthorized, errUnauthenticated)
+		return
+	} else if !fromRecorderNetwork(r) {
+		refuse(http.StatusForbidden, fmt.Errorf("%w: %s is not in -recorder-networks", errForbidden, r.RemoteAddr))
+		return
+	}
+
+	var in struct {
+		Reason string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		refuse(http.StatusBadRequest, err)
+		return
+	}
+	if audit.Reason = strings.TrimSpace(in.Reason); audit.Reason == "" {
+		refuse(http.StatusBadRequest, errMissingReason)
+		return
+	}
+
+	session := findSession(id)
+	if session == nil {
+		refuse(http.StatusNotFound, errors.New("session not found"))
+		return
+	}
+	audit.Room, audit.Principal = session.room.id, session.principal
+	recording := session.room.recordingPolicy()
+	if !session.room.policy.KeyExport {
+		refuse(http.StatusForbidden, errKeyExportDisabled)
+		return
+	} else if !recording.Allowed {
+		refuse(http.StatusForbidden, errRecordingNotAllowed)
+		return
+	}
+
+	keys, err := exportSRTPKeys(session)
+	if err != nil {
+		refuse(http.StatusConflict, err)
+		return
+	}
+	keys.RetainUntil = recording.retainUntil(audit.Time)
+
+	audit.Granted = true
+	if err = writeAudit(audit); err != nil {
+		logf("Failed to write key export audit, not exporting keys: %v\n", err)
+		keyExportRefusals.Inc()
+		http.Error(w, "failed to write audit log", http.StatusInternalServerError)
+		return
+	}
+	keyExports.Inc()
+	recordHistory(session, historyControl, "SRTP keys exported to %s: %s", r.RemoteAddr, audit.Reason)
+	logf("Exported the SRTP keys of session %s to %s\n", session.id, r.RemoteAddr)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(keys)
+}
+
+func fromRecorderNetwork(r *http.Request) bool {
+	if len(recorderNetworks) == 0 {
+		return true
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	for _, network := range recorderNetworks {
+		if ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeAudit appends entry to -recorder-audit-log and syncs it to disk.
+func writeAudit(entry KeyExportAudit) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+
+	f, err := os.OpenFile(config.RecorderAuditLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600) //nolint:gosec
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(append(line, '\n')); err != nil {
+		f.Close() //nolint:errcheck
+		return err
+	} else if err = f.Sync(); err != nil {
+		f.Close() //nolint:errcheck
+		return err
+	}
+	return f.Close()
+}
+
+// exportSRTPKeys derives the SRTP keys of session from its DTLS connection,
+// the way the DTLSTransport did when it started SRTP. A resumed session
+// derives the same ones, they don't change across restarts.
+func exportSRTPKeys(session *session) (SRTPKeys, error) {
+	dtlsConn := pionadapter.Pion.DTLSConn(session.peerConnection)
+	if dtlsConn == nil {
+		return SRTPKeys{}, errNoDTLS
+	}
+	profile, ok := dtlsConn.SelectedSRTPProtectionProfile()
+	if !ok {
+		return SRTPKeys{}, errNoDTLS
+	}
+
+	state := dtlsConn.ConnectionState()
+	srtpConfig := &srtp.Config{Profile: srtp.ProtectionProfile(profile)}
+	if err := srtpConfig.ExtractSessionKeysFromDTLS(&state, pionadapter.Pion.DTLSIsClient(&state)); err != nil {
+		return SRTPKeys{}, err
+	}
+
+	keys := SRTPKeys{
+		Session:          session.id,
+		Profile:          protectionProfileName(profile),
+		LocalMasterKey:   srtpConfig.Keys.LocalMasterKey,
+		LocalMasterSalt:  srtpConfig.Keys.LocalMasterSalt,
+		RemoteMasterKey:  srtpConfig.Keys.RemoteMasterKey,
+		RemoteMasterSalt: srtpConfig.Keys.RemoteMasterSalt,
+		Tracks:           []RecordedTrack{},
+	}
+	for _, transceiver := range session.peerConnection.GetTransceivers() {
+		if sender := transceiver.Sender(); sender != nil {
+			for _, encoding := range sender.GetParameters().Encodings {
+				keys.Tracks = append(keys.Tracks, RecordedTrack{SSRC: uint32(encoding.SSRC), Kind: transceiver.Kind().String(), Direction: "sent"})
+			}
+		}
+		if receiver := transceiver.Receiver(); receiver != nil {
+			for _, track := range receiver.Tracks() {
+				keys.Tracks = append(keys.Tracks, RecordedTrack{SSRC: uint32(track.SSRC()), Kind: track.Kind().String(), Direction: "received"})
+			}
+		}
+	}
+	return keys, nil
+}
+
+func protectionProfileName(profile dtls.SRTPProtectionProfile) string {
+	switch profile {
+	case dtls.SRTP_AES128_CM_HMAC_SHA1_80:
+		return "SRTP_AES128_CM_HMAC_SHA1_80"
+	case dtls.SRTP_AES128_CM_HMAC_SHA1_32:
+		return "SRTP_AES128_CM_HMAC_SHA1_32"
+	case dtls.SRTP_AEAD_AES_128_GCM:
+		return "SRTP_AEAD_AES_128_GCM"
+	}
+	return fmt.Sprintf("0x%04x", uint16(profile))
+}
@@ -0,0 +1,218 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"time"
+)
+
+// recordingSweepInterval is how often recordings past their retention are
+// looked for.
+const recordingSweepInterval = time.Minute
+
+var (
+	errRecordingNotAllowed = errors.New("the room doesn't allow recording")
+
+	recordingsDeleted = newCounter("recordings_deleted_total", "Recordings deleted for their room's retention policy.")
+)
+
+// RecordingPolicy is what a room allows to be recorded and for how long.
+// It is checked whenever a packet capture is started or SRTP keys are
+// exported, and saved with the room so it carries on across restarts and
+// to another instance the snapshot is imported into.
+type RecordingPolicy struct {
+	// Allowed is the consent to record the room. Withdrawing it stops the
+	// captures running, recordings already made are kept for Retention.
+	Allowed bool
+
+	// Retention is how long recordings are kept, forever if 0.
+	Retention time.Duration `json:",omitempty"`
+
+	// DeleteAt is when every recording made before it is deleted, never if
+	// zero.
+	DeleteAt time.Time `json:",omitempty"`
+}
+
+// retainUntil returns when a recording started at started must be deleted,
+// zero if never.
+func (p RecordingPolicy) retainUntil(started time.Time) time.Time {
+	until := time.Time{}
+	if p.Retention > 0 {
+		until = started.Add(p.Retention)
+	}
+	if !p.DeleteAt.IsZero() && started.Before(p.DeleteAt) && (until.IsZero() || p.DeleteAt.Before(until)) {
+		until = p.DeleteAt
+	}
+	return until
+}
+
+// Recording is a packet capture of a session of a room, kept until its
+// policy says otherwise.
+type Recording struct {
+	Path    string
+	Session string
+	Started time.Time
+}
+
+// defaultRecordingPolicy is the policy of rooms created without one, and of
+// rooms saved before they had one.
+func defaultRecordingPolicy() RecordingPolicy {
+	return RecordingPolicy{Allowed: config.RecordingAllowed, Retention: config.RecordingRetention}
+}
+
+// recordingPolicy returns the policy of r.
+func (r *room) recordingPolicy() RecordingPolicy {
+	r.recordingMutex.Lock()
+	defer r.recordingMutex.Unlock()
+	return r.recording
+}
+
+// recordingStates returns the recordings of r to save.
+func (r *room) recordingStates() []Recording {
+	r.recordingMutex.Lock()
+	defer r.recordingMutex.Unlock()
+	return append([]Recording{}, r.recordings...)
+}
+
+// restoreRecording puts back the policy and recordings of a snapshot.
+func (r *room) restoreRecording(policy *RecordingPolicy, recordings []Recording) {
+	r.recordingMutex.Lock()
+	defer r.recordingMutex.Unlock()
+	r.recording = defaultRecordingPolicy()
+	if policy != nil {
+		r.recording = *policy
+	}
+	r.recordings = append([]Recording{}, recordings...)
+}
+
+// addRecording tracks a capture of session, so it is deleted in time.
+func (r *room) addRecording(session *session, path string, started time.Time) {
+	r.recordingMutex.Lock()
+	defer r.recordingMutex.Unlock()
+	r.recordings = append(r.recordings, Recording{Path: path, Session: session.id, Started: started})
+}
+
+// setRecordingPolicy changes the policy of r, stopping the captures of its
+// sessions when consent is withdrawn.
+func setRecordingPolicy(r *room, policy RecordingPolicy) error {
+	r.recordingMutex.Lock()
+	r.recording = policy
+	r.recordingMutex.Unlock()
+	logf("Recording policy of room %s is now allowed=%t retention=%s\n", r.id, policy.Allowed, policy.Retention)
+
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	if !policy.Allowed {
+		for _, session := range sessions {
+			if session.room != r {
+				continue
+			}
+			if capture := session.capture.Swap(nil); capture != nil {
+				capture.stop()
+				recordHistory(session, historyControl, "packet capture stopped, the room no longer allows recording")
+			}
+		}
+	}
+	return serialize(context.Background())
+}
+
+// expireRecordings deletes the recordings of r its policy doesn't keep at
+// now, or all of them if all is set. It reports whether any went.
+func expireRecordings(r *room, now time.Time, all bool) bool {
+	r.recordingMutex.Lock()
+	defer r.recordingMutex.Unlock()
+
+	kept := r.recordings[:0]
+	for _, recording := range r.recordings {
+		until := r.recording.retainUntil(recording.Started)
+		if !all && (until.IsZero() || now.Before(until)) {
+			kept = append(kept, recording)
+			continue
+		}
+
+		if err := os.Remove(recording.Path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			logf("Failed to delete recording %s of room %s: %v\n", recording.Path, r.id, err)
+			kept = append(kept, recording)
+			continue
+		}
+		recordingsDeleted.Inc()
+		logf("Deleted recording %s of room %s\n", recording.Path, r.id)
+	}
+
+	expired := len(kept) != len(r.recordings)
+	r.recordings = kept
+	return expired
+}
+
+// watchRecordings deletes recordings once the policy of their room no
+// longer keeps them, starting with those due while we were down.
+func watchRecordings(ctx context.Context) {
+	sweep := func(now time.Time) {
+		expired := false
+		for _, room := range allRooms() {
+			if expireRecordings(room, now, false) {
+				expired = true
+			}
+		}
+		if !expired {
+			return
+		}
+
+		sessionsMutex.Lock()
+		defer sessionsMutex.Unlock()
+		if err := serialize(ctx); err != nil {
+			logf("Failed to serialize: %v\n", err)
+		}
+	}
+	sweep(time.Now())
+	every(ctx, recordingSweepInterval, sweep)
+}
+
+// handleAdminRoomRecording serves /admin/rooms/{id}/recording, returning the
+// policy and recordings of the room on GET. PUT or POST with a body like
+// {"Allowed": true, "Retention": "720h", "DeleteAt": "2025-01-01T00:00:00Z"}
+// sets the policy.
+func handleAdminRoomRecording(w http.ResponseWriter, r *http.Request, room *room) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			RecordingPolicy
+			Recordings []Recording
+		}{room.recordingPolicy(), room.recordingStates()})
+	case http.MethodPut, http.MethodPost:
+		var in struct {
+			Allowed   bool
+			Retention string
+			DeleteAt  time.Time
+		}
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		policy := RecordingPolicy{Allowed: in.Allowed, DeleteAt: in.DeleteAt}
+		if in.Retention != "" {
+			var err error
+			if policy.Retention, err = time.ParseDuration(in.Retention); err != nil || policy.Retention < 0 {
+				http.Error(w, "invalid retention", http.StatusBadRequest)
+				return
+			}
+		}
+
+		if err := setRecordingPolicy(room, policy); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
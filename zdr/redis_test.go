@@ -0,0 +1,250 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fakeRedis serves conn like Redis would one command at a time: it reads
+// command, which must be what the client sends, and writes reply.
+func fakeRedis(t *testing.T, conn net.Conn, command, reply string) <-chan error {
+	t.Helper()
+
+	done := make(chan error, 1)
+	go func() {
+		received := make([]byte, len(command))
+		if _, err := io.ReadFull(conn, received); err != nil {
+			done <- err
+			return
+		} else if string(received) != command {
+			done <- errors.New("got command " + string(received))
+			return
+		}
+		_, err := io.WriteString(conn, reply)
+		done <- err
+	}()
+	return done
+}
+
+// pipeConn returns both ends of a pipe, the client end as a redisConn.
+func pipeConn(t *testing.T) (*redisConn, net.Conn) {
+	t.Helper()
+
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close(); server.Close() })
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+	_ = server.SetDeadline(time.Now().Add(5 * time.Second))
+	return &redisConn{Conn: client, reader: bufio.NewReader(client)}, server
+}
+
+func TestRedisConnDo(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		reply string
+		want  any
+		err   bool
+	}{
+		{"simple string", "+OK\r\n", "OK", false},
+		{"integer", ":42\r\n", int64(42), false},
+		{"bulk string", "$5\r\nhello\r\n", []byte("hello"), false},
+		{"binary bulk string", "$4\r\na\r\nb\r\n", []byte("a\r\nb"), false},
+		{"null bulk string", "$-1\r\n", nil, false},
+		{"array", "*3\r\n$7\r\nmessage\r\n+ch\r\n:1\r\n", []any{[]byte("message"), "ch", int64(1)}, false},
+		{"null array", "*-1\r\n", nil, false},
+		{"malformed", "+OK\n", nil, true},
+		{"unknown type", "?1\r\n", nil, true},
+		{"truncated bulk string", "$5\r\nhel", nil, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			conn, server := pipeConn(t)
+			done := fakeRedis(t, server, "*2\r\n$3\r\nGET\r\n$3\r\nkey\r\n", tc.reply)
+			if tc.err {
+				// A reply cut short is only noticed once the server hangs up.
+				go func() { <-done; server.Close() }()
+			}
+
+			reply, err := conn.do("GET", "key")
+			if tc.err {
+				if err == nil {
+					t.Fatalf("got %#v, want an error", reply)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			} else if err = <-done; err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(reply, tc.want) {
+				t.Fatalf("got %#v, want %#v", reply, tc.want)
+			}
+		})
+	}
+}
+
+// TestRedisConnErrorReply checks an error reply is returned as a redisError,
+// which leaves the connection usable.
+func TestRedisConnErrorReply(t *testing.T) {
+	conn, server := pipeConn(t)
+	done := fakeRedis(t, server, "*1\r\n$4\r\nPING\r\n", "-ERR unknown command\r\n")
+
+	_, err := conn.do("PING")
+	var replyErr *redisError
+	if !errors.As(err, &replyErr) || !errors.Is(err, errRedis) {
+		t.Fatalf("got %v, want a redisError", err)
+	} else if replyErr.message != "ERR unknown command" {
+		t.Fatalf("got message %q", replyErr.message)
+	} else if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestRedisStoreLoad loads through a store whose idle connection is a pipe,
+// and checks a missing key is reported as fs.ErrNotExist.
+func TestRedisStoreLoad(t *testing.T) {
+	store, err := newRedisStore("redis://localhost/0?prefix=test&pool=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name      string
+		partition string
+		n         int
+		command   string
+		reply     string
+		want      []byte
+		err       error
+	}{
+		{"newest", "", 0, "*2\r\n$3\r\nGET\r\n$17\r\ntest:{snapshot}:0\r\n", "$4\r\ndata\r\n", []byte("data"), nil},
+		{"tenant", "a", 1, "*2\r\n$3\r\nGET\r\n$26\r\ntest:{snapshot.tenant-a}:1\r\n", "$0\r\n\r\n", []byte{}, nil},
+		{"missing", "", 2, "*2\r\n$3\r\nGET\r\n$17\r\ntest:{snapshot}:2\r\n", "$-1\r\n", nil, fs.ErrNotExist},
+		{"wrong type", "", 0, "*2\r\n$3\r\nGET\r\n$17\r\ntest:{snapshot}:0\r\n", ":1\r\n", nil, errRedis},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			conn, server := pipeConn(t)
+			store.idle <- conn
+			done := fakeRedis(t, server, tc.command, tc.reply)
+
+			data, err := store.Load(context.Background(), tc.partition, tc.n)
+			if tc.err != nil {
+				if !errors.Is(err, tc.err) {
+					t.Fatalf("got %v, want %v", err, tc.err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			} else if !reflect.DeepEqual(data, tc.want) {
+				t.Fatalf("got %q, want %q", data, tc.want)
+			}
+			if err = <-done; err != nil {
+				t.Fatal(err)
+			}
+			// The connection went back to the pool after a complete reply.
+			select {
+			case <-store.idle:
+			default:
+				t.Fatal("connection not put back")
+			}
+		})
+	}
+}
+
+// redisCommands plays Redis to the idle connection of store, answering every
+// command it reads with the next of replies, and returns the commands read.
+func redisCommands(t *testing.T, store *redisStore, replies ...string) <-chan [][]string {
+	t.Helper()
+
+	conn, server := pipeConn(t)
+	store.idle <- conn
+	commands := make(chan [][]string, 1)
+	go func() {
+		defer close(commands)
+		serverConn := &redisConn{Conn: server, reader: bufio.NewReader(server)}
+		read := [][]string{}
+		for _, reply := range replies {
+			command, err := serverConn.read()
+			if err != nil {
+				return
+			}
+			args := []string{}
+			for _, arg := range command.([]any) {
+				args = append(args, string(asBytes(arg)))
+			}
+			read = append(read, args)
+			if _, err = io.WriteString(server, reply); err != nil {
+				return
+			}
+		}
+		commands <- read
+	}()
+	return commands
+}
+
+// TestRedisStoreSaveSessions checks a save passes the script every key it
+// touches, the generations, the sessions and those of the oldest generation,
+// all under the hash tag of the partition.
+func TestRedisStoreSaveSessions(t *testing.T) {
+	generations := config.SnapshotGenerations
+	t.Cleanup(func() { config.SnapshotGenerations = generations })
+	config.SnapshotGenerations = 2
+	store, err := newRedisStore("redis://localhost/0?prefix=test&pool=1&ttl=1m")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	commands := redisCommands(t, store, "*2\r\n$1\r\nb\r\n$1\r\nc\r\n", ":1\r\n")
+	if err = store.SaveSessions(context.Background(), "a", []byte("state"), map[string][]byte{"b": []byte("B"), "a": []byte("A")}); err != nil {
+		t.Fatal(err)
+	}
+	got := <-commands
+	if len(got) != 2 {
+		t.Fatalf("got %d commands", len(got))
+	} else if want := []string{"SMEMBERS", "test:{snapshot.tenant-a}:1:sessions"}; !reflect.DeepEqual(got[0], want) {
+		t.Fatalf("got %q, want %q", got[0], want)
+	}
+	want := []string{
+		"EVAL", redisSaveScript, "8",
+		"test:{snapshot.tenant-a}:0", "test:{snapshot.tenant-a}:0:sessions",
+		"test:{snapshot.tenant-a}:1", "test:{snapshot.tenant-a}:1:sessions",
+		"test:{snapshot.tenant-a}:session:a", "test:{snapshot.tenant-a}:session:b",
+		"test:{snapshot.tenant-a}:session:b", "test:{snapshot.tenant-a}:session:c",
+		"state", "2", "60000", "2", "test:{snapshot.tenant-a}:saved",
+		"a", "b", "A", "B", "b", "c",
+	}
+	if !reflect.DeepEqual(got[1], want) {
+		t.Fatalf("got %q\nwant %q", got[1], want)
+	}
+}
+
+// TestRedisStoreLoadSessions checks sessions are read from the keys of the
+// set of the generation, and those that expired left out.
+func TestRedisStoreLoadSessions(t *testing.T) {
+	store, err := newRedisStore("redis://localhost/0?prefix=test&pool=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	commands := redisCommands(t, store, "*2\r\n$1\r\na\r\n$1\r\nb\r\n", "*2\r\n$1\r\nA\r\n$-1\r\n")
+	sessions, err := store.LoadSessions(context.Background(), "", 1)
+	if err != nil {
+		t.Fatal(err)
+	} else if want := map[string][]byte{"a": []byte("A")}; !reflect.DeepEqual(sessions, want) {
+		t.Fatalf("got %q, want %q", sessions, want)
+	}
+	want := [][]string{
+		{"SMEMBERS", "test:{snapshot}:1:sessions"},
+		{"MGET", "test:{snapshot}:session:a", "test:{snapshot}:session:b"},
+	}
+	if got := <-commands; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,222 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+
+	"webrtc-zero-downtime-reload/internal/pionadapter"
+)
+
+var (
+	errNotRehandshaking = errors.New("the session isn't waiting for a new handshake")
+
+	dtlsRehandshakes        = newCounter("dtls_rehandshakes_total", "Restored sessions whose DTLS state failed to resume and whose clients were asked for a new handshake.")
+	dtlsRehandshakesDone    = newCounter("dtls_rehandshakes_done_total", "Restored sessions that got going again with a new DTLS handshake.")
+	dtlsRehandshakeFailures = newCounter("dtls_rehandshake_failures_total", "DTLS rehandshakes that timed out or failed, ending their session.")
+
+	rehandshakesMutex sync.Mutex
+	rehandshakes      = map[string]*rehandshake{}
+)
+
+// rehandshake is a restored session whose DTLS state failed to resume while
+// ICE got through, like when the client dropped the DTLS association during
+// the restart. Neither pion nor browsers can redo the handshake of a
+// PeerConnection, so the client is sent "rehandshake" and answers with an
+// offer from a new PeerConnection on /sessions/{id}/rehandshake. The
+// session carries on on a PeerConnection of its own for it, on the ICE port
+// and with the ICE credentials of the failed one so NATs and firewalls let
+// it through, keeping its SSRCs, subscriptions and everything else. The
+// interruption is the new handshake, not a new session.
+type rehandshake struct {
+	session        *session
+	peerConnection *webrtc.PeerConnection
+	port           uint16
+	ufrag, pwd     string
+
+	// answering is set once the offer came, the timeout no longer applies.
+	answering bool
+}
+
+// startRehandshake asks the client of session for a new handshake if its
+// PeerConnection failed for DTLS alone, and reports whether it did.
+func startRehandshake(session *session) bool {
+	if !config.DTLSRehandshake || !session.resumedDTLS.CompareAndSwap(true, false) || session.collecting.Load() {
+		return false
+	}
+
+	peerConnection := session.peerConnection
+	if state := peerConnection.ICEConnectionState(); state != webrtc.ICEConnectionStateConnected && state != webrtc.ICEConnectionStateCompleted {
+		return false
+	}
+	iceTransport, _, iceAgent := pionadapter.Pion.ICE(peerConnection)
+	pair, err := iceTransport.GetSelectedCandidatePair()
+	if err != nil || pair == nil {
+		return false
+	}
+	ufrag, pwd, err := iceAgent.GetLocalUserCredentials()
+	if err != nil {
+		return false
+	}
+
+	h := &rehandshake{session: session, peerConnection: peerConnection, port: pair.Local.Port, ufrag: ufrag, pwd: pwd}
+	rehandshakesMutex.Lock()
+	rehandshakes[session.id] = h
+	rehandshakesMutex.Unlock()
+	time.AfterFunc(config.DTLSRehandshakeTimeout, func() {
+		rehandshakesMutex.Lock()
+		expired := rehandshakes[session.id] == h && !h.answering
+		if expired {
+			delete(rehandshakes, session.id)
+		}
+		rehandshakesMutex.Unlock()
+		if expired {
+			failRehandshake(session, errors.New("no offer came in time"))
+		}
+	})
+
+	dtlsRehandshakes.Inc()
+	logf("DTLS of PeerConnection %s failed to resume, asking for a new handshake\n", session.id)
+	recordHistory(session, historyRestore, "DTLS failed to resume while ICE got through, asking the client for a new handshake")
+	publishEvent(session.id, event{Name: "rehandshake"})
+	return true
+}
+
+// rehandshaking reports whether session waits for or is going through a
+// new handshake, its failed PeerConnection doesn't end it.
+func rehandshaking(session *session) bool {
+	rehandshakesMutex.Lock()
+	defer rehandshakesMutex.Unlock()
+	return rehandshakes[session.id] != nil
+}
+
+// failRehandshake ends session, whose client is told to start over.
+func failRehandshake(session *session, err error) {
+	dtlsRehandshakeFailures.Inc()
+	logf("Failed to rehandshake PeerConnection %s: %v\n", session.id, err)
+	recordHistory(session, historyRestore, "failed to rehandshake: %v", err)
+	publishEvent(session.id, event{Name: "restoreFailed"})
+	collectSession(session, tombstoneRehandshakeFailed)
+}
+
+// handleRehandshake serves POST /sessions/{id}/rehandshake, answering the
+// offer of the new PeerConnection of a session asked for a new handshake.
+// The session isn't connected yet, so it is looked up on its own.
+func handleRehandshake(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rehandshakesMutex.Lock()
+	h := rehandshakes[id]
+	rehandshakesMutex.Unlock()
+	if h == nil {
+		http.Error(w, errNotRehandshaking.Error(), http.StatusNotFound)
+		return
+	} else if err := authorizeSession(r, h.session); err != nil {
+		authError(w, err)
+		return
+	}
+
+	var offer webrtc.SessionDescription
+	if err := json.NewDecoder(r.Body).Decode(&offer); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	offer, err := shimOffer(h.session.fingerprint.SDPShim, offer)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if isViewerOffer(offer) == h.session.broadcaster {
+		http.Error(w, errInvalidOffer.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rehandshakesMutex.Lock()
+	claimed := rehandshakes[id] == h && !h.answering
+	h.answering = true
+	rehandshakesMutex.Unlock()
+	if !claimed {
+		http.Error(w, errNotRehandshaking.Error(), http.StatusNotFound)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), config.SignalingTimeout)
+	defer cancel()
+
+	err = rehandshakeSession(ctx, h, offer)
+	rehandshakesMutex.Lock()
+	delete(rehandshakes, id)
+	rehandshakesMutex.Unlock()
+	if err != nil {
+		failRehandshake(h.session, err)
+		http.Error(w, "failed to rehandshake", http.StatusInternalServerError)
+		return
+	}
+
+	dtlsRehandshakesDone.Inc()
+	recordHistory(h.session, historyRestore, "answered the offer for a new handshake")
+	writeAnswer(w, h.session, localAnswer(h.session))
+}
+
+// rehandshakeSession moves the session of h to a new PeerConnection answering
+// offer, on the ICE port of the failed one if it can be bound again and on
+// any other otherwise.
+func rehandshakeSession(ctx context.Context, h *rehandshake, offer webrtc.SessionDescription) error {
+	session := h.session
+	ssrcVideo, ssrcAudio, err := senderSSRCs(h.peerConnection)
+	if err != nil {
+		return err
+	}
+	if err = h.peerConnection.Close(); err != nil {
+		logf("Failed to close PeerConnection %s: %v\n", session.id, err)
+	}
+
+	s := webrtc.SettingEngine{}
+	s.SetICECredentials(h.ufrag, h.pwd)
+	if err = waitForPort(ctx, h.port); err != nil {
+		logf("Rehandshaking PeerConnection %s on a new port: %v\n", session.id, err)
+		portFallbacks.Inc()
+	} else if err = s.SetEphemeralUDPPortRange(h.port, h.port); err != nil {
+		return err
+	}
+
+	certificate, err := generateCertificate()
+	if err != nil {
+		return err
+	}
+	s.LoggerFactory = newSRTPLoggerFactory(session)
+	if err = newPeerConnection(session, s, webrtc.Configuration{
+		Certificates: []webrtc.Certificate{*certificate},
+		ICEServers:   useTURN(session, session.turn),
+	}); err != nil {
+		return err
+	}
+
+	// Without payload types to keep, the client gets those of the answer.
+	if err = resumeNegotiation(session, PeerConnectionState{
+		RemoteDescription: offer,
+		VideoCodec:        session.videoCodec,
+		SSRCVideo:         ssrcVideo,
+		SSRCAudio:         ssrcAudio,
+	}); err != nil {
+		return err
+	}
+
+	// The answer carries the candidates, on whichever port they ended up.
+	select {
+	case <-webrtc.GatheringCompletePromise(session.peerConnection):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
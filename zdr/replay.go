@@ -0,0 +1,200 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+// replayPacket is an RTP packet a broadcaster sent, read back from a packet
+// capture, at is when it was received since the first one.
+type replayPacket struct {
+	at     time.Duration
+	packet *rtp.Packet
+}
+
+// readCapture returns the RTP packets the remote side sent in a capture
+// written by /admin/sessions/{id}/pcap, that of a broadcaster holds its
+// ingest. RTCP and the packets sent to it are left out.
+func readCapture(path string) ([]replayPacket, error) {
+	data, err := os.ReadFile(path) //nolint:gosec
+	if err != nil {
+		return nil, err
+	} else if len(data) < 24 || binary.LittleEndian.Uint32(data) != 0xa1b2c3d4 || binary.LittleEndian.Uint32(data[20:]) != linkTypeRaw {
+		return nil, fmt.Errorf("%w: %s is not a packet capture of a session", errUnsupportedFile, path)
+	}
+
+	out := []replayPacket{}
+	var first time.Time
+	for data = data[24:]; len(data) >= 16; {
+		received := time.Unix(int64(binary.LittleEndian.Uint32(data)), int64(binary.LittleEndian.Uint32(data[4:]))*1000)
+		length := int(binary.LittleEndian.Uint32(data[8:]))
+		if len(data) < 16+length {
+			return nil, fmt.Errorf("%s: %w", path, io.ErrUnexpectedEOF)
+		}
+		record := data[16 : 16+length]
+		data = data[16+length:]
+
+		if len(record) < 28 || [4]byte(record[12:16]) != captureRemoteAddr {
+			continue
+		}
+		payload := record[28:]
+		// RTCP packet types are 192 to 223 in the second byte, RFC 5761.
+		if len(payload) < 2 || (payload[1] >= 192 && payload[1] <= 223) {
+			continue
+		}
+
+		packet := &rtp.Packet{}
+		if err := packet.Unmarshal(append([]byte(nil), payload...)); err != nil {
+			continue
+		}
+		if first.IsZero() {
+			first = received
+		}
+		out = append(out, replayPacket{at: received.Sub(first), packet: packet})
+	}
+	return out, nil
+}
+
+// replayMapping returns the codec of each payload type and the ID of the RID
+// header extension the broadcaster negotiated, from the remote description
+// of the broadcaster of room in the restored snapshot. Without one the
+// payload types of Pion's default codecs are assumed, and RIDs ignored.
+func replayMapping(room *room) (map[uint8]string, uint8) {
+	codecs := map[uint8]string{}
+	var ridExtension uint8
+
+	var description *webrtc.SessionDescription
+	sessionsMutex.Lock()
+	for _, session := range sessions {
+		if session.room == room && session.broadcaster {
+			description = session.peerConnection.RemoteDescription()
+			break
+		}
+	}
+	sessionsMutex.Unlock()
+
+	parsed := &sdp.SessionDescription{}
+	if description == nil || parsed.Unmarshal([]byte(description.SDP)) != nil {
+		audio, video, err := defaultCodecs()
+		if err != nil {
+			return codecs, 0
+		}
+		for _, codec := range append(audio, video...) {
+			codecs[uint8(codec.PayloadType)] = codec.MimeType
+		}
+		return codecs, 0
+	}
+
+	for _, media := range parsed.MediaDescriptions {
+		for _, attribute := range media.Attributes {
+			switch attribute.Key {
+			case "rtpmap":
+				payloadType, encoding, _ := strings.Cut(attribute.Value, " ")
+				name, _, _ := strings.Cut(encoding, "/")
+				if pt, err := strconv.ParseUint(payloadType, 10, 8); err == nil {
+					codecs[uint8(pt)] = media.MediaName.Media + "/" + name
+				}
+			case "extmap":
+				id, uri, _ := strings.Cut(attribute.Value, " ")
+				id, _, _ = strings.Cut(id, "/")
+				if n, err := strconv.ParseUint(id, 10, 8); err == nil && uri == sdp.SDESRTPStreamIDURI {
+					ridExtension = uint8(n)
+				}
+			}
+		}
+	}
+	return codecs, ridExtension
+}
+
+// replayCapture plays the ingest of a broadcaster captured at path into the
+// tracks of room, with the timing it was received with. It is played once,
+// then the room is left without a broadcaster until ctx is done, so a
+// reproduction doesn't run into a loop of the capture.
+func replayCapture(ctx context.Context, room *room, path string) error {
+	packets, err := readCapture(path)
+	if err != nil {
+		return err
+	}
+	codecs, ridExtension := replayMapping(room)
+
+	// Each SSRC goes to the track of its codec and layer, one per track: a
+	// second SSRC of a layer, like that of a broadcaster that reconnected
+	// mid-capture, is dropped with its RTX.
+	tracks := map[uint32]*webrtc.TrackLocalStaticRTP{}
+	taken := map[*webrtc.TrackLocalStaticRTP]bool{}
+	trackOf := func(packet *rtp.Packet) *webrtc.TrackLocalStaticRTP {
+		if track, ok := tracks[packet.SSRC]; ok {
+			return track
+		}
+
+		var track *webrtc.TrackLocalStaticRTP
+		switch mimeType := codecs[packet.PayloadType]; {
+		case strings.EqualFold(mimeType, webrtc.MimeTypeOpus):
+			track = room.audioTrack
+		case isVideoCodec(mimeType):
+			rid := ""
+			if ridExtension != 0 {
+				rid = string(packet.GetExtension(ridExtension))
+			}
+			track = room.layerTrack(mimeType, rid)
+		}
+		if track == nil || taken[track] {
+			track = nil
+		} else {
+			taken[track] = true
+		}
+		tracks[packet.SSRC] = track
+		return track
+	}
+
+	logf("Replaying %d packets of %s into room %s\n", len(packets), path, room.id)
+	start := time.Now()
+	sources := map[string]bool{}
+	defer func() {
+		for mimeType := range sources {
+			room.removeSource(mimeType)
+		}
+	}()
+	for _, replayed := range packets {
+		track := trackOf(replayed.packet)
+		if track == nil {
+			continue
+		}
+		if mimeType := track.Codec().MimeType; track != room.audioTrack && !sources[mimeType] {
+			sources[mimeType] = true
+			room.addSource(mimeType)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Until(start.Add(replayed.at))):
+		}
+
+		forwarded := time.Now()
+		markBroadcasterAlive(room)
+		markTrackAlive(room, track.Kind())
+		fanout(track, replayed.packet, ingestStage.done(forwarded))
+	}
+	logf("Replay of %s into room %s is over\n", path, room.id)
+
+	for mimeType := range sources {
+		room.removeSource(mimeType)
+	}
+	sources = nil
+	<-ctx.Done()
+	return ctx.Err()
+}
@@ -0,0 +1,122 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+var (
+	reusePortTakeovers = newCounter("reuseport_takeovers_total", "Startups that took the ICE ports over from a process draining with -reuseport-drain.")
+	reusePortDrains    = newCounter("reuseport_drains_total", "Shutdowns that drained until the next process took the ICE ports over.")
+
+	reusePort = &reusePortSockets{}
+)
+
+// reusePortSockets are the ICE sockets bound with SO_REUSEPORT, with
+// -reuseport-drain. The old and the new process then bind the same ports
+// during a restart and the kernel picks which of them each packet goes to,
+// with a reuseport BPF program attached to every port: until the new
+// process resumed the sessions everything goes to the old one, which
+// bound the port first, then everything goes to the new one. Each flow is
+// served by one process at a time and no packet finds the port unbound.
+type reusePortSockets struct {
+	mu    sync.Mutex
+	conns []*net.UDPConn
+
+	// steered is set once this process took the traffic over.
+	steered bool
+}
+
+// listen binds a socket of a session with SO_REUSEPORT, steering its port
+// to the socket bound first until this process took the traffic over.
+func (r *reusePortSockets) listen(network string, addr *net.UDPAddr) (*net.UDPConn, error) {
+	conn, err := listenReusePort(network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	index := uint32(0)
+	if r.steered {
+		index = 1
+	}
+	if err = steerReusePort(conn, index); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	r.conns = append(r.conns, conn)
+	return conn, nil
+}
+
+// takeOver steers every port bound so far to the sockets of this process,
+// those the previous process bound first, then tells it with a snapshot so
+// it stops draining.
+func (r *reusePortSockets) takeOver(ctx context.Context) {
+	if config.ReusePortDrain <= 0 {
+		return
+	}
+
+	r.mu.Lock()
+	r.steered = true
+	open := r.conns[:0]
+	for _, conn := range r.conns {
+		if !isOpen(conn) {
+			continue
+		}
+		if err := steerReusePort(conn, 1); err != nil {
+			logf("Warning: failed to take %s over: %v\n", conn.LocalAddr(), err)
+		}
+		open = append(open, conn)
+	}
+	r.conns = open
+	r.mu.Unlock()
+
+	reusePortTakeovers.Inc()
+	logf("Took over %d ICE sockets\n", len(open))
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	if err := serialize(ctx); err != nil {
+		logf("Failed to serialize: %v\n", err)
+	}
+}
+
+// drainReusePort keeps serving after the final snapshot, with
+// -reuseport-drain, until the next process bound the ICE ports and took the
+// traffic over, which it tells by saving a snapshot of a newer generation,
+// or until the drain is over. No snapshot is saved meanwhile, it would
+// overwrite those of the next process.
+func drainReusePort() {
+	if config.ReusePortDrain <= 0 {
+		return
+	}
+	handedOver.Store(true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.ReusePortDrain)
+	defer cancel()
+	saved, err := stateStore.Watch(ctx, "")
+	if err != nil {
+		logf("Warning: not draining: %v\n", err)
+		return
+	}
+
+	logf("Draining for up to %s until the next process takes the ICE ports over\n", config.ReusePortDrain)
+	ours := generation.Load()
+	for {
+		if buffer, err := stateStore.Load(ctx, "", 0); err == nil {
+			if state, err := decodeSnapshot(buffer); err == nil && state.Generation > ours {
+				logf("Generation %d took the ICE ports over\n", state.Generation)
+				reusePortDrains.Inc()
+				return
+			}
+		}
+		if _, ok := <-saved; !ok {
+			logf("Warning: no process took the ICE ports over within %s\n", config.ReusePortDrain)
+			return
+		}
+	}
+}
@@ -0,0 +1,67 @@
+//go:build !js && linux && !mips && !mipsle && !mips64 && !mips64le
+// +build !js,linux,!mips,!mipsle,!mips64,!mips64le
+
+package zdr
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// The socket options the syscall package lacks, with the values of every
+// architecture but MIPS.
+const (
+	soReusePort           = 0xf
+	soAttachReusePortCBPF = 0x33
+	bpfReturnConstant     = syscall.BPF_RET | syscall.BPF_K
+)
+
+// listenReusePort binds addr with SO_REUSEPORT, the old and new process
+// sharing each port during a restart.
+func listenReusePort(network string, addr *net.UDPAddr) (*net.UDPConn, error) {
+	listenConfig := net.ListenConfig{Control: func(_, _ string, raw syscall.RawConn) error {
+		var err error
+		if controlErr := raw.Control(func(fd uintptr) {
+			err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+		}); controlErr != nil {
+			return controlErr
+		}
+		return err
+	}}
+	conn, err := listenConfig.ListenPacket(context.Background(), network, addr.String())
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+// steerReusePort attaches to the port of conn a program sending every
+// packet to the socket at index in the order they were bound, the kernel
+// hashing them over all of them if there is none at index.
+func steerReusePort(conn *net.UDPConn, index uint32) error {
+	program := []syscall.SockFilter{{Code: bpfReturnConstant, K: index}}
+	fprog := syscall.SockFprog{Len: uint16(len(program)), Filter: &program[0]}
+
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var errno syscall.Errno
+	if err = raw.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall6(syscall.SYS_SETSOCKOPT, fd, syscall.SOL_SOCKET, soAttachReusePortCBPF,
+			uintptr(unsafe.Pointer(&fprog)), unsafe.Sizeof(fprog), 0)
+	}); err != nil {
+		return err
+	} else if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// reusePortSupported returns nil, SO_REUSEPORT and its BPF programs are
+// available.
+func reusePortSupported() error {
+	return nil
+}
@@ -0,0 +1,24 @@
+//go:build !js && (!linux || mips || mipsle || mips64 || mips64le)
+// +build !js
+// +build !linux mips mipsle mips64 mips64le
+
+package zdr
+
+import (
+	"errors"
+	"net"
+)
+
+var errReusePortUnsupported = errors.New("-reuseport-drain needs the reuseport BPF programs of Linux")
+
+func listenReusePort(string, *net.UDPAddr) (*net.UDPConn, error) {
+	return nil, errReusePortUnsupported
+}
+
+func steerReusePort(*net.UDPConn, uint32) error {
+	return errReusePortUnsupported
+}
+
+func reusePortSupported() error {
+	return errReusePortUnsupported
+}
@@ -0,0 +1,608 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// defaultRoomID is the room used when a client doesn't ask for one. It
+// always exists and can't be closed.
+const defaultRoomID = "default"
+
+var (
+	errRoomNotFound = errors.New("room not found")
+	errRoomExists   = errors.New("room already exists")
+	errRoomNotOpen  = errors.New("room is not open")
+
+	rooms      = map[string]*room{}
+	roomsMutex sync.Mutex
+)
+
+// room is a single broadcast. Each has its own output tracks, so viewers
+// only receive the broadcaster of the room they joined.
+type room struct {
+	id                string
+	opensAt, closesAt time.Time
+
+	// tenant is the tenant of -tenants the room belongs to, fixed when it
+	// is created.
+	tenant string
+
+	// policyName and policy are fixed when the room is created.
+	policyName string
+	policy     Policy
+
+	// keyframeRequests counts the keyframes viewers asked for.
+	keyframeRequests atomic.Uint64
+
+	audioTrack *webrtc.TrackLocalStaticRTP
+
+	// videoTracks holds a track per video codec, by lower case mime type.
+	videoTracks map[string]*webrtc.TrackLocalStaticRTP
+
+	// layerTracks holds a track per simulcast layer below the top one, by
+	// lower case mime type and RID.
+	layerTracks map[string]map[string]*webrtc.TrackLocalStaticRTP
+
+	// sources counts the broadcaster tracks sending each video codec.
+	sourcesMutex sync.Mutex
+	sources      map[string]int
+
+	// attached is the headless source playing as the broadcaster, if any.
+	attachedMutex sync.Mutex
+	attached      *attachment
+
+	haveBroadcaster atomic.Bool
+
+	// lastBroadcasterPacket is when we last forwarded media, in Unix nanoseconds.
+	lastBroadcasterPacket atomic.Int64
+
+	// broadcasterSince is when haveBroadcaster was last set, in Unix
+	// nanoseconds, activity follows each kind of track it sends.
+	broadcasterSince atomic.Int64
+	activity         map[string]*trackActivity
+
+	// syncs follows the latency of each track, by lower case mime type.
+	syncMutex sync.Mutex
+	syncs     map[string]*trackSync
+
+	// ingestE2EEAudio and ingestE2EEVideo are the extension IDs negotiated
+	// with the broadcaster, 0 if none.
+	ingestE2EEAudio, ingestE2EEVideo atomic.Uint32
+
+	// closedBytesSent and closedBytesReceived hold what sessions of this
+	// room that are gone relayed.
+	closedBytesSent, closedBytesReceived atomic.Uint64
+
+	// queue holds the viewers waiting for a slot once the room has
+	// policy.MaxViewers, in the order they joined.
+	queueMutex sync.Mutex
+	queue      []*queuedViewer
+
+	// taps feed the output tracks to in-process consumers, guarded by
+	// tapsMutex.
+	taps []TapState
+
+	// guest is the grant of a guest broadcasting in place of the
+	// broadcaster, nil if none.
+	guest atomic.Pointer[GuestGrant]
+
+	// ingest is which of the primary and backup broadcaster is on air.
+	ingest ingestState
+
+	// recording is what the room allows to be recorded, recordings the
+	// captures of its sessions kept for it.
+	recordingMutex sync.Mutex
+	recording      RecordingPolicy
+	recordings     []Recording
+
+	// metadata is what viewers display about the broadcast, nil if none.
+	metadata atomic.Pointer[RoomMetadata]
+}
+
+// RoomState is a room as saved in the snapshot. A zero OpensAt or ClosesAt
+// means the room has no schedule on that side.
+type RoomState struct {
+	ID                string
+	OpensAt, ClosesAt time.Time
+
+	// Tenant is the tenant the room belongs to, none if empty.
+	Tenant string `json:",omitempty"`
+
+	ClosedBytesSent, ClosedBytesReceived uint64
+
+	// Timelines let injected frames carry on the output tracks.
+	Timelines []TimelineState
+
+	// Source is the name of the headless source attached to the room.
+	Source string
+
+	// Policy is the name of the policy profile of the room, the default
+	// one if empty.
+	Policy string
+
+	// Muted are the kinds of track the broadcaster stopped sending.
+	Muted []string
+
+	// SyncMappings are the last sender reports of the broadcaster.
+	SyncMappings []SyncMapping
+
+	// SentPackets are the packets the output tracks sent last, resent to
+	// viewers asking for them after a restore.
+	SentPackets []SentPacket
+
+	// Queue are the viewers waiting for a slot, in the order they joined.
+	Queue []QueuedViewer
+
+	// Taps are the consumers tapping the output tracks.
+	Taps []TapState
+
+	// Guest is the grant of a guest broadcasting in the room.
+	Guest *GuestGrant
+
+	// ActiveIngest is the broadcaster on air, the primary one if empty.
+	ActiveIngest string `json:",omitempty"`
+
+	// Recording is the recording policy of the room, -recording-allowed
+	// and -recording-retention if nil. Recordings are the captures made
+	// under it.
+	Recording  *RecordingPolicy `json:",omitempty"`
+	Recordings []Recording      `json:",omitempty"`
+
+	// Metadata is the title, description and now playing of the room.
+	Metadata *RoomMetadata `json:",omitempty"`
+}
+
+func newRoom(state RoomState) (*room, error) {
+	policy, err := findPolicy(state.Policy)
+	if err != nil {
+		return nil, err
+	}
+
+	room := &room{
+		id:          state.ID,
+		opensAt:     state.OpensAt,
+		closesAt:    state.ClosesAt,
+		tenant:      state.Tenant,
+		policyName:  state.Policy,
+		policy:      policy,
+		videoTracks: map[string]*webrtc.TrackLocalStaticRTP{},
+		layerTracks: map[string]map[string]*webrtc.TrackLocalStaticRTP{},
+		sources:     map[string]int{},
+		activity:    newTrackActivities(),
+		syncs:       map[string]*trackSync{},
+	}
+	room.closedBytesSent.Store(state.ClosedBytesSent)
+	room.closedBytesReceived.Store(state.ClosedBytesReceived)
+	room.restoreRecording(state.Recording, state.Recordings)
+
+	for _, mimeType := range videoCodecs {
+		if !policy.allowsVideo(mimeType) {
+			continue
+		}
+
+		track, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: mimeType}, "video", "pion")
+		if err != nil {
+			return nil, err
+		}
+		room.videoTracks[strings.ToLower(mimeType)] = track
+
+		room.layerTracks[strings.ToLower(mimeType)] = map[string]*webrtc.TrackLocalStaticRTP{}
+		for _, encoding := range policy.Simulcast {
+			if encoding.RID == policy.forwardedRID() {
+				continue
+			}
+			if track, err = webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: mimeType}, "video", "pion"); err != nil {
+				return nil, err
+			}
+			room.layerTracks[strings.ToLower(mimeType)][encoding.RID] = track
+		}
+	}
+
+	if room.audioTrack, err = webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, "audio", "pion"); err != nil {
+		return nil, err
+	}
+	return room, nil
+}
+
+// isOpen reports whether sessions may join room at now.
+func (r *room) isOpen(now time.Time) bool {
+	return !now.Before(r.opensAt) && (r.closesAt.IsZero() || now.Before(r.closesAt))
+}
+
+func (r *room) state() RoomState {
+	recording := r.recordingPolicy()
+	return RoomState{
+		ID:                  r.id,
+		OpensAt:             r.opensAt,
+		ClosesAt:            r.closesAt,
+		Tenant:              r.tenant,
+		ClosedBytesSent:     r.closedBytesSent.Load(),
+		ClosedBytesReceived: r.closedBytesReceived.Load(),
+		Timelines:           r.timelines(),
+		Source:              r.attachedSource(),
+		Policy:              r.policyName,
+		Muted:               r.mutedKinds(),
+		SyncMappings:        r.syncMappings(),
+		SentPackets:         r.sentPackets(),
+		Queue:               r.queuedViewers(),
+		Taps:                r.tapStates(),
+		Guest:               r.guestGrant(),
+		ActiveIngest:        r.ingest.active(),
+		Recording:           &recording,
+		Recordings:          r.recordingStates(),
+		Metadata:            r.roomMetadata(),
+	}
+}
+
+// findRoom returns the room called id, the default room if id is empty.
+func findRoom(id string) *room {
+	if id == "" {
+		id = defaultRoomID
+	}
+
+	roomsMutex.Lock()
+	defer roomsMutex.Unlock()
+	return rooms[id]
+}
+
+// snapshotRooms returns the state of every room.
+func snapshotRooms() []RoomState {
+	roomsMutex.Lock()
+	defer roomsMutex.Unlock()
+
+	out := []RoomState{}
+	for _, room := range rooms {
+		out = append(out, room.state())
+	}
+	return out
+}
+
+// restoreRooms recreates the rooms of a snapshot, along with the default
+// room if the snapshot predates rooms. shift moves saved times onto the
+// current clock. A room that can't be recreated is skipped and returned,
+// its sessions then fail to resume on their own.
+func restoreRooms(states []RoomState, shift time.Duration) []restoreResult {
+	roomsMutex.Lock()
+	defer roomsMutex.Unlock()
+
+	failed := []restoreResult{}
+	for _, state := range append(states, RoomState{ID: defaultRoomID}) {
+		if _, ok := rooms[state.ID]; ok {
+			continue
+		}
+
+		err := restoreRecovered("recreating room "+state.ID, func() error {
+			return restoreRoom(state, shift)
+		})
+		if err != nil {
+			logf("Failed to recreate room %s: %v\n", state.ID, err)
+			failed = append(failed, restoreResult{ID: state.ID, Err: err, Error: err.Error()})
+		}
+	}
+	return failed
+}
+
+// restoreRoom recreates the room of state. roomsMutex must be held.
+func restoreRoom(state RoomState, shift time.Duration) error {
+	room, err := newRoom(state)
+	if errors.Is(err, errUnknownPolicy) {
+		// The profile was removed from -policy-profiles since.
+		logf("Room %s falls back to the default policy: %v\n", state.ID, err)
+		state.Policy = ""
+		room, err = newRoom(state)
+	}
+	if err != nil {
+		return err
+	}
+	room.restoreTimelines(state.Timelines, shift)
+	room.restoreMutes(state.Muted)
+	room.restoreSyncMappings(state.SyncMappings)
+	room.restoreSentPackets(state.SentPackets)
+	room.restoreQueue(state.Queue)
+	room.restoreTaps(state.Taps)
+	room.restoreGuest(state.Guest)
+	room.ingest.restore(state.ActiveIngest)
+	room.metadata.Store(state.Metadata)
+	restoreSource(room, state.Source)
+	rooms[state.ID] = room
+	return nil
+}
+
+// createRoom adds a room and persists it.
+func createRoom(state RoomState) (*room, error) {
+	room, err := newRoom(state)
+	if err != nil {
+		return nil, err
+	}
+
+	roomsMutex.Lock()
+	if _, ok := rooms[state.ID]; ok {
+		roomsMutex.Unlock()
+		return nil, errRoomExists
+	} else if err = checkTenant(state.Tenant); err != nil {
+		roomsMutex.Unlock()
+		return nil, err
+	}
+	rooms[state.ID] = room
+	roomsMutex.Unlock()
+
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	return room, serialize(context.Background())
+}
+
+// closeRoom removes room, tells its sessions and closes them.
+func closeRoom(room *room) error {
+	roomsMutex.Lock()
+	if rooms[room.id] != room {
+		roomsMutex.Unlock()
+		return errRoomNotFound
+	}
+	delete(rooms, room.id)
+	roomsMutex.Unlock()
+
+	// Nothing would delete the recordings of the room once it is gone.
+	if policy := room.recordingPolicy(); policy.Retention > 0 || !policy.DeleteAt.IsZero() {
+		expireRecordings(room, time.Now(), true)
+	}
+	detachSource(room)
+	room.closeQueue()
+	room.detachTaps()
+	for _, kind := range trackKinds {
+		room.stopFill(kind)
+	}
+	injectorsMutex.Lock()
+	for _, track := range room.tracks() {
+		delete(injectors, track)
+	}
+	injectorsMutex.Unlock()
+
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+
+	logf("Closing room %s\n", room.id)
+	for _, session := range sessions {
+		if session.room != room {
+			continue
+		}
+
+		publishEvent(session.id, event{Name: "roomClosed"})
+		if err := session.peerConnection.Close(); err != nil {
+			logf("Failed to close PeerConnection %s: %v\n", session.id, err)
+		}
+	}
+	return serialize(context.Background())
+}
+
+// watchRooms closes rooms once their scheduled close time has passed. This
+// also catches rooms that were due to close while we were down.
+func watchRooms(ctx context.Context) {
+	every(ctx, time.Second, func(now time.Time) {
+		due := []*room{}
+		roomsMutex.Lock()
+		for _, room := range rooms {
+			if !room.closesAt.IsZero() && !now.Before(room.closesAt) {
+				due = append(due, room)
+			}
+		}
+		roomsMutex.Unlock()
+
+		for _, room := range due {
+			if err := closeRoom(room); err != nil && !errors.Is(err, errRoomNotFound) {
+				logf("Failed to close room %s: %v\n", room.id, err)
+			}
+		}
+	})
+}
+
+type adminRoom struct {
+	ID                string
+	Tenant            string     `json:",omitempty"`
+	OpensAt, ClosesAt *time.Time `json:",omitempty"`
+	Open              bool
+	HaveBroadcaster   bool
+	Policy            string `json:",omitempty"`
+	Source            string `json:",omitempty"`
+	Sessions          int
+	Queued            int `json:",omitempty"`
+}
+
+func describeRoom(room *room) adminRoom {
+	out := adminRoom{
+		ID:              room.id,
+		Tenant:          room.tenant,
+		Open:            room.isOpen(time.Now()),
+		HaveBroadcaster: room.haveBroadcaster.Load(),
+		Policy:          room.policyName,
+		Source:          room.attachedSource(),
+		Queued:          len(room.queuedViewers()),
+	}
+	if !room.opensAt.IsZero() {
+		out.OpensAt = &room.opensAt
+	}
+	if !room.closesAt.IsZero() {
+		out.ClosesAt = &room.closesAt
+	}
+
+	sessionsMutex.Lock()
+	for _, session := range sessions {
+		if session.room == room {
+			out.Sessions++
+		}
+	}
+	sessionsMutex.Unlock()
+	return out
+}
+
+// handleAdminRooms lists rooms on GET, those of a tenant with ?tenant=,
+// and creates one on POST, with a body like {"ID": "town-hall", "OpensAt":
+// "2024-01-01T09:00:00Z", "ClosesAt": "2024-01-01T10:00:00Z", "Policy":
+// "webcam", "Tenant": "acme"}.
+func handleAdminRooms(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		tenant, filter := r.URL.Query()["tenant"]
+		roomsMutex.Lock()
+		all := []*room{}
+		for _, room := range rooms {
+			if !filter || room.tenant == tenant[0] {
+				all = append(all, room)
+			}
+		}
+		roomsMutex.Unlock()
+
+		out := []adminRoom{}
+		for _, room := range all {
+			out = append(out, describeRoom(room))
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&out)
+	case http.MethodPost:
+		var in RoomState
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if in.ID == "" || strings.Contains(in.ID, "/") {
+			http.Error(w, "invalid room ID", http.StatusBadRequest)
+			return
+		} else if !in.OpensAt.IsZero() && !in.ClosesAt.IsZero() && !in.OpensAt.Before(in.ClosesAt) {
+			http.Error(w, "room must open before it closes", http.StatusBadRequest)
+			return
+		}
+
+		room, err := createRoom(RoomState{ID: in.ID, OpensAt: in.OpensAt, ClosesAt: in.ClosesAt, Policy: in.Policy, Recording: in.Recording, Tenant: in.Tenant})
+		if errors.Is(err, errUnknownPolicy) || errors.Is(err, errUnknownTenant) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if errors.Is(err, errTenantQuota) {
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		} else if errors.Is(err, errRoomExists) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(describeRoom(room))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleAdminRoom returns a room on GET and closes it on DELETE.
+func handleAdminRoom(w http.ResponseWriter, r *http.Request) {
+	id, setting, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/admin/rooms/"), "/")
+	room := findRoom(id)
+	if room == nil {
+		http.Error(w, errRoomNotFound.Error(), http.StatusNotFound)
+		return
+	}
+
+	switch setting {
+	case "":
+	case "source":
+		handleAdminRoomSource(w, r, room)
+		return
+	case "compact":
+		handleCompact(w, r, room.id)
+		return
+	case "taps":
+		handleAdminRoomTaps(w, r, room)
+		return
+	case "guest":
+		handleAdminRoomGuest(w, r, room)
+		return
+	case "recording":
+		handleAdminRoomRecording(w, r, room)
+		return
+	case "ingest":
+		handleAdminRoomIngest(w, r, room)
+		return
+	case "metadata":
+		handleAdminRoomMetadata(w, r, room)
+		return
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(describeRoom(room))
+	case http.MethodDelete:
+		if room.id == defaultRoomID {
+			http.Error(w, ErrDefaultRoom.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := closeRoom(room); errors.Is(err, errRoomNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleAdminRoomSource serves POST /admin/rooms/{id}/source with a body like
+// {"Source": "slate"}, attaching that source of -sources to the room as its
+// broadcaster. An empty Source, or DELETE, detaches it. The attachment is
+// saved in the snapshot and carries on after a restart.
+func handleAdminRoomSource(w http.ResponseWriter, r *http.Request, room *room) {
+	var in struct {
+		Source string
+	}
+	switch r.Method {
+	case http.MethodPost:
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	case http.MethodDelete:
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	err := attachSource(room, in.Source)
+	if errors.Is(err, errUnknownSource) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	sessionsMutex.Lock()
+	err = serialize(r.Context())
+	sessionsMutex.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(describeRoom(room))
+}
@@ -0,0 +1,251 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+// SDP translations of -sdp-shim, for clients Pion can't negotiate with as
+// they are. Plan B clients, like the WebViews of older Android releases,
+// put every track of a kind in one media section, tell them apart by the
+// msid of their SSRCs and expect the same of the answer. Early Unified Plan
+// clients have a media section per track but still only signal msid on
+// their SSRCs and send simulcast as an SSRC group.
+const (
+	sdpShimPlanB         = "plan-b"
+	sdpShimLegacyUnified = "legacy-unified"
+)
+
+var sdpShimTranslations = newCounter("sdp_shim_translations_total", "Offers of legacy clients translated to Unified Plan.")
+
+// detectSDPShim returns the translation offer needs, "" if none. The client
+// may name it with ?sdpSemantics=, like the RTCConfiguration option of the
+// same name, otherwise it is worked out from the offer.
+func detectSDPShim(r *http.Request, offer webrtc.SessionDescription) (string, error) {
+	if !config.SDPShim {
+		return "", nil
+	}
+
+	switch semantics := r.URL.Query().Get("sdpSemantics"); semantics {
+	case "plan-b", "legacy-unified":
+		return semantics, nil
+	case "unified-plan":
+		return "", nil
+	case "":
+	default:
+		return "", fmt.Errorf("%w: unknown sdpSemantics %q", errInvalidOffer, semantics)
+	}
+
+	parsed := &sdp.SessionDescription{}
+	if err := parsed.Unmarshal([]byte(offer.SDP)); err != nil {
+		return "", nil
+	}
+
+	shim := ""
+	for _, media := range parsed.MediaDescriptions {
+		if _, ok := media.Attribute("msid"); ok {
+			return "", nil
+		}
+
+		mid, _ := media.Attribute(sdp.AttrKeyMID)
+		streams := ssrcStreams(media)
+		switch {
+		case len(streams) > 1 || (mid == "audio" || mid == "video") && hasSessionAttribute(parsed, "msid-semantic"):
+			shim = sdpShimPlanB
+		case len(streams) == 1 && shim == "":
+			shim = sdpShimLegacyUnified
+		}
+	}
+	return shim, nil
+}
+
+func hasSessionAttribute(parsed *sdp.SessionDescription, key string) bool {
+	_, ok := parsed.Attribute(key)
+	return ok
+}
+
+// ssrcStreams returns the distinct msid values of the SSRCs of media, in
+// the order they first appear.
+func ssrcStreams(media *sdp.MediaDescription) []string {
+	streams := []string{}
+	seen := map[string]bool{}
+	for _, attribute := range media.Attributes {
+		if attribute.Key != sdp.AttrKeySSRC {
+			continue
+		}
+		_, rest, _ := strings.Cut(attribute.Value, " ")
+		if msid, ok := strings.CutPrefix(rest, "msid:"); ok && !seen[msid] {
+			seen[msid] = true
+			streams = append(streams, msid)
+		}
+	}
+	return streams
+}
+
+// shimOffer translates the offer of a legacy client to Unified Plan. Each
+// media section keeps the first track it carries, Pion relays one per kind
+// anyway, with an msid attribute of its own. A simulcast SSRC group is
+// reduced to its first layer and the retransmissions of it.
+func shimOffer(shim string, offer webrtc.SessionDescription) (webrtc.SessionDescription, error) {
+	if shim == "" {
+		return offer, nil
+	}
+
+	parsed := &sdp.SessionDescription{}
+	if err := parsed.Unmarshal([]byte(offer.SDP)); err != nil {
+		return offer, fmt.Errorf("%w: %v", errInvalidOffer, err)
+	}
+
+	for _, media := range parsed.MediaDescriptions {
+		streams := ssrcStreams(media)
+		if len(streams) == 0 {
+			continue
+		}
+
+		kept := keptSSRCs(media, streams[0])
+		attributes := []sdp.Attribute{}
+		for _, attribute := range media.Attributes {
+			switch attribute.Key {
+			case sdp.AttrKeySSRC:
+				ssrc, _, _ := strings.Cut(attribute.Value, " ")
+				if !kept[ssrc] {
+					continue
+				}
+			case sdp.AttrKeySSRCGroup:
+				semantics, ssrcs, _ := strings.Cut(attribute.Value, " ")
+				first, _, _ := strings.Cut(ssrcs, " ")
+				if semantics != "FID" || !kept[first] {
+					continue
+				}
+			}
+			attributes = append(attributes, attribute)
+		}
+		media.Attributes = append(attributes, sdp.Attribute{Key: "msid", Value: streams[0]})
+	}
+
+	raw, err := parsed.Marshal()
+	if err != nil {
+		return offer, fmt.Errorf("%w: %v", errInvalidOffer, err)
+	}
+	sdpShimTranslations.Inc()
+	return webrtc.SessionDescription{Type: offer.Type, SDP: string(raw)}, nil
+}
+
+// keptSSRCs returns the SSRCs of the track msid of media that are kept, the
+// first layer of a simulcast group and its retransmissions.
+func keptSSRCs(media *sdp.MediaDescription, msid string) map[string]bool {
+	kept := map[string]bool{}
+	for _, attribute := range media.Attributes {
+		if attribute.Key != sdp.AttrKeySSRC {
+			continue
+		}
+		ssrc, rest, _ := strings.Cut(attribute.Value, " ")
+		if rest == "msid:"+msid {
+			kept[ssrc] = true
+		}
+	}
+
+	for _, attribute := range media.Attributes {
+		if attribute.Key != sdp.AttrKeySSRCGroup {
+			continue
+		}
+		fields := strings.Fields(attribute.Value)
+		if len(fields) < 2 || fields[0] != "SIM" || !kept[fields[1]] {
+			continue
+		}
+		for _, layer := range fields[2:] {
+			delete(kept, layer)
+		}
+	}
+
+	for _, attribute := range media.Attributes {
+		if attribute.Key != sdp.AttrKeySSRCGroup {
+			continue
+		}
+		fields := strings.Fields(attribute.Value)
+		if len(fields) == 3 && fields[0] == "FID" && !kept[fields[1]] {
+			delete(kept, fields[2])
+		}
+	}
+	return kept
+}
+
+// shimAnswer translates an answer for a Plan B client, which learns the
+// tracks it receives from the msid of their SSRCs. Legacy Unified Plan
+// clients understand the answer as it is.
+func shimAnswer(shim string, answer webrtc.SessionDescription) (webrtc.SessionDescription, error) {
+	if shim != sdpShimPlanB {
+		return answer, nil
+	}
+
+	parsed := &sdp.SessionDescription{}
+	if err := parsed.Unmarshal([]byte(answer.SDP)); err != nil {
+		return answer, err
+	}
+
+	streams := []string{}
+	for _, media := range parsed.MediaDescriptions {
+		msid, ok := media.Attribute("msid")
+		if !ok {
+			continue
+		}
+		stream, _, _ := strings.Cut(msid, " ")
+		streams = append(streams, stream)
+
+		attributes := []sdp.Attribute{}
+		signaled := map[string]bool{}
+		for _, attribute := range media.Attributes {
+			if attribute.Key == "msid" {
+				continue
+			} else if attribute.Key == sdp.AttrKeySSRC {
+				ssrc, rest, _ := strings.Cut(attribute.Value, " ")
+				signaled[ssrc] = signaled[ssrc] || strings.HasPrefix(rest, "msid:")
+			}
+			attributes = append(attributes, attribute)
+		}
+		for _, attribute := range media.Attributes {
+			if attribute.Key != sdp.AttrKeySSRC {
+				continue
+			}
+			if ssrc, _, _ := strings.Cut(attribute.Value, " "); !signaled[ssrc] {
+				signaled[ssrc] = true
+				attributes = append(attributes, sdp.Attribute{Key: sdp.AttrKeySSRC, Value: ssrc + " msid:" + msid})
+			}
+		}
+		media.Attributes = attributes
+	}
+
+	session := []sdp.Attribute{}
+	for _, attribute := range parsed.Attributes {
+		if attribute.Key != "msid-semantic" {
+			session = append(session, attribute)
+		}
+	}
+	parsed.Attributes = append(session, sdp.Attribute{Key: "msid-semantic", Value: " WMS " + strings.Join(streams, " ")})
+
+	raw, err := parsed.Marshal()
+	if err != nil {
+		return answer, err
+	}
+	return webrtc.SessionDescription{Type: answer.Type, SDP: string(raw)}, nil
+}
+
+// localAnswer returns the answer of session as its client expects it. An
+// answer that can't be translated is sent as it is, the client fails to
+// apply it and starts over.
+func localAnswer(session *session) webrtc.SessionDescription {
+	answer := *session.peerConnection.LocalDescription()
+	translated, err := shimAnswer(session.fingerprint.SDPShim, answer)
+	if err != nil {
+		logf("Failed to translate the answer of %s for %s: %v\n", session.id, session.fingerprint.SDPShim, err)
+		return answer
+	}
+	return translated
+}
@@ -0,0 +1,1407 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/dtls/v2"
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/stats"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+
+	"webrtc-zero-downtime-reload/internal/pionadapter"
+	"webrtc-zero-downtime-reload/pcmigrate"
+)
+
+const (
+	indexHtml = `
+<html>
+  <head>
+    <title>webrtc-zero-downtime-reload</title>
+  </head>
+
+  <body>
+  	<h1 id="statusElement"> </h1>
+  	<h2 id="titleElement"> </h2>
+  	<p id="nowPlayingElement"> </p>
+    <video id="videoElement" controls muted autoplay> </video>
+  </body>
+
+  <script>
+	let pc, sessionID, generation = '', events, localStream, ticket, rehandshaking = false
+	const room = new URLSearchParams(location.search).get('room') || 'default'
+	const codecs = (new URLSearchParams(location.search).get('codecs') || '').split(',').filter(c => c)
+	const ingest = new URLSearchParams(location.search).get('ingest')
+
+	// A token in the page URL is sent along with every request, EventSource
+	// can't set headers so it takes it as a query parameter.
+	const token = new URLSearchParams(location.search).get('token')
+	const authorized = headers => token ? Object.assign({'Authorization': 'Bearer ' + token}, headers) : headers
+
+	const negotiate = () => {
+    	pc.createOffer()
+    	.then(offer => {
+    	  pc.setLocalDescription(offer)
+
+    	  const url = rehandshaking ? '/sessions/' + sessionID + '/rehandshake' : '/doSignaling?room=' + encodeURIComponent(room) + (ticket ? '&ticket=' + encodeURIComponent(ticket) : '') + (ingest ? '&ingest=' + encodeURIComponent(ingest) : '')
+    	  return fetch(url, {
+    	    method: 'post',
+    	    headers: authorized({
+    	      'Accept': 'application/json, text/plain, */*',
+    	      'Content-Type': 'application/json'
+    	    }),
+    	    body: JSON.stringify(offer)
+    	  })
+    	})
+    	.then(res => {
+    	  if (res.status === 202) {
+    	    return res.json().then(wait)
+    	  }
+    	  if (!res.ok) {
+    	    throw new Error(res.statusText)
+    	  }
+    	  rehandshaking = false
+    	  sessionID = res.headers.get('X-Session-ID')
+    	  generation = res.headers.get('X-Restart-Generation') || ''
+    	  listen()
+    	  return res.json().then(res => pc.setRemoteDescription(res))
+    	})
+    	.catch(() => {
+    	  // The server may have gone away before answering, in which case it
+    	  // has no state for us and we simply try again.
+    	  statusElement.innerText = 'Failed to connect, retrying';
+    	  rehandshaking = false
+    	  setTimeout(() => {
+    	    pc.close()
+    	    start()
+    	  }, 2000)
+    	})
+	}
+
+	// The room is full, we are told where we are in line until a slot is
+	// ours. The line is saved across restarts of the server.
+	const wait = queued => {
+		ticket = queued.Ticket
+		statusElement.innerText = 'The room is full, you are number ' + queued.Position + ' in line';
+		const line = new EventSource('/events?id=' + ticket + (token ? '&token=' + encodeURIComponent(token) : ''))
+		line.addEventListener('queuePosition', e => {
+			statusElement.innerText = 'The room is full, you are number ' + JSON.parse(e.data) + ' in line';
+		})
+		line.addEventListener('admitted', () => {
+			line.close()
+			statusElement.innerText = 'You are viewing';
+			negotiate()
+		})
+		line.addEventListener('roomClosed', () => {
+			line.close()
+			statusElement.innerText = 'The room has closed';
+		})
+	}
+
+	// EventSource reconnects by itself, so after a restart the server can
+	// tell us if our session couldn't be resumed and we need a new one.
+	const listen = () => {
+		events = new EventSource('/events?id=' + sessionID + (token ? '&token=' + encodeURIComponent(token) : ''))
+		events.addEventListener('restoreFailed', () => {
+			events.close()
+			pc.close()
+			start()
+		})
+		// The server is going away without saving our session.
+		events.addEventListener('reconnect', () => {
+			events.close()
+			pc.close()
+			start()
+		})
+		// Our session survived a restart but its DTLS didn't, a new
+		// PeerConnection does the handshake again within the same session.
+		events.addEventListener('rehandshake', () => {
+			events.close()
+			pc.close()
+			rehandshaking = true
+			start()
+		})
+		events.addEventListener('broadcasterLost', () => {
+			if (!localStream) {
+				statusElement.innerText = 'The broadcaster has left';
+			}
+		})
+		events.addEventListener('trackMuted', e => {
+			statusElement.innerText = 'The broadcaster muted their ' + JSON.parse(e.data);
+		})
+		events.addEventListener('trackUnmuted', () => {
+			statusElement.innerText = 'You are viewing';
+		})
+		events.addEventListener('sessionEnded', () => {
+			fetch('/sessions/' + sessionID + '/ack', {method: 'post', headers: authorized({})})
+			events.close()
+			pc.close()
+			start()
+		})
+		events.addEventListener('roomClosed', () => {
+			events.close()
+			pc.close()
+			statusElement.innerText = 'The room has closed';
+		})
+		events.addEventListener('candidates', e => {
+			JSON.parse(e.data).forEach(c => pc.addIceCandidate(c))
+		})
+		events.addEventListener('metadata', e => showMetadata(JSON.parse(e.data)))
+		events.addEventListener('renegotiate', e => {
+			const subscriptions = JSON.parse(e.data)
+			pc.getTransceivers().forEach(t => {
+				t.direction = subscriptions.includes(t.receiver.track.kind) ? 'recvonly' : 'inactive'
+			})
+			renegotiate()
+		})
+	}
+
+	// The title of the broadcast is kept by the server, it is shown again
+	// after a reload.
+	const showMetadata = metadata => {
+		titleElement.innerText = metadata.Title || ' ';
+		titleElement.title = metadata.Description || '';
+		nowPlayingElement.innerText = metadata.NowPlaying ? 'Now playing: ' + metadata.NowPlaying : ' ';
+	}
+
+	const renegotiate = () => {
+		pc.createOffer()
+		.then(offer => {
+			pc.setLocalDescription(offer)
+
+			return fetch('/sessions/' + sessionID + '/offer', {
+			  method: 'post',
+			  headers: authorized({
+			    'Accept': 'application/json, text/plain, */*',
+			    'Content-Type': 'application/json'
+			  }),
+			  body: JSON.stringify(offer)
+			})
+		})
+		.then(res => res.json())
+		.then(res => pc.setRemoteDescription(res))
+	}
+
+	const broadcast = stream => {
+		localStream = stream
+		statusElement.innerText = 'You are broadcasting';
+		videoElement.srcObject = stream;
+
+		// The room policy decides the simulcast layers we send, asked again
+		// on every start in case it changed.
+		fetch('/encodings?room=' + encodeURIComponent(room), {headers: authorized({'Accept': 'application/json'})})
+		.then(res => res.json())
+		.then(encodings => {
+			const video = encodings.length ? {direction: 'sendonly', sendEncodings: encodings} : {direction: 'sendonly'}
+			stream.getTracks().forEach(t => {
+				if (t.kind !== 'video') {
+					pc.addTransceiver(t, {direction: 'sendonly'})
+					return
+				} else if (codecs.length === 0) {
+					pc.addTransceiver(t, video)
+					return
+				}
+
+				// One transceiver per codec, viewers get whichever they prefer.
+				codecs.forEach(name => {
+					const preferred = RTCRtpSender.getCapabilities('video').codecs
+						.filter(c => c.mimeType.toLowerCase() === 'video/' + name.toLowerCase())
+					pc.addTransceiver(t, video).setCodecPreferences(preferred)
+				})
+			})
+			negotiate()
+		})
+	}
+
+	// The server hands out TURN credentials if it has TURN servers.
+	const start = () => {
+		fetch('/turn?room=' + encodeURIComponent(room), {headers: authorized({'Accept': 'application/json'})})
+		.then(res => res.ok ? res.json() : {iceServers: []})
+		.catch(() => ({iceServers: []}))
+		.then(turn => connect(turn.iceServers))
+	}
+
+	const connect = iceServers => {
+		pc = new RTCPeerConnection({iceServers})
+		pc.ontrack = event => {
+		  videoElement.srcObject = event.streams[0];
+		};
+		// What the browser saw when connectivity failed is uploaded, to be
+		// lined up with the history of the session. Servers without
+		// -client-log-dir refuse it.
+		pc.oniceconnectionstatechange = () => {
+			if (pc.iceConnectionState === 'failed' && sessionID) {
+				pc.getStats().then(stats => fetch('/sessions/' + sessionID + '/logs?kind=stats', {
+					method: 'post',
+					headers: authorized({'Content-Type': 'application/json', 'X-Restart-Generation': generation}),
+					body: JSON.stringify([...stats.values()])
+				})).catch(() => {})
+			}
+		}
+
+		if (localStream) {
+			broadcast(localStream)
+			return
+		}
+
+		fetch('/haveBroadcaster?room=' + encodeURIComponent(room), {
+			   headers: authorized({
+				 'Accept': 'application/json, text/plain, */*',
+			   }),
+		})
+		.then(res => res.json())
+		.then(res => {
+			showMetadata(res.Metadata || {})
+			if (!res.Open) {
+				statusElement.innerText = 'The room is not open';
+			} else if (res.HaveBroadcaster) {
+				statusElement.innerText = 'You are viewing';
+				pc.addTransceiver('audio', {direction: 'recvonly'})
+				if (!res.Policy.AudioOnly) {
+					pc.addTransceiver('video', {direction: 'recvonly'})
+				}
+				negotiate()
+			} else if (!res.CanBroadcast && res.Login) {
+				location = res.Login + '?return=' + encodeURIComponent(location.pathname + location.search)
+			} else if (!res.CanBroadcast) {
+				statusElement.innerText = 'You may not broadcast in this room';
+			} else {
+				// The room policy caps what we capture, media isn't transcoded.
+				const video = res.Policy.AudioOnly ? false : {}
+				if (res.Policy.MaxWidth) {
+					video.width = {max: res.Policy.MaxWidth}
+				}
+				if (res.Policy.MaxHeight) {
+					video.height = {max: res.Policy.MaxHeight}
+				}
+				navigator.mediaDevices.getUserMedia({audio: true, video})
+				.then(broadcast)
+			}
+		})
+	}
+
+	// Tell the server we are gone so it doesn't resume our session.
+	window.addEventListener('pagehide', () => {
+		if (sessionID) {
+			fetch('/sessions/' + sessionID, {method: 'delete', keepalive: true, headers: authorized({})})
+		}
+	})
+
+	start()
+  </script>
+</html>
+`
+)
+
+// snapshotVersion is written into every GlobalState. Bump it whenever a
+// change makes older binaries unable to resume from a snapshot, or changes
+// what a field means, and add the migration from the previous version to
+// snapshotMigrations.
+const snapshotVersion = 1
+
+type GlobalState struct {
+	Version    int
+	Generation uint64
+	SavedAt    time.Time
+
+	// HandedOff is set on the final snapshot of a process handing off.
+	HandedOff bool
+
+	PeerConnectionState []PeerConnectionState
+	Rooms               []RoomState
+	RetiredHistories    []SessionHistory
+	SSRCs               map[uint32]string
+	Tombstones          []Tombstone
+	Logins              []Login
+
+	// Analytics are the counts of clients by prefix, ASN and country.
+	Analytics []AnalyticsBucket
+
+	// ClosedBytesSent and ClosedBytesReceived account for sessions that are
+	// no longer part of the snapshot.
+	ClosedBytesSent     uint64
+	ClosedBytesReceived uint64
+}
+
+type PeerConnectionState struct {
+	ID                string
+	Room              string
+	RemoteDescription webrtc.SessionDescription
+
+	ICEPort             uint16
+	ICEUsernameFragment string
+	ICEPassword         string
+
+	DTLSConnectionState dtls.State
+
+	SSRCAudio, SSRCVideo webrtc.SSRC
+	SRTPState            map[uint32]uint32
+
+	// VideoCodec is the mime type of the video a viewer negotiated, VP8 if
+	// empty.
+	VideoCodec string
+
+	Fingerprint Fingerprint
+
+	// Principal is who created the session, empty without an auth provider
+	// unless it joined as a guest.
+	Principal Principal
+
+	// TURN is the credential the PeerConnection of the server was given.
+	TURN TURNCredential
+
+	// Backup is set for a broadcaster that joined as the backup ingest.
+	Backup bool `json:",omitempty"`
+
+	MaxBitrate uint64
+
+	// Unsubscribed is stored instead of the subscriptions so snapshots from
+	// before subscriptions existed resume with everything subscribed.
+	Unsubscribed []string
+
+	Paused         bool
+	DroppedPackets map[uint32]uint16
+
+	// Layer is the simulcast layer a viewer receives, the top one if empty.
+	Layer       string
+	LayerShifts map[uint32]LayerShift
+
+	// Probe is the prober of a viewer in a simulcast room.
+	Probe ProbeState
+
+	// JitterSequences is the sequence number the jitter buffer of each
+	// SSRC of a broadcaster forwards next.
+	JitterSequences map[uint32]uint16 `json:",omitempty"`
+
+	// Pacer is the pacer of a viewer.
+	Pacer PacerState
+
+	// SocketBuffers are the sizes the buffers of the sockets of the session
+	// were given with the admin API.
+	SocketBuffers SocketBuffers
+
+	// Bandwidth is the bandwidth estimator of a viewer with gcc.
+	Bandwidth *BandwidthState `json:",omitempty"`
+
+	// PayloadTypes are those the client was answered with, a resumed
+	// PeerConnection may answer with others.
+	PayloadTypes []PayloadTypeMapping `json:",omitempty"`
+
+	// KV is the store the application keeps with the session.
+	KV map[string]string `json:",omitempty"`
+
+	// ClientIP is the address the client signaled from, for analytics.
+	ClientIP string `json:",omitempty"`
+
+	// CodecFallback is set once a viewer was moved to VideoCodec because it
+	// couldn't decode the one it was served first.
+	CodecFallback *CodecFallback `json:",omitempty"`
+
+	BytesSent, BytesReceived uint64
+
+	TWCCSequence uint32
+
+	History []HistoryEntry
+}
+
+// restoreReport describes the outcome of the last deserialize, so operators
+// can see which sessions made it across a restart.
+type restoreReport struct {
+	Time       time.Time
+	Generation uint64
+	Sessions   []restoreResult
+
+	// Rooms are those that couldn't be recreated.
+	Rooms []restoreResult `json:",omitempty"`
+}
+
+type restoreResult struct {
+	ID string
+
+	// Err is why the session couldn't be resumed, compare it with
+	// errors.Is. Error is its message, for the admin endpoint.
+	Err   error  `json:"-"`
+	Error string `json:",omitempty"`
+
+	// FromJournal is set for sessions that were still negotiating.
+	FromJournal bool `json:",omitempty"`
+
+	// Latch is how far the session got in latching again since.
+	Latch *LatchDiagnostics `json:",omitempty"`
+}
+
+type session struct {
+	id             string
+	room           *room
+	peerConnection *webrtc.PeerConnection
+	broadcaster    bool
+	maxBitrate     atomic.Uint64
+
+	// videoCodec is the mime type of the room track a viewer receives, it
+	// is chosen once when the session is created.
+	videoCodec string
+
+	// fingerprint is worked out from the offer, the answer and interceptors
+	// are adapted to it.
+	fingerprint Fingerprint
+
+	// principal is who created the session, only they may act on it.
+	principal Principal
+
+	// origin is where the client signaled from.
+	origin clientOrigin
+
+	// backup is set for a broadcaster that joined as the backup ingest of
+	// its room.
+	backup bool
+
+	// latch follows a restored session latching again, nil for new ones.
+	latch *latchState
+
+	// turn is the credential the PeerConnection gathers relay candidates
+	// with, empty without TURN servers.
+	turn TURNCredential
+
+	pause   pauseState
+	layer   layerState
+	probe   probeState
+	jitter  jitterState
+	pacer   pacerState
+	srtp    srtpGuard
+	capture atomic.Pointer[packetCapture]
+
+	payloadTypes payloadTypes
+	bandwidth    bandwidthState
+	buffers      socketBuffers
+	kv           kvStore
+
+	codecFallback codecFallbackState
+
+	bytesSent, bytesReceived atomic.Uint64
+
+	// twccNext points into the TWCC interceptor of a viewer, twccRestored is
+	// where it starts from.
+	twccNext     atomic.Pointer[uint32]
+	twccRestored uint32
+	stats        atomic.Pointer[stats.Getter]
+
+	historyMutex sync.Mutex
+	history      []HistoryEntry
+
+	// collecting is set once the session is being removed, see
+	// collectSession.
+	collecting atomic.Bool
+
+	// resumedDTLS is set while a restored session hasn't connected on the
+	// DTLS state of the snapshot yet, see startRehandshake.
+	resumedDTLS atomic.Bool
+
+	// unsubscribed holds the kinds of broadcaster track this viewer opted out
+	// of, guarded by sessionsMutex.
+	unsubscribed map[string]bool
+}
+
+func newSessionState(id string, room *room, offer webrtc.SessionDescription) *session {
+	return &session{
+		id:           id,
+		room:         room,
+		broadcaster:  !isViewerOffer(offer),
+		unsubscribed: map[string]bool{},
+		pause:        pauseState{dropped: map[uint32]uint16{}},
+		layer:        layerState{shifts: map[uint32]LayerShift{}, last: map[uint32]sentPosition{}},
+		probe:        probeState{padding: map[uint32]uint16{}, last: map[uint32]probePosition{}},
+	}
+}
+
+var (
+	sessions          = []*session{}
+	sessionsMutex     sync.Mutex
+	lastRestoreReport = &restoreReport{}
+
+	errRestorePanic = errors.New("panicked while resuming")
+	errRolledBack   = errors.New("rolled back, answer was never sent")
+)
+
+func doSignaling(w http.ResponseWriter, r *http.Request) {
+	var offer webrtc.SessionDescription
+	if err := json.NewDecoder(r.Body).Decode(&offer); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if handingOff.Load() {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, errHandingOff.Error(), http.StatusServiceUnavailable)
+		return
+	} else if phase.Load() != phaseServing {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, errNotServing.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	if session := renegotiatedSession(r, offer); session != nil {
+		if err := authorizeSession(r, session); err != nil {
+			authError(w, err)
+			return
+		}
+		handleSignalingRenegotiation(w, r, session, offer)
+		return
+	}
+
+	room := findRoom(r.URL.Query().Get("room"))
+	if room == nil {
+		http.Error(w, errRoomNotFound.Error(), http.StatusNotFound)
+		return
+	} else if !room.isOpen(time.Now()) {
+		http.Error(w, errRoomNotOpen.Error(), http.StatusForbidden)
+		return
+	}
+	principal, err := authorizeRoomJoin(r, room, !isViewerOffer(offer))
+	if err != nil {
+		authError(w, err)
+		return
+	}
+	backup, err := parseIngest(r.URL.Query().Get("ingest"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err = runPreOfferHooks(r, room.id, &offer); err != nil {
+		hookError(w, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), config.SignalingTimeout)
+	defer cancel()
+
+	if overloaded.Load() && isViewerOffer(offer) {
+		w.Header().Set("Retry-After", "10")
+		http.Error(w, "server is overloaded", http.StatusServiceUnavailable)
+		return
+	} else if err = admitTenantSession(room); err != nil {
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+
+	// Viewers of a room at capacity wait in line, and join with their
+	// ticket once admitted.
+	ticket := ""
+	if room.policy.MaxViewers > 0 && isViewerOffer(offer) {
+		if ticket = r.URL.Query().Get("ticket"); !room.admitted(ticket) {
+			if viewer, position, queued := room.enqueue(); queued {
+				writeQueued(w, viewer, position)
+				return
+			}
+			ticket = ""
+		}
+	}
+
+	// The offer of a legacy client is saved translated, restores only
+	// need the translation for the answers and offers that follow.
+	shim, err := detectSDPShim(r, offer)
+	if err == nil {
+		offer, err = shimOffer(shim, offer)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fingerprint := fingerprintOffer(offer, r.UserAgent())
+	fingerprint.SDPShim = shim
+
+	origin := lookupOrigin(r.RemoteAddr)
+	session, err := newSession(ctx, room, offer, fingerprint, origin, principal, backup)
+	if err != nil && !errors.Is(err, errInvalidOffer) {
+		countOrigin(origin, 0, 0, 1)
+	}
+	if errors.Is(err, errInvalidOffer) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if errors.Is(err, context.DeadlineExceeded) {
+		http.Error(w, "timed out creating session", http.StatusGatewayTimeout)
+		return
+	} else if err != nil {
+		logf("Failed to create session: %v\n", err)
+		http.Error(w, "failed to create session", http.StatusInternalServerError)
+		return
+	}
+
+	if ticket != "" {
+		room.joined(ticket, session.id)
+	}
+	countJoin(session)
+	publishMetadata(room, session)
+
+	answer := localAnswer(session)
+	if err = runPostAnswerHooks(r, session.info(), &answer); err != nil {
+		if closeErr := session.peerConnection.Close(); closeErr != nil {
+			logf("Failed to close PeerConnection %s: %v\n", session.id, closeErr)
+		}
+		hookError(w, err)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    session.id,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	writeAnswer(w, session, answer)
+}
+
+// writeAnswer sends answer to the client of session.
+func writeAnswer(w http.ResponseWriter, session *session, answer webrtc.SessionDescription) {
+	response, err := json.Marshal(answer)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Session-ID", session.id)
+	w.Header().Set("X-Restart-Generation", strconv.FormatUint(generation.Load(), 10))
+	if _, err := w.Write(response); err != nil {
+		logf("Failed to write answer: %v\n", err)
+	}
+}
+
+// newSession creates a PeerConnection for offer and returns once gathering is
+// complete. The negotiation is journaled until the session connects, so a
+// crash before then can be recovered from. The PeerConnection is closed if
+// anything fails.
+func newSession(ctx context.Context, room *room, offer webrtc.SessionDescription, fingerprint Fingerprint, origin clientOrigin, principal Principal, backup bool) (*session, error) {
+	session := newSessionState(newSessionID(), room, offer)
+	session.fingerprint = fingerprint
+	session.origin = origin
+	session.principal = principal
+	session.backup = backup && session.broadcaster
+	session.maxBitrate.Store(room.policy.bitrateCap(config.DefaultMaxBitrate))
+
+	certificate, err := newSessionCertificate()
+	if err != nil {
+		return nil, err
+	} else if err = journalOffer(session.id, offer); err != nil {
+		return nil, err
+	}
+
+	// With ICE ports from systemd every session gets one, so they stay
+	// bound across restarts.
+	s := webrtc.SettingEngine{}
+	if port, ok := reserveActivatedPort(time.Now()); ok {
+		if err = s.SetEphemeralUDPPortRange(port, port); err != nil {
+			journalAbort(session.id)
+			return nil, err
+		}
+	}
+	if err = newPeerConnection(session, s, webrtc.Configuration{
+		Certificates: []webrtc.Certificate{*certificate},
+		ICEServers:   useTURN(session, TURNCredential{}),
+	}); err != nil {
+		journalAbort(session.id)
+		return nil, err
+	}
+
+	if err = negotiate(ctx, session, offer); err == nil {
+		err = journalAnswer(session, offer, certificate)
+	}
+	if err != nil {
+		journalAbort(session.id)
+		if closeErr := session.peerConnection.Close(); closeErr != nil {
+			logf("Failed to close PeerConnection %s: %v\n", session.id, closeErr)
+		}
+		return nil, err
+	}
+	return session, nil
+}
+
+// newPeerConnection creates the PeerConnection of session. Settings shared by
+// new and resumed sessions are applied on top of s.
+func newPeerConnection(session *session, s webrtc.SettingEngine, configuration webrtc.Configuration) error {
+	s.SetSRTPProtectionProfiles(dtls.SRTP_AEAD_AES_128_GCM)
+	m := &webrtc.MediaEngine{}
+	if err := registerPolicyCodecs(m, session.room.policy); err != nil {
+		return err
+	} else if err = registerE2EEHeaderExtension(m); err != nil {
+		return err
+	}
+
+	// The DSCP interceptor only learns the streams sent. The capture sits
+	// below everything else so it records what is actually sent, the pacer
+	// of viewers right above it. Sync corrections come next so they apply to
+	// the sender reports of the reports interceptor, payload types are
+	// mapped in between, see payloadTypes. Configured interceptors come
+	// next, NACK responses must carry the extension IDs and sequence numbers
+	// set by the ones above them.
+	i := &interceptor.Registry{}
+	n, err := newSessionNet(session)
+	if err != nil {
+		return err
+	}
+	useDSCP(&n, i)
+	if session.latch != nil {
+		n = &latchNet{Net: n, latch: session.latch}
+	}
+	s.SetNet(n)
+	i.Add(&accountingInterceptorFactory{session: session})
+	i.Add(&historyInterceptorFactory{session: session})
+	i.Add(&captureInterceptorFactory{session: session})
+	if !session.broadcaster {
+		i.Add(&pacerInterceptorFactory{session: session})
+	}
+	i.Add(&payloadTypeInterceptorFactory{session: session})
+	i.Add(&syncInterceptorFactory{session: session})
+	if err := configureInterceptors(session, m, i); err != nil {
+		return err
+	}
+	i.Add(&e2eeInterceptorFactory{room: session.room})
+	if !session.broadcaster && config.RestoreWarmup > 0 {
+		i.Add(&warmupInterceptorFactory{session: session})
+	}
+	if config.Probing && !session.broadcaster && len(session.room.policy.Simulcast) > 1 && !session.room.policy.AudioOnly {
+		i.Add(&probeInterceptorFactory{session: session})
+	}
+	i.Add(&pauseInterceptorFactory{state: &session.pause})
+	if !session.broadcaster && len(session.room.policy.Simulcast) > 1 && !session.room.policy.AudioOnly {
+		i.Add(&layerInterceptorFactory{session: session})
+	}
+
+	peerConnection, err := webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithSettingEngine(s), webrtc.WithInterceptorRegistry(i)).NewPeerConnection(configuration)
+	if err != nil {
+		return err
+	}
+
+	session.peerConnection = peerConnection
+	peerConnection.OnConnectionStateChange(func(connectionState webrtc.PeerConnectionState) {
+		// A PeerConnection replaced by a rehandshake is closed without
+		// ending the session.
+		if session.peerConnection != peerConnection {
+			return
+		}
+		onConnectionStateChangeHandler(session, connectionState)
+	})
+	peerConnection.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		onTrackHandler(session, track, receiver)
+	})
+	peerConnection.OnDataChannel(func(dataChannel *webrtc.DataChannel) {
+		onDataChannelHandler(session, dataChannel)
+	})
+	return nil
+}
+
+func negotiate(ctx context.Context, session *session, offer webrtc.SessionDescription) error {
+	peerConnection := session.peerConnection
+	if isViewerOffer(offer) {
+		session.videoCodec = chooseVideoCodec(session.room, offer)
+		tracks := []webrtc.TrackLocal{session.room.audioTrack}
+		if video := session.videoTrack(); video != nil {
+			tracks = append([]webrtc.TrackLocal{video}, tracks...)
+		}
+		for _, track := range tracks {
+			ssrc, err := allocateSSRC(session.id)
+			if err != nil {
+				return err
+			} else if _, err = peerConnection.AddTransceiverFromTrack(track, webrtc.RTPTransceiverInit{
+				Direction:    webrtc.RTPTransceiverDirectionSendrecv,
+				SSRCOverride: ssrc,
+			}); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := peerConnection.SetRemoteDescription(offer); err != nil {
+		return fmt.Errorf("%w: %v", errInvalidOffer, err)
+	}
+
+	gatherComplete := webrtc.GatheringCompletePromise(peerConnection)
+	answer, err := peerConnection.CreateAnswer(nil)
+	if err != nil {
+		return err
+	} else if answer.SDP, err = applyBitrateCap(answer.SDP, session.maxBitrate.Load()); err != nil {
+		return err
+	} else if err = peerConnection.SetLocalDescription(answer); err != nil {
+		return err
+	}
+	session.payloadTypes.negotiated(answer)
+	readRTCP(session)
+	controlLayers(session)
+	controlProbing(session)
+
+	// A STUN server that never answers would otherwise hold this request
+	// open forever.
+	select {
+	case <-gatherComplete:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// serialize writes the state of every connected session to disk, that of
+// every tenant to its own snapshot. Sessions that can't be captured are
+// skipped so one bad session doesn't cost us the others, and a snapshot that
+// can't be written doesn't stop the others. sessionsMutex must be held by the
+// caller, writing gives up after -snapshot-timeout so a slow disk can't hold
+// it forever. With -snapshot-write-behind the snapshots are queued for the
+// next flush instead, unless handing off. Once a hot restart handed the
+// sessions over it does nothing, the new process saves them.
+func serialize(ctx context.Context) error {
+	if handedOver.Load() {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, config.SnapshotTimeout)
+	defer cancel()
+	defer measureCheckpoint()()
+
+	state, err := snapshotState(ctx)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for partition, partial := range partitionState(state) {
+		toSave, err := encodeSnapshot(partial)
+		if err != nil {
+			errs = append(errs, err)
+		} else if config.SnapshotWriteBehind > 0 && !handingOff.Load() {
+			writeBehind.queue(partition, toSave, sessionIDs(partial), partial.SavedAt)
+		} else if err = writeBehind.writeThrough(ctx, partition, toSave, sessionIDs(partial), partial.SavedAt); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// snapshotState captures the state of every connected session after running
+// the pre-checkpoint hooks. sessionsMutex must be held by the caller.
+func snapshotState(ctx context.Context) (GlobalState, error) {
+	if err := runPreCheckpointHooks(ctx); err != nil {
+		return GlobalState{}, err
+	}
+
+	state := GlobalState{
+		Version:             snapshotVersion,
+		Generation:          generation.Load(),
+		SavedAt:             time.Now(),
+		HandedOff:           handingOff.Load(),
+		PeerConnectionState: []PeerConnectionState{},
+		ClosedBytesSent:     closedBytesSent.Load(),
+		ClosedBytesReceived: closedBytesReceived.Load(),
+		Rooms:               snapshotRooms(),
+		RetiredHistories:    snapshotRetiredHistories(),
+		SSRCs:               snapshotSSRCs(),
+		Tombstones:          snapshotTombstones(),
+		Logins:              snapshotLogins(),
+		Analytics:           snapshotAnalytics(),
+	}
+
+	for i := range sessions {
+		if sessions[i].collecting.Load() {
+			continue
+		}
+
+		sessionState, err := snapshotSession(sessions[i])
+		if err != nil {
+			logf("Failed to serialize PeerConnection %s: %v\n", sessions[i].id, err)
+			continue
+		}
+		state.PeerConnectionState = append(state.PeerConnectionState, sessionState)
+	}
+	return state, nil
+}
+
+// senderSSRCs returns the SSRCs we send video and audio with, so a resumed
+// session can keep using them.
+func senderSSRCs(peerConnection *webrtc.PeerConnection) (SSRCVideo, SSRCAudio webrtc.SSRC, err error) {
+	for _, transceiver := range peerConnection.GetTransceivers() {
+		if transceiver.Sender() == nil {
+			continue
+		}
+
+		encodes := transceiver.Sender().GetParameters().Encodings
+		if len(encodes) == 0 {
+			return 0, 0, errNoEncodings
+		}
+
+		// The track is gone while unsubscribed, the transceiver keeps its kind.
+		if transceiver.Kind() == webrtc.RTPCodecTypeVideo {
+			SSRCVideo = encodes[0].SSRC
+		} else {
+			SSRCAudio = encodes[0].SSRC
+		}
+	}
+	return SSRCVideo, SSRCAudio, nil
+}
+
+func snapshotSession(session *session) (PeerConnectionState, error) {
+	peerConnection := session.peerConnection
+	SSRCVideo, SSRCAudio, err := senderSSRCs(peerConnection)
+	if err != nil {
+		return PeerConnectionState{}, err
+	}
+	migration, err := pcmigrate.Capture(peerConnection)
+	if err != nil {
+		return PeerConnectionState{}, err
+	}
+
+	return PeerConnectionState{
+		ID:                  session.id,
+		Room:                session.room.id,
+		RemoteDescription:   migration.RemoteDescription,
+		ICEPort:             migration.ICEPort,
+		ICEUsernameFragment: migration.ICEUsernameFragment,
+		ICEPassword:         migration.ICEPassword,
+		DTLSConnectionState: migration.DTLSConnectionState,
+		SSRCAudio:           SSRCAudio,
+		SSRCVideo:           SSRCVideo,
+		SRTPState:           migration.SRTPState,
+		VideoCodec:          session.videoCodec,
+		Fingerprint:         session.fingerprint,
+		Principal:           session.principal,
+		TURN:                session.turn,
+		Backup:              session.backup,
+		MaxBitrate:          session.maxBitrate.Load(),
+		Unsubscribed:        unsubscribedKinds(session),
+		Paused:              session.pause.paused.Load(),
+		DroppedPackets:      session.pause.droppedPackets(),
+		Layer:               session.layer.current(),
+		LayerShifts:         session.layer.layerShifts(),
+		Probe:               session.probe.persisted(),
+		JitterSequences:     session.jitter.persisted(),
+		Pacer:               session.pacer.persisted(),
+		SocketBuffers:       session.buffers.persisted(),
+		Bandwidth:           session.bandwidth.persisted(),
+		PayloadTypes:        session.payloadTypes.clientPayloadTypes(),
+		KV:                  session.kv.persisted(),
+		ClientIP:            session.origin.address(),
+		CodecFallback:       session.codecFallback.persisted(),
+		BytesSent:           session.bytesSent.Load(),
+		BytesReceived:       session.bytesReceived.Load(),
+		TWCCSequence:        twccSequence(session),
+		History:             sessionHistory(session),
+	}, nil
+}
+
+// deserialize resumes every session in state, which must have been
+// provisioned. A session that fails to resume is recorded in the returned
+// report and skipped, the rest carry on. Sessions still waiting when ctx is
+// done are recorded as failed. source is where state was obtained, for the
+// log, empty if no snapshot was found.
+func deserialize(ctx context.Context, state GlobalState, source string) *restoreReport {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+
+	if source == "" {
+		logf("No snapshot to resume sessions from\n")
+	} else {
+		logf("Resuming %d sessions from %s\n", len(state.PeerConnectionState), source)
+	}
+
+	resetLatches()
+	report := &restoreReport{Time: time.Now(), Generation: generation.Load(), Sessions: []restoreResult{}, Rooms: failedRooms}
+	failedRooms = nil
+	for i := range state.PeerConnectionState {
+		result := restoreResult{ID: state.PeerConnectionState[i].ID}
+		err := restoreRecovered("resuming PeerConnection "+result.ID, func() error {
+			return restoreSession(ctx, state.PeerConnectionState[i])
+		})
+		runPostRestoreHooks(SessionInfo{
+			ID:          result.ID,
+			Room:        state.PeerConnectionState[i].Room,
+			Broadcaster: !isViewerOffer(state.PeerConnectionState[i].RemoteDescription),
+			Principal:   state.PeerConnectionState[i].Principal,
+		}, err)
+		if err != nil {
+			logf("Failed to resume PeerConnection %s: %v\n", result.ID, err)
+			closedBytesSent.Add(state.PeerConnectionState[i].BytesSent)
+			closedBytesReceived.Add(state.PeerConnectionState[i].BytesReceived)
+			retireHistory(result.ID, state.PeerConnectionState[i].Room, appendHistory(state.PeerConnectionState[i].History, HistoryEntry{
+				Time:    time.Now(),
+				Kind:    historyRestore,
+				Message: fmt.Sprintf("failed to resume: %v", err),
+			}))
+			releaseSSRCs(result.ID)
+			result.Err, result.Error = err, err.Error()
+			publishEvent(result.ID, event{Name: "restoreFailed"})
+		}
+		report.Sessions = append(report.Sessions, result)
+	}
+	return report
+}
+
+// restoreRecovered runs fn, resuming one session, and turns a panic into
+// errRestorePanic so a corrupt session fails on its own rather than taking
+// every other one down with the process.
+func restoreRecovered(name string, fn func() error) (err error) {
+	if runRecovered(name, func() { err = fn() }) {
+		return errRestorePanic
+	}
+	return err
+}
+
+func restoreSession(ctx context.Context, state PeerConnectionState) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	} else if err = validatePeerConnectionState(state); err != nil {
+		return err
+	}
+
+	// If the old port stays taken we resume on any port and trickle the new
+	// candidates to the client, its ICE agent then moves over to them.
+	migration := pcmigrate.State{
+		ICEPort:             state.ICEPort,
+		ICEUsernameFragment: state.ICEUsernameFragment,
+		ICEPassword:         state.ICEPassword,
+		DTLSConnectionState: state.DTLSConnectionState,
+		SRTPState:           state.SRTPState,
+	}
+	portMoved := false
+	if err := waitForPort(ctx, state.ICEPort); err != nil {
+		logf("Resuming PeerConnection %s on a new port: %v\n", state.ID, err)
+		portFallbacks.Inc()
+		portMoved = true
+		migration.ICEPort = 0
+	}
+	s := webrtc.SettingEngine{}
+	if err := pcmigrate.Configure(&s, migration); err != nil {
+		return err
+	}
+
+	room := findRoom(state.Room)
+	if room == nil {
+		return fmt.Errorf("%w: %s", errRoomNotFound, state.Room)
+	}
+
+	session := newSessionState(state.ID, room, state.RemoteDescription)
+	if session.id == "" {
+		session.id = newSessionID()
+	}
+	session.maxBitrate.Store(state.MaxBitrate)
+	session.fingerprint = restoredFingerprint(state.Fingerprint, state.RemoteDescription)
+	session.principal = state.Principal
+	session.backup = state.Backup
+	for _, kind := range state.Unsubscribed {
+		session.unsubscribed[kind] = true
+	}
+	session.pause.paused.Store(state.Paused)
+	session.bytesSent.Store(state.BytesSent)
+	session.bytesReceived.Store(state.BytesReceived)
+	session.twccRestored = state.TWCCSequence
+	session.history = state.History
+	for ssrc, dropped := range state.DroppedPackets {
+		session.pause.dropped[ssrc] = dropped
+	}
+	session.layer.rid = state.Layer
+	for ssrc, shift := range state.LayerShifts {
+		session.layer.shifts[ssrc] = shift
+	}
+	session.probe.restore(state.Probe)
+	session.jitter.restore(state.JitterSequences)
+	session.pacer.restore(state.Pacer)
+	session.buffers.restore(state.SocketBuffers)
+	session.bandwidth.restore(state.Bandwidth)
+	session.kv.restore(state.KV)
+	session.origin = lookupOrigin(state.ClientIP)
+	session.codecFallback.restore(state.CodecFallback)
+	session.resumedDTLS.Store(true)
+	s.LoggerFactory = newSRTPLoggerFactory(session)
+	followLatch(session)
+	if err := newPeerConnection(session, s, webrtc.Configuration{ICEServers: useTURN(session, state.TURN)}); err != nil {
+		return err
+	}
+	watchLatch(session)
+
+	err := resumeNegotiation(session, state)
+	if err == nil && portMoved {
+		err = trickleCandidates(ctx, session)
+	}
+	if err != nil {
+		recordHistory(session, historyRestore, "failed to resume: %v", err)
+		if closeErr := session.peerConnection.Close(); closeErr != nil {
+			logf("Failed to close PeerConnection %s: %v\n", session.id, closeErr)
+		}
+		return err
+	}
+
+	guardSRTP(session)
+	if portMoved {
+		recordHistory(session, historyRestore, "resumed from snapshot on a new port")
+	} else {
+		recordHistory(session, historyRestore, "resumed from snapshot on port %d", state.ICEPort)
+	}
+	return nil
+}
+
+// trickleCandidates waits for gathering to complete and sends the local
+// candidates to the client of session.
+func trickleCandidates(ctx context.Context, session *session) error {
+	select {
+	case <-webrtc.GatheringCompletePromise(session.peerConnection):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	_, iceGatherer, _ := pionadapter.Pion.ICE(session.peerConnection)
+	localCandidates, err := iceGatherer.GetLocalCandidates()
+	if err != nil {
+		return err
+	}
+
+	candidates := []webrtc.ICECandidateInit{}
+	for _, candidate := range localCandidates {
+		candidateInit := candidate.ToJSON()
+		candidateInit.SDPMid = nil
+		candidates = append(candidates, candidateInit)
+	}
+	publishEvent(session.id, event{Name: "candidates", Data: candidates})
+	return nil
+}
+
+func resumeNegotiation(session *session, state PeerConnectionState) error {
+	peerConnection := session.peerConnection
+	if isViewerOffer(state.RemoteDescription) {
+		session.videoCodec = state.VideoCodec
+		if session.room.videoTrack(session.videoCodec) == nil {
+			session.videoCodec = session.room.defaultVideoCodec()
+		}
+		if video := session.videoTrack(); video != nil {
+			if _, err := peerConnection.AddTransceiverFromTrack(video, webrtc.RTPTransceiverInit{
+				Direction:    webrtc.RTPTransceiverDirectionSendonly,
+				SSRCOverride: state.SSRCVideo,
+			}); err != nil {
+				return err
+			}
+		}
+		if _, err := peerConnection.AddTransceiverFromTrack(session.room.audioTrack, webrtc.RTPTransceiverInit{
+			Direction:    webrtc.RTPTransceiverDirectionSendonly,
+			SSRCOverride: state.SSRCAudio,
+		}); err != nil {
+			return err
+		}
+	}
+
+	if err := peerConnection.SetRemoteDescription(state.RemoteDescription); err != nil {
+		return err
+	}
+
+	answer, err := peerConnection.CreateAnswer(nil)
+	if err != nil {
+		return err
+	}
+	// The client never sees this answer, it keeps the payload types of the
+	// one it got before.
+	if mapped := session.payloadTypes.resume(state.PayloadTypes, answer); len(mapped) > 0 {
+		payloadTypeRemaps.Inc()
+		recordHistory(session, historyRestore, "mapped payload types %s", describePayloadTypes(mapped))
+	}
+	if err = peerConnection.SetLocalDescription(answer); err != nil {
+		return err
+	}
+	readRTCP(session)
+	controlLayers(session)
+	controlProbing(session)
+	return attachTracks(session, session.unsubscribed)
+}
+
+func onConnectionStateChangeHandler(session *session, connectionState webrtc.PeerConnectionState) {
+	logf("PeerConnection %s is now: %s\n", session.id, connectionState)
+	recordHistory(session, historyState, "connection state is %s", connectionState)
+
+	switch connectionState {
+	case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed:
+		// Once handed over the sessions are served by another process, their
+		// PeerConnections here failing as the sockets are released is not the
+		// end of them.
+		if handedOver.Load() {
+			return
+		}
+		if rehandshaking(session) || connectionState == webrtc.PeerConnectionStateFailed && startRehandshake(session) {
+			return
+		}
+		collectSession(session, connectionState.String())
+	case webrtc.PeerConnectionStateConnected:
+		session.resumedDTLS.Store(false)
+		sessionsMutex.Lock()
+		defer sessionsMutex.Unlock()
+
+		sessions = append(sessions, session)
+		if !session.broadcaster {
+			session.room.requestKeyframe()
+		} else if isGuest(session) {
+			go guestJoined(session.room, session)
+		}
+		runConnectHooks(session.info())
+		if err := serialize(context.Background()); err != nil {
+			logf("Failed to serialize: %v\n", err)
+		} else {
+			// The session is in the snapshot from here on, it doesn't need
+			// the journal anymore.
+			journalCommit(session.id)
+		}
+	}
+}
+
+func onTrackHandler(session *session, track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+	peerConnection, room := session.peerConnection, session.room
+	markBroadcasterAlive(room)
+	snapshotter.Trigger("a new track")
+	recordIngestE2EEExtension(room, track, receiver)
+
+	// Every simulcast layer is relayed on a track of its own, the top one on
+	// the track of the codec. Only the top one is timed for sync.
+	rid := track.RID()
+	top := rid == "" || rid == room.policy.forwardedRID()
+	if track.Kind() == webrtc.RTPCodecTypeVideo && room.layerTrack(track.Codec().MimeType, rid) == nil {
+		supervise("simulcast drain", session, func() {
+			drainLayer(room, track)
+		})
+		return
+	}
+
+	supervise("RTCP reader", session, func() {
+		for {
+			read := receiver.ReadRTCP
+			if rid != "" {
+				read = func() ([]rtcp.Packet, interceptor.Attributes, error) { return receiver.ReadSimulcastRTCP(rid) }
+			}
+			packets, _, err := read()
+			if err != nil {
+				return
+			} else if !top {
+				continue
+			}
+			recordSenderReports(room, track.Codec().MimeType, track.Codec().ClockRate, packets)
+		}
+	})
+	supervise("PLI sender", session, func() {
+		sendKeyframeRequests(room, peerConnection, track)
+	})
+	// Clients that don't take REMB are left with the b=TIAS of the answer.
+	if track.Kind() == webrtc.RTPCodecTypeVideo && session.fingerprint.REMB && top {
+		supervise("REMB sender", session, func() {
+			sendBitrateCap(room, peerConnection, track)
+		})
+	}
+
+	mimeType := track.Codec().MimeType
+	if strings.HasPrefix(mimeType, "audio") {
+		// A panic while forwarding is most likely caused by a single
+		// malformed packet, so the loop is restarted and picks up with the
+		// next one.
+		supervise("forwarder", session, func() {
+			forward(session, track, room.audioTrack)
+		})
+		return
+	}
+
+	outputTrack := room.videoTrack(mimeType)
+	if outputTrack == nil {
+		logf("Not relaying %s from PeerConnection %s, the room has no track for it\n", mimeType, session.id)
+		return
+	} else if !top {
+		supervise("forwarder", session, func() {
+			forward(session, track, room.layerTrack(mimeType, rid))
+		})
+		return
+	}
+	supervise("forwarder", session, func() {
+		room.addSource(mimeType)
+		defer room.removeSource(mimeType)
+		forward(session, track, outputTrack)
+	})
+}
+
+func forward(session *session, track *webrtc.TrackRemote, outputTrack *webrtc.TrackLocalStaticRTP) {
+	peerConnection, room := session.peerConnection, session.room
+	mimeType := track.Codec().MimeType
+	top := track.RID() == "" || track.RID() == room.policy.forwardedRID()
+	// A guest or backup starts off air, so its first packet carries on where
+	// the broadcaster left off like every other switch between them.
+	onAir := !isGuest(session) && !session.backup
+	jitter := session.jitter.buffer(track)
+	for {
+		// Read RTP packets being sent to Pion
+		packet, _, readErr := track.ReadRTP()
+		if errors.Is(readErr, io.EOF) {
+			return
+		} else if readErr != nil {
+			logf("Failed to read from track %s, closing PeerConnection: %v\n", track.ID(), readErr)
+			if err := peerConnection.Close(); err != nil {
+				logf("Failed to close PeerConnection: %v\n", err)
+			}
+			return
+		}
+
+		start := time.Now()
+		markBroadcasterAlive(room)
+		markTrackAlive(room, track.Kind())
+		if !isGuest(session) {
+			room.ingest.received(room, session, start)
+		}
+		start = ingestStage.done(start)
+
+		packets := []*rtp.Packet{packet}
+		if jitter != nil {
+			packets = jitter.push(packet)
+			start = jitterStage.done(start)
+		}
+		if !room.onAir(session) {
+			onAir = false
+			continue
+		} else if !onAir {
+			onAir = true
+			rebaseForwarded(outputTrack)
+		}
+		for _, packet := range packets {
+			if top {
+				observeLatency(room, mimeType, packet.Timestamp, time.Now())
+			}
+			start = fanout(outputTrack, packet, start)
+		}
+	}
+}
+
+// isViewerOffer reports whether offer comes from a viewer, they only ever
+// receive.
+func isViewerOffer(offer webrtc.SessionDescription) bool {
+	return !strings.Contains(offer.SDP, "a=sendonly") && !strings.Contains(offer.SDP, "a=sendrecv")
+}
+
+// recoverHandler turns a panic in a handler into a 500 for that request
+// instead of letting it take down the other sessions.
+func recoverHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if err := recover(); err != nil {
+				logf("Recovered from panic serving %s: %v\n", r.URL.Path, err)
+				http.Error(w, "internal server error", http.StatusInternalServerError)
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+func newSessionID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
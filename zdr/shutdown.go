@@ -0,0 +1,154 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// shutdownFallback is the part of -shutdown-deadline kept for telling clients
+// to reconnect and writing the marker, should the final snapshot not make it.
+const shutdownFallback = time.Second
+
+var (
+	// ErrShutdownForced is returned by Server.Shutdown when the final
+	// snapshot couldn't be written within Config.ShutdownDeadline.
+	ErrShutdownForced = errors.New("zdr: shutdown forced")
+
+	shutdownsForced = newCounter("shutdowns_forced_total", "Forced shutdowns of the previous process found at startup.")
+)
+
+// ShutdownMarker is written next to the snapshot by a shutdown that was
+// forced, naming the sessions whose clients were told to reconnect. The next
+// process doesn't resume those, their clients are already starting new ones.
+type ShutdownMarker struct {
+	Time       time.Time
+	Generation uint64
+	Reason     string
+	Sessions   []string
+}
+
+func shutdownMarkerPath() string {
+	return config.SnapshotPath + ".shutdown"
+}
+
+// Shutdown prepares for the process to exit within Config.ShutdownDeadline,
+// so deploy tooling can count on how long a restart takes. It hands off like
+// Handoff, and if the final snapshot isn't written in time, for a wedged disk
+// or a session that holds up serialize, clients listening on /events are
+// told to reconnect and a ShutdownMarker is written instead, then
+// ErrShutdownForced is returned. The process should exit either way. With
+// -reuseport-drain it keeps serving after the final snapshot until the next
+// process took the ICE ports over.
+func (s *Server) Shutdown() error {
+	handingOff.Store(true)
+	sdNotify("STOPPING=1")
+
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Checkpoint()
+	}()
+
+	var reason error
+	select {
+	case err := <-done:
+		if err == nil {
+			drainReusePort()
+			return nil
+		}
+		reason = err
+	case <-time.After(config.ShutdownDeadline - shutdownFallback):
+		reason = fmt.Errorf("final snapshot not written within %s", config.ShutdownDeadline-shutdownFallback)
+	}
+
+	logf("ALERT: forcing shutdown: %v\n", reason)
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownFallback)
+	defer cancel()
+
+	marker := ShutdownMarker{Time: time.Now(), Generation: generation.Load(), Reason: reason.Error(), Sessions: tellReconnect(ctx)}
+	if err := writeShutdownMarker(ctx, marker); err != nil {
+		logf("Failed to write the shutdown marker: %v\n", err)
+	}
+	return fmt.Errorf("%w: %v", ErrShutdownForced, reason)
+}
+
+// tellReconnect sends reconnect to every client listening on /events and
+// waits until the events are written or ctx is done. sessionsMutex may be
+// held by the wedged serialize, so it goes by the streams open rather than by
+// sessions. It returns the sessions told.
+func tellReconnect(ctx context.Context) []string {
+	eventsMutex.Lock()
+	told := make([]string, 0, len(eventStreams))
+	for id, events := range eventStreams {
+		select {
+		case events <- event{Name: "reconnect"}:
+			told = append(told, id)
+		default:
+		}
+	}
+	eventsMutex.Unlock()
+	sort.Strings(told)
+
+	for {
+		eventsMutex.Lock()
+		pending := 0
+		for _, events := range eventStreams {
+			pending += len(events)
+		}
+		eventsMutex.Unlock()
+
+		if pending == 0 {
+			return told
+		}
+		select {
+		case <-ctx.Done():
+			return told
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func writeShutdownMarker(ctx context.Context, marker ShutdownMarker) error {
+	data, err := json.Marshal(marker)
+	if err != nil {
+		return err
+	}
+	return withContext(ctx, func() error {
+		return os.WriteFile(shutdownMarkerPath(), data, 0644)
+	})
+}
+
+// readShutdownMarker tombstones the sessions of the marker left by a forced
+// shutdown, if there is one, so they aren't resumed, and removes it.
+func readShutdownMarker(state GlobalState) GlobalState {
+	data, err := os.ReadFile(shutdownMarkerPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return state
+	} else if err != nil {
+		logf("Warning: failed to read the shutdown marker: %v\n", err)
+		return state
+	}
+
+	marker := ShutdownMarker{}
+	if err = json.Unmarshal(data, &marker); err != nil {
+		logf("Warning: skipping shutdown marker: %v\n", err)
+	} else {
+		shutdownsForced.Inc()
+		logf("Warning: generation %d was forced to shut down (%s), not resuming the %d sessions told to reconnect\n", marker.Generation, marker.Reason, len(marker.Sessions))
+		for _, id := range marker.Sessions {
+			state.Tombstones = append(state.Tombstones, Tombstone{ID: id, Time: marker.Time, Reason: "told to reconnect by a forced shutdown", Acknowledged: true})
+		}
+	}
+
+	if err = os.Remove(shutdownMarkerPath()); err != nil {
+		logf("Warning: failed to remove the shutdown marker: %v\n", err)
+	}
+	return state
+}
@@ -0,0 +1,49 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// handleEncodings serves /encodings?room=, the simulcast encodings the
+// broadcaster of the room is to configure on its video transceivers. They
+// come from the policy of the room, so what the client sends always matches
+// what the server relays. An empty list means a single encoding.
+func handleEncodings(w http.ResponseWriter, r *http.Request) {
+	room := findRoom(r.URL.Query().Get("room"))
+	if room == nil {
+		http.Error(w, errRoomNotFound.Error(), http.StatusNotFound)
+		return
+	} else if _, err := authorizeJoin(r, room.id, true); err != nil {
+		authError(w, err)
+		return
+	}
+
+	encodings := room.policy.Simulcast
+	if encodings == nil || room.policy.AudioOnly {
+		encodings = []SimulcastEncoding{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(encodings)
+}
+
+// drainLayer reads a simulcast layer of the broadcaster that isn't relayed,
+// so the interceptors still see its packets and report on them.
+func drainLayer(room *room, track *webrtc.TrackRemote) {
+	for {
+		if _, _, err := track.ReadRTP(); errors.Is(err, io.EOF) {
+			return
+		} else if err != nil {
+			logf("Failed to read simulcast layer %s of track %s: %v\n", track.RID(), track.ID(), err)
+			return
+		}
+		markBroadcasterAlive(room)
+	}
+}
@@ -0,0 +1,243 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"sort"
+)
+
+// snapshotChecksumPrefix starts the line appended to every snapshot written,
+// with the SHA-256 of what precedes it in hex. It is text so a JSON snapshot
+// stays readable, gob ignores it.
+const snapshotChecksumPrefix = "\n#zdr-sha256 "
+
+const snapshotChecksumLength = len(snapshotChecksumPrefix) + 2*sha256.Size + 1
+
+const (
+	snapshotEncodingGob      = "gob"
+	snapshotEncodingProtobuf = "protobuf"
+	snapshotEncodingJSON     = "json"
+)
+
+var (
+	snapshotDecodeFailures = newCounter("snapshot_decode_failures_total", "Snapshots that could not be decoded at startup.")
+	snapshotFallbacks      = newCounter("snapshot_fallbacks_total", "Startups that resumed from an older snapshot generation.")
+	snapshotChecksumFails  = newCounter("snapshot_checksum_failures_total", "Snapshots that didn't match their checksum when read.")
+)
+
+// writeSnapshot stores data as the newest snapshot of partition, with its
+// checksum and encrypted with -snapshot-key if set.
+func writeSnapshot(ctx context.Context, partition string, data []byte) error {
+	if store, ok := stateStore.(sessionStore); ok {
+		return writeSessions(ctx, store, partition, data)
+	}
+	sealed, err := sealSnapshot(appendChecksum(data))
+	if err != nil {
+		return err
+	}
+	return stateStore.Save(ctx, partition, sealed)
+}
+
+// writeSessions saves data to a store keeping every session on its own: the
+// snapshot without its sessions, and each session as a snapshot holding only
+// it, checksummed and sealed alike. data comes encoded whole, as the
+// write-behind cache holds it, so it is decoded to be split.
+func writeSessions(ctx context.Context, store sessionStore, partition string, data []byte) error {
+	state := GlobalState{}
+	if err := unmarshalSnapshot(data, &state); err != nil {
+		return err
+	}
+
+	sessions := make(map[string][]byte, len(state.PeerConnectionState))
+	for _, session := range state.PeerConnectionState {
+		encoded, err := encodeSnapshot(GlobalState{
+			Version:             state.Version,
+			Generation:          state.Generation,
+			SavedAt:             state.SavedAt,
+			PeerConnectionState: []PeerConnectionState{session},
+		})
+		if err != nil {
+			return err
+		} else if sessions[session.ID], err = sealSnapshot(appendChecksum(encoded)); err != nil {
+			return err
+		}
+	}
+
+	state.PeerConnectionState = nil
+	encoded, err := encodeSnapshot(state)
+	if err != nil {
+		return err
+	}
+	sealed, err := sealSnapshot(appendChecksum(encoded))
+	if err != nil {
+		return err
+	}
+	return store.SaveSessions(ctx, partition, sealed, sessions)
+}
+
+// loadSessions returns the sessions saved along with generation n of
+// partition in store. A session that can't be decoded is skipped, costing
+// only that session.
+func loadSessions(ctx context.Context, store sessionStore, partition string, n int) ([]PeerConnectionState, error) {
+	saved, err := store.LoadSessions(ctx, partition, n)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(saved))
+	for id := range saved {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	sessions := []PeerConnectionState{}
+	for _, id := range ids {
+		state, err := decodeSnapshot(saved[id])
+		if err == nil && len(state.PeerConnectionState) != 1 {
+			err = fmt.Errorf("holds %d sessions", len(state.PeerConnectionState))
+		}
+		if err != nil {
+			logf("Warning: skipping session %s of snapshot %s: %v\n", id, snapshotName(partition, n), err)
+			snapshotDecodeFailures.Inc()
+			continue
+		}
+		sessions = append(sessions, state.PeerConnectionState[0])
+	}
+	return sessions, nil
+}
+
+// loadSnapshot returns the main snapshot merged with that of every tenant,
+// and the name of the main one, empty if there is none. A tenant whose
+// snapshot can't be read starts without rooms and sessions, the others are
+// restored all the same.
+func loadSnapshot(ctx context.Context) (GlobalState, string) {
+	state, source := loadPartition(ctx, "")
+	for id := range tenants {
+		partition, _ := loadPartition(ctx, id)
+		mergePartition(&state, partition)
+	}
+	return state, source
+}
+
+// loadPartition returns the newest generation of partition that decodes and
+// its name. If none do it starts without any sessions.
+func loadPartition(ctx context.Context, partition string) (GlobalState, string) {
+	for n := 0; n < config.SnapshotGenerations; n++ {
+		buffer, err := stateStore.Load(ctx, partition, n)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			logf("Warning: failed to read snapshot %s: %v\n", snapshotName(partition, n), err)
+			continue
+		}
+
+		state, err := decodeSnapshot(buffer)
+		if err != nil {
+			logf("Warning: skipping snapshot %s: %v\n", snapshotName(partition, n), err)
+			snapshotDecodeFailures.Inc()
+			continue
+		}
+		if store, ok := stateStore.(sessionStore); ok {
+			if state.PeerConnectionState, err = loadSessions(ctx, store, partition, n); err != nil {
+				logf("Warning: failed to read the sessions of snapshot %s: %v\n", snapshotName(partition, n), err)
+				continue
+			}
+		}
+
+		if n != 0 {
+			logf("Warning: resuming from older snapshot %s\n", snapshotName(partition, n))
+			snapshotFallbacks.Inc()
+		}
+		return state, "snapshot " + snapshotName(partition, n)
+	}
+	return GlobalState{}, ""
+}
+
+// encodeSnapshot encodes state with -snapshot-encoding.
+func encodeSnapshot(state GlobalState) ([]byte, error) {
+	switch config.SnapshotEncoding {
+	case snapshotEncodingProtobuf:
+		data, err := marshalProto(state)
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte(snapshotProtoMagic), data...), nil
+	case snapshotEncodingJSON:
+		return marshalSnapshotJSON(state)
+	}
+
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(state); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// unmarshalSnapshot decodes buffer into v, whichever encoding it was written
+// with, so changing -snapshot-encoding doesn't lose the sessions saved before.
+func unmarshalSnapshot(buffer []byte, v any) error {
+	if bytes.HasPrefix(buffer, []byte(snapshotProtoMagic)) {
+		return unmarshalProto(buffer[len(snapshotProtoMagic):], v)
+	} else if trimmed := bytes.TrimSpace(buffer); bytes.HasPrefix(trimmed, []byte("{")) && json.Valid(trimmed) {
+		// A gob stream may start with a '{' as well, but never is valid JSON.
+		return unmarshalSnapshotJSON(trimmed, v)
+	}
+	return gob.NewDecoder(bytes.NewReader(buffer)).Decode(v)
+}
+
+// appendChecksum appends the checksum line of data to it.
+func appendChecksum(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	out := make([]byte, 0, len(data)+snapshotChecksumLength)
+	out = append(append(out, data...), snapshotChecksumPrefix...)
+	return append(append(out, hex.EncodeToString(sum[:])...), '\n')
+}
+
+// verifyChecksum checks the checksum line of buffer and returns buffer
+// without it. Snapshots written before checksums were are returned as they
+// are, and left to fail decoding if they are corrupted, unless they end with
+// what is left of a checksum line cut short.
+func verifyChecksum(buffer []byte) ([]byte, error) {
+	tail := buffer[max(len(buffer)-snapshotChecksumLength, 0):]
+	if len(tail) < snapshotChecksumLength || !bytes.HasPrefix(tail, []byte(snapshotChecksumPrefix)) || tail[len(tail)-1] != '\n' {
+		if bytes.Contains(tail, []byte(snapshotChecksumPrefix)) {
+			snapshotChecksumFails.Inc()
+			return nil, fmt.Errorf("%w: truncated", ErrSnapshotChecksum)
+		}
+		return buffer, nil
+	}
+	data, line := buffer[:len(buffer)-snapshotChecksumLength], tail
+
+	sum := sha256.Sum256(data)
+	expected, actual := string(line[len(snapshotChecksumPrefix):len(line)-1]), hex.EncodeToString(sum[:])
+	if expected != actual {
+		snapshotChecksumFails.Inc()
+		return nil, fmt.Errorf("%w: expected %.12s, got %.12s", ErrSnapshotChecksum, expected, actual)
+	}
+	return data, nil
+}
+
+// withContext runs fn but stops waiting for it once ctx is done. fn is left to
+// finish in the background since file operations can't be interrupted.
+func withContext(ctx context.Context, fn func() error) error {
+	errs := make(chan error, 1)
+	go func() {
+		errs <- fn()
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,239 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/dtls/v2"
+	"github.com/pion/dtls/v2/pkg/crypto/selfsign"
+	"github.com/pion/webrtc/v3"
+)
+
+// dtlsStateFixture returns the state of the client end of a real DTLS
+// handshake, which is what snapshots carry. A zero dtls.State can't even be
+// encoded.
+func dtlsStateFixture(t *testing.T) dtls.State {
+	t.Helper()
+
+	certificate, err := selfsign.GenerateSelfSigned()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &dtls.Config{
+		Certificates:           []tls.Certificate{certificate},
+		InsecureSkipVerify:     true, //nolint:gosec
+		SRTPProtectionProfiles: []dtls.SRTPProtectionProfile{dtls.SRTP_AES128_CM_HMAC_SHA1_80},
+	}
+
+	clientConn, serverConn := net.Pipe()
+	t.Cleanup(func() { clientConn.Close(); serverConn.Close() })
+	servers := make(chan error, 1)
+	go func() {
+		server, err := dtls.Server(serverConn, config)
+		if err == nil {
+			t.Cleanup(func() { server.Close() })
+		}
+		servers <- err
+	}()
+	client, err := dtls.Client(clientConn, config)
+	if err != nil {
+		t.Fatal(err)
+	} else if err = <-servers; err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client.ConnectionState()
+}
+
+// snapshotFixture returns a snapshot of a broadcaster, with most fields set
+// to something else than their zero value.
+func snapshotFixture(t *testing.T) GlobalState {
+	t.Helper()
+
+	return GlobalState{
+		Version:    snapshotVersion,
+		Generation: 7,
+		SavedAt:    time.Date(2024, 5, 6, 7, 8, 9, 10, time.UTC),
+		PeerConnectionState: []PeerConnectionState{{
+			ID:                  "0123456789abcdef",
+			Room:                defaultRoomID,
+			RemoteDescription:   webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: "v=0\r\no=- 1 2 IN IP4 127.0.0.1\r\n"},
+			ICEPort:             50000,
+			ICEUsernameFragment: "ufrag",
+			ICEPassword:         "password",
+			DTLSConnectionState: dtlsStateFixture(t),
+			SSRCAudio:           1111,
+			SSRCVideo:           2222,
+			SRTPState:           map[uint32]uint32{1111: 1, 2222: 3},
+			VideoCodec:          webrtc.MimeTypeVP8,
+			Principal:           Principal{Subject: "alice", Roles: []string{"broadcaster"}},
+			MaxBitrate:          1500000,
+			Unsubscribed:        []string{"audio"},
+			DroppedPackets:      map[uint32]uint16{2222: 4},
+			Bandwidth:           &BandwidthState{Estimate: 1000000, RTT: 20 * time.Millisecond},
+			KV:                  map[string]string{"seat": "12"},
+			BytesSent:           1 << 40,
+			BytesReceived:       12345,
+			TWCCSequence:        65535,
+			History:             []HistoryEntry{{Time: time.Date(2024, 5, 6, 7, 0, 0, 0, time.UTC), Kind: historyRestore, Message: "resumed"}},
+		}},
+		Rooms:               []RoomState{{ID: defaultRoomID, Policy: "default", Muted: []string{"video"}}},
+		SSRCs:               map[uint32]string{1111: "0123456789abcdef"},
+		ClosedBytesSent:     99,
+		ClosedBytesReceived: 98,
+	}
+}
+
+// assertSnapshotsEqual fails t unless got is want. Times are compared with
+// Equal and DTLS states by what they encode to, neither keeps what they
+// are compared by otherwise.
+func assertSnapshotsEqual(t *testing.T, got, want GlobalState) {
+	t.Helper()
+
+	if !got.SavedAt.Equal(want.SavedAt) {
+		t.Fatalf("SavedAt is %v, want %v", got.SavedAt, want.SavedAt)
+	} else if len(got.PeerConnectionState) != len(want.PeerConnectionState) {
+		t.Fatalf("got %d sessions, want %d", len(got.PeerConnectionState), len(want.PeerConnectionState))
+	}
+	got.SavedAt, want.SavedAt = time.Time{}, time.Time{}
+	got.PeerConnectionState = append([]PeerConnectionState(nil), got.PeerConnectionState...)
+	want.PeerConnectionState = append([]PeerConnectionState(nil), want.PeerConnectionState...)
+	for i := range want.PeerConnectionState {
+		gotState, wantState := &got.PeerConnectionState[i], &want.PeerConnectionState[i]
+		gotDTLS, err := gotState.DTLSConnectionState.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantDTLS, err := wantState.DTLSConnectionState.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(gotDTLS, wantDTLS) {
+			t.Fatalf("session %s: DTLS state changed", wantState.ID)
+		}
+		gotState.DTLSConnectionState, wantState.DTLSConnectionState = dtls.State{}, dtls.State{}
+
+		gotHistory, wantHistory := append([]HistoryEntry(nil), gotState.History...), append([]HistoryEntry(nil), wantState.History...)
+		for j := range wantHistory {
+			if j < len(gotHistory) && gotHistory[j].Time.Equal(wantHistory[j].Time) {
+				gotHistory[j].Time = wantHistory[j].Time
+			}
+		}
+		gotState.History, wantState.History = gotHistory, wantHistory
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v\nwant %+v", got, want)
+	}
+}
+
+// TestSnapshotEncodings writes the fixture with every encoding and checks it
+// is read back as it was, and that corrupted or truncated snapshots are
+// refused rather than resumed half way.
+func TestSnapshotEncodings(t *testing.T) {
+	want := snapshotFixture(t)
+	encoding := config.SnapshotEncoding
+	t.Cleanup(func() { config.SnapshotEncoding = encoding })
+
+	for _, name := range []string{snapshotEncodingGob, snapshotEncodingProtobuf, snapshotEncodingJSON} {
+		t.Run(name, func(t *testing.T) {
+			config.SnapshotEncoding = name
+			data, err := encodeSnapshot(want)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := GlobalState{}
+			if err = unmarshalSnapshot(data, &got); err != nil {
+				t.Fatal(err)
+			}
+			assertSnapshotsEqual(t, got, want)
+
+			decoded, err := decodeSnapshot(appendChecksum(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertSnapshotsEqual(t, decoded, want)
+
+			for _, tc := range []struct {
+				name string
+				data []byte
+			}{
+				{"truncated", appendChecksum(data)[:len(data)/2]},
+				{"truncated checksum", appendChecksum(data)[:len(data)+snapshotChecksumLength-1]},
+				{"flipped byte", flipByte(appendChecksum(data), len(data)/2)},
+				{"flipped checksum", flipByte(appendChecksum(data), len(data)+len(snapshotChecksumPrefix))},
+			} {
+				if _, err := decodeSnapshot(tc.data); err == nil {
+					t.Fatalf("%s snapshot decoded", tc.name)
+				}
+			}
+		})
+	}
+}
+
+// flipByte returns a copy of data with the byte at i changed.
+func flipByte(data []byte, i int) []byte {
+	out := append([]byte(nil), data...)
+	out[i] ^= 0xff
+	return out
+}
+
+// TestChecksum checks the checksum line is stripped from what it matches,
+// and refused otherwise.
+func TestChecksum(t *testing.T) {
+	data := []byte("some snapshot")
+	withChecksum := appendChecksum(data)
+	if len(withChecksum) != len(data)+snapshotChecksumLength {
+		t.Fatalf("checksum line is %d bytes, want %d", len(withChecksum)-len(data), snapshotChecksumLength)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		buffer []byte
+		want   []byte
+		err    error
+	}{
+		{"matching", withChecksum, data, nil},
+		{"empty", appendChecksum(nil), []byte{}, nil},
+		{"without checksum", data, data, nil},
+		{"shorter than a checksum", []byte("gob"), []byte("gob"), nil},
+		{"data changed", flipByte(withChecksum, 0), nil, ErrSnapshotChecksum},
+		{"checksum changed", flipByte(withChecksum, len(data)+len(snapshotChecksumPrefix)+1), nil, ErrSnapshotChecksum},
+		{"checksum cut short", withChecksum[:len(withChecksum)-10], nil, ErrSnapshotChecksum},
+		{"newline cut", withChecksum[:len(withChecksum)-1], nil, ErrSnapshotChecksum},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := verifyChecksum(tc.buffer)
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("got error %v, want %v", err, tc.err)
+			} else if tc.err == nil && !bytes.Equal(got, tc.want) {
+				t.Fatalf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+// TestDeserializeKeepsError checks the restore report holds why a session
+// failed to resume, not only its message.
+func TestDeserializeKeepsError(t *testing.T) {
+	state := snapshotFixture(t)
+	state.PeerConnectionState[0].RemoteDescription.SDP = "v=0\r\no=- 1 2 IN IP4 127.0.0.1\r\ns=-\r\nt=0 0\r\n" +
+		"a=fingerprint:sha-256 " + strings.Repeat("00:", 31) + "00\r\n"
+
+	report := deserialize(context.Background(), state, "the fixture")
+	if len(report.Sessions) != 1 {
+		t.Fatalf("got %d sessions, want 1", len(report.Sessions))
+	}
+	if result := report.Sessions[0]; !errors.Is(result.Err, ErrDTLSStateMismatch) || result.Error != result.Err.Error() {
+		t.Fatalf("got %v (%q), want ErrDTLSStateMismatch", result.Err, result.Error)
+	}
+}
@@ -0,0 +1,121 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// snapshotStatsDelta is how many bytes a session relays in either direction
+// between snapshots taken for its counters, which carry the SRTCP indexes
+// along with them.
+const snapshotStatsDelta = 1 << 20
+
+var (
+	snapshotTriggers  = newCounter("snapshot_triggers_total", "Changes that asked the snapshotter for a snapshot, before debouncing.")
+	triggeredSnapshot = newCounter("snapshots_triggered_total", "Snapshots the snapshotter took after a change, one per debounce window.")
+
+	snapshotter = &Snapshotter{}
+)
+
+// Snapshotter saves every session shortly after something a restore depends
+// on changed, rather than waiting for the next Config.SnapshotInterval:
+// packets moving the SRTP rollover counter of a stream on, a new track, or a
+// session relaying another snapshotStatsDelta bytes. Changes within
+// Config.SnapshotDebounce of the first one are saved together, so a burst of
+// them costs one snapshot. Changes saved on the spot, like a new session or
+// an admin request, don't go through it.
+type Snapshotter struct {
+	mu sync.Mutex
+
+	// ctx is that of Start, nil until the sessions of the last snapshot are
+	// resumed. Nothing is saved before, it would drop the ones still
+	// resuming.
+	ctx context.Context
+
+	// timer fires at the end of the current debounce window, nil outside of
+	// one. reason is what opened it.
+	timer  *time.Timer
+	reason string
+}
+
+// Snapshotter returns the snapshotter of the Server, for code embedding it
+// to ask for a snapshot after changes of its own.
+func (s *Server) Snapshotter() *Snapshotter {
+	return snapshotter
+}
+
+// Trigger asks for a snapshot within Config.SnapshotDebounce, reason naming
+// the change in logs if it fails. It never blocks, so it can be called from
+// the packet path.
+func (s *Snapshotter) Trigger(reason string) {
+	snapshotTriggers.Inc()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ctx == nil || s.timer != nil {
+		return
+	}
+	s.reason = reason
+	s.timer = time.AfterFunc(config.SnapshotDebounce, s.save)
+}
+
+// start lets triggers through once Start resumed the sessions.
+func (s *Snapshotter) start(ctx context.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ctx = ctx
+}
+
+// save takes the snapshot of the debounce window that just ended. Changes
+// from here on open a new window, so none is missed while it is written.
+func (s *Snapshotter) save() {
+	s.mu.Lock()
+	ctx, reason := s.ctx, s.reason
+	s.timer, s.reason = nil, ""
+	s.mu.Unlock()
+	if ctx.Err() != nil {
+		return
+	}
+
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	triggeredSnapshot.Inc()
+	if err := serialize(ctx); err != nil {
+		logf("Failed to serialize after %s: %v\n", reason, err)
+	}
+}
+
+// rolloverWatch spots the sequence numbers of an RTP stream wrapping around,
+// which moves its SRTP rollover counter on. A snapshot missing it leaves the
+// restored stream unable to encrypt or authenticate until the SRTP
+// quarantine finds the counter again.
+type rolloverWatch struct {
+	// last is the last sequence number seen with bit 16 set, 0 before the
+	// first one.
+	last atomic.Uint32
+}
+
+// wrapped reports whether sequence number seq wrapped around from the one
+// before it. Packets reordered across the wrap are taken as wrapping again,
+// costing a spare snapshot at worst.
+func (w *rolloverWatch) wrapped(seq uint16) bool {
+	previous := w.last.Swap(uint32(seq) | 1<<16)
+	return previous != 0 && seq < uint16(previous) && uint16(previous)-seq > 0x8000
+}
+
+// addRelayed adds n bytes to counter, asking for a snapshot each time it
+// crosses another snapshotStatsDelta.
+func addRelayed(counter *atomic.Uint64, n int) {
+	if n <= 0 {
+		return
+	}
+	total := counter.Add(uint64(n))
+	if (total-uint64(n))/snapshotStatsDelta != total/snapshotStatsDelta {
+		snapshotter.Trigger("relaying another MiB")
+	}
+}
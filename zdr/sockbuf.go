@@ -0,0 +1,223 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/pion/transport/v2"
+	"github.com/pion/transport/v2/stdnet"
+)
+
+var socketBufferErrors = newCounter("socket_buffer_errors_total", "UDP sockets whose buffers couldn't be resized.")
+
+// SocketBuffers are the sizes in bytes of the receive and send buffers of
+// the UDP sockets of a session, 0 leaves them to -udp-read-buffer and
+// -udp-write-buffer. The kernel may cap them, like Linux at
+// net.core.rmem_max and net.core.wmem_max.
+type SocketBuffers struct {
+	Read  int `json:",omitempty"`
+	Write int `json:",omitempty"`
+}
+
+// socketBuffers sizes the buffers of the sockets of a session. They are
+// saved with the session, so the sockets a restore binds again come up
+// tuned as they were rather than with the kernel defaults.
+type socketBuffers struct {
+	mu  sync.Mutex
+	own SocketBuffers
+
+	// conns are the sockets of the session, sized again when own changes.
+	conns []*net.UDPConn
+}
+
+// settings returns the sizes applied, those of the session or the
+// configured ones. b.mu must be held.
+func (b *socketBuffers) settings() SocketBuffers {
+	settings := b.own
+	if settings.Read == 0 {
+		settings.Read = config.UDPReadBuffer
+	}
+	if settings.Write == 0 {
+		settings.Write = config.UDPWriteBuffer
+	}
+	return settings
+}
+
+// persisted returns the sizes of the session to save.
+func (b *socketBuffers) persisted() SocketBuffers {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.own
+}
+
+func (b *socketBuffers) restore(state SocketBuffers) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.own = state
+}
+
+// set changes the sizes of the session and applies them to its sockets,
+// dropping those that were closed since.
+func (b *socketBuffers) set(own SocketBuffers) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.own = own
+
+	open := b.conns[:0]
+	for _, conn := range b.conns {
+		if b.apply(conn) {
+			open = append(open, conn)
+		}
+	}
+	b.conns = open
+}
+
+// apply sizes the buffers of conn, reporting whether it is still open.
+// b.mu must be held.
+func (b *socketBuffers) apply(conn *net.UDPConn) bool {
+	settings := b.settings()
+	for _, resize := range []struct {
+		size int
+		set  func(int) error
+	}{{settings.Read, conn.SetReadBuffer}, {settings.Write, conn.SetWriteBuffer}} {
+		if resize.size == 0 {
+			continue
+		}
+		if err := resize.set(resize.size); errors.Is(err, net.ErrClosed) {
+			return false
+		} else if err != nil {
+			logf("Failed to resize the buffers of %s: %v\n", conn.LocalAddr(), err)
+			socketBufferErrors.Inc()
+		}
+	}
+	return true
+}
+
+// add sizes the buffers of conn, a new socket of the session, and keeps it
+// to size again.
+func (b *socketBuffers) add(conn *net.UDPConn) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.apply(conn) {
+		b.conns = append(b.conns, conn)
+	}
+}
+
+// newSessionNet returns the network pion/ice binds the sockets of session
+// through, sized by its socketBuffers.
+func newSessionNet(session *session) (transport.Net, error) {
+	base, err := stdnet.NewNet()
+	if err != nil {
+		return nil, err
+	}
+	return &bufferNet{Net: base, buffers: &session.buffers}, nil
+}
+
+// open returns the sockets of the session that are still open.
+func (b *socketBuffers) open() []*net.UDPConn {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var open []*net.UDPConn
+	for _, conn := range b.conns {
+		if isOpen(conn) {
+			open = append(open, conn)
+		}
+	}
+	return open
+}
+
+// bufferNet hands pion/ice sockets with their buffers sized. Sockets a hot
+// restart handed over or systemd passed are taken over rather than bound
+// again, the others are bound with SO_REUSEPORT with -reuseport-drain.
+type bufferNet struct {
+	transport.Net
+	buffers *socketBuffers
+}
+
+func (n *bufferNet) ListenUDP(network string, addr *net.UDPAddr) (transport.UDPConn, error) {
+	if conn := takeInheritedConn(addr); conn != nil {
+		handActivated(conn)
+		n.buffers.add(conn)
+		return conn, nil
+	} else if conn, err := activatedConn(addr); err != nil {
+		return nil, err
+	} else if conn != nil {
+		n.buffers.add(conn)
+		return conn, nil
+	} else if config.ReusePortDrain > 0 {
+		conn, err := reusePort.listen(network, addr)
+		if err != nil {
+			return nil, err
+		}
+		n.buffers.add(conn)
+		return conn, nil
+	}
+	conn, err := n.Net.ListenUDP(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if udp, ok := conn.(*net.UDPConn); ok {
+		n.buffers.add(udp)
+	}
+	return conn, nil
+}
+
+func (n *bufferNet) ListenPacket(network, address string) (net.PacketConn, error) {
+	conn, err := n.Net.ListenPacket(network, address)
+	if err != nil {
+		return nil, err
+	}
+	if udp, ok := conn.(*net.UDPConn); ok {
+		n.buffers.add(udp)
+	}
+	return conn, nil
+}
+
+// handleAdminSocketBuffers serves /admin/sessions/{id}/buffers, returning
+// the sizes of the session and those applied on GET. PUT or POST with a body
+// like {"Read": 4194304} resizes the buffers of its sockets, 0 goes back to
+// the configured size. Without one either, sockets keep the size they have.
+func handleAdminSocketBuffers(w http.ResponseWriter, r *http.Request, session *session) {
+	switch r.Method {
+	case http.MethodGet:
+		session.buffers.mu.Lock()
+		own, applied := session.buffers.own, session.buffers.settings()
+		session.buffers.mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			SocketBuffers
+			Applied SocketBuffers
+		}{own, applied})
+	case http.MethodPut, http.MethodPost:
+		var in SocketBuffers
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if in.Read < 0 || in.Write < 0 {
+			http.Error(w, "buffer sizes can't be negative", http.StatusBadRequest)
+			return
+		}
+
+		session.buffers.set(in)
+		recordHistory(session, historyControl, "socket buffers set to %d bytes to read and %d to write", in.Read, in.Write)
+		sessionsMutex.Lock()
+		err := serialize(r.Context())
+		sessionsMutex.Unlock()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,85 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+
+	"github.com/pion/webrtc/v3"
+)
+
+var (
+	errSSRCsExhausted = errors.New("no free SSRC")
+
+	// ssrcs maps every SSRC we send with to the session that owns it. It is
+	// saved in the snapshot and provisioned before sessions are resumed, so
+	// a new session can never be handed the SSRC of a restored one.
+	ssrcs      = map[webrtc.SSRC]string{}
+	ssrcsMutex sync.Mutex
+)
+
+// allocateSSRC returns a free SSRC for a track of the session called id.
+func allocateSSRC(id string) (webrtc.SSRC, error) {
+	ssrcsMutex.Lock()
+	defer ssrcsMutex.Unlock()
+
+	for attempt := 0; attempt < 64; attempt++ {
+		ssrc := webrtc.SSRC(rand.Uint32()) //nolint:gosec
+		if _, taken := ssrcs[ssrc]; ssrc != 0 && !taken {
+			ssrcs[ssrc] = id
+			return ssrc, nil
+		}
+	}
+	return 0, errSSRCsExhausted
+}
+
+// reserveSSRCs records SSRCs a resumed session keeps using. Zero, the SSRC
+// of a track that wasn't there, is skipped.
+func reserveSSRCs(id string, list ...webrtc.SSRC) {
+	ssrcsMutex.Lock()
+	defer ssrcsMutex.Unlock()
+
+	for _, ssrc := range list {
+		if ssrc != 0 {
+			ssrcs[ssrc] = id
+		}
+	}
+}
+
+// releaseSSRCs frees the SSRCs of the session called id once it is gone.
+func releaseSSRCs(id string) {
+	ssrcsMutex.Lock()
+	defer ssrcsMutex.Unlock()
+
+	for ssrc, owner := range ssrcs {
+		if owner == id {
+			delete(ssrcs, ssrc)
+		}
+	}
+}
+
+// snapshotSSRCs returns the allocation table for the snapshot.
+func snapshotSSRCs() map[uint32]string {
+	ssrcsMutex.Lock()
+	defer ssrcsMutex.Unlock()
+
+	out := map[uint32]string{}
+	for ssrc, id := range ssrcs {
+		out[uint32(ssrc)] = id
+	}
+	return out
+}
+
+// restoreSSRCs provisions the allocation table of a snapshot, along with the
+// SSRCs of its sessions for snapshots that predate the table.
+func restoreSSRCs(state GlobalState) {
+	for ssrc, id := range state.SSRCs {
+		reserveSSRCs(id, webrtc.SSRC(ssrc))
+	}
+	for _, sessionState := range state.PeerConnectionState {
+		reserveSSRCs(sessionState.ID, sessionState.SSRCAudio, sessionState.SSRCVideo)
+	}
+}
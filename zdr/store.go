@@ -0,0 +1,242 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fileWatchInterval is how often the file store looks for a new snapshot
+// saved by another process.
+const fileWatchInterval = 250 * time.Millisecond
+
+var (
+	errInvalidStateStore = errors.New("invalid snapshot store")
+
+	// stateStore keeps the snapshots, the files of -snapshot unless
+	// Server.SetStateStore was called.
+	stateStore StateStore = &fileStore{}
+
+	snapshotWaits = newCounter("snapshot_waits_total", "Startups that waited for the previous process to save its final snapshot, by -snapshot-wait.")
+)
+
+// StateStore keeps the snapshots of the Server. Each partition, "" for the
+// main snapshot and the ID of a tenant for that of the tenant, is saved and
+// loaded on its own.
+type StateStore interface {
+	// Save stores data as the newest snapshot of partition. Stores that
+	// keep older generations, up to Config.SnapshotGenerations, shift them
+	// back by one.
+	Save(ctx context.Context, partition string, data []byte) error
+
+	// Load returns generation n of partition, 0 being the newest. A
+	// generation that doesn't exist is reported with an error wrapping
+	// fs.ErrNotExist.
+	Load(ctx context.Context, partition string, n int) ([]byte, error)
+
+	// Watch returns a channel receiving whenever a snapshot of partition is
+	// saved, by this process or another one sharing the store. It is closed
+	// once ctx is done.
+	Watch(ctx context.Context, partition string) (<-chan struct{}, error)
+}
+
+// sessionStore is a StateStore keeping every session under a key of its own,
+// with a TTL of its own. Save and Load then carry the snapshot without its
+// sessions.
+type sessionStore interface {
+	StateStore
+
+	// SaveSessions stores data like Save, and sessions by ID along with it,
+	// in one atomic write.
+	SaveSessions(ctx context.Context, partition string, data []byte, sessions map[string][]byte) error
+
+	// LoadSessions returns the sessions saved along with generation n of
+	// partition, by ID, as they were saved last. Those that expired since
+	// are left out.
+	LoadSessions(ctx context.Context, partition string, n int) (map[string][]byte, error)
+}
+
+// SetStateStore makes the Server save its snapshots to store, in place of
+// the files of -snapshot. It must be called before Start.
+func (s *Server) SetStateStore(store StateStore) {
+	stateStore = store
+}
+
+// parseStateStore returns the store of -snapshot-store, nil for the files of
+// -snapshot if it is empty.
+func parseStateStore(spec string) (StateStore, error) {
+	switch {
+	case spec == "":
+		return nil, nil
+	case strings.HasPrefix(spec, "redis://"), strings.HasPrefix(spec, "rediss://"):
+		return newRedisStore(spec)
+	case strings.HasPrefix(spec, "etcd://"), strings.HasPrefix(spec, "etcds://"):
+		return newEtcdStore(spec)
+	case strings.HasPrefix(spec, "s3://"), strings.HasPrefix(spec, "gs://"):
+		return newObjectStore(spec)
+	}
+	return nil, fmt.Errorf("%w: %q", errInvalidStateStore, spec)
+}
+
+// snapshotName names generation n of partition in logs.
+func snapshotName(partition string, n int) string {
+	if _, ok := stateStore.(*fileStore); ok {
+		return fmt.Sprintf("'%s'", generationPath(partition, n))
+	} else if partition == "" {
+		return fmt.Sprintf("generation %d", n)
+	}
+	return fmt.Sprintf("generation %d of tenant %s", n, partition)
+}
+
+// waitForSnapshot waits up to -snapshot-wait for the main snapshot to be one
+// saved by a process handing off, for deploys that start the new process
+// before stopping the old one. The new one then resumes every session as it
+// was left rather than as of the last checkpoint.
+func waitForSnapshot(ctx context.Context) {
+	if config.SnapshotWait <= 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, config.SnapshotWait)
+	defer cancel()
+	saved, err := stateStore.Watch(ctx, "")
+	if err != nil {
+		logf("Warning: not waiting for the final snapshot: %v\n", err)
+		return
+	}
+
+	snapshotWaits.Inc()
+	logf("Waiting up to %s for the previous process to save its final snapshot\n", config.SnapshotWait)
+	for {
+		if buffer, err := stateStore.Load(ctx, "", 0); err == nil {
+			if state, err := decodeSnapshot(buffer); err == nil && state.HandedOff {
+				logf("Generation %d saved its final snapshot\n", state.Generation)
+				return
+			}
+		}
+		if _, ok := <-saved; !ok {
+			logf("Warning: no final snapshot saved within %s, resuming from the last one\n", config.SnapshotWait)
+			return
+		}
+	}
+}
+
+// fileStore is the StateStore of -snapshot. Generation n of a partition is
+// its file with a .n suffix.
+type fileStore struct {
+	// mu is held by whoever is touching the snapshot files. A write that
+	// timed out keeps running in the background, so the next one has to
+	// wait for it instead of racing it through the renames.
+	mu sync.Mutex
+}
+
+// generationPath returns where generation n of partition is stored, 0 being
+// the newest. partition is a tenant, or "" for the main snapshot.
+func generationPath(partition string, n int) string {
+	path := config.SnapshotPath
+	if partition != "" {
+		path = fmt.Sprintf("%s.tenant-%s", path, partition)
+	}
+	if n == 0 {
+		return path
+	}
+	return fmt.Sprintf("%s.%d", path, n)
+}
+
+// Save shifts every generation of partition back by one and writes data as
+// the newest, dropping whatever falls off the end. data is written to a
+// temporary file and synced before it is renamed into place, so a crash
+// leaves either the previous snapshot or the new one, never a truncated one.
+func (f *fileStore) Save(ctx context.Context, partition string, data []byte) error {
+	return withContext(ctx, func() error {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		path := generationPath(partition, 0)
+		tmpPath := path + ".tmp"
+		if err := writeSynced(tmpPath, data, 0644); err != nil {
+			return err
+		}
+		for n := config.SnapshotGenerations - 1; n > 0; n-- {
+			if err := os.Rename(generationPath(partition, n-1), generationPath(partition, n)); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+		if err := os.Rename(tmpPath, path); err != nil {
+			return err
+		}
+		return syncDir(filepath.Dir(path))
+	})
+}
+
+// writeSynced writes data to path and syncs it to disk before returning.
+func writeSynced(path string, data []byte, perm os.FileMode) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(data); err != nil {
+		file.Close()
+		return err
+	} else if err = file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func (f *fileStore) Load(ctx context.Context, partition string, n int) (buffer []byte, err error) {
+	err = withContext(ctx, func() (err error) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		buffer, err = os.ReadFile(generationPath(partition, n))
+		return err
+	})
+	return buffer, err
+}
+
+// Watch polls the newest generation of partition, files can't be waited on
+// portably.
+func (f *fileStore) Watch(ctx context.Context, partition string) (<-chan struct{}, error) {
+	var modified time.Time
+	var size int64
+	if info, err := os.Stat(generationPath(partition, 0)); err == nil {
+		modified, size = info.ModTime(), info.Size()
+	}
+
+	saved := make(chan struct{}, 1)
+	go func() {
+		defer close(saved)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(fileWatchInterval):
+			}
+
+			// The file is missing for a moment while a save shifts the
+			// generations.
+			info, err := os.Stat(generationPath(partition, 0))
+			if err != nil {
+				continue
+			}
+			if m, s := info.ModTime(), info.Size(); !m.Equal(modified) || s != size {
+				modified, size = m, s
+				select {
+				case saved <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+	return saved, nil
+}
@@ -0,0 +1,177 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestFileStoreFallback saves generations of the snapshot to files, breaks
+// the newest ones and checks loadSnapshot resumes from the newest one left
+// that decodes.
+func TestFileStoreFallback(t *testing.T) {
+	store, path, generations := stateStore, config.SnapshotPath, config.SnapshotGenerations
+	t.Cleanup(func() { stateStore, config.SnapshotPath, config.SnapshotGenerations = store, path, generations })
+	stateStore = &fileStore{}
+	config.SnapshotGenerations = 3
+
+	for _, tc := range []struct {
+		name       string
+		corrupt    func(t *testing.T)
+		generation uint64
+		source     string
+	}{
+		{"newest", func(*testing.T) {}, 3, ""},
+		{"corrupt newest", func(t *testing.T) { corruptFile(t, generationPath("", 0)) }, 2, ".1"},
+		{"missing newest", func(t *testing.T) { removeFile(t, generationPath("", 0)) }, 2, ".1"},
+		{"truncated newest", func(t *testing.T) { truncateFile(t, generationPath("", 0)) }, 2, ".1"},
+		{"two corrupt", func(t *testing.T) {
+			corruptFile(t, generationPath("", 0))
+			truncateFile(t, generationPath("", 1))
+		}, 1, ".2"},
+		{"all corrupt", func(t *testing.T) {
+			for n := 0; n < config.SnapshotGenerations; n++ {
+				corruptFile(t, generationPath("", n))
+			}
+		}, 0, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			config.SnapshotPath = filepath.Join(t.TempDir(), "peerConnections.gob")
+			for generation := uint64(1); generation <= 3; generation++ {
+				data, err := encodeSnapshot(GlobalState{Version: snapshotVersion, Generation: generation})
+				if err != nil {
+					t.Fatal(err)
+				} else if err = writeSnapshot(context.Background(), "", data); err != nil {
+					t.Fatal(err)
+				}
+			}
+			tc.corrupt(t)
+
+			fallbacks := snapshotFallbacks.value.Load()
+			state, source := loadSnapshot(context.Background())
+			if state.Generation != tc.generation {
+				t.Fatalf("resumed generation %d, want %d", state.Generation, tc.generation)
+			} else if tc.generation == 0 && source != "" {
+				t.Fatalf("got source %s without a snapshot", source)
+			} else if tc.generation != 0 && !strings.HasSuffix(source, generationPath("", 0)+tc.source+"'") {
+				t.Fatalf("got source %s", source)
+			}
+			if fell := snapshotFallbacks.value.Load() != fallbacks; fell != (tc.source != "") {
+				t.Fatalf("fallback counted: %v", fell)
+			}
+		})
+	}
+}
+
+func corruptFile(t *testing.T, path string) {
+	t.Helper()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	} else if err = os.WriteFile(path, flipByte(data, len(data)/2), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func truncateFile(t *testing.T, path string) {
+	t.Helper()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	} else if err = os.WriteFile(path, data[:len(data)/2], 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func removeFile(t *testing.T, path string) {
+	t.Helper()
+
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// memorySessionStore is a sessionStore keeping a single generation in memory.
+type memorySessionStore struct {
+	data     []byte
+	sessions map[string][]byte
+}
+
+func (m *memorySessionStore) Save(ctx context.Context, partition string, data []byte) error {
+	return m.SaveSessions(ctx, partition, data, nil)
+}
+
+func (m *memorySessionStore) SaveSessions(_ context.Context, _ string, data []byte, sessions map[string][]byte) error {
+	m.data, m.sessions = data, sessions
+	return nil
+}
+
+func (m *memorySessionStore) Load(_ context.Context, _ string, n int) ([]byte, error) {
+	if n != 0 || m.data == nil {
+		return nil, fs.ErrNotExist
+	}
+	return m.data, nil
+}
+
+func (m *memorySessionStore) LoadSessions(context.Context, string, int) (map[string][]byte, error) {
+	return m.sessions, nil
+}
+
+func (m *memorySessionStore) Watch(context.Context, string) (<-chan struct{}, error) {
+	return nil, nil
+}
+
+// TestSessionStore checks every session is saved on its own, readable alone,
+// and that one that can't be decoded only costs that session.
+func TestSessionStore(t *testing.T) {
+	store := stateStore
+	t.Cleanup(func() { stateStore = store })
+	memory := &memorySessionStore{}
+	stateStore = memory
+
+	want := snapshotFixture(t)
+	other := want.PeerConnectionState[0]
+	other.ID = "fedcba9876543210"
+	want.PeerConnectionState = append(want.PeerConnectionState, other)
+	data, err := encodeSnapshot(want)
+	if err != nil {
+		t.Fatal(err)
+	} else if err = writeSnapshot(context.Background(), "", data); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(memory.sessions) != 2 {
+		t.Fatalf("saved %d sessions", len(memory.sessions))
+	} else if index, err := decodeSnapshot(memory.data); err != nil {
+		t.Fatal(err)
+	} else if len(index.PeerConnectionState) != 0 {
+		t.Fatal("sessions saved with the snapshot")
+	}
+	for id, session := range memory.sessions {
+		if state, err := decodeSnapshot(session); err != nil {
+			t.Fatal(err)
+		} else if len(state.PeerConnectionState) != 1 || state.PeerConnectionState[0].ID != id {
+			t.Fatalf("session %s holds %+v", id, state.PeerConnectionState)
+		}
+	}
+
+	got, _ := loadSnapshot(context.Background())
+	assertSnapshotsEqual(t, got, want)
+
+	memory.sessions[other.ID] = flipByte(memory.sessions[other.ID], 0)
+	failures := snapshotDecodeFailures.value.Load()
+	got, _ = loadSnapshot(context.Background())
+	want.PeerConnectionState = want.PeerConnectionState[:1]
+	assertSnapshotsEqual(t, got, want)
+	if snapshotDecodeFailures.value.Load() != failures+1 {
+		t.Fatal("session that failed decoding not counted")
+	}
+}
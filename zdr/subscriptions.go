@@ -0,0 +1,339 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+// sessionCookie holds the ID of the last session /doSignaling created for a
+// client, so offers renegotiating it can be told apart from new sessions.
+const sessionCookie = "zdr-session"
+
+var trackKinds = []string{webrtc.RTPCodecTypeAudio.String(), webrtc.RTPCodecTypeVideo.String()}
+
+// handleSession serves /sessions/{id}/{resource}. These are used by the client
+// of a session, which proves who it is by knowing the session ID.
+func handleSession(w http.ResponseWriter, r *http.Request) {
+	id, resource, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/sessions/"), "/")
+	if resource == "rehandshake" {
+		handleRehandshake(w, r, id)
+		return
+	}
+
+	session := findSession(id)
+	if session == nil {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	} else if err := authorizeSession(r, session); err != nil {
+		authError(w, err)
+		return
+	}
+
+	switch resource {
+	case "subscriptions":
+		handleSubscriptions(w, r, session)
+	case "offer":
+		handleRenegotiation(w, r, session)
+	case "pause":
+		handlePause(w, r, session, true)
+	case "resume":
+		handlePause(w, r, session, false)
+	case "ack":
+		handleAck(w, r, session)
+	case "logs":
+		handleClientLogs(w, r, session)
+	case "metadata":
+		handleMetadata(w, r, session)
+	case "":
+		handleLeave(w, r, session)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// handleSubscriptions returns the broadcaster tracks a viewer receives on GET,
+// and changes them on POST with a body like {"Add": ["video"], "Remove": ["audio"]}.
+// The client is then asked over /events to renegotiate.
+func handleSubscriptions(w http.ResponseWriter, r *http.Request, session *session) {
+	if session.broadcaster {
+		http.Error(w, ErrNotViewer.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var in struct {
+			Add, Remove []string
+		}
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		err := changeSubscriptions(r.Context(), session, in.Add, in.Remove)
+		if errors.Is(err, ErrUnknownTrackKind) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(subscribedKinds(session))
+}
+
+// changeSubscriptions subscribes the viewer of session to the kinds of track
+// in add and unsubscribes it from those in remove, then asks its client to
+// renegotiate.
+func changeSubscriptions(ctx context.Context, session *session, add, remove []string) error {
+	if session.broadcaster {
+		return ErrNotViewer
+	}
+	for _, kind := range append(append([]string{}, add...), remove...) {
+		if !isTrackKind(kind) {
+			return fmt.Errorf("%w %q", ErrUnknownTrackKind, kind)
+		}
+	}
+
+	sessionsMutex.Lock()
+	for _, kind := range add {
+		delete(session.unsubscribed, kind)
+	}
+	for _, kind := range remove {
+		session.unsubscribed[kind] = true
+	}
+	err := serialize(ctx)
+	sessionsMutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	recordHistory(session, historyControl, "subscribed to %v", subscribedKinds(session))
+	publishEvent(session.id, event{Name: "renegotiate", Data: subscribedKinds(session)})
+	return nil
+}
+
+// handleRenegotiation applies a new offer from the client to its existing
+// PeerConnection and returns the answer.
+func handleRenegotiation(w http.ResponseWriter, r *http.Request, session *session) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var offer webrtc.SessionDescription
+	if err := json.NewDecoder(r.Body).Decode(&offer); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if answerRenegotiation(w, r, session, offer) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(localAnswer(session))
+	}
+}
+
+// handleSignalingRenegotiation is handleRenegotiation for offers sent to
+// /doSignaling, the answer is sent like that of a new session.
+func handleSignalingRenegotiation(w http.ResponseWriter, r *http.Request, session *session, offer webrtc.SessionDescription) {
+	if answerRenegotiation(w, r, session, offer) {
+		writeAnswer(w, session, localAnswer(session))
+	}
+}
+
+// answerRenegotiation renegotiates session with offer within
+// -signaling-timeout and reports whether it did. The error is sent to the
+// client otherwise.
+func answerRenegotiation(w http.ResponseWriter, r *http.Request, session *session, offer webrtc.SessionDescription) bool {
+	ctx, cancel := context.WithTimeout(r.Context(), config.SignalingTimeout)
+	defer cancel()
+
+	err := renegotiate(ctx, session, offer)
+	if errors.Is(err, errInvalidOffer) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	} else if err != nil {
+		logf("Failed to renegotiate PeerConnection %s: %v\n", session.id, err)
+		http.Error(w, "failed to renegotiate", http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+// renegotiatedSession returns the session offer renegotiates, if the request
+// names one with an X-Session-ID header or the cookie set by /doSignaling.
+// The offer must also come from the same PeerConnection, which keeps the
+// session ID of its SDP origin across renegotiations. Otherwise, like when
+// a client that lost its session starts over, nil is returned and a new
+// session created.
+func renegotiatedSession(r *http.Request, offer webrtc.SessionDescription) *session {
+	id := r.Header.Get("X-Session-ID")
+	if cookie, err := r.Cookie(sessionCookie); id == "" && err == nil {
+		id = cookie.Value
+	}
+	if id == "" {
+		return nil
+	}
+
+	session := findSession(id)
+	if session == nil || session.collecting.Load() {
+		return nil
+	}
+
+	current := session.peerConnection.RemoteDescription()
+	if current == nil {
+		return nil
+	}
+	offered, ok := originSessionID(offer)
+	if negotiated, _ := originSessionID(*current); !ok || offered != negotiated {
+		return nil
+	}
+	return session
+}
+
+// originSessionID returns the session ID of the o= line of description.
+func originSessionID(description webrtc.SessionDescription) (uint64, bool) {
+	parsed := &sdp.SessionDescription{}
+	if err := parsed.Unmarshal([]byte(description.SDP)); err != nil {
+		return 0, false
+	}
+	return parsed.Origin.SessionID, true
+}
+
+// renegotiate answers offer on the existing PeerConnection of session and
+// stores the result, the snapshot must always hold the latest offer.
+func renegotiate(ctx context.Context, session *session, offer webrtc.SessionDescription) (err error) {
+	defer func() {
+		if err != nil {
+			recordHistory(session, historyRenegotiation, "failed: %v", err)
+		} else {
+			recordHistory(session, historyRenegotiation, "answered new offer")
+		}
+	}()
+
+	if offer, err = shimOffer(session.fingerprint.SDPShim, offer); err != nil {
+		return err
+	}
+	peerConnection := session.peerConnection
+	if err := peerConnection.SetRemoteDescription(offer); err != nil {
+		return fmt.Errorf("%w: %v", errInvalidOffer, err)
+	}
+
+	answer, err := peerConnection.CreateAnswer(nil)
+	if err != nil {
+		return err
+	} else if answer.SDP, err = applyBitrateCap(answer.SDP, session.maxBitrate.Load()); err != nil {
+		return err
+	} else if err = peerConnection.SetLocalDescription(answer); err != nil {
+		return err
+	}
+	session.payloadTypes.negotiated(answer)
+	if err = applySubscriptions(session); err != nil {
+		return err
+	}
+
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	return serialize(ctx)
+}
+
+// applySubscriptions detaches the broadcaster tracks session is unsubscribed
+// from and attaches the rest, so nothing is sent on inactive transceivers.
+func applySubscriptions(session *session) error {
+	sessionsMutex.Lock()
+	unsubscribed := map[string]bool{}
+	for kind := range session.unsubscribed {
+		unsubscribed[kind] = true
+	}
+	sessionsMutex.Unlock()
+
+	return attachTracks(session, unsubscribed)
+}
+
+// attachTracks is applySubscriptions for a session nothing else can see yet,
+// like one being restored while sessionsMutex is held.
+func attachTracks(session *session, unsubscribed map[string]bool) error {
+	for _, transceiver := range session.peerConnection.GetTransceivers() {
+		sender := transceiver.Sender()
+		if sender == nil {
+			continue
+		}
+
+		var track webrtc.TrackLocal
+		if transceiver.Kind() == webrtc.RTPCodecTypeAudio {
+			track = session.room.audioTrack
+		} else if video := session.videoTrack(); video != nil {
+			track = video
+		}
+		if unsubscribed[transceiver.Kind().String()] {
+			track = nil
+		}
+
+		if sender.Track() == track {
+			continue
+		}
+		// Moving to another simulcast layer, the old one is detached first so
+		// none of its packets follow the rebase.
+		if transceiver.Kind() == webrtc.RTPCodecTypeVideo && sender.Track() != nil && track != nil {
+			if err := sender.ReplaceTrack(nil); err != nil {
+				return err
+			}
+			session.layer.rebaseNext()
+		}
+		if err := sender.ReplaceTrack(track); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// subscribedKinds returns the kinds of track session receives.
+func subscribedKinds(session *session) []string {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+
+	kinds := []string{}
+	for _, kind := range trackKinds {
+		if !session.unsubscribed[kind] {
+			kinds = append(kinds, kind)
+		}
+	}
+	return kinds
+}
+
+// unsubscribedKinds returns the kinds of track session opted out of.
+// sessionsMutex must be held by the caller.
+func unsubscribedKinds(session *session) []string {
+	kinds := []string{}
+	for kind := range session.unsubscribed {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+func isTrackKind(kind string) bool {
+	for _, k := range trackKinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,106 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// viewerOffer returns the offer of a client receiving audio and video.
+func viewerOffer(t *testing.T) webrtc.SessionDescription {
+	t.Helper()
+
+	client, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio} {
+		if _, err = client.AddTransceiverFromKind(kind, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	offer, err := client.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	} else if err = client.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	return offer
+}
+
+// closeSession closes the PeerConnection of session and waits for it to be
+// collected, so nothing is left reading the globals later tests change.
+func closeSession(t *testing.T, session *session) {
+	t.Helper()
+
+	if err := session.peerConnection.Close(); err != nil {
+		t.Error(err)
+	}
+	for deadline := time.Now().Add(10 * time.Second); !isTombstoned(session.id); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("session %s not collected", session.id)
+		}
+	}
+	// collectSession holds sessionsMutex until it is done.
+	sessionsMutex.Lock()
+	sessionsMutex.Unlock() //nolint:staticcheck
+}
+
+// TestResumeNegotiationSubscriptions resumes viewers unsubscribed from some
+// tracks the way deserialize does, with sessionsMutex held, and checks it
+// neither deadlocks nor sends them the tracks they opted out of.
+func TestResumeNegotiationSubscriptions(t *testing.T) {
+	room, err := newRoom(RoomState{ID: "subscriptions"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name         string
+		unsubscribed []string
+	}{
+		{"audio", []string{"audio"}},
+		{"video", []string{"video"}},
+		{"both", []string{"audio", "video"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			offer := viewerOffer(t)
+			session := newSessionState("viewer-"+tc.name, room, offer)
+			for _, kind := range tc.unsubscribed {
+				session.unsubscribed[kind] = true
+			}
+			if err := newPeerConnection(session, webrtc.SettingEngine{}, webrtc.Configuration{}); err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { closeSession(t, session) })
+
+			done := make(chan error, 1)
+			go func() {
+				sessionsMutex.Lock()
+				defer sessionsMutex.Unlock()
+				done <- resumeNegotiation(session, PeerConnectionState{RemoteDescription: offer})
+			}()
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Fatal(err)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatal("resuming the viewer deadlocked")
+			}
+
+			for _, transceiver := range session.peerConnection.GetTransceivers() {
+				kind := transceiver.Kind().String()
+				if sent := transceiver.Sender().Track() != nil; sent == session.unsubscribed[kind] {
+					t.Errorf("%s track sent: %v, unsubscribed: %v", kind, sent, session.unsubscribed[kind])
+				}
+			}
+		})
+	}
+}
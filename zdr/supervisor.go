@@ -0,0 +1,58 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"runtime/debug"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	supervisorMaxRestarts  = 5
+	supervisorRestartDelay = 100 * time.Millisecond
+)
+
+var goroutinePanics = newCounter("goroutine_panics_total", "Panics recovered in per-session goroutines.")
+
+// supervise runs fn in its own goroutine and contains any panic to session.
+// fn is run again after a panic, so it must be safe to restart. Once it has
+// panicked supervisorMaxRestarts times the PeerConnection is closed, leaving
+// every other session alone. With -profile-sessions the goroutine carries
+// pprof labels naming the session and name.
+func supervise(name string, session *session, fn func()) {
+	peerConnection := session.peerConnection
+	go withSessionLabels(session, name, func() {
+		for restarts := 0; ; restarts++ {
+			if !runRecovered(name, fn) {
+				return
+			}
+
+			if restarts == supervisorMaxRestarts || peerConnection.ConnectionState() == webrtc.PeerConnectionStateClosed {
+				break
+			}
+			time.Sleep(supervisorRestartDelay)
+		}
+
+		logf("Giving up on %s, closing PeerConnection\n", name)
+		if err := peerConnection.Close(); err != nil {
+			logf("Failed to close PeerConnection: %v\n", err)
+		}
+	})
+}
+
+// runRecovered runs fn and reports whether it panicked.
+func runRecovered(name string, fn func()) (panicked bool) {
+	defer func() {
+		if err := recover(); err != nil {
+			logf("Recovered from panic in %s: %v\n%s", name, err, debug.Stack())
+			goroutinePanics.Inc()
+			panicked = true
+		}
+	}()
+
+	fn()
+	return false
+}
@@ -0,0 +1,202 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// sdListenFDsStart is the first descriptor systemd passes sockets on, see
+// sd_listen_fds(3).
+const sdListenFDsStart = 3
+
+var (
+	activatedSockets = newCounter("socket_activation_sockets_total", "Sockets received from systemd at startup.")
+
+	// activated holds the sockets systemd started the process with.
+	activated = &activation{conns: map[int]*net.UDPConn{}, handed: map[int]*net.UDPConn{}, reserved: map[int]time.Time{}}
+)
+
+// activation holds the sockets of systemd socket activation. Stream sockets
+// are taken by Listen. UDP sockets are ICE ports: each is kept open for as
+// long as the process runs, like systemd keeps its own, and the session on
+// its port is given a duplicate, so the port stays bound when the session
+// ends or the process restarts. Sessions resumed on one of them take it
+// over, new sessions are given one that is free.
+type activation struct {
+	mu        sync.Mutex
+	listeners []net.Listener
+
+	// conns are the UDP sockets by port, handed the duplicate given to the
+	// session using each.
+	conns  map[int]*net.UDPConn
+	handed map[int]*net.UDPConn
+
+	// reserved are the ports given to new sessions that didn't bind them
+	// yet, with when.
+	reserved map[int]time.Time
+}
+
+// receiveSocketActivation takes the sockets systemd passed, if it started
+// the process with some. The variables are cleared, so a hot restart or an
+// upgrade doesn't take the descriptors for them.
+func receiveSocketActivation() error {
+	pid, fds := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if fds == "" || pid != strconv.Itoa(os.Getpid()) {
+		return nil
+	}
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid LISTEN_FDS %q", fds)
+	}
+
+	activated.mu.Lock()
+	defer activated.mu.Unlock()
+	for fd := sdListenFDsStart; fd < sdListenFDsStart+n; fd++ {
+		file := os.NewFile(uintptr(fd), "systemd socket")
+		err := activated.add(file)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("systemd socket %d: %w", fd, err)
+		}
+		activatedSockets.Inc()
+	}
+	logf("Received %d listeners and %d UDP ports from systemd\n", len(activated.listeners), len(activated.conns))
+	return nil
+}
+
+// add keeps the socket of file, a stream or UDP socket. a.mu must be held.
+func (a *activation) add(file *os.File) error {
+	if listener, err := net.FileListener(file); err == nil {
+		a.listeners = append(a.listeners, listener)
+		return nil
+	}
+
+	conn, err := net.FilePacketConn(file)
+	if err != nil {
+		return err
+	}
+	udp, ok := conn.(*net.UDPConn)
+	if !ok {
+		conn.Close()
+		return fmt.Errorf("%s is neither a stream nor a UDP socket", conn.LocalAddr())
+	}
+	a.conns[udp.LocalAddr().(*net.UDPAddr).Port] = udp
+	return nil
+}
+
+// takeActivatedListener returns a stream socket systemd passed for network,
+// nil if there is none left.
+func takeActivatedListener(network string) net.Listener {
+	activated.mu.Lock()
+	defer activated.mu.Unlock()
+	for i, listener := range activated.listeners {
+		if listener.Addr().Network() == network {
+			activated.listeners = append(activated.listeners[:i], activated.listeners[i+1:]...)
+			return listener
+		}
+	}
+	return nil
+}
+
+// activatedConn returns a duplicate of the UDP socket systemd passed on the
+// port of addr, nil if there is none or a session is using it.
+func activatedConn(addr *net.UDPAddr) (*net.UDPConn, error) {
+	if addr == nil {
+		return nil, nil
+	}
+	activated.mu.Lock()
+	defer activated.mu.Unlock()
+	conn := activated.conns[addr.Port]
+	if conn == nil || isOpen(activated.handed[addr.Port]) {
+		return nil, nil
+	}
+
+	file, err := conn.File()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	duplicate, err := net.FilePacketConn(file)
+	if err != nil {
+		return nil, err
+	}
+	activated.handed[addr.Port] = duplicate.(*net.UDPConn)
+	delete(activated.reserved, addr.Port)
+	return activated.handed[addr.Port], nil
+}
+
+// handActivated records conn, a socket a hot restart handed over, as the
+// session using its port if systemd passed it.
+func handActivated(conn *net.UDPConn) {
+	activated.mu.Lock()
+	defer activated.mu.Unlock()
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	if activated.conns[port] != nil {
+		activated.handed[port] = conn
+	}
+}
+
+// activatedPort reports whether port is one systemd passed, free for a
+// session to be resumed on. The socket is bound, so waitForPort can't try
+// binding it.
+func activatedPort(port uint16) bool {
+	activated.mu.Lock()
+	defer activated.mu.Unlock()
+	return activated.conns[int(port)] != nil && !isOpen(activated.handed[int(port)])
+}
+
+// reserveActivatedPort returns a port systemd passed that no session is
+// using for a new session, false if there is none. It stays reserved for
+// -signaling-timeout unless the session binds it.
+func reserveActivatedPort(now time.Time) (uint16, bool) {
+	activated.mu.Lock()
+	defer activated.mu.Unlock()
+	for port := range activated.conns {
+		if isOpen(activated.handed[port]) || now.Sub(activated.reserved[port]) < config.SignalingTimeout {
+			continue
+		}
+		activated.reserved[port] = now
+		return uint16(port), true
+	}
+	return 0, false
+}
+
+// isOpen reports whether conn is a socket that wasn't closed.
+func isOpen(conn *net.UDPConn) bool {
+	if conn == nil {
+		return false
+	}
+	raw, err := conn.SyscallConn()
+	return err == nil && raw.Control(func(uintptr) {}) == nil
+}
+
+// sdNotify sends state to systemd, for units of Type=notify. It does
+// nothing if the process wasn't started by one.
+func sdNotify(state string) {
+	name := os.Getenv("NOTIFY_SOCKET")
+	if name == "" {
+		return
+	} else if name[0] == '@' {
+		name = "\x00" + name[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		logf("Failed to notify systemd: %v\n", err)
+		return
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte(state)); err != nil {
+		logf("Failed to notify systemd: %v\n", err)
+	}
+}
@@ -0,0 +1,265 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// tapQueueLength is how many packets a tap consumer may fall behind before
+// packets are dropped for it.
+const tapQueueLength = 256
+
+var (
+	errUnknownTapConsumer = errors.New("tap consumer is not registered")
+	errInvalidTap         = errors.New("invalid tap")
+
+	tapPackets = newCounter("tap_packets_total", "Packets handed to tap consumers.")
+	tapDropped = newCounter("tap_dropped_packets_total", "Packets dropped for tap consumers that fell behind.")
+
+	tapConsumers = map[string]*tapConsumer{}
+
+	// tappedTracks are the consumers tapping each output track, worked out
+	// again whenever the taps of its room or the consumers change.
+	tappedTracks = map[*webrtc.TrackLocalStaticRTP]tappedTrack{}
+	tapsMutex    sync.RWMutex
+)
+
+// TapPacket is a packet sent to the viewers of a room, as handed to a tap
+// consumer. Packet is a copy the consumer may keep.
+type TapPacket struct {
+	Room     string
+	Kind     string
+	MimeType string
+	Packet   *rtp.Packet
+}
+
+// TapConsumer receives the packets of the tracks it taps. It is called from
+// a goroutine of its own, one packet at a time, and never holds up viewers:
+// packets are dropped for a consumer that falls behind.
+type TapConsumer func(packet TapPacket)
+
+// TapState taps the track of a room of Kind, audio or video, for the
+// consumer registered as Consumer. Taps are saved with their room.
+type TapState struct {
+	Consumer string
+	Kind     string
+}
+
+type tapConsumer struct {
+	name    string
+	consume TapConsumer
+	packets chan TapPacket
+}
+
+type tappedTrack struct {
+	room, kind, mimeType string
+	consumers            []*tapConsumer
+}
+
+// RegisterTapConsumer makes consumer available to taps as name. Taps saved in
+// the snapshot attach to the consumer of their name once it is registered,
+// so a program should register its consumers before Start.
+func (s *Server) RegisterTapConsumer(name string, consumer TapConsumer) {
+	c := &tapConsumer{name: name, consume: consumer, packets: make(chan TapPacket, tapQueueLength)}
+	go c.run()
+
+	tapsMutex.Lock()
+	tapConsumers[name] = c
+	tapsMutex.Unlock()
+
+	for _, room := range allRooms() {
+		room.attachTaps()
+	}
+}
+
+// AddTap taps a track of room for the consumer of tap and saves it with the
+// room, so the tap carries on after a restart.
+func (s *Server) AddTap(room string, tap TapState) error {
+	r := findRoom(room)
+	if r == nil {
+		return errRoomNotFound
+	}
+	return addTap(r, tap)
+}
+
+// RemoveTap removes a tap added with AddTap.
+func (s *Server) RemoveTap(room string, tap TapState) error {
+	r := findRoom(room)
+	if r == nil {
+		return errRoomNotFound
+	}
+	return removeTap(r, tap)
+}
+
+func addTap(room *room, tap TapState) error {
+	if tap.Kind != webrtc.RTPCodecTypeAudio.String() && tap.Kind != webrtc.RTPCodecTypeVideo.String() {
+		return fmt.Errorf("%w: kind must be audio or video, got %q", errInvalidTap, tap.Kind)
+	}
+
+	tapsMutex.Lock()
+	if _, ok := tapConsumers[tap.Consumer]; !ok {
+		tapsMutex.Unlock()
+		return fmt.Errorf("%w: %q", errUnknownTapConsumer, tap.Consumer)
+	}
+	for _, existing := range room.taps {
+		if existing == tap {
+			tapsMutex.Unlock()
+			return nil
+		}
+	}
+	room.taps = append(room.taps, tap)
+	tapsMutex.Unlock()
+
+	room.attachTaps()
+	logf("Tapped %s of room %s for %s\n", tap.Kind, room.id, tap.Consumer)
+
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	return serialize(context.Background())
+}
+
+func removeTap(room *room, tap TapState) error {
+	tapsMutex.Lock()
+	kept := []TapState{}
+	for _, existing := range room.taps {
+		if existing != tap {
+			kept = append(kept, existing)
+		}
+	}
+	room.taps = kept
+	tapsMutex.Unlock()
+
+	room.attachTaps()
+
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	return serialize(context.Background())
+}
+
+// tapStates returns the taps of room to save.
+func (r *room) tapStates() []TapState {
+	tapsMutex.RLock()
+	defer tapsMutex.RUnlock()
+	return append([]TapState{}, r.taps...)
+}
+
+// restoreTaps puts back the taps of a snapshot. Those of consumers that
+// aren't registered yet are kept, and attach once they are.
+func (r *room) restoreTaps(taps []TapState) {
+	tapsMutex.Lock()
+	r.taps = append([]TapState{}, taps...)
+	tapsMutex.Unlock()
+
+	r.attachTaps()
+}
+
+// attachTaps works out the consumers tapping each output track of r.
+func (r *room) attachTaps() {
+	tapsMutex.Lock()
+	defer tapsMutex.Unlock()
+
+	for _, track := range r.tracks() {
+		tapped := tappedTrack{room: r.id, kind: track.Kind().String(), mimeType: track.Codec().MimeType}
+		for _, tap := range r.taps {
+			if consumer, ok := tapConsumers[tap.Consumer]; ok && tap.Kind == tapped.kind {
+				tapped.consumers = append(tapped.consumers, consumer)
+			}
+		}
+
+		if len(tapped.consumers) == 0 {
+			delete(tappedTracks, track)
+		} else {
+			tappedTracks[track] = tapped
+		}
+	}
+}
+
+// detachTaps stops tapping the tracks of r, which is closing.
+func (r *room) detachTaps() {
+	tapsMutex.Lock()
+	defer tapsMutex.Unlock()
+
+	for _, track := range r.tracks() {
+		delete(tappedTracks, track)
+	}
+}
+
+// tapSent hands a copy of a packet written to track to the consumers tapping
+// it. It is called for every packet written to an output track, alongside
+// recordSent, and never blocks.
+func tapSent(track *webrtc.TrackLocalStaticRTP, packet *rtp.Packet) {
+	tapsMutex.RLock()
+	tapped, ok := tappedTracks[track]
+	tapsMutex.RUnlock()
+	if !ok {
+		return
+	}
+
+	for _, consumer := range tapped.consumers {
+		select {
+		case consumer.packets <- TapPacket{Room: tapped.room, Kind: tapped.kind, MimeType: tapped.mimeType, Packet: packet.Clone()}:
+			tapPackets.Inc()
+		default:
+			tapDropped.Inc()
+		}
+	}
+}
+
+// run hands packets to the consumer. A consumer that panics loses that
+// packet only.
+func (c *tapConsumer) run() {
+	for packet := range c.packets {
+		func() {
+			defer func() {
+				if err := recover(); err != nil {
+					logf("Recovered from panic in tap consumer %s: %v\n", c.name, err)
+				}
+			}()
+			c.consume(packet)
+		}()
+	}
+}
+
+// handleAdminRoomTaps serves /admin/rooms/{id}/taps, listing the taps of the
+// room on GET. POST with a body like {"Consumer": "loudness", "Kind": "audio"}
+// adds a tap and DELETE with the same body removes it.
+func handleAdminRoomTaps(w http.ResponseWriter, r *http.Request, room *room) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(room.tapStates())
+	case http.MethodPost, http.MethodDelete:
+		var tap TapState
+		if err := json.NewDecoder(r.Body).Decode(&tap); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var err error
+		if r.Method == http.MethodPost {
+			err = addTap(room, tap)
+		} else {
+			err = removeTap(room, tap)
+		}
+		if errors.Is(err, errInvalidTap) || errors.Is(err, errUnknownTapConsumer) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,274 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+)
+
+var (
+	errUnknownTenant  = errors.New("unknown tenant")
+	errTenantQuota    = errors.New("tenant quota exhausted")
+	errInvalidTenants = errors.New("invalid tenants")
+
+	// validTenantID keeps tenant IDs fit for the name of their snapshot.
+	validTenantID = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+	// tenants are those of -tenants, by ID.
+	tenants = map[string]Tenant{}
+
+	tenantQuotaRefusals = newCounter("tenant_quota_refusals_total", "Rooms and sessions refused for going over the quota of their tenant.")
+	_                   = newGaugeVec("tenant_rooms", "Rooms per tenant.", "tenant", func() map[string]float64 {
+		out := map[string]float64{}
+		for id := range tenants {
+			out[id] = float64(tenantRooms(id))
+		}
+		return out
+	})
+	_ = newGaugeVec("tenant_sessions", "Connected sessions per tenant.", "tenant", func() map[string]float64 {
+		out := map[string]float64{}
+		for id := range tenants {
+			out[id] = float64(tenantSessions(id))
+		}
+		return out
+	})
+)
+
+// Tenant is a customer sharing the server with others without seeing them.
+// Its rooms can only be joined by principals of the tenant, they and their
+// sessions count against its quotas, and they are saved in a snapshot of
+// their own so that one that can't be read only costs the tenant its
+// sessions.
+type Tenant struct {
+	// Keys are bearer tokens of the tenant, along with the principal each
+	// of them is. They may not grant admin, the admin API spans tenants.
+	Keys map[string]Principal `json:",omitempty"`
+
+	// MaxRooms and MaxSessions are the quotas of the tenant, 0 for none.
+	MaxRooms    int `json:",omitempty"`
+	MaxSessions int `json:",omitempty"`
+}
+
+// parseTenants reads the tenants of -tenants, a JSON object of Tenant by
+// ID, none if path is empty.
+func parseTenants(path string) (map[string]Tenant, error) {
+	out := map[string]Tenant{}
+	if path == "" {
+		return out, nil
+	}
+
+	data, err := os.ReadFile(path) //nolint:gosec
+	if err != nil {
+		return nil, err
+	} else if err = json.Unmarshal(data, &out); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	for id, tenant := range out {
+		if !validTenantID.MatchString(id) {
+			return nil, fmt.Errorf("%w: ID %q may only have letters, digits, - and _", errInvalidTenants, id)
+		} else if tenant.MaxRooms < 0 || tenant.MaxSessions < 0 {
+			return nil, fmt.Errorf("%w: quotas of %s can't be negative", errInvalidTenants, id)
+		}
+		for key, principal := range tenant.Keys {
+			if principal.has(roleAdmin) {
+				return nil, fmt.Errorf("%w: a key of %s grants admin", errInvalidTenants, id)
+			}
+			principal.Tenant = id
+			tenant.Keys[key] = principal
+		}
+	}
+	return out, nil
+}
+
+// tenantKeyPrincipal returns the principal of the tenant key r was made
+// with, if any.
+func tenantKeyPrincipal(r *http.Request) (Principal, bool) {
+	token := bearerToken(r)
+	if token == "" {
+		return Principal{}, false
+	}
+	for _, tenant := range tenants {
+		for key, principal := range tenant.Keys {
+			if hmac.Equal([]byte(key), []byte(token)) {
+				return principal, true
+			}
+		}
+	}
+	return Principal{}, false
+}
+
+// authorizeTenant checks that principal may join room, which it may if
+// they are of the same tenant. Any room is fine if room is empty.
+func authorizeTenant(principal Principal, room string) error {
+	if room == "" {
+		return nil
+	}
+	if r := findRoom(room); r != nil && r.tenant != principal.Tenant {
+		return fmt.Errorf("%w: %s may not join rooms of another tenant", errForbidden, principal.Subject)
+	}
+	return nil
+}
+
+// checkTenant returns an error if a room of tenant can't be created, for a
+// tenant that isn't configured or a quota that is exhausted. roomsMutex
+// must be held.
+func checkTenant(tenant string) error {
+	if tenant == "" {
+		return nil
+	}
+	t, ok := tenants[tenant]
+	if !ok {
+		return fmt.Errorf("%w: %s", errUnknownTenant, tenant)
+	}
+
+	n := 0
+	for _, room := range rooms {
+		if room.tenant == tenant {
+			n++
+		}
+	}
+	if t.MaxRooms > 0 && n >= t.MaxRooms {
+		tenantQuotaRefusals.Inc()
+		return fmt.Errorf("%w: %s has %d rooms", errTenantQuota, tenant, n)
+	}
+	return nil
+}
+
+// admitTenantSession returns an error if the tenant of room is at its quota
+// of sessions.
+func admitTenantSession(room *room) error {
+	t, ok := tenants[room.tenant]
+	if !ok || t.MaxSessions == 0 {
+		return nil
+	}
+	if n := tenantSessions(room.tenant); n >= t.MaxSessions {
+		tenantQuotaRefusals.Inc()
+		return fmt.Errorf("%w: %s has %d sessions", errTenantQuota, room.tenant, n)
+	}
+	return nil
+}
+
+// tenantRooms returns how many rooms tenant has.
+func tenantRooms(tenant string) int {
+	roomsMutex.Lock()
+	defer roomsMutex.Unlock()
+
+	n := 0
+	for _, room := range rooms {
+		if room.tenant == tenant {
+			n++
+		}
+	}
+	return n
+}
+
+// tenantSessions returns how many sessions are connected to rooms of
+// tenant.
+func tenantSessions(tenant string) int {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+
+	n := 0
+	for _, session := range sessions {
+		if session.room.tenant == tenant {
+			n++
+		}
+	}
+	return n
+}
+
+// partitionState splits state into the snapshot of every tenant, holding
+// its rooms and their sessions, and the main one under "" holding the
+// rest. Every tenant has one, even without rooms, so what was saved for it
+// before is replaced. Rooms of tenants no longer configured stay in the main
+// one.
+func partitionState(state GlobalState) map[string]GlobalState {
+	partitions := map[string]GlobalState{}
+	for id := range tenants {
+		partitions[id] = GlobalState{
+			Version:             state.Version,
+			Generation:          state.Generation,
+			SavedAt:             state.SavedAt,
+			PeerConnectionState: []PeerConnectionState{},
+			Rooms:               []RoomState{},
+		}
+	}
+
+	shared := state
+	shared.Rooms, shared.PeerConnectionState = []RoomState{}, []PeerConnectionState{}
+	tenantOf := map[string]string{}
+	for _, room := range state.Rooms {
+		partition, ok := partitions[room.Tenant]
+		if room.Tenant == "" || !ok {
+			shared.Rooms = append(shared.Rooms, room)
+			continue
+		}
+		partition.Rooms = append(partition.Rooms, room)
+		partitions[room.Tenant] = partition
+		tenantOf[room.ID] = room.Tenant
+	}
+	for _, session := range state.PeerConnectionState {
+		tenant, ok := tenantOf[session.Room]
+		if !ok {
+			shared.PeerConnectionState = append(shared.PeerConnectionState, session)
+			continue
+		}
+		partition := partitions[tenant]
+		partition.PeerConnectionState = append(partition.PeerConnectionState, session)
+		partitions[tenant] = partition
+	}
+	partitions[""] = shared
+	return partitions
+}
+
+// mergePartition adds the rooms and sessions of the snapshot of a tenant to
+// state.
+func mergePartition(state *GlobalState, partition GlobalState) {
+	if partition.Generation > state.Generation {
+		state.Generation, state.SavedAt = partition.Generation, partition.SavedAt
+	}
+	if state.Version == 0 {
+		state.Version = partition.Version
+	}
+	state.Rooms = append(state.Rooms, partition.Rooms...)
+	state.PeerConnectionState = append(state.PeerConnectionState, partition.PeerConnectionState...)
+}
+
+type adminTenant struct {
+	ID                    string
+	MaxRooms, MaxSessions int `json:",omitempty"`
+	Rooms, Sessions       int
+}
+
+// handleAdminTenants lists the tenants of -tenants on GET, with their quotas
+// and what they use of them. Keys are left out.
+func handleAdminTenants(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	out := []adminTenant{}
+	for id, tenant := range tenants {
+		out = append(out, adminTenant{
+			ID:          id,
+			MaxRooms:    tenant.MaxRooms,
+			MaxSessions: tenant.MaxSessions,
+			Rooms:       tenantRooms(id),
+			Sessions:    tenantSessions(id),
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&out)
+}
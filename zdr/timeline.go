@@ -0,0 +1,100 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+var clockSteps = newCounter("restore_clock_steps_total", "Startups where the wall clock was behind the time the snapshot was written.")
+
+// TimelineState is the last position an output track sent, as saved in the
+// snapshot. At is the wall clock time the packet was sent. MimeType tells
+// the video tracks apart, it is empty in snapshots from before rooms had a
+// track per codec.
+type TimelineState struct {
+	Kind           string
+	MimeType       string
+	SequenceNumber uint16
+	Timestamp      uint32
+	At             time.Time
+
+	// Rebase, SequenceOffset and TimestampOffset keep packets forwarded
+	// after a restart past frames injected before it.
+	Rebase          bool
+	SequenceOffset  uint16
+	TimestampOffset uint32
+}
+
+// timelines returns the positions of the output tracks of r that sent
+// anything.
+func (r *room) timelines() []TimelineState {
+	out := []TimelineState{}
+	for _, track := range r.tracks() {
+		i, err := injectorFor(track)
+		if err != nil {
+			continue
+		}
+
+		i.mu.Lock()
+		if i.started {
+			out = append(out, TimelineState{
+				Kind:            track.Kind().String(),
+				MimeType:        track.Codec().MimeType,
+				SequenceNumber:  i.seq,
+				Timestamp:       i.timestamp,
+				At:              i.at,
+				Rebase:          i.rebase,
+				SequenceOffset:  i.seqOffset,
+				TimestampOffset: i.timestampOffset,
+			})
+		}
+		i.mu.Unlock()
+	}
+	return out
+}
+
+// restoreTimelines carries the output tracks of r on from where the previous
+// process left them. shift is added to every saved time to move it onto the
+// current clock, see clockShift.
+func (r *room) restoreTimelines(states []TimelineState, shift time.Duration) {
+	for _, state := range states {
+		track := r.videoTrack(state.MimeType)
+		if state.Kind == webrtc.RTPCodecTypeAudio.String() {
+			track = r.audioTrack
+		} else if track == nil {
+			track = r.videoTrack(r.defaultVideoCodec())
+		}
+		if track == nil {
+			continue
+		}
+
+		i, err := injectorFor(track)
+		if err != nil {
+			continue
+		}
+
+		i.mu.Lock()
+		i.started, i.seq, i.timestamp, i.at = true, state.SequenceNumber, state.Timestamp, state.At.Add(shift)
+		i.rebase, i.seqOffset, i.timestampOffset = state.Rebase, state.SequenceOffset, state.TimestampOffset
+		i.mu.Unlock()
+	}
+}
+
+// clockShift compares the time a snapshot was written with now. Normally the
+// saved times are used as they are, so timestamps advance by the length of
+// the outage. If the clock was stepped back past the snapshot, they would run
+// backwards, which browsers drop as stale, so the saved times are moved back
+// as if the snapshot was written now.
+func clockShift(savedAt, now time.Time) time.Duration {
+	if savedAt.IsZero() || !now.Before(savedAt) {
+		return 0
+	}
+
+	clockSteps.Inc()
+	logf("Warning: clock is %s behind the snapshot, rebasing RTP timelines\n", savedAt.Sub(now))
+	return now.Sub(savedAt)
+}
@@ -0,0 +1,116 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"crypto/hmac"
+	"crypto/sha1" //nolint:gosec
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+var (
+	errTURNDisabled = errors.New("no TURN servers are configured")
+
+	turnCredentialsMinted = newCounter("turn_credentials_minted_total", "TURN credentials minted for clients and for sessions of the server.")
+)
+
+// TURNCredential is a username and password for the TURN servers of
+// -turn-urls, minted the way the REST API of coturn expects: the username is
+// "expiry:user" and the password the base64 HMAC-SHA1 of it under the shared
+// -turn-secret. TURN servers check them without asking back, so every
+// instance sharing the secret mints credentials valid on all of them.
+type TURNCredential struct {
+	Username string
+	Password string
+	Expires  time.Time
+}
+
+func turnEnabled() bool {
+	return config.TURNSecret != "" && config.TURNURLs != ""
+}
+
+// mintTURNCredential returns a credential for user valid for -turn-ttl.
+func mintTURNCredential(user string) TURNCredential {
+	expires := time.Now().Add(config.TURNTTL).Truncate(time.Second)
+	username := fmt.Sprintf("%d:%s", expires.Unix(), user)
+
+	mac := hmac.New(sha1.New, []byte(config.TURNSecret))
+	mac.Write([]byte(username)) //nolint:errcheck
+
+	turnCredentialsMinted.Inc()
+	return TURNCredential{
+		Username: username,
+		Password: base64.StdEncoding.EncodeToString(mac.Sum(nil)),
+		Expires:  expires,
+	}
+}
+
+// iceServers returns the TURN servers of -turn-urls with credential.
+func (c TURNCredential) iceServers() []webrtc.ICEServer {
+	urls := []string{}
+	for _, url := range strings.Split(config.TURNURLs, ",") {
+		if url = strings.TrimSpace(url); url != "" {
+			urls = append(urls, url)
+		}
+	}
+	return []webrtc.ICEServer{{
+		URLs:           urls,
+		Username:       c.Username,
+		Credential:     c.Password,
+		CredentialType: webrtc.ICECredentialTypePassword,
+	}}
+}
+
+// useTURN gives the PeerConnection of session a credential and returns the
+// ICE servers to gather relay candidates from. A credential restored from
+// the snapshot or journal is kept while it has half of -turn-ttl left, TURN
+// servers refuse to refresh allocations once it expires.
+func useTURN(session *session, restored TURNCredential) []webrtc.ICEServer {
+	if !turnEnabled() {
+		return nil
+	}
+
+	if restored.Username == "" || time.Until(restored.Expires) < config.TURNTTL/2 {
+		restored = mintTURNCredential(session.id)
+	}
+	session.turn = restored
+	return restored.iceServers()
+}
+
+// handleTURN serves /turn?room=, the ICE servers a client of the room
+// creates its PeerConnection with. Each request gets a credential of its
+// own.
+func handleTURN(w http.ResponseWriter, r *http.Request) {
+	if !turnEnabled() {
+		http.Error(w, errTURNDisabled.Error(), http.StatusNotFound)
+		return
+	}
+
+	room := findRoom(r.URL.Query().Get("room"))
+	if room == nil {
+		http.Error(w, errRoomNotFound.Error(), http.StatusNotFound)
+		return
+	} else if err := authorizeAny(r, room.id); err != nil {
+		authError(w, err)
+		return
+	}
+
+	credential := mintTURNCredential(randomToken()[:16])
+	out := struct {
+		ICEServers []webrtc.ICEServer `json:"iceServers"`
+		Expires    time.Time          `json:"expires"`
+	}{credential.iceServers(), credential.Expires}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(&out)
+}
@@ -0,0 +1,178 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime/debug"
+	"time"
+)
+
+// handoffProbeTimeout bounds how long the new binary may take to answer the
+// probe.
+const handoffProbeTimeout = 10 * time.Second
+
+// stateModules are the modules whose types end up in the snapshot. DTLS and
+// SRTP state is saved as is, so both binaries must agree on their versions.
+var stateModules = []string{
+	"github.com/pion/webrtc/v3",
+	"github.com/pion/dtls/v2",
+	"github.com/pion/srtp/v2",
+}
+
+// ErrUpgradeIncompatible is returned by Upgrade when the new binary can't
+// resume the sessions of this one.
+var ErrUpgradeIncompatible = errors.New("zdr: new binary can't resume the current sessions")
+
+// HandoffProbe is what a binary run with -handoff-probe reports about itself.
+type HandoffProbe struct {
+	SnapshotVersion int
+	Modules         map[string]string
+
+	// SnapshotError is set if the current snapshot failed to decode.
+	SnapshotError string `json:",omitempty"`
+}
+
+// WriteHandoffProbe is run by the new binary when asked to -handoff-probe. It
+// decodes the current snapshot with cfg and writes a HandoffProbe to w.
+func WriteHandoffProbe(cfg Config, w io.Writer) error {
+	probe := HandoffProbe{SnapshotVersion: snapshotVersion, Modules: buildModules()}
+
+	var buffer []byte
+	store, err := parseStateStore(cfg.SnapshotStore)
+	if err == nil && store != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), handoffProbeTimeout)
+		buffer, err = store.Load(ctx, "", 0)
+		cancel()
+	} else if err == nil {
+		buffer, err = os.ReadFile(cfg.SnapshotPath)
+	}
+	if err == nil && cfg.SnapshotKey != "" {
+		snapshotCipher, err = newSealer(context.Background(), cfg.SnapshotKey)
+	}
+	if err == nil {
+		_, err = decodeSnapshot(buffer)
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		probe.SnapshotError = err.Error()
+	}
+	return json.NewEncoder(w).Encode(&probe)
+}
+
+// buildModules returns the versions of stateModules this binary was built
+// with.
+func buildModules() map[string]string {
+	modules := map[string]string{}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return modules
+	}
+
+	for _, dep := range info.Deps {
+		if dep.Replace != nil {
+			dep = dep.Replace
+		}
+		for _, path := range stateModules {
+			if dep.Path == path {
+				modules[path] = dep.Version
+			}
+		}
+	}
+	return modules
+}
+
+// probeBinary runs binary with -handoff-probe against the snapshot of this
+// process, in the environment it would inherit, and checks it can resume.
+func probeBinary(ctx context.Context, binary string) error {
+	ctx, cancel := context.WithTimeout(ctx, handoffProbeTimeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	// The arguments are those the new binary will run with, so flags it no
+	// longer knows fail the probe rather than the handoff.
+	cmd := exec.CommandContext(ctx, binary, append(os.Args[1:], "-handoff-probe")...)
+	cmd.Env, cmd.Stdout, cmd.Stderr = os.Environ(), &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%w: probe failed: %v: %s", ErrUpgradeIncompatible, err, bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	probe := HandoffProbe{}
+	if err := json.Unmarshal(stdout.Bytes(), &probe); err != nil {
+		return fmt.Errorf("%w: unreadable probe: %v", ErrUpgradeIncompatible, err)
+	}
+
+	if probe.SnapshotVersion < snapshotVersion {
+		return fmt.Errorf("%w: it reads snapshots up to version %d, we write %d", ErrUpgradeIncompatible, probe.SnapshotVersion, snapshotVersion)
+	} else if probe.SnapshotError != "" {
+		return fmt.Errorf("%w: it can't decode the snapshot: %s", ErrUpgradeIncompatible, probe.SnapshotError)
+	}
+
+	for path, version := range buildModules() {
+		if probe.Modules[path] != version {
+			return fmt.Errorf("%w: it is built with %s %s, we are built with %s", ErrUpgradeIncompatible, path, probe.Modules[path], version)
+		}
+	}
+	return nil
+}
+
+// Upgrade replaces this process with binary, keeping its arguments and
+// environment. binary is probed first and the handoff refused if it can't
+// resume the current sessions, this process then carries on serving.
+func (s *Server) Upgrade(ctx context.Context, binary string) error {
+	if err := s.Checkpoint(); err != nil {
+		return err
+	} else if err = probeBinary(ctx, binary); err != nil {
+		return err
+	} else if err = s.Handoff(); err != nil {
+		handingOff.Store(false)
+		return err
+	}
+
+	logf("Handing off to %s\n", binary)
+	err := execBinary(binary)
+
+	// Still here, so the exec failed and nobody else is serving.
+	handingOff.Store(false)
+	return err
+}
+
+// handleAdminUpgrade serves POST /admin/upgrade. The body may name the binary
+// to run, {"Binary": "/usr/local/bin/server"}, it defaults to the running one.
+func (s *Server) handleAdminUpgrade(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var in struct {
+		Binary string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if in.Binary == "" {
+		var err error
+		if in.Binary, err = exec.LookPath(os.Args[0]); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	err := s.Upgrade(r.Context(), in.Binary)
+	if errors.Is(err, ErrUpgradeIncompatible) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
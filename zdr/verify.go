@@ -0,0 +1,499 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/srtp/v2"
+	"github.com/pion/webrtc/v3"
+)
+
+// verifyKeyAttempts is how many times the keys of a session are asked for,
+// a second apart, while its DTLS handshake isn't done.
+const verifyKeyAttempts = 30
+
+// VerifyConfig configures the verification proxy, which stands in front of
+// another instance to check independently of it that its sessions survive
+// its restarts.
+type VerifyConfig struct {
+	// Listen is the HTTP address clients signal through, Backend the URL of
+	// the instance they are proxied to.
+	Listen  string
+	Backend string
+
+	// IP is the address clients are told to send media to, the one the
+	// relays of the proxy listen on.
+	IP string
+
+	// RecorderToken is the -recorder-token of the backend, with it the
+	// SRTP keys of every session are fetched to check that packets still
+	// authenticate. Only sessions of rooms that allow exporting keys and
+	// recording are checked.
+	RecorderToken string
+
+	// MaxGap is the longest a stream may go without a packet for the
+	// report to pass.
+	MaxGap time.Duration
+}
+
+// VerificationReport is what the verification proxy saw of the streams going
+// through it.
+type VerificationReport struct {
+	Started, Ended time.Time
+	Backend        string
+	Sessions       int
+	MaxGap         time.Duration
+
+	// Passed is set if every stream kept within MaxGap and every packet
+	// that was checked authenticated.
+	Passed  bool
+	Streams []StreamReport
+}
+
+// StreamReport is the continuity of an SSRC in one direction, "sent" by the
+// backend or "received" by it.
+type StreamReport struct {
+	SSRC      uint32
+	Direction string
+	Session   string `json:",omitempty"`
+
+	// Lost counts the sequence numbers skipped, Reordered the packets that
+	// came after a later one.
+	Packets   uint64
+	Lost      uint64
+	Reordered uint64
+
+	// LongestGap is the longest time between two packets, which ended at
+	// LongestGapEnded, or from the last packet to the end of the report if
+	// that is longer. Streams stopping before the end count as a gap.
+	LongestGap      time.Duration
+	LongestGapEnded time.Time `json:",omitempty"`
+
+	// AuthChecked counts the packets whose SRTP authentication was checked,
+	// AuthFailed those that failed.
+	AuthChecked uint64 `json:",omitempty"`
+	AuthFailed  uint64 `json:",omitempty"`
+}
+
+type streamKey struct {
+	ssrc      uint32
+	direction string
+}
+
+type streamStats struct {
+	StreamReport
+	lastSequence uint16
+	last         time.Time
+}
+
+// verifier is the state of the verification proxy. One mutex covers it all,
+// it is meant for test runs rather than production traffic.
+type verifier struct {
+	cfg     VerifyConfig
+	backend *url.URL
+	started time.Time
+
+	mu       sync.Mutex
+	streams  map[streamKey]*streamStats
+	contexts map[streamKey]*srtp.Context
+	sessions map[string]bool
+	relays   map[string]*relay
+}
+
+// RunVerifyProxy runs the verification proxy until ctx is done and returns
+// what it saw. Signaling is proxied to the backend with the candidates of its
+// answers replaced by relays of the proxy, so media goes through it both ways
+// and keeps going to the same backend port across a restart, as sessions are
+// resumed on their port.
+func RunVerifyProxy(ctx context.Context, cfg VerifyConfig) (*VerificationReport, error) {
+	backend, err := url.Parse(cfg.Backend)
+	if err != nil {
+		return nil, fmt.Errorf("zdr: %w", err)
+	} else if net.ParseIP(cfg.IP) == nil {
+		return nil, fmt.Errorf("zdr: %q is not an IP address", cfg.IP)
+	}
+
+	v := &verifier{
+		cfg:      cfg,
+		backend:  backend,
+		started:  time.Now(),
+		streams:  map[streamKey]*streamStats{},
+		contexts: map[streamKey]*srtp.Context{},
+		sessions: map[string]bool{},
+		relays:   map[string]*relay{},
+	}
+
+	proxy := httputil.NewSingleHostReverseProxy(backend)
+	proxy.ModifyResponse = func(res *http.Response) error {
+		return v.rewriteAnswer(ctx, res)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/", proxy)
+	mux.HandleFunc("/verify/report", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(v.report())
+	})
+
+	server := &http.Server{Addr: cfg.Listen, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.ListenAndServe()
+	}()
+
+	select {
+	case err = <-errs:
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err = server.Shutdown(shutdownCtx)
+		cancel()
+	}
+
+	v.mu.Lock()
+	for _, r := range v.relays {
+		r.close()
+	}
+	v.mu.Unlock()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return nil, fmt.Errorf("zdr: %w", err)
+	}
+	return v.report(), nil
+}
+
+// rewriteAnswer points the candidates of the session descriptions the
+// backend answers with at relays of the proxy.
+func (v *verifier) rewriteAnswer(ctx context.Context, res *http.Response) error {
+	if !strings.HasPrefix(res.Header.Get("Content-Type"), "application/json") {
+		return nil
+	}
+
+	body, err := io.ReadAll(res.Body)
+	res.Body.Close() //nolint:errcheck
+	if err != nil {
+		return err
+	}
+
+	var description webrtc.SessionDescription
+	if json.Unmarshal(body, &description) == nil && description.SDP != "" {
+		if description.SDP, err = v.rewriteCandidates(ctx, description.SDP); err != nil {
+			return err
+		} else if body, err = json.Marshal(description); err != nil {
+			return err
+		}
+
+		if id := res.Header.Get("X-Session-ID"); id != "" {
+			v.mu.Lock()
+			known := v.sessions[id]
+			v.sessions[id] = true
+			v.mu.Unlock()
+			if !known && v.cfg.RecorderToken != "" {
+				go v.fetchKeys(ctx, id)
+			}
+		}
+	}
+
+	res.Body = io.NopCloser(bytes.NewReader(body))
+	res.ContentLength = int64(len(body))
+	res.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return nil
+}
+
+// rewriteCandidates replaces the address of every UDP host and server
+// reflexive candidate of sdp with that of its relay. Relayed candidates go
+// through TURN and are left alone.
+func (v *verifier) rewriteCandidates(ctx context.Context, sdp string) (string, error) {
+	lines := strings.Split(sdp, "\r\n")
+	for i, line := range lines {
+		if !strings.HasPrefix(line, "a=candidate:") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 8 || !strings.EqualFold(fields[2], "udp") || (fields[7] != "host" && fields[7] != "srflx") {
+			continue
+		}
+		ip := net.ParseIP(fields[4])
+		port, err := strconv.Atoi(fields[5])
+		if ip == nil || err != nil {
+			continue
+		}
+
+		r, err := v.relay(ctx, &net.UDPAddr{IP: ip, Port: port})
+		if err != nil {
+			return "", err
+		}
+		fields[4], fields[5] = v.cfg.IP, strconv.Itoa(r.port())
+		lines[i] = strings.Join(fields, " ")
+	}
+	return strings.Join(lines, "\r\n"), nil
+}
+
+// relay returns the relay to backend. It listens on a port of its own rather
+// than that of the backend, which may be on the same host and needs its port
+// back when it restarts.
+func (v *verifier) relay(ctx context.Context, backend *net.UDPAddr) (*relay, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if r, ok := v.relays[backend.String()]; ok {
+		return r, nil
+	}
+	listener, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(v.cfg.IP)})
+	if err != nil {
+		return nil, err
+	}
+
+	r := &relay{verifier: v, listener: listener, backend: backend, flows: map[string]*net.UDPConn{}}
+	v.relays[backend.String()] = r
+	go r.serve(ctx)
+	return r, nil
+}
+
+// fetchKeys asks the backend for the SRTP keys of session id, retrying while
+// its DTLS handshake isn't done.
+func (v *verifier) fetchKeys(ctx context.Context, id string) {
+	endpoint := v.backend.JoinPath("/recorder/sessions", id, "keys").String()
+	for attempt := 0; attempt < verifyKeyAttempts; attempt++ {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(`{"Reason": "zero-downtime verification"}`))
+		if err != nil {
+			logf("Failed to ask for the keys of %s: %v\n", id, err)
+			return
+		}
+		req.Header.Set("Authorization", "Bearer "+v.cfg.RecorderToken)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			continue
+		}
+
+		var keys SRTPKeys
+		if res.StatusCode == http.StatusOK {
+			err = json.NewDecoder(res.Body).Decode(&keys)
+		} else {
+			message, _ := io.ReadAll(res.Body)
+			err = fmt.Errorf("%s: %s", res.Status, strings.TrimSpace(string(message)))
+		}
+		res.Body.Close() //nolint:errcheck
+		if res.StatusCode == http.StatusConflict {
+			continue
+		} else if err == nil {
+			err = v.installKeys(keys)
+		}
+		if err != nil {
+			logf("Not checking SRTP authentication of %s: %v\n", id, err)
+		}
+		return
+	}
+	logf("Not checking SRTP authentication of %s: no DTLS connection after %d attempts\n", id, verifyKeyAttempts)
+}
+
+// installKeys checks the packets of the tracks of keys from now on.
+func (v *verifier) installKeys(keys SRTPKeys) error {
+	var profile srtp.ProtectionProfile
+	switch keys.Profile {
+	case "SRTP_AES128_CM_HMAC_SHA1_80":
+		profile = srtp.ProtectionProfileAes128CmHmacSha1_80
+	case "SRTP_AES128_CM_HMAC_SHA1_32":
+		profile = srtp.ProtectionProfileAes128CmHmacSha1_32
+	case "SRTP_AEAD_AES_128_GCM":
+		profile = srtp.ProtectionProfileAeadAes128Gcm
+	default:
+		return fmt.Errorf("unsupported protection profile %s", keys.Profile)
+	}
+
+	sent, err := srtp.CreateContext(keys.LocalMasterKey, keys.LocalMasterSalt, profile)
+	if err != nil {
+		return err
+	}
+	received, err := srtp.CreateContext(keys.RemoteMasterKey, keys.RemoteMasterSalt, profile)
+	if err != nil {
+		return err
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for _, track := range keys.Tracks {
+		key := streamKey{track.SSRC, track.Direction}
+		v.contexts[key] = received
+		if track.Direction == "sent" {
+			v.contexts[key] = sent
+		}
+		v.stream(key).Session = keys.Session
+	}
+	return nil
+}
+
+// stream returns the stats of key. v.mu must be held.
+func (v *verifier) stream(key streamKey) *streamStats {
+	s, ok := v.streams[key]
+	if !ok {
+		s = &streamStats{StreamReport: StreamReport{SSRC: key.ssrc, Direction: key.direction}}
+		v.streams[key] = s
+	}
+	return s
+}
+
+// observe records an RTP packet going in direction. STUN, DTLS and RTCP are
+// passed on without looking at them.
+func (v *verifier) observe(packet []byte, direction string) {
+	if len(packet) < 12 || packet[0]>>6 != 2 || (packet[1] >= 192 && packet[1] <= 223) {
+		return
+	}
+	header := &rtp.Header{}
+	if _, err := header.Unmarshal(packet); err != nil {
+		return
+	}
+
+	now := time.Now()
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	key := streamKey{header.SSRC, direction}
+	s := v.stream(key)
+	if s.Packets > 0 {
+		if gap := now.Sub(s.last); gap > s.LongestGap {
+			s.LongestGap, s.LongestGapEnded = gap, now
+		}
+		if diff := header.SequenceNumber - s.lastSequence; diff == 0 || diff > 0x8000 {
+			s.Reordered++
+		} else {
+			s.Lost += uint64(diff - 1)
+			s.lastSequence = header.SequenceNumber
+		}
+	} else {
+		s.lastSequence = header.SequenceNumber
+	}
+	s.last = now
+	s.Packets++
+
+	if srtpContext := v.contexts[key]; srtpContext != nil {
+		s.AuthChecked++
+		if _, err := srtpContext.DecryptRTP(nil, packet, header); err != nil {
+			s.AuthFailed++
+		}
+	}
+}
+
+func (v *verifier) report() *VerificationReport {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	out := &VerificationReport{
+		Started:  v.started,
+		Ended:    time.Now(),
+		Backend:  v.cfg.Backend,
+		Sessions: len(v.sessions),
+		MaxGap:   v.cfg.MaxGap,
+		Passed:   len(v.streams) > 0,
+		Streams:  []StreamReport{},
+	}
+	for _, s := range v.streams {
+		stream := s.StreamReport
+		if silence := out.Ended.Sub(s.last); stream.Packets > 0 && silence > stream.LongestGap {
+			stream.LongestGap, stream.LongestGapEnded = silence, out.Ended
+		}
+		out.Streams = append(out.Streams, stream)
+		if stream.LongestGap > v.cfg.MaxGap || stream.AuthFailed > 0 {
+			out.Passed = false
+		}
+	}
+	sort.Slice(out.Streams, func(i, j int) bool {
+		if out.Streams[i].Direction != out.Streams[j].Direction {
+			return out.Streams[i].Direction < out.Streams[j].Direction
+		}
+		return out.Streams[i].SSRC < out.Streams[j].SSRC
+	})
+	return out
+}
+
+// relay forwards the media of clients to a port of the backend, each client
+// through a socket of its own so the backend keeps seeing the same address
+// for it whether or not it restarted.
+type relay struct {
+	verifier *verifier
+	listener *net.UDPConn
+	backend  *net.UDPAddr
+
+	mu    sync.Mutex
+	flows map[string]*net.UDPConn
+}
+
+func (r *relay) port() int {
+	return r.listener.LocalAddr().(*net.UDPAddr).Port
+}
+
+func (r *relay) serve(ctx context.Context) {
+	buffer := make([]byte, 1500)
+	for {
+		n, client, err := r.listener.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+
+		r.mu.Lock()
+		flow, ok := r.flows[client.String()]
+		if !ok {
+			if flow, err = net.DialUDP("udp", nil, r.backend); err != nil {
+				r.mu.Unlock()
+				logf("Failed to relay %s to %s: %v\n", client, r.backend, err)
+				continue
+			}
+			r.flows[client.String()] = flow
+			go r.answer(flow, client)
+		}
+		r.mu.Unlock()
+
+		r.verifier.observe(buffer[:n], "received")
+		if _, err = flow.Write(buffer[:n]); err != nil && ctx.Err() == nil {
+			logf("Failed to relay to %s: %v\n", r.backend, err)
+		}
+	}
+}
+
+// answer forwards what the backend sends over flow back to client. Errors
+// while the backend restarts, like ICMP port unreachable, are let go.
+func (r *relay) answer(flow *net.UDPConn, client *net.UDPAddr) {
+	buffer := make([]byte, 1500)
+	for {
+		n, err := flow.Read(buffer)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			continue
+		}
+
+		r.verifier.observe(buffer[:n], "sent")
+		if _, err = r.listener.WriteToUDP(buffer[:n], client); errors.Is(err, net.ErrClosed) {
+			return
+		}
+	}
+}
+
+func (r *relay) close() {
+	r.listener.Close() //nolint:errcheck
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, flow := range r.flows {
+		flow.Close() //nolint:errcheck
+	}
+}
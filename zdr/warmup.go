@@ -0,0 +1,279 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// sentHistoryAge is how old the packets saved in the snapshot may be. Viewers
+// only ask for packets they are about to play.
+const sentHistoryAge = time.Second
+
+var (
+	sentHistoriesMutex sync.Mutex
+	sentHistories      = map[*webrtc.TrackLocalStaticRTP]*sentHistory{}
+
+	// restoredAt is when sessions were last resumed, in Unix nanoseconds,
+	// the warm-up window starts from it.
+	restoredAt atomic.Int64
+
+	warmupRetransmissions = newCounter("warmup_retransmissions_total", "Packets resent to viewers from the history buffer during the restore warm-up.")
+)
+
+// SentPacket is a packet an output track sent, as saved in the snapshot.
+type SentPacket struct {
+	MimeType string
+	At       time.Time
+	Packet   []byte
+}
+
+type sentEntry struct {
+	at     time.Time
+	packet []byte
+}
+
+// sentHistory keeps the last -restore-warmup-packets packets an output track
+// sent by sequence number, so NACKs can be answered for them. restored holds
+// those the previous process sent, which the NACK responders of resumed
+// sessions never saw.
+type sentHistory struct {
+	mu       sync.Mutex
+	live     []sentEntry
+	next     int
+	restored map[uint16]sentEntry
+}
+
+func sentHistoryFor(track *webrtc.TrackLocalStaticRTP) *sentHistory {
+	sentHistoriesMutex.Lock()
+	defer sentHistoriesMutex.Unlock()
+
+	h, ok := sentHistories[track]
+	if !ok {
+		h = &sentHistory{live: make([]sentEntry, config.RestoreWarmupPackets), restored: map[uint16]sentEntry{}}
+		sentHistories[track] = h
+	}
+	return h
+}
+
+// recordSent is called for every packet written to an output track.
+func recordSent(track *webrtc.TrackLocalStaticRTP, packet *rtp.Packet) {
+	if config.RestoreWarmupPackets <= 0 {
+		return
+	}
+	raw, err := packet.Marshal()
+	if err != nil {
+		return
+	}
+
+	h := sentHistoryFor(track)
+	h.mu.Lock()
+	h.live[h.next] = sentEntry{at: time.Now(), packet: raw}
+	h.next = (h.next + 1) % len(h.live)
+	h.mu.Unlock()
+}
+
+// find returns the packet with sequence number seq, looking at live ones
+// only if live is set.
+func (h *sentHistory) find(seq uint16, live bool) *rtp.Packet {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	entry, ok := h.restored[seq]
+	if !ok && live {
+		for _, e := range h.live {
+			if len(e.packet) >= 4 && uint16(e.packet[2])<<8|uint16(e.packet[3]) == seq {
+				entry, ok = e, true
+				break
+			}
+		}
+	}
+	if !ok {
+		return nil
+	}
+
+	packet := &rtp.Packet{}
+	if err := packet.Unmarshal(entry.packet); err != nil {
+		return nil
+	}
+	return packet
+}
+
+// sentPackets returns the recent packets of the output tracks of r.
+func (r *room) sentPackets() []SentPacket {
+	out := []SentPacket{}
+	if config.RestoreWarmupPackets <= 0 {
+		return out
+	}
+
+	now := time.Now()
+	for _, track := range r.tracks() {
+		h := sentHistoryFor(track)
+		h.mu.Lock()
+		for _, entry := range h.live {
+			if entry.packet != nil && now.Sub(entry.at) < sentHistoryAge {
+				out = append(out, SentPacket{MimeType: track.Codec().MimeType, At: entry.at, Packet: entry.packet})
+			}
+		}
+		h.mu.Unlock()
+	}
+	return out
+}
+
+func (r *room) restoreSentPackets(saved []SentPacket) {
+	if config.RestoreWarmupPackets <= 0 {
+		return
+	}
+
+	for _, sent := range saved {
+		track := r.videoTrack(sent.MimeType)
+		if strings.EqualFold(sent.MimeType, webrtc.MimeTypeOpus) {
+			track = r.audioTrack
+		}
+		if track == nil || len(sent.Packet) < 4 {
+			continue
+		}
+
+		h := sentHistoryFor(track)
+		h.mu.Lock()
+		h.restored[uint16(sent.Packet[2])<<8|uint16(sent.Packet[3])] = sentEntry{at: sent.At, packet: sent.Packet}
+		h.mu.Unlock()
+	}
+}
+
+// markRestored starts the warm-up window.
+func markRestored() {
+	restoredAt.Store(time.Now().UnixNano())
+}
+
+// inWarmup reports whether we are within -restore-warmup of resuming sessions.
+func inWarmup() bool {
+	at := restoredAt.Load()
+	return at != 0 && time.Since(time.Unix(0, at)) < config.RestoreWarmup
+}
+
+// warmupBitrate leaves -restore-warmup-headroom of bitrate for
+// retransmissions during the warm-up.
+func warmupBitrate(bitrate uint64) uint64 {
+	if !inWarmup() {
+		return bitrate
+	}
+	return uint64(float64(bitrate) * (1 - config.RestoreWarmupHeadroom))
+}
+
+type warmupInterceptorFactory struct {
+	session *session
+}
+
+func (f *warmupInterceptorFactory) NewInterceptor(string) (interceptor.Interceptor, error) {
+	names, err := parseInterceptors(config.ViewerInterceptors)
+	if err != nil {
+		return nil, err
+	}
+
+	return &warmupInterceptor{session: f.session, nack: hasInterceptor(names, interceptorNACK), streams: map[uint32]warmupStream{}}, nil
+}
+
+// warmupInterceptor answers the NACKs of a viewer from the history buffer
+// during the warm-up after a restore. The NACK responder, if there is one,
+// only has what was sent since, so only packets of the previous process are
+// resent, all of them without one. It sits right below the prober, so resent
+// packets are written with the sequence numbers the viewer asked for.
+type warmupInterceptor struct {
+	interceptor.NoOp
+	session *session
+	nack    bool
+
+	mu      sync.Mutex
+	streams map[uint32]warmupStream
+}
+
+type warmupStream struct {
+	info   *interceptor.StreamInfo
+	writer interceptor.RTPWriter
+}
+
+func (i *warmupInterceptor) BindLocalStream(info *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	i.mu.Lock()
+	i.streams[info.SSRC] = warmupStream{info: info, writer: writer}
+	i.mu.Unlock()
+	return writer
+}
+
+func (i *warmupInterceptor) UnbindLocalStream(info *interceptor.StreamInfo) {
+	i.mu.Lock()
+	delete(i.streams, info.SSRC)
+	i.mu.Unlock()
+}
+
+func (i *warmupInterceptor) BindRTCPReader(reader interceptor.RTCPReader) interceptor.RTCPReader {
+	return interceptor.RTCPReaderFunc(func(b []byte, attributes interceptor.Attributes) (int, interceptor.Attributes, error) {
+		n, attributes, err := reader.Read(b, attributes)
+		if err != nil || !inWarmup() {
+			return n, attributes, err
+		}
+		if attributes == nil {
+			attributes = interceptor.Attributes{}
+		}
+
+		packets, err := attributes.GetRTCPPackets(b[:n])
+		if err != nil {
+			return n, attributes, nil
+		}
+		for _, packet := range packets {
+			if nack, ok := packet.(*rtcp.TransportLayerNack); ok {
+				i.resend(nack)
+			}
+		}
+		return n, attributes, nil
+	})
+}
+
+func (i *warmupInterceptor) resend(nack *rtcp.TransportLayerNack) {
+	i.mu.Lock()
+	stream, ok := i.streams[nack.MediaSSRC]
+	i.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	track := i.session.videoTrack()
+	if strings.EqualFold(stream.info.MimeType, webrtc.MimeTypeOpus) {
+		track = i.session.room.audioTrack
+	}
+	if track == nil {
+		return
+	}
+
+	// The pause interceptor shifted the sequence numbers of this viewer by
+	// the packets it dropped, the layer interceptor by where its simulcast
+	// layer took over and the prober by the padding it sent.
+	dropped := i.session.pause.droppedPackets()[nack.MediaSSRC]
+	shift := i.session.layer.shift(nack.MediaSSRC)
+	padding := i.session.probe.paddingSent(nack.MediaSSRC)
+	h := sentHistoryFor(track)
+	for _, pair := range nack.Nacks {
+		for _, seq := range pair.PacketList() {
+			packet := h.find(seq+dropped-shift.Seq-padding, !i.nack)
+			if packet == nil {
+				continue
+			}
+
+			packet.SSRC, packet.PayloadType, packet.SequenceNumber = stream.info.SSRC, stream.info.PayloadType, seq
+			packet.Timestamp += shift.Timestamp
+			if _, err := stream.writer.Write(&packet.Header, packet.Payload, interceptor.Attributes{}); err != nil {
+				return
+			}
+			warmupRetransmissions.Inc()
+		}
+	}
+}
@@ -0,0 +1,224 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	writeBehindFailures = newCounter("snapshot_write_behind_failures_total", "Snapshots the write-behind cache failed to write, retried on its next flush.")
+
+	_ = newGauge("snapshot_loss_window_seconds", "How old the oldest change not written to the snapshot store yet is, what a crash would lose.", func() float64 {
+		return writeBehind.status(time.Now()).LossWindow.Seconds()
+	})
+	_ = newGauge("snapshot_sessions_at_risk", "Sessions missing from the snapshots written so far, which a crash would leave unrestorable.", func() float64 {
+		return float64(writeBehind.status(time.Now()).SessionsAtRisk)
+	})
+
+	writeBehind = &writeBehindCache{partitions: map[string]*writeBehindPartition{}}
+)
+
+// writeBehindCache holds the snapshots serialize took with
+// -snapshot-write-behind, writing the latest of each partition every
+// interval instead of every change. Snapshot stores that are slow or far away
+// then cost a bounded window of changes on a crash rather than latency on
+// every change. A graceful restart loses nothing: once handing off,
+// snapshots are written through.
+type writeBehindCache struct {
+	// flushMutex keeps a flush of an older snapshot from landing after a
+	// write through of a newer one.
+	flushMutex sync.Mutex
+
+	mu         sync.Mutex
+	partitions map[string]*writeBehindPartition
+}
+
+// writeBehindPartition is what the cache knows of a partition.
+type writeBehindPartition struct {
+	// pending is the newest snapshot not written yet, nil if none, taken at
+	// pendingTaken. pendingSince is when the oldest change it holds was
+	// taken.
+	pending      []byte
+	pendingIDs   map[string]bool
+	pendingTaken time.Time
+	pendingSince time.Time
+
+	// written is when the last snapshot written was taken, writtenIDs the
+	// sessions it holds.
+	written    time.Time
+	writtenIDs map[string]bool
+
+	lastError string
+}
+
+func (c *writeBehindCache) partition(name string) *writeBehindPartition {
+	p, ok := c.partitions[name]
+	if !ok {
+		p = &writeBehindPartition{}
+		c.partitions[name] = p
+	}
+	return p
+}
+
+// queue holds data, the snapshot of partition taken at taken holding the
+// sessions ids, until the next flush.
+func (c *writeBehindCache) queue(partition string, data []byte, ids map[string]bool, taken time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	p := c.partition(partition)
+	if p.pending == nil {
+		p.pendingSince = taken
+	}
+	p.pending, p.pendingIDs, p.pendingTaken = data, ids, taken
+}
+
+// writeThrough writes data now, dropping what was pending for partition
+// since data is newer.
+func (c *writeBehindCache) writeThrough(ctx context.Context, partition string, data []byte, ids map[string]bool, taken time.Time) error {
+	c.flushMutex.Lock()
+	defer c.flushMutex.Unlock()
+
+	c.mu.Lock()
+	p := c.partition(partition)
+	p.pending, p.pendingIDs = nil, nil
+	c.mu.Unlock()
+
+	err := writeSnapshot(ctx, partition, data)
+	c.written(partition, ids, taken, err)
+	return err
+}
+
+// flush writes the pending snapshot of every partition. Those that fail stay
+// pending, unless a newer one replaced them meanwhile, and are tried again
+// on the next flush.
+func (c *writeBehindCache) flush(ctx context.Context) {
+	c.flushMutex.Lock()
+	defer c.flushMutex.Unlock()
+
+	type pendingWrite struct {
+		partition string
+		data      []byte
+		ids       map[string]bool
+		taken     time.Time
+		since     time.Time
+	}
+	c.mu.Lock()
+	writes := []pendingWrite{}
+	for name, p := range c.partitions {
+		if p.pending != nil {
+			writes = append(writes, pendingWrite{name, p.pending, p.pendingIDs, p.pendingTaken, p.pendingSince})
+			p.pending, p.pendingIDs = nil, nil
+		}
+	}
+	c.mu.Unlock()
+
+	for _, write := range writes {
+		writeCtx, cancel := context.WithTimeout(ctx, config.SnapshotTimeout)
+		err := writeSnapshot(writeCtx, write.partition, write.data)
+		cancel()
+		if err != nil {
+			writeBehindFailures.Inc()
+			logf("Failed to write the snapshot of partition %q behind: %v\n", write.partition, err)
+
+			c.mu.Lock()
+			p := c.partition(write.partition)
+			if p.pending == nil {
+				p.pending, p.pendingIDs, p.pendingTaken = write.data, write.ids, write.taken
+			}
+			p.pendingSince = write.since
+			c.mu.Unlock()
+		}
+		c.written(write.partition, write.ids, write.taken, err)
+	}
+}
+
+// written records the outcome of writing a snapshot of partition holding ids
+// taken at taken.
+func (c *writeBehindCache) written(partition string, ids map[string]bool, taken time.Time, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	p := c.partition(partition)
+	if err != nil {
+		p.lastError = err.Error()
+		return
+	}
+	p.written, p.writtenIDs, p.lastError = taken, ids, ""
+}
+
+// WriteBehindStatus is what a crash could cost right now. MaxLossWindow is
+// the most LossWindow should reach while writes succeed.
+type WriteBehindStatus struct {
+	WriteBehind    time.Duration
+	MaxLossWindow  time.Duration
+	LossWindow     time.Duration
+	SessionsAtRisk int
+	Partitions     []WriteBehindPartitionStatus
+}
+
+// WriteBehindPartitionStatus is the status of the snapshot of a tenant, or
+// the main one if Partition is empty.
+type WriteBehindPartitionStatus struct {
+	Partition      string    `json:",omitempty"`
+	LastWritten    time.Time `json:",omitempty"`
+	PendingSince   time.Time `json:",omitempty"`
+	SessionsAtRisk int       `json:",omitempty"`
+	LastError      string    `json:",omitempty"`
+}
+
+func (c *writeBehindCache) status(now time.Time) WriteBehindStatus {
+	out := WriteBehindStatus{WriteBehind: config.SnapshotWriteBehind, Partitions: []WriteBehindPartitionStatus{}}
+	if config.SnapshotWriteBehind > 0 {
+		out.MaxLossWindow = config.SnapshotWriteBehind + config.SnapshotTimeout
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for name, p := range c.partitions {
+		status := WriteBehindPartitionStatus{Partition: name, LastWritten: p.written, LastError: p.lastError}
+		if p.pending != nil {
+			status.PendingSince = p.pendingSince
+			for id := range p.pendingIDs {
+				if !p.writtenIDs[id] {
+					status.SessionsAtRisk++
+				}
+			}
+			if window := now.Sub(p.pendingSince); window > out.LossWindow {
+				out.LossWindow = window
+			}
+		}
+		out.SessionsAtRisk += status.SessionsAtRisk
+		out.Partitions = append(out.Partitions, status)
+	}
+	sort.Slice(out.Partitions, func(i, j int) bool { return out.Partitions[i].Partition < out.Partitions[j].Partition })
+	return out
+}
+
+// sessionIDs returns the IDs of the sessions of state.
+func sessionIDs(state GlobalState) map[string]bool {
+	out := make(map[string]bool, len(state.PeerConnectionState))
+	for _, session := range state.PeerConnectionState {
+		out[session.ID] = true
+	}
+	return out
+}
+
+// handleAdminDurability serves GET /admin/durability, returning the
+// WriteBehindStatus.
+func handleAdminDurability(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(writeBehind.status(time.Now()))
+}
@@ -0,0 +1,452 @@
+//go:build !js
+// +build !js
+
+// Package zdr is a WebRTC broadcast server whose sessions survive a restart
+// of the process serving them. It is what the webrtc-zero-downtime-reload
+// command runs, and can be embedded into other Go programs.
+package zdr
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrServerExists is returned by New when the process already has a
+	// Server. Sessions, rooms and snapshots are process wide state.
+	ErrServerExists = errors.New("zdr: a Server already exists in this process")
+
+	// ErrServerStarted is returned by Start when called twice.
+	ErrServerStarted = errors.New("zdr: Server already started")
+
+	errHandingOff = errors.New("server is handing off to a new process")
+
+	serverExists atomic.Bool
+
+	// handingOff is set by Handoff, new sessions are refused from then on.
+	handingOff atomic.Bool
+)
+
+// Server serves the signaling, event and admin endpoints and keeps its
+// sessions in the snapshot. Only one Server can exist per process.
+type Server struct {
+	mux, admin *http.ServeMux
+	started    atomic.Bool
+
+	// released is closed by /handoff once another instance took over.
+	released    chan struct{}
+	releaseOnce sync.Once
+
+	// handoffTimer takes a handoff back unless it is finished in time.
+	handoffMu    sync.Mutex
+	handoffTimer *time.Timer
+}
+
+// New validates cfg and creates the Server of this process. It doesn't do
+// anything until Start is called.
+func New(cfg Config) (*Server, error) {
+	if err := validateInterceptors(cfg.BroadcasterInterceptors, cfg.ViewerInterceptors); err != nil {
+		return nil, err
+	}
+
+	switch cfg.ShedPolicy {
+	case shedNewest, shedOldest, shedNone:
+	default:
+		return nil, fmt.Errorf("zdr: unknown shed policy %q", cfg.ShedPolicy)
+	}
+
+	sources, err := parseSources(cfg.Sources)
+	if err != nil {
+		return nil, fmt.Errorf("zdr: %w", err)
+	}
+	marks, err := parseDSCP(cfg.DSCP)
+	if err != nil {
+		return nil, fmt.Errorf("zdr: %w", err)
+	}
+	provider, err := parseAuth(cfg.Auth, cfg.AuthClient)
+	if err != nil {
+		return nil, fmt.Errorf("zdr: %w", err)
+	} else if err = validateLoginConfig(cfg); err != nil {
+		return nil, fmt.Errorf("zdr: %w", err)
+	}
+	loadedTenants, err := parseTenants(cfg.Tenants)
+	if err != nil {
+		return nil, fmt.Errorf("zdr: %w", err)
+	}
+	networks, err := parseRecorderNetworks(cfg.RecorderNetworks)
+	if err != nil {
+		return nil, fmt.Errorf("zdr: %w", err)
+	}
+	reader, err := loadGeoIPFile(cfg.GeoIPFile)
+	if err != nil {
+		return nil, fmt.Errorf("zdr: %w", err)
+	}
+	loadedPolicies, err := loadPolicies(cfg.PolicyProfiles)
+	if err != nil {
+		return nil, fmt.Errorf("zdr: %w", err)
+	}
+	store, err := parseStateStore(cfg.SnapshotStore)
+	if err != nil {
+		return nil, fmt.Errorf("zdr: %w", err)
+	}
+	var keySealer *sealer
+	if cfg.SnapshotKey != "" {
+		if keySealer, err = newSealer(context.Background(), cfg.SnapshotKey); err != nil {
+			return nil, fmt.Errorf("zdr: %w", err)
+		}
+	}
+	var fillFrame []byte
+	fillMimeType := ""
+	if cfg.MuteFillFrame != "" {
+		if fillFrame, fillMimeType, err = readIVFFrame(cfg.MuteFillFrame); err != nil {
+			return nil, fmt.Errorf("zdr: %w", err)
+		}
+	}
+
+	if cfg.SnapshotGenerations < 1 {
+		cfg.SnapshotGenerations = 1
+	}
+	if cfg.RestoreWarmupHeadroom < 0 || cfg.RestoreWarmupHeadroom >= 1 {
+		return nil, fmt.Errorf("zdr: restore warm-up headroom must be at least 0 and below 1, got %v", cfg.RestoreWarmupHeadroom)
+	}
+	if cfg.CompactionInterval < 0 || cfg.TombstoneRetention < 0 || cfg.HistoryRetention < 0 {
+		return nil, errors.New("zdr: compaction interval and retentions can't be negative")
+	}
+	if cfg.JitterBuffer < 0 || cfg.JitterBuffer > math.MaxInt16 {
+		return nil, fmt.Errorf("zdr: jitter buffer must be at least 0 and at most %d packets, got %d", math.MaxInt16, cfg.JitterBuffer)
+	}
+	if cfg.ClientLogMaxBytes <= 0 {
+		return nil, errors.New("zdr: client log max bytes must be positive")
+	}
+	if cfg.ShutdownDeadline <= shutdownFallback {
+		return nil, fmt.Errorf("zdr: shutdown deadline must be longer than %s", shutdownFallback)
+	}
+	if cfg.KVMaxBytes <= 0 {
+		return nil, errors.New("zdr: kv max bytes must be positive")
+	}
+	if cfg.RecordingRetention < 0 {
+		return nil, errors.New("zdr: recording retention can't be negative")
+	}
+	if cfg.PacingBurst <= 0 || cfg.PacingInterval <= 0 {
+		return nil, errors.New("zdr: pacing burst and interval must be positive")
+	}
+	if cfg.SRTPFailureThreshold < 0 || cfg.SRTPRepairTimeout <= 0 {
+		return nil, errors.New("zdr: SRTP failure threshold can't be negative and the repair timeout must be positive")
+	}
+	if cfg.CodecFallbackKeyframes < 0 || cfg.CodecFallbackKeyframes > 0 && cfg.CodecFallbackWindow <= 0 {
+		return nil, errors.New("zdr: codec fallback keyframes can't be negative and the window must be positive")
+	}
+	if cfg.FailoverGap <= 0 {
+		return nil, errors.New("zdr: failover gap must be positive")
+	}
+	if cfg.GCCInitialBitrate <= 0 {
+		return nil, errors.New("zdr: gcc initial bitrate must be positive")
+	}
+	if cfg.UDPReadBuffer < 0 || cfg.UDPWriteBuffer < 0 {
+		return nil, errors.New("zdr: UDP buffer sizes can't be negative")
+	}
+	if cfg.DTLSRehandshakeTimeout <= 0 {
+		return nil, errors.New("zdr: DTLS rehandshake timeout must be positive")
+	}
+	if cfg.SnapshotInterval <= 0 {
+		return nil, fmt.Errorf("zdr: snapshot interval must be positive, got %s", cfg.SnapshotInterval)
+	}
+	if cfg.SnapshotDebounce < 0 {
+		return nil, errors.New("zdr: snapshot debounce can't be negative")
+	}
+	if cfg.HandoffFrom != "" {
+		if from, err := url.Parse(cfg.HandoffFrom); err != nil {
+			return nil, fmt.Errorf("zdr: handoff from: %w", err)
+		} else if from.Scheme != "http" && from.Scheme != "https" {
+			return nil, fmt.Errorf("zdr: handoff from %q: not an http or https URL", cfg.HandoffFrom)
+		}
+	}
+	if cfg.ReusePortDrain < 0 {
+		return nil, errors.New("zdr: reuseport drain can't be negative")
+	} else if cfg.ReusePortDrain > 0 {
+		if err := reusePortSupported(); err != nil {
+			return nil, fmt.Errorf("zdr: %w", err)
+		}
+	}
+	if cfg.PrewarmPool < 0 {
+		return nil, errors.New("zdr: prewarm pool size can't be negative")
+	}
+	if cfg.SnapshotWriteBehind < 0 {
+		return nil, errors.New("zdr: snapshot write-behind interval can't be negative")
+	}
+	if cfg.SnapshotWait < 0 {
+		return nil, errors.New("zdr: snapshot wait can't be negative")
+	}
+	switch cfg.SnapshotEncoding {
+	case snapshotEncodingGob, snapshotEncodingProtobuf, snapshotEncodingJSON:
+	default:
+		return nil, fmt.Errorf("zdr: unknown snapshot encoding %q", cfg.SnapshotEncoding)
+	}
+
+	// Taking the sockets over is the last thing that can fail, so a caller
+	// given an error can still call New again. Either only ever happens once
+	// per process, their variables are cleared.
+	if err := receiveSocketActivation(); err != nil {
+		return nil, fmt.Errorf("zdr: socket activation: %w", err)
+	}
+	if err := receiveHotRestart(); err != nil {
+		return nil, fmt.Errorf("zdr: taking over from the previous process: %w", err)
+	}
+
+	if !serverExists.CompareAndSwap(false, true) {
+		return nil, ErrServerExists
+	}
+	config = cfg
+	sourceConfigs = sources
+	dscpMarks = marks
+	policies = loadedPolicies
+	authProvider = provider
+	tenants = loadedTenants
+	recorderNetworks = networks
+	geoIPReader = reader
+	if store != nil {
+		stateStore = store
+	}
+	snapshotCipher = keySealer
+	muteFillFrame, muteFillMimeType = fillFrame, fillMimeType
+
+	s := &Server{mux: http.NewServeMux(), admin: http.NewServeMux(), released: make(chan struct{})}
+	s.admin.HandleFunc("/admin/restore", handleAdminRestore)
+	s.admin.HandleFunc("/admin/inject/", handleAdminInject)
+	s.admin.HandleFunc("/admin/accounting", handleAdminAccounting)
+	s.admin.HandleFunc("/admin/analytics", handleAdminAnalytics)
+	s.admin.HandleFunc("/admin/sessions", handleAdminSessions)
+	s.admin.HandleFunc("/admin/sessions/", handleAdminSession)
+	s.admin.HandleFunc("/admin/rooms", handleAdminRooms)
+	s.admin.HandleFunc("/admin/tenants", handleAdminTenants)
+	s.admin.HandleFunc("/admin/rooms/", handleAdminRoom)
+	s.admin.HandleFunc("/admin/upgrade", s.handleAdminUpgrade)
+	s.admin.HandleFunc("/admin/profile", handleAdminProfile)
+	s.admin.HandleFunc("/admin/snapshot", handleAdminSnapshot)
+	s.admin.HandleFunc("/admin/durability", handleAdminDurability)
+	s.admin.HandleFunc("/admin/compact", handleAdminCompact)
+
+	s.mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, indexHtml)
+	})
+	s.mux.HandleFunc("/doSignaling", doSignaling)
+	s.mux.HandleFunc("/haveBroadcaster", handleHaveBroadcaster)
+	s.mux.HandleFunc("/encodings", handleEncodings)
+	s.mux.HandleFunc("/turn", handleTURN)
+	s.mux.HandleFunc("/events", handleEvents)
+	s.mux.HandleFunc("/metrics", handleMetrics)
+	s.mux.HandleFunc("/sessions/", handleSession)
+	s.mux.HandleFunc("/oidc/", handleOIDC)
+	s.mux.HandleFunc("/recorder/", handleRecorder)
+	s.mux.Handle("/admin/", requireAdmin(s.admin))
+	s.mux.Handle("/handoff", requireAdmin(http.HandlerFunc(s.handleHandoff)))
+	return s, nil
+}
+
+// Start resumes the sessions in the snapshot and journal, then keeps saving
+// them until ctx is done. It returns once resuming is over, which takes at
+// most Config.RestoreTimeout. The handlers may be served before that, new
+// sessions are refused with 503 until Start returns.
+func (s *Server) Start(ctx context.Context) error {
+	if !s.started.CompareAndSwap(false, true) {
+		return ErrServerStarted
+	}
+
+	// The pool fills while sessions are resumed, ready for the clients that
+	// reconnect once signaling opens.
+	prewarm(ctx)
+	state, resumed := inheritedState()
+	source := "the previous process"
+	handedOff := false
+	if !resumed {
+		state, handedOff = fetchHandoff(ctx)
+		resumed = handedOff
+		source = fmt.Sprintf("the handoff of '%s'", config.HandoffFrom)
+	}
+	if !resumed {
+		waitForSnapshot(ctx)
+	}
+
+	restoreCtx, cancelRestore := context.WithTimeout(ctx, config.RestoreTimeout)
+	phase.Store(phaseProvisioning)
+	if !resumed {
+		state, source = loadSnapshot(restoreCtx)
+	}
+	state = readShutdownMarker(state)
+	state = provision(state)
+
+	phase.Store(phaseRestoring)
+	// The ports of the instance handing off can only be bound once it
+	// released them, unless both bind them with SO_REUSEPORT.
+	if handedOff && config.ReusePortDrain <= 0 {
+		finishHandoff(restoreCtx, http.MethodPost)
+	}
+	lastRestoreReport = deserialize(restoreCtx, state, source)
+	recoverJournal(restoreCtx, lastRestoreReport)
+	markRestored()
+	cancelRestore()
+	phase.Store(phaseServing)
+	snapshotter.start(ctx)
+	reusePort.takeOver(ctx)
+	if handedOff && config.ReusePortDrain > 0 {
+		finishHandoff(ctx, http.MethodPost)
+	}
+	// systemd follows the process that took over, which needs
+	// NotifyAccess=all.
+	if ackHotRestart() {
+		sdNotify(fmt.Sprintf("READY=1\nMAINPID=%d", os.Getpid()))
+	} else {
+		sdNotify("READY=1")
+	}
+
+	go watchBroadcaster(ctx)
+	go watchRooms(ctx)
+	go watchLoad(ctx)
+	go watchAllocs(ctx)
+	go watchQueues(ctx)
+	go watchGuests(ctx)
+	go watchRecordings(ctx)
+	if config.MuteTimeout > 0 {
+		go watchMutes(ctx)
+	}
+	go every(ctx, config.SnapshotInterval, func(time.Time) {
+		if err := s.Checkpoint(); err != nil {
+			logf("Failed to serialize: %v\n", err)
+		}
+	})
+	if config.SnapshotWriteBehind > 0 {
+		go every(ctx, config.SnapshotWriteBehind, func(time.Time) { writeBehind.flush(ctx) })
+	}
+	if config.DryRunInterval > 0 {
+		go every(ctx, config.DryRunInterval, func(time.Time) { dryRun() })
+	}
+	if config.CompactionInterval > 0 {
+		go every(ctx, config.CompactionInterval, func(time.Time) { compact(ctx, "", configuredRetention()) })
+	}
+	return nil
+}
+
+// Checkpoint saves every session now. Sessions are also saved on every
+// change, shortly after those the Snapshotter is told of, and every
+// Config.SnapshotInterval. With Config.SnapshotWriteBehind the snapshot is
+// only written on the next flush, unless handing off.
+func (s *Server) Checkpoint() error {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	return serialize(context.Background())
+}
+
+// Handoff prepares for another process to take over. New sessions are refused
+// and a final snapshot is written. Existing sessions are left running: the
+// process should exit once Handoff returns, which releases their ports
+// without the clients noticing, and the next process resumes them.
+func (s *Server) Handoff() error {
+	handingOff.Store(true)
+	return s.Checkpoint()
+}
+
+// Handler returns every endpoint, including the demo page and admin API.
+func (s *Server) Handler() http.Handler {
+	return recoverHandler(s.mux)
+}
+
+// SignalingHandler returns the /doSignaling endpoint that creates sessions.
+func (s *Server) SignalingHandler() http.Handler {
+	return recoverHandler(http.HandlerFunc(doSignaling))
+}
+
+// SessionHandler returns the /sessions/ endpoints used by clients of a session.
+func (s *Server) SessionHandler() http.Handler {
+	return recoverHandler(http.HandlerFunc(handleSession))
+}
+
+// EncodingsHandler returns the /encodings endpoint broadcasters learn the
+// simulcast layers of their room from.
+func (s *Server) EncodingsHandler() http.Handler {
+	return recoverHandler(http.HandlerFunc(handleEncodings))
+}
+
+// TURNHandler returns the /turn endpoint clients get TURN credentials from.
+func (s *Server) TURNHandler() http.Handler {
+	return recoverHandler(http.HandlerFunc(handleTURN))
+}
+
+// LoginHandler returns the /oidc/ endpoints logging users in to the demo page.
+func (s *Server) LoginHandler() http.Handler {
+	return recoverHandler(http.HandlerFunc(handleOIDC))
+}
+
+// RecorderHandler returns the /recorder/ endpoint SRTP keys are exported
+// from. It is served apart from the admin API, with credentials of its own.
+func (s *Server) RecorderHandler() http.Handler {
+	return recoverHandler(http.HandlerFunc(handleRecorder))
+}
+
+// EventsHandler returns the /events stream clients listen on.
+func (s *Server) EventsHandler() http.Handler {
+	return recoverHandler(http.HandlerFunc(handleEvents))
+}
+
+// MetricsHandler returns the Prometheus metrics.
+func (s *Server) MetricsHandler() http.Handler {
+	return http.HandlerFunc(handleMetrics)
+}
+
+// AdminHandler returns the /admin/ endpoints. Requests must keep their
+// /admin/ prefix.
+func (s *Server) AdminHandler() http.Handler {
+	return recoverHandler(requireAdmin(s.admin))
+}
+
+func handleHaveBroadcaster(w http.ResponseWriter, r *http.Request) {
+	room := findRoom(r.URL.Query().Get("room"))
+	if room == nil {
+		http.Error(w, errRoomNotFound.Error(), http.StatusNotFound)
+		return
+	} else if err := authorizeAny(r, room.id); err != nil {
+		authError(w, err)
+		return
+	}
+
+	// The demo page sends users who may not broadcast to log in first, if
+	// they can.
+	_, err := authorizeJoin(r, room.id, true)
+	login := ""
+	if _, ok := loginPrincipal(r); loginsEnabled() && !ok {
+		login = "/oidc/login"
+	}
+
+	out := struct {
+		HaveBroadcaster bool
+		Open            bool
+		Policy          Policy
+		CanBroadcast    bool
+		Login           string        `json:",omitempty"`
+		Metadata        *RoomMetadata `json:",omitempty"`
+	}{room.haveBroadcaster.Load(), room.isOpen(time.Now()), room.policy, err == nil, login, room.roomMetadata()}
+	json.NewEncoder(w).Encode(&out)
+}
+
+// every calls fn every interval until ctx is done.
+func every(ctx context.Context, interval time.Duration, fn func(now time.Time)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			fn(now)
+		}
+	}
+}
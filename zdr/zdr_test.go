@@ -0,0 +1,29 @@
+//go:build !js
+// +build !js
+
+package zdr
+
+import (
+	"os"
+	"strconv"
+	"testing"
+)
+
+// TestNewAfterFailedTakeover checks a New that failed taking the sockets
+// over leaves the process free to call New again.
+func TestNewAfterFailedTakeover(t *testing.T) {
+	cfg := config
+	t.Cleanup(func() { config = cfg })
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("LISTEN_FDS", "not a number")
+	if _, err := New(cfg); err == nil {
+		t.Fatal("New took invalid LISTEN_FDS")
+	}
+
+	if _, err := New(cfg); err != nil {
+		t.Fatalf("New after a failed takeover: %v", err)
+	}
+	if _, err := New(cfg); err != ErrServerExists {
+		t.Fatalf("second New: got %v, want ErrServerExists", err)
+	}
+}